@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/bench"
+	"github.com/hlindberg/mezquit/internal/benchplot"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measure the throughput and latency of a MQTT broker",
+	Long: `Runs --publishers and --subscribers sessions at the same time and prints a summary
+
+	Each publisher publishes --rate messages per second (0 is as fast as possible) of --payload bytes for
+	--duration seconds, to its own topic below --topic. Every subscriber subscribes to all of them. The
+	summary has the throughput, and the latency from publish to acknowledgement (ack) and from publish to
+	receive (receive) - for QoS 0 the ack latency is the time to queue the message for sending. With QoS 1
+	and 2 a publisher does not wait for the ack of a message before publishing the next - it has up to
+	--in-flight messages waiting for an ack.
+
+	With --json the result is also written as JSON to the given file - or only to stdout if the file is "-".
+	With --plot charts of the latency distribution, latency over time, and throughput over time are written
+	to the given .svg or .png file. The plot command draws the charts of several saved JSON results.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runBench()
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if BenchQoS < 0 || BenchQoS > 2 {
+			return fmt.Errorf("--qos must be between 0 and 2, got %d", BenchQoS)
+		}
+		if BenchPublishers < 1 || BenchSubscribers < 0 {
+			return fmt.Errorf("--publishers must be at least 1, and --subscribers cannot be negative")
+		}
+		if BenchPayloadSize < bench.MinPayloadSize {
+			return fmt.Errorf("--payload must be at least %d", bench.MinPayloadSize)
+		}
+		if BenchInFlight < 1 || BenchInFlight > 0xFFFF {
+			return fmt.Errorf("--in-flight must be between 1 and %d", 0xFFFF)
+		}
+		if BenchRate < 0 || BenchWait < 0 {
+			return fmt.Errorf("--rate and --wait cannot be negative")
+		}
+		if BenchDuration < 1 {
+			return fmt.Errorf("--duration must be at least 1")
+		}
+		if BenchPlot != "" {
+			if _, err := benchplot.Format(BenchPlot); err != nil {
+				return err
+			}
+		}
+		return mqtt.ValidateTopicName(BenchTopic)
+	},
+}
+
+func runBench() {
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", brokerAddress(BenchBroker))
+	}
+	options := []bench.BenchOption{
+		bench.Dialer(dial),
+		bench.ClientName(BenchClientName),
+		bench.Topic(BenchTopic),
+		bench.Publishers(BenchPublishers),
+		bench.Subscribers(BenchSubscribers),
+		bench.QoS(BenchQoS),
+		bench.PayloadSize(BenchPayloadSize),
+		bench.Rate(BenchRate),
+		bench.InFlight(BenchInFlight),
+		bench.Duration(time.Duration(BenchDuration) * time.Second),
+		bench.Wait(time.Duration(BenchWait) * time.Second),
+	}
+	if BenchCreds != "" {
+		options = append(options, bench.ConnectOptions(credsConnectOptions(BenchCreds)...))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Debugf("Interrupted - stopping")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	result, err := bench.NewBench(options...).Run(ctx)
+	if err != nil {
+		log.Fatalf("Benchmark failed: %s", err)
+	}
+	result.Label = BenchBroker
+
+	if BenchJSON != "-" {
+		printBenchResult(os.Stdout, result)
+	}
+	if BenchJSON != "" {
+		data, _ := json.MarshalIndent(result, "", "  ")
+		data = append(data, '\n')
+		if BenchJSON == "-" {
+			os.Stdout.Write(data)
+		} else if err := ioutil.WriteFile(BenchJSON, data, 0644); err != nil {
+			log.Fatalf("Cannot write %s: %s", BenchJSON, err)
+		}
+	}
+	if BenchPlot != "" {
+		if err := benchplot.Save(BenchPlot, result); err != nil {
+			log.Fatalf("Cannot plot: %s", err)
+		}
+	}
+}
+
+// printBenchResult prints the given result as a table
+//
+func printBenchResult(w io.Writer, r *bench.Result) {
+	rate := "max"
+	if r.Rate > 0 {
+		rate = fmt.Sprintf("%d/s", r.Rate)
+	}
+	fmt.Fprintf(w, "%d publishers  %d subscribers  QoS %d  %d byte payload  rate %s  %s\n\n",
+		r.Publishers, r.Subscribers, r.QoS, r.PayloadSize, rate, r.Duration.Round(time.Millisecond))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "\tmessages\tmsg/s\tMB/s\tmin\tmean\tp50\tp90\tp99\tmax\t\n")
+	row := func(name string, count int64, throughput float64, stats bench.LatencyStats) {
+		mbs := throughput * float64(r.PayloadSize) / 1e6
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.3f\t%s\t%s\t%s\t%s\t%s\t%s\t\n", name, count, throughput, mbs,
+			benchDuration(stats.Min), benchDuration(stats.Mean), benchDuration(stats.P50),
+			benchDuration(stats.P90), benchDuration(stats.P99), benchDuration(stats.Max))
+	}
+	row("ack", r.Sent, r.PublishThroughput, r.AckLatency)
+	row("receive", r.Received, r.ReceiveThroughput, r.ReceiveLatency)
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nexpected %d  received %d  lost %d  publish errors %d\n", r.Expected, r.Received, r.Lost, r.Errors)
+}
+
+// benchDuration formats a latency with a precision suitable for a table
+func benchDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
+
+// BenchBroker is the MQTT host (or host:port) to benchmark
+var BenchBroker string
+
+// BenchClientName is the name the client IDs of the sessions are based on
+var BenchClientName string
+
+// BenchCreds is a NATS creds file with the user JWT to use as password
+var BenchCreds string
+
+// BenchTopic is the topic the publishers publish below
+var BenchTopic string
+
+// BenchPublishers is the number of publishing sessions
+var BenchPublishers int
+
+// BenchSubscribers is the number of subscribing sessions
+var BenchSubscribers int
+
+// BenchQoS is the QoS to publish and subscribe with
+var BenchQoS int
+
+// BenchPayloadSize is the number of bytes in each message
+var BenchPayloadSize int
+
+// BenchRate is the number of messages per second of each publisher (0 is as fast as possible)
+var BenchRate int
+
+// BenchInFlight is the maximum number of QoS 1 and 2 messages of each publisher waiting for an ack
+var BenchInFlight int
+
+// BenchDuration is the number of seconds to publish
+var BenchDuration int
+
+// BenchWait is the number of seconds to wait for messages after publishing has ended
+var BenchWait int
+
+// BenchJSON is the file to write the result to as JSON ("-" for stdout)
+var BenchJSON string
+
+// BenchPlot is the .svg or .png file to draw the charts of the result in
+var BenchPlot string
+
+func init() {
+	RootCmd.AddCommand(benchCmd)
+	flags := benchCmd.PersistentFlags()
+
+	flags.StringVarP(&BenchBroker,
+		"broker", "b", "localhost", "the MQTT Broker host (or host:port) to connect to (default 'localhost')")
+	flags.StringVarP(&BenchClientName,
+		"client", "c", "mezquit-bench", "the client IDs are this name followed by -pub-<n> and -sub-<n>")
+	flags.StringVarP(&BenchCreds,
+		"creds", "", "", "a NATS creds file - its user JWT is used as the password")
+	flags.StringVarP(&BenchTopic,
+		"topic", "t", "mezquit/bench", "publisher <n> publishes to <topic>/<n>")
+	flags.IntVarP(&BenchPublishers,
+		"publishers", "", 1, "the number of publishers (default 1)")
+	flags.IntVarP(&BenchSubscribers,
+		"subscribers", "", 1, "the number of subscribers (default 1)")
+	flags.IntVarP(&BenchQoS,
+		"qos", "q", 0, "Quality of service 0-2 (default 0)")
+	flags.IntVarP(&BenchPayloadSize,
+		"payload", "", 64, "the number of bytes in each message (default 64)")
+	flags.IntVarP(&BenchRate,
+		"rate", "", 100, "the number of messages per second of each publisher - 0 is as fast as possible (default 100)")
+	flags.IntVarP(&BenchInFlight,
+		"in-flight", "", 100, "the maximum number of QoS 1 and 2 messages of each publisher waiting for an ack (default 100)")
+	flags.IntVarP(&BenchDuration,
+		"duration", "d", 10, "the number of seconds to publish (default 10)")
+	flags.IntVarP(&BenchWait,
+		"wait", "", 2, "the number of seconds to wait for messages after publishing (default 2)")
+	flags.StringVarP(&BenchJSON,
+		"json", "", "", "a file to write the result to as JSON - '-' writes only JSON to stdout")
+	flags.StringVarP(&BenchPlot,
+		"plot", "", "", "a .svg or .png file to draw charts of the result in")
+}
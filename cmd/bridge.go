@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/hlindberg/mezquit/internal/bridge"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var bridgeCmd = &cobra.Command{
+	Use:   "bridge",
+	Short: "Forward MQTT messages from one broker to another",
+	Long: `Subscribes to MQTT topic filters on the --from broker and publishes each received message on the --to broker
+
+	A message is acknowledged to the --from broker only after the --to broker has acknowledged it (for QoS 1
+	and 2) - if the bridge stops before that, the --from broker sends the message again when the bridge is
+	started again with the same --client.
+
+	The topic of a forwarded message can be rewritten with --strip_prefix and --prefix. A message with a topic
+	that starts with the --prefix is not forwarded - this prevents loops when bridging a broker to itself, or
+	when there are bridges in both directions.
+
+	The command runs until interrupted, or until a connection ends - a connection to a broker that does not
+	respond within the --keep_alive is regarded as lost.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runBridge()
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if BridgeFrom == "" || BridgeTo == "" {
+			return fmt.Errorf("both --from and --to are required")
+		}
+		if BridgeQoS < 0 || BridgeQoS > 2 {
+			return fmt.Errorf("--qos must be between 0 and 2, got %d", BridgeQoS)
+		}
+		if len(BridgeTopics) == 0 {
+			return fmt.Errorf("at least one --topic is required")
+		}
+		for _, filter := range BridgeTopics {
+			if err := mqtt.ValidateTopicFilter(filter); err != nil {
+				return err
+			}
+		}
+		if BridgeKeepAlive < 0 || BridgeKeepAlive > 0xff {
+			return fmt.Errorf("--keep_alive must be between 0 and 255, got %d", BridgeKeepAlive)
+		}
+		if BridgeClientName == "" {
+			return fmt.Errorf("--client cannot be empty")
+		}
+		if brokerAddress(BridgeFrom) == brokerAddress(BridgeTo) && BridgePrefix == "" {
+			return fmt.Errorf("a --prefix is required to prevent loops when bridging a broker to itself")
+		}
+		return nil
+	},
+}
+
+func runBridge() {
+	fromConn, err := net.Dial("tcp", brokerAddress(BridgeFrom))
+	if err != nil {
+		log.Fatalf("Cannot connect to %s: %s", BridgeFrom, err)
+	}
+	toConn, err := net.Dial("tcp", brokerAddress(BridgeTo))
+	if err != nil {
+		fromConn.Close()
+		log.Fatalf("Cannot connect to %s: %s", BridgeTo, err)
+	}
+
+	b := bridge.NewBridge(fromConn, toConn,
+		bridge.ClientName(BridgeClientName),
+		bridge.Topics(BridgeTopics...),
+		bridge.QoS(BridgeQoS),
+		bridge.StripPrefix(BridgeStripPrefix),
+		bridge.Prefix(BridgePrefix),
+		bridge.KeepAlive(BridgeKeepAlive),
+	)
+	if err := b.Start(); err != nil {
+		log.Fatalf("Cannot start bridge: %s", err)
+	}
+	log.Infof("Bridging %v from %s to %s", BridgeTopics, BridgeFrom, BridgeTo)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	select {
+	case <-interrupt:
+		log.Debugf("Interrupted - disconnecting")
+		if err := b.Close(); err != nil {
+			log.Errorf("Bridge ended with error: %s", err)
+		}
+	case <-b.Done():
+		b.Close()
+		log.Fatalf("Bridge ended with error: %s", b.Err())
+	}
+}
+
+// BridgeFrom is the MQTT host (or host:port) to forward messages from
+var BridgeFrom string
+
+// BridgeTo is the MQTT host (or host:port) to forward messages to
+var BridgeTo string
+
+// BridgeClientName is the name the client IDs of the bridge are based on
+var BridgeClientName string
+
+// BridgeTopics are the MQTT topic filters to forward messages for
+var BridgeTopics []string
+
+// BridgeQoS is the maximum QoS of forwarded messages
+var BridgeQoS int
+
+// BridgeStripPrefix is removed from the topic of forwarded messages
+var BridgeStripPrefix string
+
+// BridgePrefix is added to the topic of forwarded messages
+var BridgePrefix string
+
+// BridgeKeepAlive is the keep alive seconds of the connections to the brokers
+var BridgeKeepAlive int
+
+func init() {
+	RootCmd.AddCommand(bridgeCmd)
+	flags := bridgeCmd.PersistentFlags()
+
+	flags.StringVarP(&BridgeFrom,
+		"from", "", "", "the MQTT Broker host (or host:port) to forward messages from")
+	flags.StringVarP(&BridgeTo,
+		"to", "", "", "the MQTT Broker host (or host:port) to forward messages to")
+	flags.StringVarP(&BridgeClientName,
+		"client", "c", "mezquit-bridge", "the client ID of the bridge is this name followed by -from and -to")
+	flags.StringSliceVarP(&BridgeTopics,
+		"topic", "t", nil, "the MQTT topic filter(s) to forward messages for")
+	flags.IntVarP(&BridgeQoS,
+		"qos", "q", 1, "Maximum quality of service 0-2 of forwarded messages (default 1)")
+	flags.StringVarP(&BridgeStripPrefix,
+		"strip_prefix", "", "", "a prefix to remove from the topic of forwarded messages")
+	flags.StringVarP(&BridgePrefix,
+		"prefix", "", "", "a prefix to add to the topic of forwarded messages")
+	flags.IntVarP(&BridgeKeepAlive,
+		"keep_alive", "", 60, "the keep alive seconds of the connections to the brokers - 0 turns it off (default 60)")
+}
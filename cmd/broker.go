@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/broker"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var brokerCmd = &cobra.Command{
+	Use:   "broker",
+	Short: "Run a MQTT broker",
+	Long: `Runs a MQTT 3.1.1 broker that can be used as a reference when comparing brokers
+
+	The broker accepts clients on the --listen address until interrupted. It supports QoS 0, 1, and 2,
+	persistent sessions, retained messages, and will messages. With --retained_file the retained
+	messages are kept in the given file and survive a restart of the broker. A will is published when
+	a client disconnects without DISCONNECT, or misses its keep alive. With --loglevel debug every packet
+	received from, and sent to, a client is traced.
+
+	MQTT 5 clients are also accepted, and their Session Expiry Interval and Will Delay Interval are
+	honored - the will is published when the delay has passed, or the session expires, unless the client
+	connects again. A Will Delay Interval longer than --max_will_delay is shortened.
+
+	With --auth_file clients are authenticated, and authorized to publish and subscribe, by the users
+	and topic filter rules in the given file - see FileAuth in internal/broker for the format. The file is
+	read again when the broker receives SIGHUP.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runBroker()
+	},
+}
+
+func runBroker() {
+	listener, err := net.Listen("tcp", BrokerListen)
+	if err != nil {
+		log.Fatalf("Cannot listen on %s: %s", BrokerListen, err)
+	}
+	log.Infof("Broker listening on %s", listener.Addr())
+
+	retained, err := broker.NewRetainedStore(BrokerRetainedFile)
+	if err != nil {
+		log.Fatalf("Cannot read retained messages from %s: %s", BrokerRetainedFile, err)
+	}
+	if BrokerMaxWillDelay < 0 {
+		log.Fatalf("--max_will_delay cannot be negative")
+	}
+	options := []broker.BrokerOption{
+		broker.Retained(retained),
+		broker.MaxWillDelay(time.Duration(BrokerMaxWillDelay) * time.Second),
+	}
+	if BrokerAuthFile != "" {
+		auth, err := broker.NewFileAuth(BrokerAuthFile)
+		if err != nil {
+			log.Fatalf("Cannot read auth file: %s", err)
+		}
+		options = append(options, broker.Authentication(auth), broker.Authorization(auth))
+
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		go func() {
+			for range hangup {
+				if err := auth.Reload(); err != nil {
+					log.Errorf("Cannot reload auth file - keeping the earlier rules: %s", err)
+				} else {
+					log.Infof("Reloaded auth file %s", BrokerAuthFile)
+				}
+			}
+		}()
+	}
+	if log.IsLevelEnabled(log.DebugLevel) {
+		options = append(options,
+			broker.OnReceived(func(clientID string, packet *mqtt.GenericMessage) {
+				log.Debugf("Broker <- %s: %s", clientID, packet)
+			}),
+			broker.OnSent(func(clientID string, packet *mqtt.GenericMessage) {
+				log.Debugf("Broker -> %s: %s", clientID, packet)
+			}),
+		)
+	}
+	b := broker.NewBroker(options...)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Infof("Interrupted - closing broker")
+		b.Close()
+	}()
+
+	if err := b.Serve(listener); err != nil {
+		log.Fatalf("Broker stopped: %s", err)
+	}
+}
+
+// BrokerListen is the address the broker listens on
+var BrokerListen string
+
+// BrokerRetainedFile is the file where the broker keeps retained messages (kept only in memory if empty)
+var BrokerRetainedFile string
+
+// BrokerMaxWillDelay is the longest Will Delay Interval in seconds the broker honors (0 is no limit)
+var BrokerMaxWillDelay int
+
+// BrokerAuthFile is the file with users and topic rules for the broker (all clients are allowed everything if empty)
+var BrokerAuthFile string
+
+func init() {
+	RootCmd.AddCommand(brokerCmd)
+	flags := brokerCmd.PersistentFlags()
+
+	flags.StringVarP(&BrokerListen,
+		"listen", "l", ":"+mqtt.UnencryptedPortTCP, "the address to accept MQTT clients on (default ':1883')")
+	flags.StringVarP(&BrokerRetainedFile,
+		"retained_file", "", "", "the file to keep retained messages in - default is to keep them only in memory")
+	flags.IntVarP(&BrokerMaxWillDelay,
+		"max_will_delay", "", 0, "the longest Will Delay Interval in seconds honored for MQTT 5 clients (default 0 - no limit)")
+	flags.StringVarP(&BrokerAuthFile,
+		"auth_file", "", "", "the file with users and topic rules - default is to allow all clients everything")
+}
@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/conformance"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var conformanceCmd = &cobra.Command{
+	Use:   "conformance",
+	Short: "Check how a MQTT broker follows the MQTT 3.1.1 specification",
+	Long: `Runs a catalogue of named scenarios against a MQTT broker and reports which passed and which failed
+
+	Each scenario connects the clients it needs and checks what the broker does - for example that an
+	unacknowledged QoS 1 message is delivered again when the session is resumed. The packets sent and received
+	by the clients of a failed scenario are printed after the reason it failed (use --trace to also print
+	those of the scenarios that passed). Use --list to see the scenarios, and --scenario to run only some
+	of them.
+
+	With --junit the report is also written as JUnit XML to the given file - or only to stdout if the file
+	is "-". The command exits with status 1 if a scenario failed.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if ConformanceList {
+			listConformanceScenarios()
+			return
+		}
+		runConformance()
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if ConformanceTimeout < 1 {
+			return fmt.Errorf("--timeout must be at least 1")
+		}
+		if ConformanceQuiet < 1 {
+			return fmt.Errorf("--quiet must be at least 1")
+		}
+		return mqtt.ValidateTopicName(ConformanceTopic)
+	},
+}
+
+func listConformanceScenarios() {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, scenario := range conformance.Scenarios() {
+		fmt.Fprintf(tw, "%s\t%s\n", scenario.Name, scenario.Description)
+	}
+	tw.Flush()
+}
+
+func runConformance() {
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", brokerAddress(ConformanceBroker))
+	}
+	options := []conformance.SuiteOption{
+		conformance.Dialer(dial),
+		conformance.ClientName(ConformanceClientName),
+		conformance.Topic(ConformanceTopic),
+		conformance.Timeout(time.Duration(ConformanceTimeout) * time.Second),
+		conformance.Quiet(time.Duration(ConformanceQuiet) * time.Millisecond),
+	}
+	if ConformanceCreds != "" {
+		options = append(options, conformance.ConnectOptions(credsConnectOptions(ConformanceCreds)...))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Debugf("Interrupted - stopping")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report, err := conformance.NewSuite(options...).Run(ctx, ConformanceScenarios...)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	if ConformanceJUnit != "-" {
+		report.WriteText(os.Stdout, ConformanceTrace)
+	}
+	if ConformanceJUnit != "" {
+		name := "mezquit conformance " + brokerAddress(ConformanceBroker)
+		if ConformanceJUnit == "-" {
+			report.WriteJUnit(os.Stdout, name)
+		} else if err := writeJUnit(ConformanceJUnit, name, report); err != nil {
+			log.Fatalf("Cannot write %s: %s", ConformanceJUnit, err)
+		}
+	}
+	if !report.Passed() {
+		os.Exit(1)
+	}
+}
+
+// writeJUnit writes the given report as JUnit XML to the given file
+func writeJUnit(fileName, name string, report *conformance.Report) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := report.WriteJUnit(f, name); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ConformanceBroker is the MQTT host (or host:port) to check
+var ConformanceBroker string
+
+// ConformanceClientName is the name the client IDs of the scenarios are based on
+var ConformanceClientName string
+
+// ConformanceCreds is a NATS creds file with the user JWT to use as password
+var ConformanceCreds string
+
+// ConformanceTopic is the topic the topics of the scenarios are below
+var ConformanceTopic string
+
+// ConformanceScenarios are the names of the scenarios to run (all if empty)
+var ConformanceScenarios []string
+
+// ConformanceTimeout is the number of seconds to wait for something the broker is expected to do
+var ConformanceTimeout int
+
+// ConformanceQuiet is the number of milliseconds to wait to conclude that the broker does not do something
+var ConformanceQuiet int
+
+// ConformanceJUnit is the file to write the report to as JUnit XML ("-" for stdout)
+var ConformanceJUnit string
+
+// ConformanceTrace if true prints the traces of the scenarios that passed
+var ConformanceTrace bool
+
+// ConformanceList if true lists the scenarios instead of running them
+var ConformanceList bool
+
+func init() {
+	RootCmd.AddCommand(conformanceCmd)
+	flags := conformanceCmd.PersistentFlags()
+
+	flags.StringVarP(&ConformanceBroker,
+		"broker", "b", "localhost", "the MQTT Broker host (or host:port) to connect to (default 'localhost')")
+	flags.StringVarP(&ConformanceClientName,
+		"client", "c", "mezquit", "the client IDs are this name followed by -<run ID>-<client>")
+	flags.StringVarP(&ConformanceCreds,
+		"creds", "", "", "a NATS creds file - its user JWT is used as the password")
+	flags.StringVarP(&ConformanceTopic,
+		"topic", "t", "mezquit/conformance", "the topics of the scenarios are below <topic>/<run ID>")
+	flags.StringSliceVarP(&ConformanceScenarios,
+		"scenario", "", nil, "the name of a scenario to run - may be repeated (default all)")
+	flags.IntVarP(&ConformanceTimeout,
+		"timeout", "", 5, "the number of seconds to wait for something the broker should do (default 5)")
+	flags.IntVarP(&ConformanceQuiet,
+		"quiet", "", 500, "the number of milliseconds to wait to conclude the broker does not do something (default 500)")
+	flags.StringVarP(&ConformanceJUnit,
+		"junit", "", "", "a file to write the report to as JUnit XML - '-' writes only XML to stdout")
+	flags.BoolVarP(&ConformanceTrace,
+		"trace", "", false, "also print the packet traces of the scenarios that passed")
+	flags.BoolVarP(&ConformanceList,
+		"list", "", false, "list the scenarios instead of running them")
+}
@@ -0,0 +1,259 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/creds"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var credsCmd = &cobra.Command{
+	Use:   "creds",
+	Short: "Create and decode NATS nkeys and user JWTs",
+	Long: `Creates nkeys, creates creds files with a user JWT and user seed, and decodes user JWTs
+
+	NATS server with MQTT support enabled accepts a user JWT as the password of a MQTT client. The pub and
+	sub commands use the JWT of a creds file as the password when given --creds.
+	`,
+}
+
+var credsNkeyCmd = &cobra.Command{
+	Use:   "nkey",
+	Short: "Create an operator, account, or user nkey",
+	Long: `Creates an nkey of the given --type and prints its seed and public key
+
+	The seed is the private key and should be kept secret.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		kp, err := creds.CreateKeyPair(credsPrefixes[CredsKeyType])
+		if err != nil {
+			log.Fatalf("Cannot create nkey: %s", err)
+		}
+		fmt.Printf("seed: %s\npublic key: %s\n", kp.Seed(), kp.PublicKey())
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if _, ok := credsPrefixes[CredsKeyType]; !ok {
+			return fmt.Errorf("--type must be operator, account, or user, got '%s'", CredsKeyType)
+		}
+		return nil
+	},
+}
+
+var credsUserCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Create a creds file with a user JWT",
+	Long: `Creates a user JWT signed by an account, and writes it with the user seed as a creds file
+
+	The account is given by its seed with --account_seed (the seed, or a file containing it). If no account is
+	given a new account key is created and its seed and public key are printed to stderr - the NATS server
+	must trust the account.
+
+	The permissions are NATS subjects - a MQTT topic a/b is the subject a.b, and the topic filter a/# is the
+	subjects a and a.>. The JWT is a bearer token unless --bearer=false is given - NATS server requires this
+	when the JWT is used as a MQTT password, as a MQTT client cannot sign a nonce.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runCredsUser()
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if CredsExpiry < 0 {
+			return fmt.Errorf("--expiry cannot be negative")
+		}
+		return nil
+	},
+}
+
+var credsDecodeCmd = &cobra.Command{
+	Use:   "decode <creds file or JWT>",
+	Short: "Decode and verify a user JWT",
+	Long: `Prints the claims of a user JWT - given as a creds file or as the JWT itself
+
+	The command exits with status 1 if the JWT is not signed by its issuer, has expired, or is otherwise
+	not valid.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runCredsDecode(args[0])
+	},
+
+	Args: cobra.ExactArgs(1),
+}
+
+// credsPrefixes are the nkey prefix bytes of the values of --type
+var credsPrefixes = map[string]byte{
+	"operator": creds.PrefixOperator,
+	"account":  creds.PrefixAccount,
+	"user":     creds.PrefixUser,
+}
+
+// readSeed returns the key pair of the given seed, or of the seed in the given file
+//
+func readSeed(seedOrFile string) (*creds.KeyPair, error) {
+	seed := seedOrFile
+	if data, err := ioutil.ReadFile(seedOrFile); err == nil {
+		seed = strings.TrimSpace(string(data))
+	}
+	return creds.FromSeed(seed)
+}
+
+func runCredsUser() {
+	var account *creds.KeyPair
+	var err error
+	if CredsAccountSeed == "" {
+		if account, err = creds.CreateKeyPair(creds.PrefixAccount); err != nil {
+			log.Fatalf("Cannot create account nkey: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "Created account\nseed: %s\npublic key: %s\n", account.Seed(), account.PublicKey())
+	} else if account, err = readSeed(CredsAccountSeed); err != nil {
+		log.Fatalf("Cannot read --account_seed: %s", err)
+	}
+
+	var user *creds.KeyPair
+	if CredsUserSeed == "" {
+		user, err = creds.CreateKeyPair(creds.PrefixUser)
+	} else {
+		user, err = readSeed(CredsUserSeed)
+	}
+	if err != nil {
+		log.Fatalf("Cannot get user nkey: %s", err)
+	}
+
+	claims := creds.NewUserClaims(user.PublicKey())
+	claims.Name = CredsName
+	claims.Nats.Pub = creds.Permission{Allow: CredsAllowPub, Deny: CredsDenyPub}
+	claims.Nats.Sub = creds.Permission{Allow: CredsAllowSub, Deny: CredsDenySub}
+	claims.Nats.BearerToken = CredsBearer
+	if CredsExpiry > 0 {
+		claims.ExpiresAt = time.Now().Add(CredsExpiry).Unix()
+	}
+	token, err := creds.EncodeUserClaims(claims, account)
+	if err != nil {
+		log.Fatalf("Cannot create user JWT: %s", err)
+	}
+
+	content := creds.FormatCreds(token, user.Seed())
+	if CredsOutput == "" {
+		os.Stdout.Write(content)
+		return
+	}
+	if err := ioutil.WriteFile(CredsOutput, content, 0600); err != nil {
+		log.Fatalf("Cannot write %s: %s", CredsOutput, err)
+	}
+}
+
+func runCredsDecode(credsOrJWT string) {
+	token := credsOrJWT
+	if data, err := ioutil.ReadFile(credsOrJWT); err == nil {
+		if token, _, err = creds.ParseCreds(data); err != nil {
+			log.Fatalf("Cannot read %s: %s", credsOrJWT, err)
+		}
+	}
+	claims, err := creds.DecodeUserClaims(token)
+	if claims == nil {
+		log.Fatalf("Cannot decode JWT: %s", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(claims)
+	if expires := claims.Expires(); !expires.IsZero() {
+		fmt.Printf("expires: %s\n", expires.Format(time.RFC3339))
+	}
+	if err != nil {
+		fmt.Printf("NOT VALID: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("valid")
+}
+
+// credsConnectOptions returns the MQTT connect options for the user JWT of the given creds file - the JWT is the
+// password, and the user name is the name in the JWT (or the user public key if it has no name)
+//
+func credsConnectOptions(fileName string) []mqtt.ConnectOption {
+	token, kp, err := creds.ReadCreds(fileName)
+	if kp == nil {
+		log.Fatalf("Cannot read creds: %s", err)
+	}
+	if err != nil {
+		log.Warnf("Using creds that are not valid: %s", err)
+	}
+	userName := kp.PublicKey()
+	if claims, _ := creds.DecodeUserClaims(token); claims != nil && claims.Name != "" {
+		userName = claims.Name
+	}
+	return []mqtt.ConnectOption{mqtt.UserName(userName), mqtt.Password([]byte(token))}
+}
+
+// CredsKeyType is the type of nkey to create - operator, account, or user
+var CredsKeyType string
+
+// CredsAccountSeed is the seed (or a file with the seed) of the account signing a user JWT
+var CredsAccountSeed string
+
+// CredsUserSeed is the seed (or a file with the seed) of the user of a JWT - a new user is created if empty
+var CredsUserSeed string
+
+// CredsName is the name of the user
+var CredsName string
+
+// CredsAllowPub are the subjects the user may publish to
+var CredsAllowPub []string
+
+// CredsDenyPub are the subjects the user may not publish to
+var CredsDenyPub []string
+
+// CredsAllowSub are the subjects the user may subscribe to
+var CredsAllowSub []string
+
+// CredsDenySub are the subjects the user may not subscribe to
+var CredsDenySub []string
+
+// CredsExpiry is the time until the user JWT expires (0 means never)
+var CredsExpiry time.Duration
+
+// CredsBearer indicates if the user JWT is a bearer token
+var CredsBearer bool
+
+// CredsOutput is the file to write the creds to - stdout if empty
+var CredsOutput string
+
+func init() {
+	RootCmd.AddCommand(credsCmd)
+	credsCmd.AddCommand(credsNkeyCmd)
+	credsCmd.AddCommand(credsUserCmd)
+	credsCmd.AddCommand(credsDecodeCmd)
+
+	flags := credsNkeyCmd.PersistentFlags()
+	flags.StringVarP(&CredsKeyType,
+		"type", "", "user", "the type of nkey - operator, account, or user (default user)")
+
+	flags = credsUserCmd.PersistentFlags()
+	flags.StringVarP(&CredsAccountSeed,
+		"account_seed", "", "", "the seed (or a file with the seed) of the account signing the JWT - default is a new account")
+	flags.StringVarP(&CredsUserSeed,
+		"user_seed", "", "", "the seed (or a file with the seed) of the user - default is a new user")
+	flags.StringVarP(&CredsName,
+		"name", "", "", "the name of the user")
+	flags.StringSliceVarP(&CredsAllowPub,
+		"allow_pub", "", nil, "subject(s) the user may publish to - default is all")
+	flags.StringSliceVarP(&CredsDenyPub,
+		"deny_pub", "", nil, "subject(s) the user may not publish to")
+	flags.StringSliceVarP(&CredsAllowSub,
+		"allow_sub", "", nil, "subject(s) the user may subscribe to - default is all")
+	flags.StringSliceVarP(&CredsDenySub,
+		"deny_sub", "", nil, "subject(s) the user may not subscribe to")
+	flags.DurationVarP(&CredsExpiry,
+		"expiry", "", 0, "the time until the JWT expires, for example 24h (default 0 - never)")
+	flags.BoolVarP(&CredsBearer,
+		"bearer", "", true, "If the JWT is a bearer token (required when it is used as a MQTT password)")
+	flags.StringVarP(&CredsOutput,
+		"output", "o", "", "the creds file to write - default is stdout")
+}
@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/decode"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/internal/pcap"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var decodeCmd = &cobra.Command{
+	Use:   "decode [file]...",
+	Short: "Decode and print MQTT packets from hex, binary, or a capture",
+	Long: `Decodes MQTT packets and prints each of them field by field
+
+	The packets are read from the given files, or from stdin when no file (or -) is given, or from the --hex
+	given on the command line. The --input is detected unless given: a capture recorded with --record (of pub
+	or sub), a pcap or pcapng capture (from tcpdump or Wireshark), hex, or else raw binary bytes. Hex may have
+	white space, commas, colons, or 0x between bytes, and a hex dump copied from Wireshark or made with
+	hexdump -C can be used as it is.
+
+	Each packet is printed with its type, flags, remaining length, variable header, MQTT 5 properties, and
+	payload (as text, or as a hex dump when it is not text), with the offset of each field. What is malformed
+	is flagged with the offset of the offending byte. Offsets in a capture are from the start of each packet.
+
+	The TCP connections to the --port in a pcap or pcapng capture (--pcap) are reassembled, and the MQTT
+	conversation of each client is listed with the time of each packet since the connection started. Besides
+	malformed packets, packets violating the protocol in the conversation are flagged - for example a client
+	not starting with CONNECT. Use --fields to print all fields of the packets.
+
+	Packets are decoded as MQTT 3.1.1 until a CONNECT with another protocol level is decoded - use --protocol 5
+	to decode MQTT 5 packets without a CONNECT. The command exits with status 1 if a packet is malformed.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runDecode(args)
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if DecodeHex != "" && len(args) > 0 {
+			return fmt.Errorf("files cannot be given with --hex")
+		}
+		switch DecodeInput {
+		case "auto", "hex", "raw", "capture", "pcap":
+		default:
+			return fmt.Errorf("--input must be auto, hex, raw, capture, or pcap, got '%s'", DecodeInput)
+		}
+		if DecodePcap {
+			DecodeInput = "pcap"
+		}
+		if DecodePort < 1 || DecodePort > 65535 {
+			return fmt.Errorf("--port must be between 1 and 65535, got %d", DecodePort)
+		}
+		if DecodeProtocol < 3 || DecodeProtocol > 5 {
+			return fmt.Errorf("--protocol must be 3, 4, or 5, got %d", DecodeProtocol)
+		}
+		return nil
+	},
+}
+
+func runDecode(fileNames []string) {
+	packets, malformed := 0, 0
+	count := func(decoded []*decode.Packet) {
+		for _, p := range decoded {
+			packets++
+			if p.Malformed() {
+				malformed++
+			}
+		}
+	}
+
+	if DecodeHex != "" {
+		data, err := decode.ParseHex(DecodeHex)
+		if err != nil {
+			log.Fatalf("Cannot decode --hex: %s", err)
+		}
+		count(decodeData(data, "raw"))
+	} else {
+		if len(fileNames) == 0 {
+			fileNames = []string{"-"}
+		}
+		for _, fileName := range fileNames {
+			if len(fileNames) > 1 {
+				fmt.Printf("== %s\n\n", fileName)
+			}
+			count(decodeFile(fileName))
+		}
+	}
+
+	fmt.Printf("%d packets, %d malformed\n", packets, malformed)
+	if malformed > 0 {
+		os.Exit(1)
+	}
+}
+
+// decodeFile prints the packets of the given file (- for stdin) and returns them
+func decodeFile(fileName string) []*decode.Packet {
+	var data []byte
+	var err error
+	if fileName == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(fileName)
+	}
+	if err != nil {
+		log.Fatalf("Cannot read %s: %s", fileName, err)
+	}
+	return decodeData(data, DecodeInput)
+}
+
+// decodeData prints the packets of the given data in the given input format and returns them
+func decodeData(data []byte, input string) []*decode.Packet {
+	if input == "auto" {
+		trimmed := bytes.TrimSpace(data)
+		switch {
+		case pcap.IsCapture(data):
+			input = "pcap"
+		case bytes.HasPrefix(trimmed, []byte(`{"format":"`+mqtt.CaptureFormat+`"`)):
+			input = "capture"
+		case len(trimmed) > 0 && isHex(trimmed):
+			input = "hex"
+		default:
+			input = "raw"
+		}
+		log.Debugf("Decoding the input as %s", input)
+	}
+
+	decoder := decode.NewDecoder(DecodeProtocol)
+	switch input {
+	case "capture":
+		capture, err := mqtt.ReadCapture(bytes.NewReader(data))
+		if err != nil {
+			log.Fatalf("Cannot read the capture: %s", err)
+		}
+		var packets []*decode.Packet
+		for _, r := range capture.Records {
+			fmt.Printf("%s at %s\n", r.Direction(), r.At)
+			decoded := decoder.DecodeAll(r.Data, 0)
+			printPackets(decoded)
+			packets = append(packets, decoded...)
+		}
+		return packets
+
+	case "pcap":
+		connections, err := pcap.ReadConnections(bytes.NewReader(data), DecodePort)
+		if err != nil {
+			log.Fatalf("Cannot read the pcap capture: %s", err)
+		}
+		return decodeConnections(connections)
+
+	case "hex":
+		var err error
+		if data, err = decode.ParseHex(string(data)); err != nil {
+			log.Fatalf("Cannot decode the hex: %s", err)
+		}
+	}
+	packets := decoder.DecodeAll(data, 0)
+	printPackets(packets)
+	return packets
+}
+
+func printPackets(packets []*decode.Packet) {
+	for _, p := range packets {
+		fmt.Println(p.Format())
+	}
+}
+
+// decodeConnections prints the MQTT conversation of each of the given connections and returns the packets
+func decodeConnections(connections []*pcap.Connection) []*decode.Packet {
+	var packets []*decode.Packet
+	for _, c := range connections {
+		fmt.Printf("== %s -> %s at %s\n", c.Client, c.Server, c.Started.Format(time.RFC3339Nano))
+		conversation := decode.NewConversation(DecodeProtocol)
+		last := map[bool]time.Duration{}
+		for _, d := range c.Data {
+			at := d.At.Sub(c.Started)
+			last[d.FromClient] = at
+			if d.Missing > 0 {
+				note := fmt.Sprintf("%d bytes were not captured", d.Missing)
+				if dropped := conversation.Skip(d.FromClient, d.Missing); dropped > 0 {
+					note += fmt.Sprintf(" - the %d bytes of a packet before them are dropped", dropped)
+				}
+				fmt.Printf("  %-12s %-6s ! %s\n", fmt.Sprintf("+%.6f", at.Seconds()), side(d.FromClient), note)
+			}
+			for _, p := range conversation.Add(d.FromClient, d.Bytes) {
+				printConversationPacket(at, d.FromClient, p)
+				packets = append(packets, p)
+			}
+		}
+		for _, fromClient := range []bool{true, false} {
+			if p := conversation.Close(fromClient); p != nil {
+				printConversationPacket(last[fromClient], fromClient, p)
+				packets = append(packets, p)
+			}
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d connections\n", len(connections))
+	return packets
+}
+
+// printConversationPacket prints a packet sent by the client (or else by the broker) at the given time
+func printConversationPacket(at time.Duration, fromClient bool, p *decode.Packet) {
+	fmt.Printf("  %-12s %-6s %s\n", fmt.Sprintf("+%.6f", at.Seconds()), side(fromClient), p.Summary())
+	if DecodeFields {
+		lines := strings.Split(strings.TrimSuffix(p.Format(), "\n"), "\n")
+		for _, line := range lines[1:] {
+			fmt.Printf("%22s%s\n", "", line)
+		}
+		return
+	}
+	for _, problem := range p.Problems {
+		fmt.Printf("%22s! %s\n", "", problem)
+	}
+}
+
+// side returns the name of the side of a connection sending data
+func side(fromClient bool) string {
+	if fromClient {
+		return "client"
+	}
+	return "broker"
+}
+
+// isHex returns true if the given data can be parsed as hex
+func isHex(data []byte) bool {
+	_, err := decode.ParseHex(string(data))
+	return err == nil
+}
+
+// DecodeHex is hex to decode instead of files
+var DecodeHex string
+
+// DecodeInput is the format of the input - auto, hex, raw, or capture
+var DecodeInput string
+
+// DecodePcap tells that the files are pcap or pcapng captures (the same as --input pcap)
+var DecodePcap bool
+
+// DecodePort is the port of the MQTT broker in pcap and pcapng captures
+var DecodePort int
+
+// DecodeFields tells that all fields of the packets in pcap and pcapng captures are printed
+var DecodeFields bool
+
+// DecodeProtocol is the protocol level to decode packets as until a CONNECT is decoded
+var DecodeProtocol int
+
+func init() {
+	RootCmd.AddCommand(decodeCmd)
+	flags := decodeCmd.PersistentFlags()
+
+	flags.StringVarP(&DecodeHex,
+		"hex", "x", "", "hex bytes to decode instead of files")
+	flags.StringVarP(&DecodeInput,
+		"input", "i", "auto", "the format of the input - auto, hex, raw, capture, or pcap (default 'auto')")
+	flags.BoolVarP(&DecodePcap,
+		"pcap", "", false, "the files are pcap or pcapng captures (the same as --input pcap)")
+	flags.IntVarP(&DecodePort,
+		"port", "", 1883, "the port of the MQTT broker in pcap and pcapng captures (default 1883)")
+	flags.BoolVarP(&DecodeFields,
+		"fields", "f", false, "print all fields of the packets in pcap and pcapng captures")
+	flags.IntVarP(&DecodeProtocol,
+		"protocol", "p", 4, "the protocol level before a CONNECT - 3 (MQTT 3.1), 4 (MQTT 3.1.1), or 5 (MQTT 5) (default 4)")
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/spf13/cobra"
+)
+
+// FaultLatency is the number of milliseconds to delay what is read and written
+var FaultLatency int
+
+// FaultJitter is the maximum number of milliseconds of random delay added to the latency
+var FaultJitter int
+
+// FaultBandwidth is the number of bytes per second that can be read and written (0 for unlimited)
+var FaultBandwidth int
+
+// FaultFragment is the maximum number of bytes of each read and write (0 for no fragmentation)
+var FaultFragment int
+
+// FaultDropBytes is the number of bytes read and written after which the connection is dropped (0 for never)
+var FaultDropBytes int64
+
+// FaultDropPackets is the number of packets read and written after which the connection is dropped (0 for never)
+var FaultDropPackets int
+
+// FaultCorrupt is the probability that a byte read or written is corrupted
+var FaultCorrupt float64
+
+// FaultStallAfter is the number of bytes read after which reads stall (-1 for no stall)
+var FaultStallAfter int64
+
+// FaultStall is the number of milliseconds reads stall (0 until the connection ends)
+var FaultStall int
+
+// FaultSeed is the seed of the random jitter and corruption (0 for a seed based on the time)
+var FaultSeed int64
+
+// addFaultFlags adds the flags injecting network faults to the given command. The flags are shared by the commands
+// having them - only one command runs.
+//
+func addFaultFlags(cmd *cobra.Command) {
+	flags := cmd.PersistentFlags()
+	flags.IntVarP(&FaultLatency,
+		"fault_latency", "", 0, "milliseconds to delay what is read and written")
+	flags.IntVarP(&FaultJitter,
+		"fault_jitter", "", 0, "maximum milliseconds of random delay added to --fault_latency")
+	flags.IntVarP(&FaultBandwidth,
+		"fault_bandwidth", "", 0, "bytes per second that can be read and written in each direction (default unlimited)")
+	flags.IntVarP(&FaultFragment,
+		"fault_fragment", "", 0, "split reads and writes into fragments of at most this many bytes")
+	flags.Int64VarP(&FaultDropBytes,
+		"fault_drop_bytes", "", 0, "drop the connection after this many bytes have been read and written")
+	flags.IntVarP(&FaultDropPackets,
+		"fault_drop_packets", "", 0, "drop the connection after this many MQTT packets have been read and written")
+	flags.Float64VarP(&FaultCorrupt,
+		"fault_corrupt", "", 0, "the probability (0-1) that a byte read or written is corrupted")
+	flags.Int64VarP(&FaultStallAfter,
+		"fault_stall_after", "", -1, "stall reads after this many bytes have been read (default no stall)")
+	flags.IntVarP(&FaultStall,
+		"fault_stall", "", 0, "milliseconds reads stall - see --fault_stall_after (default until the connection ends)")
+	flags.Int64VarP(&FaultSeed,
+		"fault_seed", "", 0, "the seed of the random jitter and corruption (default based on the time)")
+}
+
+// checkFaultFlags returns an error if a flag injecting network faults has an invalid value
+func checkFaultFlags() error {
+	switch {
+	case FaultLatency < 0 || FaultJitter < 0:
+		return fmt.Errorf("--fault_latency and --fault_jitter cannot be negative")
+	case FaultBandwidth < 0:
+		return fmt.Errorf("--fault_bandwidth cannot be negative")
+	case FaultFragment < 0:
+		return fmt.Errorf("--fault_fragment cannot be negative")
+	case FaultDropBytes < 0 || FaultDropPackets < 0:
+		return fmt.Errorf("--fault_drop_bytes and --fault_drop_packets cannot be negative")
+	case FaultCorrupt < 0 || FaultCorrupt > 1:
+		return fmt.Errorf("--fault_corrupt must be between 0 and 1, got %g", FaultCorrupt)
+	case FaultStall < 0:
+		return fmt.Errorf("--fault_stall cannot be negative")
+	}
+	return nil
+}
+
+// faultyConn returns the given connection wrapped in a FaultyConnection if a flag injecting network faults is given
+func faultyConn(conn net.Conn) net.Conn {
+	var options []mqtt.FaultOption
+	if FaultLatency > 0 || FaultJitter > 0 {
+		options = append(options, mqtt.AddLatency(time.Duration(FaultLatency)*time.Millisecond,
+			time.Duration(FaultJitter)*time.Millisecond))
+	}
+	if FaultBandwidth > 0 {
+		options = append(options, mqtt.LimitBandwidth(FaultBandwidth))
+	}
+	if FaultFragment > 0 {
+		options = append(options, mqtt.Fragment(FaultFragment))
+	}
+	if FaultDropBytes > 0 {
+		options = append(options, mqtt.DropAfterBytes(FaultDropBytes))
+	}
+	if FaultDropPackets > 0 {
+		options = append(options, mqtt.DropAfterPackets(FaultDropPackets))
+	}
+	if FaultCorrupt > 0 {
+		options = append(options, mqtt.CorruptBytes(FaultCorrupt))
+	}
+	if FaultStallAfter >= 0 {
+		options = append(options, mqtt.StallReads(FaultStallAfter, time.Duration(FaultStall)*time.Millisecond))
+	}
+	if len(options) == 0 {
+		return conn
+	}
+	if FaultSeed != 0 {
+		options = append(options, mqtt.FaultSeed(FaultSeed))
+	}
+	return mqtt.NewFaultyConnection(conn, options...)
+}
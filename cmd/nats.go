@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/nats"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var natsCmd = &cobra.Command{
+	Use:   "nats",
+	Short: "Publish and subscribe with the NATS core protocol",
+	Long: `Publishes or subscribes at a NATS server using the NATS core text protocol
+
+	See the pub and sub sub commands.
+	`,
+}
+
+var natsPubCmd = &cobra.Command{
+	Use:   "pub",
+	Short: "Publish a message to a NATS subject",
+	Long: `Publishes a message to a NATS subject, optionally with headers given as --header key:value
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runNatsPub()
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := nats.ValidateSubject(NatsPubSubject); err != nil {
+			return err
+		}
+		for _, header := range NatsHeaders {
+			if parts := strings.SplitN(header, ":", 2); len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+				return fmt.Errorf("a --header must be given as key:value, got '%s'", header)
+			}
+		}
+		return nil
+	},
+}
+
+var natsSubCmd = &cobra.Command{
+	Use:   "sub",
+	Short: "Subscribe to NATS subjects",
+	Long: `Subscribes to NATS subjects and prints each received message as "<subject> <message>"
+
+	Headers of received messages are logged at info level. The command runs until interrupted, or until
+	--count messages have been received.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runNatsSub()
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(NatsSubSubjects) == 0 {
+			return fmt.Errorf("at least one --subject is required")
+		}
+		for _, subject := range NatsSubSubjects {
+			if err := nats.ValidateSubjectFilter(subject); err != nil {
+				return err
+			}
+		}
+		if NatsSubCount < 0 {
+			return fmt.Errorf("--count cannot be negative")
+		}
+		return nil
+	},
+}
+
+// natsAddress returns the given server as host:port - the standard NATS port is used if the given server does not
+// include a port
+//
+func natsAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, nats.DefaultPort)
+}
+
+// natsConnect connects to the NATS server given by the flags, and ends the command if this fails
+//
+func natsConnect(name string) *nats.Client {
+	conn, err := net.Dial("tcp", natsAddress(NatsServer))
+	if err != nil {
+		log.Fatalf("Cannot connect to %s: %s", NatsServer, err)
+	}
+	client := nats.NewClient(nats.Connection(conn), nats.Name(name),
+		nats.UserInfo(NatsUser, NatsPassword), nats.Token(NatsToken))
+	if err := client.Connect(); err != nil {
+		log.Fatalf("Cannot connect to %s: %s", NatsServer, err)
+	}
+	info := client.Info()
+	log.Debugf("Connected to NATS server %s version %s", info.ServerID, info.Version)
+	return client
+}
+
+func runNatsPub() {
+	client := natsConnect("mezquit-pub")
+	defer client.Close()
+
+	msg := &nats.Msg{Subject: NatsPubSubject, Data: []byte(NatsPubMessage)}
+	if len(NatsHeaders) > 0 {
+		msg.Header = nats.Header{}
+		for _, header := range NatsHeaders {
+			parts := strings.SplitN(header, ":", 2)
+			msg.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+	if err := client.PublishMsg(msg); err != nil {
+		log.Fatalf("Cannot publish to %s: %s", NatsPubSubject, err)
+	}
+
+	// Make sure the server has processed the message before closing
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Flush(ctx); err != nil {
+		log.Fatalf("Publishing to %s failed: %s", NatsPubSubject, err)
+	}
+}
+
+func runNatsSub() {
+	client := natsConnect("mezquit-sub")
+	defer client.Close()
+
+	received := make(chan *nats.Msg, 100)
+	handler := func(msg *nats.Msg) { received <- msg }
+	for _, subject := range NatsSubSubjects {
+		if _, err := client.QueueSubscribe(subject, NatsQueue, handler); err != nil {
+			log.Fatalf("Cannot subscribe to %s: %s", subject, err)
+		}
+		log.Infof("Subscribed to %s", subject)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	for count := 0; NatsSubCount == 0 || count < NatsSubCount; count++ {
+		select {
+		case msg := <-received:
+			for key, values := range msg.Header {
+				log.Infof("%s header %s: %s", msg.Subject, key, strings.Join(values, ", "))
+			}
+			fmt.Printf("%s %s\n", msg.Subject, msg.Data)
+		case <-interrupt:
+			log.Debugf("Interrupted - disconnecting")
+			return
+		case <-client.Done():
+			log.Errorf("Connection ended with error: %s", client.Err())
+			return
+		}
+	}
+}
+
+// NatsServer is the NATS host (or host:port) to connect to
+var NatsServer string
+
+// NatsUser is the user name to connect with
+var NatsUser string
+
+// NatsPassword is the password to connect with
+var NatsPassword string
+
+// NatsToken is the authentication token to connect with
+var NatsToken string
+
+// NatsPubSubject is the subject to publish to
+var NatsPubSubject string
+
+// NatsPubMessage is the message to publish
+var NatsPubMessage string
+
+// NatsHeaders are the headers (key:value) of the published message
+var NatsHeaders []string
+
+// NatsSubSubjects are the subjects to subscribe to
+var NatsSubSubjects []string
+
+// NatsQueue is the queue group to subscribe in (none if empty)
+var NatsQueue string
+
+// NatsSubCount is the number of messages to receive before disconnecting (0 means until interrupted)
+var NatsSubCount int
+
+func init() {
+	RootCmd.AddCommand(natsCmd)
+	natsCmd.AddCommand(natsPubCmd)
+	natsCmd.AddCommand(natsSubCmd)
+
+	flags := natsCmd.PersistentFlags()
+	flags.StringVarP(&NatsServer,
+		"server", "s", "localhost", "the NATS server host (or host:port) to connect to (default 'localhost')")
+	flags.StringVarP(&NatsUser,
+		"user", "", "", "the user name to connect with")
+	flags.StringVarP(&NatsPassword,
+		"password", "", "", "the password to connect with")
+	flags.StringVarP(&NatsToken,
+		"token", "", "", "the authentication token to connect with")
+
+	flags = natsPubCmd.PersistentFlags()
+	flags.StringVarP(&NatsPubSubject,
+		"subject", "t", "", "the NATS subject to publish to")
+	flags.StringVarP(&NatsPubMessage,
+		"message", "m", "", "the message to publish")
+	flags.StringSliceVarP(&NatsHeaders,
+		"header", "H", nil, "header(s) of the message as key:value")
+
+	flags = natsSubCmd.PersistentFlags()
+	flags.StringSliceVarP(&NatsSubSubjects,
+		"subject", "t", nil, "the NATS subject(s) to subscribe to - may contain the wildcards '*' and '>'")
+	flags.StringVarP(&NatsQueue,
+		"queue", "g", "", "the queue group to subscribe in")
+	flags.IntVarP(&NatsSubCount,
+		"count", "n", 0, "the number of messages to receive before disconnecting (default 0 - until interrupted)")
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hlindberg/mezquit/internal/bench"
+	"github.com/hlindberg/mezquit/internal/benchplot"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var plotCmd = &cobra.Command{
+	Use:   "plot <result.json>...",
+	Short: "Draw charts of benchmark results",
+	Long: `Draws charts of results saved with bench --json to the --output .svg or .png file
+
+	The charts are the latency distribution, the latency over time, and the throughput over time. Each result
+	is drawn in its own color - to compare for example different brokers side by side. A result is labeled
+	with its --label (given once per result, in order), or else the broker it was run against, or else its
+	file name.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runPlot(args)
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("at least one result file is required")
+		}
+		if len(PlotLabels) > len(args) {
+			return fmt.Errorf("got %d --label for %d result files", len(PlotLabels), len(args))
+		}
+		_, err := benchplot.Format(PlotOutput)
+		return err
+	},
+}
+
+func runPlot(fileNames []string) {
+	results := make([]*bench.Result, len(fileNames))
+	for i, fileName := range fileNames {
+		r, err := bench.ReadResult(fileName)
+		if err != nil {
+			log.Fatalf("Cannot read %s: %s", fileName, err)
+		}
+		switch {
+		case i < len(PlotLabels):
+			r.Label = PlotLabels[i]
+		case r.Label == "":
+			r.Label = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+		}
+		results[i] = r
+	}
+	if err := benchplot.Save(PlotOutput, results...); err != nil {
+		log.Fatalf("Cannot plot: %s", err)
+	}
+}
+
+// PlotOutput is the .svg or .png file to draw the charts in
+var PlotOutput string
+
+// PlotLabels are the labels of the results, in the order of the result files
+var PlotLabels []string
+
+func init() {
+	RootCmd.AddCommand(plotCmd)
+	flags := plotCmd.PersistentFlags()
+
+	flags.StringVarP(&PlotOutput,
+		"output", "o", "bench.svg", "the .svg or .png file to draw the charts in (default 'bench.svg')")
+	flags.StringSliceVarP(&PlotLabels,
+		"label", "l", nil, "the label of a result - given once per result file, in order")
+}
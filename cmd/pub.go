@@ -1,10 +1,15 @@
 package cmd
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"os/signal"
 
 	"github.com/hlindberg/mezquit/internal/mqtt"
 	log "github.com/sirupsen/logrus"
@@ -16,6 +21,15 @@ var publishCmd = &cobra.Command{
 	Short: "Publish MQTT message",
 	Long: `Publishes a message via MQTT
 
+	The --message is published to the --topic, or each <topic, message> line of a CSV --file, or each record
+	read from stdin (--stdin) to the --topic. The file and stdin are read as the messages are published, so a
+	large file is not read into memory, and output piped to the command (for example from tail -f) is
+	published as it arrives, using one session, until stdin ends or the command is interrupted.
+
+	The records read from stdin are lines (--delimiter line, the default), NUL terminated (nul), or each
+	prefixed with its length as a 4 byte big endian integer (length). Empty lines and empty NUL terminated
+	records are skipped, while a record of length 0 is published as an empty message (which with --retain
+	clears the retained message of the topic).
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		p := &publisher{}
@@ -36,6 +50,18 @@ var publishCmd = &cobra.Command{
 		if KeepAliveSeconds < 0 {
 			return fmt.Errorf("--keep_alive cannot be negative")
 		}
+		if err := checkFaultFlags(); err != nil {
+			return err
+		}
+		if FromStdin && FileName != "" {
+			return fmt.Errorf("--stdin and --file cannot be used at the same time")
+		}
+		if FromStdin && Message != "" {
+			return fmt.Errorf("--stdin and --message cannot be used at the same time")
+		}
+		if _, ok := delimiters[Delimiter]; !ok {
+			return fmt.Errorf("--delimiter must be line, nul, or length, got '%s'", Delimiter)
+		}
 		if TestQoS1Resend && TestQoS2Resend {
 			return fmt.Errorf("--test_qos1_resend and --test_qos2_resend cannot be used at the same time")
 		}
@@ -59,14 +85,24 @@ type publisher struct {
 }
 
 func (p *publisher) dial() net.Conn {
-	// This MQTT client uses a hard coded broker and unencrypted TCP port
+	// This MQTT client uses unencrypted TCP (on the standard port unless the broker is given as host:port)
 	// It gives the resulting conn as both Input and Output to a MQTT Session
 	//
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", MQTTBroker, mqtt.UnencryptedPortTCP))
+	conn, err := net.Dial("tcp", brokerAddress(MQTTBroker))
 	if err != nil {
 		panic(err)
 	}
-	return conn
+	return faultyConn(recordingConn(conn))
+}
+
+// brokerAddress returns the given broker as host:port - the standard unencrypted MQTT port is used if the given
+// broker does not include a port
+//
+func brokerAddress(broker string) string {
+	if _, _, err := net.SplitHostPort(broker); err == nil {
+		return broker
+	}
+	return net.JoinHostPort(broker, mqtt.UnencryptedPortTCP)
 }
 
 func (p *publisher) clientName() string {
@@ -90,6 +126,9 @@ func (p *publisher) connect(session *mqtt.Session, options ...mqtt.ConnectOption
 		mqtt.WillRetain(WillRetain),
 		mqtt.KeepAliveSeconds(KeepAliveSeconds),
 	}
+	if MQTTCreds != "" {
+		opts = append(opts, credsConnectOptions(MQTTCreds)...)
+	}
 	for _, o := range options {
 		opts = append(opts, o)
 	}
@@ -113,21 +152,182 @@ func (p *publisher) publishFromFile(session *mqtt.Session) {
 	if err != nil {
 		panic(fmt.Sprintf("Cannot open file %s", FileName))
 	}
-	all, err := csv.NewReader(f).ReadAll()
-	for _, r := range all {
-		session.Publish(mqtt.Message([]byte(r[1])),
+	defer f.Close()
+	next := csvMessages(f)
+	for {
+		r, err := next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Errorf("Cannot read %s: %s", FileName, err)
+			return
+		}
+		err = session.Publish(mqtt.Message([]byte(r[1])),
 			mqtt.Topic(r[0]),
 			mqtt.QoS(QoS),
 			mqtt.Retain(false),
 		)
+		if err != nil {
+			log.Errorf("Cannot publish to %s: %s", r[0], err)
+			return
+		}
+	}
+}
+
+// csvMessages returns a function reading the next <topic, message> record of CSV from the reader. The returned
+// error is io.EOF when there are no more records.
+//
+func csvMessages(reader io.Reader) func() ([]string, error) {
+	csvReader := csv.NewReader(reader)
+	count := 0
+	return func() ([]string, error) {
+		r, err := csvReader.Read()
+		if err != nil {
+			return nil, err
+		}
+		count++
+		if len(r) < 2 {
+			return nil, fmt.Errorf("record %d: expected <topic, message>", count)
+		}
+		return r, nil
+	}
+}
+
+// publishFromStdin publishes each record read from stdin to the topic as it is read, until stdin ends or the
+// command is interrupted
+//
+func (p *publisher) publishFromStdin(session *mqtt.Session) {
+	records := make(chan []byte)
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(records)
+		next := delimiters[Delimiter](bufio.NewReader(os.Stdin))
+		for {
+			record, err := next()
+			if err != nil {
+				if err != io.EOF {
+					failed <- err
+				}
+				return
+			}
+			select {
+			case records <- record:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	count := 0
+	defer func() { log.Infof("Published %d messages", count) }()
+	for {
+		select {
+		case record, ok := <-records:
+			if !ok {
+				select {
+				case err := <-failed:
+					log.Errorf("Cannot read stdin: %s", err)
+				default:
+				}
+				return
+			}
+			err := session.Publish(mqtt.Message(record),
+				mqtt.Topic(Topic),
+				mqtt.QoS(QoS),
+				mqtt.Retain(Retain),
+			)
+			if err != nil {
+				log.Errorf("Cannot publish to %s: %s", Topic, err)
+				return
+			}
+			count++
+		case <-interrupt:
+			log.Debugf("Interrupted - stopping")
+			return
+		}
+	}
+}
+
+// maxRecordSize is the largest record read from stdin - the largest remaining length of an MQTT packet
+const maxRecordSize = 268435455
+
+// delimiters are functions returning a function reading the next record from a reader for each --delimiter.
+// The returned error is io.EOF when there are no more records. Empty lines and empty NUL terminated records are
+// skipped since they are typically blank lines or trailing terminators, while a length prefixed record of length 0
+// is returned as it is deliberately empty - an empty message clears the retained message of a topic.
+//
+var delimiters = map[string]func(*bufio.Reader) func() ([]byte, error){
+	"line": func(reader *bufio.Reader) func() ([]byte, error) {
+		return skipEmpty(terminated(reader, '\n'))
+	},
+	"nul": func(reader *bufio.Reader) func() ([]byte, error) {
+		return skipEmpty(terminated(reader, 0))
+	},
+	"length": func(reader *bufio.Reader) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			length := make([]byte, 4)
+			if _, err := io.ReadFull(reader, length); err != nil {
+				if err == io.ErrUnexpectedEOF {
+					return nil, fmt.Errorf("the length of the last record is truncated")
+				}
+				return nil, err
+			}
+			size := binary.BigEndian.Uint32(length)
+			if size > maxRecordSize {
+				return nil, fmt.Errorf("a record of %d bytes is larger than an MQTT message can be", size)
+			}
+			record := make([]byte, size)
+			if n, err := io.ReadFull(reader, record); err != nil {
+				return nil, fmt.Errorf("expected a record of %d bytes but got %d", len(record), n)
+			}
+			return record, nil
+		}
+	},
+}
+
+// terminated returns a function reading the next record ending with the given terminator (or the end of the
+// reader) from the reader. A line also ending with \r has it removed.
+//
+func terminated(reader *bufio.Reader, terminator byte) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		record, err := reader.ReadBytes(terminator)
+		if err != nil && (err != io.EOF || len(record) == 0) {
+			return nil, err
+		}
+		record = bytes.TrimSuffix(record, []byte{terminator})
+		if terminator == '\n' {
+			record = bytes.TrimSuffix(record, []byte{'\r'})
+		}
+		return record, nil
+	}
+}
+
+// skipEmpty returns a function returning the next non empty record returned by next
+func skipEmpty(next func() ([]byte, error)) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		for {
+			record, err := next()
+			if err != nil || len(record) > 0 {
+				return record, err
+			}
+		}
 	}
 }
 
 func (p *publisher) publishGivenMessage(session *mqtt.Session) {
-	if FileName == "" {
-		p.publishMessage(session)
-	} else {
+	switch {
+	case FromStdin:
+		p.publishFromStdin(session)
+	case FileName != "":
 		p.publishFromFile(session)
+	default:
+		p.publishMessage(session)
 	}
 }
 
@@ -137,12 +337,8 @@ func (p *publisher) standardPublish() {
 	session := p.session(clientName, conn)
 	p.connect(session, mqtt.CleanSession(true))
 	p.publishGivenMessage(session)
+	p.disconnect(session)
 
-	if TestNoDisconnect {
-		session.DisconnectWithoutMessage(1)
-	} else {
-		session.Disconnect(1)
-	}
 	// Done
 	conn.Close()
 }
@@ -167,10 +363,17 @@ func (p *publisher) qos1ResendPublish() {
 
 }
 func (p *publisher) disconnect(session *mqtt.Session) {
+	var err error
 	if TestNoDisconnect {
-		session.DisconnectWithoutMessage(1)
+		err = session.DisconnectWithoutMessage(1)
 	} else {
-		session.Disconnect(1)
+		err = session.Disconnect(1)
+	}
+	if _, ok := err.(*mqtt.UnacknowledgedError); ok {
+		// Expected when acknowledgements are ignored by the --test_qos<n>_resend options
+		log.Warnf("%s", err)
+	} else if err != nil {
+		log.Errorf("Session ended with error: %s", err)
 	}
 }
 func (p *publisher) qos2ResendPublish() {
@@ -206,6 +409,9 @@ var MQTTBroker string
 // MQTTClientName is the MQTT client name - a short UUID by default
 var MQTTClientName string
 
+// MQTTCreds is a NATS creds file with the user JWT to use as password
+var MQTTCreds string
+
 // Topic is the MQTT topic to publish to
 var Topic string
 
@@ -221,6 +427,12 @@ var QoS int
 // FileName the name of a file to read instead of using --topic and --message
 var FileName string
 
+// FromStdin if true each record read from stdin is published to the topic
+var FromStdin bool
+
+// Delimiter is how the records read from stdin are delimited - line, nul, or length
+var Delimiter string
+
 // Retain indicates if the published message should be retained
 var Retain bool
 
@@ -250,11 +462,17 @@ func init() {
 	flags := publishCmd.PersistentFlags()
 
 	flags.StringVarP(&MQTTBroker,
-		"broker", "b", "localhost", "the MQTT Broker host to connect to (default 'localhost')")
+		"broker", "b", "localhost", "the MQTT Broker host (or host:port) to connect to (default 'localhost')")
 	flags.StringVarP(&MQTTClientName,
 		"client", "c", "", "the MQTT client name to use - default is a short UUID")
+	flags.StringVarP(&MQTTCreds,
+		"creds", "", "", "a NATS creds file - its user JWT is used as the password")
 	flags.StringVarP(&FileName,
 		"file", "f", "", "File with CSV <topic, message> lines to publish")
+	flags.BoolVarP(&FromStdin,
+		"stdin", "", false, "publish each record read from stdin to the topic as it arrives")
+	flags.StringVarP(&Delimiter,
+		"delimiter", "", "line", "how records read from stdin are delimited - line, nul, or length (4 bytes big endian) (default 'line')")
 	flags.IntVarP(&KeepAliveSeconds,
 		"keep_alive", "", 0, "sets the number of seconds to keep a connection alive")
 	flags.StringVarP(&Message,
@@ -282,4 +500,10 @@ func init() {
 
 	flags.BoolVarP(&TestQoS2Resend,
 		"test_qos2_resend", "", false, "Performs: 2phased ignore first PUBREC, then PUBCOM with redeliveries in between")
+
+	// Options injecting network faults
+	addFaultFlags(publishCmd)
+
+	// Option recording the connection
+	addRecordFlag(publishCmd)
 }
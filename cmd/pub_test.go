@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/broker"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+// testhelperStartBroker starts an embedded broker listening on a free local port and returns it with its address.
+// The returned channel receives the client ID of each client the broker sends a SUBACK to.
+func testhelperStartBroker(t *testing.T) (*broker.Broker, string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	testutils.CheckNotError(err, t)
+	subscribed := make(chan string, 10)
+	b := broker.NewBroker(broker.OnSent(func(clientID string, packet *mqtt.GenericMessage) {
+		if packet.Type() == mqtt.SubAckType {
+			subscribed <- clientID
+		}
+	}))
+	go b.Serve(listener)
+	return b, listener.Addr().String(), subscribed
+}
+
+// testhelperSubscribe runs the sub command code until count messages have been received and returns what it
+// printed on the returned channel. It returns when the subscription has been acknowledged by the broker.
+func testhelperSubscribe(address string, subscribed <-chan string, count int, t *testing.T, filters ...string) <-chan string {
+	t.Helper()
+	SubBroker, SubClientName, SubQoS, SubCount, SubCleanSession, TopicFilters = address, "subscriber", 1, count, true, filters
+	output := make(chan string, 1)
+	go func() {
+		out := &bytes.Buffer{}
+		s := &subscriber{out: out}
+		s.subscribe()
+		output <- out.String()
+	}()
+	select {
+	case <-subscribed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the subscriber to subscribe")
+	}
+	return output
+}
+
+func testhelperReceived(output <-chan string, t *testing.T) string {
+	t.Helper()
+	select {
+	case text := <-output:
+		return text
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the subscriber to receive all messages")
+	}
+	return ""
+}
+
+func Test_pub_message_is_received_by_sub_via_the_embedded_broker(t *testing.T) {
+	b, address, subscribed := testhelperStartBroker(t)
+	defer b.Close()
+	output := testhelperSubscribe(address, subscribed, 2, t, "sensors/#")
+
+	MQTTBroker, MQTTClientName, QoS, Retain, FromStdin, FileName = address, "publisher", 1, false, false, ""
+	p := &publisher{}
+	Topic, Message = "sensors/kitchen", "21"
+	p.standardPublish()
+	Topic, Message = "sensors/hall", "19"
+	p.standardPublish()
+
+	testutils.CheckEqual("sensors/kitchen 21\nsensors/hall 19\n", testhelperReceived(output, t), t)
+}
+
+func Test_pub_retained_message_is_received_by_a_later_sub(t *testing.T) {
+	b, address, subscribed := testhelperStartBroker(t)
+	defer b.Close()
+
+	MQTTBroker, MQTTClientName, QoS, Retain, FromStdin, FileName = address, "publisher", 2, true, false, ""
+	Topic, Message = "status", "up"
+	p := &publisher{}
+	p.standardPublish()
+
+	output := testhelperSubscribe(address, subscribed, 1, t, "status")
+	testutils.CheckEqual("status up\n", testhelperReceived(output, t), t)
+}
+
+// testhelperReadRecords reads all records with the given --delimiter and returns them with the error ending them
+// (nil at the end of the input)
+func testhelperReadRecords(delimiter string, input []byte) ([]string, error) {
+	next := delimiters[delimiter](bufio.NewReader(bytes.NewReader(input)))
+	records := []string{}
+	for {
+		record, err := next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, string(record))
+	}
+}
+
+func Test_pub_delimiters_read_the_records_of_stdin(t *testing.T) {
+	for _, c := range []struct {
+		delimiter string
+		input     []byte
+		records   []string
+		err       string
+	}{
+		{"line", []byte("a\nb\n"), []string{"a", "b"}, ""},
+		{"line", []byte("a\r\nb\r\n"), []string{"a", "b"}, ""},
+		{"line", []byte("\na\n\n\r\nb\n\n"), []string{"a", "b"}, ""},
+		{"line", []byte("a\nb"), []string{"a", "b"}, ""},
+		{"line", []byte(""), []string{}, ""},
+		{"nul", []byte("a\nb\x00\x00c\x00d"), []string{"a\nb", "c", "d"}, ""},
+		{"length", []byte{0, 0, 0, 2, 'a', 'b', 0, 0, 0, 1, 'c'}, []string{"ab", "c"}, ""},
+		{"length", []byte{0, 0, 0, 0, 0, 0, 0, 1, 'c'}, []string{"", "c"}, ""},
+		{"length", []byte{0, 0, 0, 0}, []string{""}, ""},
+		{"length", []byte{0, 0, 0, 1, 'a', 0, 0}, []string{"a"}, "the length of the last record is truncated"},
+		{"length", []byte{0, 0, 0, 3, 'a', 'b'}, []string{}, "expected a record of 3 bytes but got 2"},
+		{"length", []byte{0x0F, 0xFF, 0xFF, 0xFF, 'a'}, []string{}, "expected a record of 268435455 bytes but got 1"},
+		{"length", []byte{0x10, 0, 0, 0, 'a'}, []string{}, "a record of 268435456 bytes is larger than an MQTT message can be"},
+	} {
+		records, err := testhelperReadRecords(c.delimiter, c.input)
+		if c.err == "" {
+			testutils.CheckNotError(err, t)
+		} else {
+			testutils.CheckError(err, t)
+			testutils.CheckEqual(c.err, err.Error(), t)
+		}
+		testutils.CheckEqual(c.records, records, t)
+	}
+}
+
+func Test_pub_csvMessages_reads_topic_and_message_records(t *testing.T) {
+	for _, c := range []struct {
+		input    string
+		messages [][]string
+		err      string // "csv" is any error of the CSV reader
+	}{
+		{"a,1\nb/c,2\n", [][]string{{"a", "1"}, {"b/c", "2"}}, ""},
+		{"a,\"x, y\"\nb,\"line\nbreak\"", [][]string{{"a", "x, y"}, {"b", "line\nbreak"}}, ""},
+		{"", [][]string{}, ""},
+		{"a\nb\n", [][]string{}, "record 1: expected <topic, message>"},
+		{"a,1\nb\n", [][]string{{"a", "1"}}, "csv"},
+		{"a,1\nb,\"2\n", [][]string{{"a", "1"}}, "csv"},
+	} {
+		next := csvMessages(strings.NewReader(c.input))
+		messages := [][]string{}
+		var err error
+		for {
+			var r []string
+			if r, err = next(); err != nil {
+				break
+			}
+			messages = append(messages, r)
+		}
+		switch c.err {
+		case "":
+			testutils.CheckEqual(io.EOF, err, t)
+		case "csv":
+			_, ok := err.(*csv.ParseError)
+			testutils.CheckTrue(ok, t)
+		default:
+			testutils.CheckEqual(c.err, err.Error(), t)
+		}
+		testutils.CheckEqual(c.messages, messages, t)
+	}
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"net"
+	"os"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// RecordFile is a capture file to record the packets sent and received to (empty for no recording)
+var RecordFile string
+
+// recordCapture is the capture the connections record to - created by the first recording connection
+var recordCapture *mqtt.CaptureWriter
+
+// addRecordFlag adds the flag recording the packets of the connections to the given command
+func addRecordFlag(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVarP(&RecordFile,
+		"record", "", "", "record the packets sent and received to this capture file (see the replay command)")
+}
+
+// recordingConn returns the given connection wrapped in a RecordingConnection if --record is given. All
+// connections record to the same capture.
+//
+func recordingConn(conn net.Conn) net.Conn {
+	if RecordFile == "" {
+		return conn
+	}
+	if recordCapture == nil {
+		f, err := os.Create(RecordFile)
+		if err != nil {
+			log.Fatalf("Cannot create %s: %s", RecordFile, err)
+		}
+		recordCapture = mqtt.NewCaptureWriter(f)
+	}
+	return mqtt.NewRecordingConnection(conn, recordCapture)
+}
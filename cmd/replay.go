@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/internal/replay"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <capture>",
+	Short: "Replay a captured MQTT session as a client or as a broker",
+	Long: `Replays a session captured with --record (of pub or sub)
+
+	As a client (the default) the messages published in the capture are published again to the broker, with
+	the time between them in the capture divided by --speed (0 publishes them without waiting). The client
+	connects with the client ID and clean session flag of the capture unless --client is given.
+
+	With --serve the command instead listens at the given host:port and answers the clients connecting to it
+	the way the broker in the capture answered - a client must send the same kinds of packets in the same
+	order as the client in the capture. This makes it possible to check a client against a recorded broker.
+	Clients are served one at a time, and the capture starts over for the next client when a client has
+	done all of it, or did something else. The command runs until interrupted.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		capture, err := mqtt.ReadCaptureFile(args[0])
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		if ReplayServe != "" {
+			serveReplay(capture)
+		} else {
+			publishReplay(capture)
+		}
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("a capture file must be given")
+		}
+		if ReplaySpeed < 0 {
+			return fmt.Errorf("--speed cannot be negative")
+		}
+		return nil
+	},
+}
+
+func publishReplay(capture *mqtt.Capture) {
+	var options []mqtt.ConnectOption
+	clientName := ReplayClientName
+	if cr := replay.Connect(capture); cr != nil {
+		if clientName == "" {
+			clientName = cr.Options().ClientName
+		}
+		options = append(options, mqtt.CleanSession(cr.IsCleanSession()))
+	}
+	if clientName == "" {
+		clientName = mqtt.RandomClientID()
+		log.Infof("Using generated client ID %s", clientName)
+	}
+	if ReplayCreds != "" {
+		options = append(options, credsConnectOptions(ReplayCreds)...)
+	}
+
+	conn, err := net.Dial("tcp", brokerAddress(ReplayBroker))
+	if err != nil {
+		log.Fatalf("Cannot connect to %s: %s", brokerAddress(ReplayBroker), err)
+	}
+	defer conn.Close()
+	session := mqtt.NewSession(mqtt.ClientID(clientName), mqtt.Connection(conn))
+	if err := session.Connect(options...); err != nil {
+		log.Fatalf("Cannot connect to %s: %s", brokerAddress(ReplayBroker), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Debugf("Interrupted - stopping")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	count, err := replay.Publish(ctx, session, capture, ReplaySpeed)
+	if err != nil {
+		log.Errorf("Replay stopped: %s", err)
+	}
+	if err := session.Disconnect(5); err != nil {
+		log.Errorf("Session ended with error: %s", err)
+	}
+	fmt.Printf("Published %d messages\n", count)
+}
+
+func serveReplay(capture *mqtt.Capture) {
+	listener, err := net.Listen("tcp", ReplayServe)
+	if err != nil {
+		log.Fatalf("Cannot listen at %s: %s", ReplayServe, err)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Infof("Interrupted - closing")
+		listener.Close()
+	}()
+	log.Infof("Replaying the broker of the capture at %s", listener.Addr())
+
+	b := replay.NewBroker(capture, ReplaySpeed)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		log.Infof("Client connected from %s", conn.RemoteAddr())
+		if err := b.Serve(conn); err != nil {
+			log.Errorf("%s - starting over", err)
+			b = replay.NewBroker(capture, ReplaySpeed)
+		} else if b.Done() {
+			log.Infof("The client did all of the capture - starting over")
+			b = replay.NewBroker(capture, ReplaySpeed)
+		}
+	}
+}
+
+// ReplayBroker is the MQTT host (or host:port) to publish the messages of the capture to
+var ReplayBroker string
+
+// ReplayClientName is the client ID to use instead of the one in the capture
+var ReplayClientName string
+
+// ReplayCreds is a NATS creds file with the user JWT to use as password
+var ReplayCreds string
+
+// ReplaySpeed is what the time between packets in the capture is divided by (0 for no waiting)
+var ReplaySpeed float64
+
+// ReplayServe is the host:port to listen at as the broker of the capture (empty to replay as a client)
+var ReplayServe string
+
+func init() {
+	RootCmd.AddCommand(replayCmd)
+	flags := replayCmd.PersistentFlags()
+
+	flags.StringVarP(&ReplayBroker,
+		"broker", "b", "localhost", "the MQTT Broker host (or host:port) to connect to (default 'localhost')")
+	flags.StringVarP(&ReplayClientName,
+		"client", "c", "", "the MQTT client name to use - default is the one in the capture")
+	flags.StringVarP(&ReplayCreds,
+		"creds", "", "", "a NATS creds file - its user JWT is used as the password")
+	flags.Float64VarP(&ReplaySpeed,
+		"speed", "", 1, "the time between packets in the capture is divided by this - 0 for no waiting (default 1)")
+	flags.StringVarP(&ReplayServe,
+		"serve", "", "", "listen at this host:port and answer clients like the broker in the capture")
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/conformance"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run <scenario.yaml>...",
+	Short: "Run scenarios written in YAML against a MQTT broker",
+	Long: `Runs scenarios written in YAML against a MQTT broker and reports which passed and which failed
+
+	A scenario has a name, a description, and steps performed in order by named clients ("main" if not
+	given). For example:
+
+	    name: qos2-resend-after-ignored-pubrec
+	    description: A QoS 2 message whose PUBREC was lost is delivered once
+	    steps:
+	      - connect: {client: sub}
+	      - subscribe: {client: sub, topic: "${topic}/a", qos: 2}
+	      - connect: {client: pub, clean: false}
+	      - ignore: {client: pub, packet: PUBREC}
+	      - publish: {client: pub, topic: "${topic}/a", message: hello, qos: 2}
+	      - expect: {client: pub, packet: PUBREC}
+	      - drop: {client: pub}
+	      - reconnect: {client: pub}
+	      - expect: {client: pub, packet: PUBCOMP}
+	      - expect: {client: sub, packet: PUBLISH, message: hello}
+	      - expect_none: {client: sub, packet: PUBLISH}
+
+	The steps are connect (client_id, clean, keep_alive, username, password, will), reconnect (as connect
+	but continuing the session by default), subscribe (topic, qos), publish (topic, message, qos, retain -
+	without waiting for acknowledgement), ignore (packet, count - the packets are not processed or
+	acknowledged), drop_on (packet - the connection is closed when it arrives), drop (close without
+	DISCONNECT), disconnect, wait (a duration like 500ms), expect and expect_none (packet, and topic,
+	message, qos, dup, retain, packet_id, session_present, within), and expect_closed (within).
+	"${topic}" is replaced by a topic below --topic that is unique for each run, and "${run}" by the run ID.
+
+	The report is like the one of the conformance command - with --junit it is also written as JUnit XML
+	to the given file, or only to stdout if the file is "-". The command exits with status 1 if a scenario
+	failed.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var scenarios []conformance.Scenario
+		for _, fileName := range args {
+			scenario, err := conformance.ReadScript(fileName)
+			if err != nil {
+				log.Fatalf("%s", err)
+			}
+			scenarios = append(scenarios, scenario)
+		}
+		runScenarios(scenarios)
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("at least one scenario file must be given")
+		}
+		if RunTimeout < 1 {
+			return fmt.Errorf("--timeout must be at least 1")
+		}
+		if RunQuiet < 1 {
+			return fmt.Errorf("--quiet must be at least 1")
+		}
+		return mqtt.ValidateTopicName(RunTopic)
+	},
+}
+
+func runScenarios(scenarios []conformance.Scenario) {
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", brokerAddress(RunBroker))
+	}
+	options := []conformance.SuiteOption{
+		conformance.Dialer(dial),
+		conformance.ClientName(RunClientName),
+		conformance.Topic(RunTopic),
+		conformance.Timeout(time.Duration(RunTimeout) * time.Second),
+		conformance.Quiet(time.Duration(RunQuiet) * time.Millisecond),
+	}
+	if RunCreds != "" {
+		options = append(options, conformance.ConnectOptions(credsConnectOptions(RunCreds)...))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Debugf("Interrupted - stopping")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report := conformance.NewSuite(options...).RunScenarios(ctx, scenarios...)
+
+	if RunJUnit != "-" {
+		report.WriteText(os.Stdout, RunTrace)
+	}
+	if RunJUnit != "" {
+		name := "mezquit run " + brokerAddress(RunBroker)
+		if RunJUnit == "-" {
+			report.WriteJUnit(os.Stdout, name)
+		} else if err := writeJUnit(RunJUnit, name, report); err != nil {
+			log.Fatalf("Cannot write %s: %s", RunJUnit, err)
+		}
+	}
+	if !report.Passed() {
+		os.Exit(1)
+	}
+}
+
+// RunBroker is the MQTT host (or host:port) to run the scenarios against
+var RunBroker string
+
+// RunClientName is the name the client IDs of the scenarios are based on
+var RunClientName string
+
+// RunCreds is a NATS creds file with the user JWT to use as password
+var RunCreds string
+
+// RunTopic is the topic that ${topic} in the scenarios is below
+var RunTopic string
+
+// RunTimeout is the default number of seconds an expect step waits
+var RunTimeout int
+
+// RunQuiet is the default number of milliseconds an expect_none step waits
+var RunQuiet int
+
+// RunJUnit is the file to write the report to as JUnit XML ("-" for stdout)
+var RunJUnit string
+
+// RunTrace if true prints the traces of the scenarios that passed
+var RunTrace bool
+
+func init() {
+	RootCmd.AddCommand(runCmd)
+	flags := runCmd.PersistentFlags()
+
+	flags.StringVarP(&RunBroker,
+		"broker", "b", "localhost", "the MQTT Broker host (or host:port) to connect to (default 'localhost')")
+	flags.StringVarP(&RunClientName,
+		"client", "c", "mezquit", "the client IDs are this name followed by -<run ID>-<client>")
+	flags.StringVarP(&RunCreds,
+		"creds", "", "", "a NATS creds file - its user JWT is used as the password")
+	flags.StringVarP(&RunTopic,
+		"topic", "t", "mezquit/run", "${topic} in the scenarios is <topic>/<run ID>")
+	flags.IntVarP(&RunTimeout,
+		"timeout", "", 5, "the number of seconds an expect step waits unless it has 'within' (default 5)")
+	flags.IntVarP(&RunQuiet,
+		"quiet", "", 500, "the number of milliseconds an expect_none step waits unless it has 'within' (default 500)")
+	flags.StringVarP(&RunJUnit,
+		"junit", "", "", "a file to write the report to as JUnit XML - '-' writes only XML to stdout")
+	flags.BoolVarP(&RunTrace,
+		"trace", "", false, "also print the packet traces of the scenarios that passed")
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var subscribeCmd = &cobra.Command{
+	Use:   "sub",
+	Short: "Subscribe to MQTT topics",
+	Long: `Subscribes to MQTT topic filters and prints each received message as "<topic> <message>"
+
+	The command runs until interrupted, or until --count messages have been received.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		s := &subscriber{out: os.Stdout}
+		s.subscribe()
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if SubQoS < 0 || SubQoS > 2 {
+			return fmt.Errorf("--qos must be between 0 and 2, got %d", SubQoS)
+		}
+		if len(TopicFilters) == 0 {
+			return fmt.Errorf("at least one --topic is required")
+		}
+		for _, filter := range TopicFilters {
+			if err := mqtt.ValidateTopicFilter(filter); err != nil {
+				return err
+			}
+		}
+		if SubCount < 0 {
+			return fmt.Errorf("--count cannot be negative")
+		}
+		return checkFaultFlags()
+	},
+}
+
+type subscriber struct {
+	out io.Writer // where the received messages are printed
+}
+
+func (s *subscriber) subscribe() {
+	conn, err := net.Dial("tcp", brokerAddress(SubBroker))
+	if err != nil {
+		panic(err)
+	}
+	conn = faultyConn(recordingConn(conn))
+	defer conn.Close()
+
+	clientName := SubClientName
+	if clientName == "" {
+		clientName = mqtt.RandomClientID()
+		log.Infof("Using generated client ID %s", clientName)
+	}
+
+	received := make(chan mqtt.PublishOptions, 100)
+	session := mqtt.NewSession(mqtt.ClientID(clientName), mqtt.Connection(conn),
+		mqtt.MessageHandler(func(msg *mqtt.PublishRequest) { received <- msg.Options() }))
+
+	connectOptions := []mqtt.ConnectOption{mqtt.CleanSession(SubCleanSession)}
+	if SubCreds != "" {
+		connectOptions = append(connectOptions, credsConnectOptions(SubCreds)...)
+	}
+	err = session.Connect(connectOptions...)
+	if err != nil {
+		panic(err)
+	}
+
+	filters := []mqtt.SubscribeOption{}
+	for _, filter := range TopicFilters {
+		filters = append(filters, mqtt.TopicFilter(filter, SubQoS))
+	}
+	granted, err := session.Subscribe(filters...)
+	if err != nil {
+		panic(err)
+	}
+	for i, rc := range granted {
+		if rc == mqtt.SubAckFailure {
+			log.Errorf("Subscription to %s was refused by the broker", TopicFilters[i])
+		} else {
+			log.Infof("Subscribed to %s with QoS %d", TopicFilters[i], rc)
+		}
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	for count := 0; SubCount == 0 || count < SubCount; count++ {
+		select {
+		case msg := <-received:
+			fmt.Fprintf(s.out, "%s %s\n", msg.Topic, msg.Message)
+		case <-interrupt:
+			log.Debugf("Interrupted - disconnecting")
+			s.disconnect(session)
+			return
+		case <-session.Done():
+			log.Errorf("Session ended with error: %s", session.Err())
+			return
+		}
+	}
+	s.disconnect(session)
+}
+
+func (s *subscriber) disconnect(session *mqtt.Session) {
+	if err := session.Disconnect(1); err != nil {
+		log.Errorf("Session ended with error: %s", err)
+	}
+}
+
+// SubBroker is the MQTT host (or host:port) to subscribe at
+var SubBroker string
+
+// SubClientName is the MQTT client name of the subscriber - a short UUID by default
+var SubClientName string
+
+// SubCreds is a NATS creds file with the user JWT to use as password
+var SubCreds string
+
+// TopicFilters are the MQTT topic filters to subscribe to
+var TopicFilters []string
+
+// SubQoS is the maximum QoS to subscribe with
+var SubQoS int
+
+// SubCount is the number of messages to receive before disconnecting (0 means until interrupted)
+var SubCount int
+
+// SubCleanSession indicates if the subscriber should connect with a clean session
+var SubCleanSession bool
+
+func init() {
+	RootCmd.AddCommand(subscribeCmd)
+	flags := subscribeCmd.PersistentFlags()
+
+	flags.StringVarP(&SubBroker,
+		"broker", "b", "localhost", "the MQTT Broker host (or host:port) to connect to (default 'localhost')")
+	flags.StringVarP(&SubClientName,
+		"client", "c", "", "the MQTT client name to use - default is a short UUID")
+	flags.StringVarP(&SubCreds,
+		"creds", "", "", "a NATS creds file - its user JWT is used as the password")
+	flags.StringSliceVarP(&TopicFilters,
+		"topic", "t", nil, "the MQTT topic filter(s) to subscribe to")
+	flags.IntVarP(&SubQoS,
+		"qos", "q", 0, "Maximum quality of service 0-2 (default 0)")
+	flags.IntVarP(&SubCount,
+		"count", "n", 0, "the number of messages to receive before disconnecting (default 0 - until interrupted)")
+	flags.BoolVarP(&SubCleanSession,
+		"clean", "", true, "If the subscriber should connect with a clean session")
+
+	// Options injecting network faults
+	addFaultFlags(subscribeCmd)
+
+	// Option recording the connection
+	addRecordFlag(subscribeCmd)
+}
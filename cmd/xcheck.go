@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/internal/xcheck"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var xcheckCmd = &cobra.Command{
+	Use:   "xcheck",
+	Short: "Check messages crossing between MQTT and NATS",
+	Long: `Publishes numbered messages over MQTT and receives them over NATS, and the other way around
+
+	The MQTT --topic is mapped to a NATS subject the same way as the MQTT support in NATS server does it
+	(for example a/b.c is a.b//c). For each --direction the report tells how many messages were lost,
+	duplicated, or received out of order, what they looked like when received (NATS headers, or the MQTT QoS
+	and retain flag), and their latency. With --latencies the latency of each message is listed.
+
+	The --broker and --server may be the same host when checking NATS server with MQTT support enabled. The
+	command exits with status 1 if a message was lost, duplicated, or received out of order.
+	`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runXcheck()
+	},
+
+	Args: func(cmd *cobra.Command, args []string) error {
+		if XcheckQoS < 0 || XcheckQoS > 2 {
+			return fmt.Errorf("--qos must be between 0 and 2, got %d", XcheckQoS)
+		}
+		if err := mqtt.ValidateTopicName(XcheckTopic); err != nil {
+			return err
+		}
+		if XcheckCount < 1 {
+			return fmt.Errorf("--count must be at least 1")
+		}
+		if XcheckInterval < 0 || XcheckWait < 0 {
+			return fmt.Errorf("--interval and --wait cannot be negative")
+		}
+		if _, ok := xcheckDirections[XcheckDirection]; !ok {
+			return fmt.Errorf("--direction must be mqtt-nats, nats-mqtt, or both, got '%s'", XcheckDirection)
+		}
+		return nil
+	},
+}
+
+// xcheckDirections are the directions to check for each value of --direction
+var xcheckDirections = map[string][]xcheck.Direction{
+	"mqtt-nats": {xcheck.MQTTToNATS},
+	"nats-mqtt": {xcheck.NATSToMQTT},
+	"both":      {xcheck.MQTTToNATS, xcheck.NATSToMQTT},
+}
+
+func runXcheck() {
+	mqttConn, err := net.Dial("tcp", brokerAddress(XcheckBroker))
+	if err != nil {
+		log.Fatalf("Cannot connect to %s: %s", XcheckBroker, err)
+	}
+	natsConn, err := net.Dial("tcp", natsAddress(XcheckServer))
+	if err != nil {
+		mqttConn.Close()
+		log.Fatalf("Cannot connect to %s: %s", XcheckServer, err)
+	}
+
+	clientName := XcheckClientName
+	if clientName == "" {
+		clientName = mqtt.RandomClientID()
+		log.Infof("Using generated client ID %s", clientName)
+	}
+	c := xcheck.NewChecker(
+		xcheck.MQTTConnection(mqttConn),
+		xcheck.NATSConnection(natsConn),
+		xcheck.ClientName(clientName),
+		xcheck.Topic(XcheckTopic),
+		xcheck.QoS(XcheckQoS),
+		xcheck.Count(XcheckCount),
+		xcheck.Interval(time.Duration(XcheckInterval)*time.Millisecond),
+		xcheck.Wait(time.Duration(XcheckWait)*time.Second),
+	)
+	if err := c.Start(); err != nil {
+		log.Fatalf("Cannot start check: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Debugf("Interrupted - stopping")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	passed := true
+	for _, direction := range xcheckDirections[XcheckDirection] {
+		r, err := c.Run(ctx, direction)
+		if err != nil {
+			c.Close()
+			log.Fatalf("Check %s failed: %s", direction, err)
+		}
+		printXcheckReport(r)
+		passed = passed && r.Passed()
+	}
+	cancel()
+	if err := c.Close(); err != nil {
+		log.Errorf("Disconnect failed: %s", err)
+	}
+	if !passed {
+		os.Exit(1)
+	}
+}
+
+func printXcheckReport(r *xcheck.Report) {
+	fmt.Printf("%s  topic %s  subject %s  QoS %d\n", r.Direction, r.Topic, r.Subject, r.QoS)
+	fmt.Printf("  sent %d  received %d  lost %d  duplicates %d  out of order %d  unexpected %d\n",
+		r.Sent, r.Received, len(r.Lost), r.Duplicates, r.OutOfOrder, r.Unexpected)
+	if len(r.Lost) > 0 {
+		fmt.Printf("  lost messages %v\n", r.Lost)
+	}
+	min, median, max := r.LatencySummary()
+	fmt.Printf("  latency min %s  median %s  max %s\n", min, median, max)
+	if XcheckLatencies {
+		for i, latency := range r.Latencies {
+			if latency >= 0 {
+				fmt.Printf("    %d %s\n", i+1, latency)
+			} else {
+				fmt.Printf("    %d lost\n", i+1)
+			}
+		}
+	}
+	properties := make([]string, 0, len(r.Properties))
+	for p := range r.Properties {
+		properties = append(properties, p)
+	}
+	sort.Strings(properties)
+	fmt.Printf("  received with\n")
+	for _, p := range properties {
+		fmt.Printf("    %s (%d)\n", p, r.Properties[p])
+	}
+	if r.Passed() {
+		fmt.Printf("  PASSED\n")
+	} else {
+		fmt.Printf("  FAILED\n")
+	}
+}
+
+// XcheckBroker is the MQTT host (or host:port) to connect to
+var XcheckBroker string
+
+// XcheckServer is the NATS host (or host:port) to connect to
+var XcheckServer string
+
+// XcheckClientName is the MQTT client ID and NATS connection name - a short UUID by default
+var XcheckClientName string
+
+// XcheckTopic is the MQTT topic to send messages to
+var XcheckTopic string
+
+// XcheckQoS is the QoS to publish and subscribe with over MQTT
+var XcheckQoS int
+
+// XcheckCount is the number of messages to send in each direction
+var XcheckCount int
+
+// XcheckInterval is the number of milliseconds between sending two messages
+var XcheckInterval int
+
+// XcheckWait is the number of seconds to wait for missing messages after the last message was sent
+var XcheckWait int
+
+// XcheckDirection is the direction(s) to check - mqtt-nats, nats-mqtt, or both
+var XcheckDirection string
+
+// XcheckLatencies indicates if the latency of each message should be listed
+var XcheckLatencies bool
+
+func init() {
+	RootCmd.AddCommand(xcheckCmd)
+	flags := xcheckCmd.PersistentFlags()
+
+	flags.StringVarP(&XcheckBroker,
+		"broker", "b", "localhost", "the MQTT Broker host (or host:port) to connect to (default 'localhost')")
+	flags.StringVarP(&XcheckServer,
+		"server", "s", "localhost", "the NATS server host (or host:port) to connect to (default 'localhost')")
+	flags.StringVarP(&XcheckClientName,
+		"client", "c", "", "the MQTT client name (and NATS connection name) to use - default is a short UUID")
+	flags.StringVarP(&XcheckTopic,
+		"topic", "t", "mezquit/xcheck", "the MQTT topic to send messages to")
+	flags.IntVarP(&XcheckQoS,
+		"qos", "q", 0, "Quality of service 0-2 over MQTT (default 0)")
+	flags.IntVarP(&XcheckCount,
+		"count", "n", 10, "the number of messages to send in each direction (default 10)")
+	flags.IntVarP(&XcheckInterval,
+		"interval", "", 10, "the number of milliseconds between sending two messages (default 10)")
+	flags.IntVarP(&XcheckWait,
+		"wait", "", 2, "the number of seconds to wait for missing messages (default 2)")
+	flags.StringVarP(&XcheckDirection,
+		"direction", "", "both", "the direction(s) to check - mqtt-nats, nats-mqtt, or both (default both)")
+	flags.BoolVarP(&XcheckLatencies,
+		"latencies", "", false, "list the latency of each message")
+}
@@ -12,9 +12,11 @@ require (
 	github.com/sirupsen/logrus v1.5.0
 	github.com/spf13/cobra v0.0.6
 	github.com/spf13/viper v1.6.2
+	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
 	golang.org/x/exp v0.0.0-20200331195152-e8c3332aa8e5 // indirect
 	golang.org/x/image v0.0.0-20200119044424-58c23975cae1 // indirect
 	golang.org/x/tools v0.0.0-20200331192549-ac2e956812a8 // indirect
 	gonum.org/v1/netlib v0.0.0-20200317120129-c5a04cffd98a // indirect
-	gonum.org/v1/plot v0.7.0 // indirect
+	gonum.org/v1/plot v0.7.0
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -0,0 +1,467 @@
+// Package bench measures the throughput and latency of a MQTT broker.
+//
+// A Bench runs a number of publisher and subscriber sessions at the same time. Each publisher publishes to its
+// own topic below a common topic, and each subscriber subscribes to all of them - so every subscriber receives
+// every message. The payload of a message starts with the time it was published, which gives the latency from
+// publish to receive. The latency from publish to acknowledgement (PUBACK for QoS 1, PUBCOMP for QoS 2) is
+// measured by the publisher, which does not wait for the acknowledgement of a message before publishing the next -
+// it keeps up to InFlight messages in flight.
+//
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// MinPayloadSize is the smallest payload size - the payload starts with a run ID and the time of publishing
+const MinPayloadSize = 16
+
+// Bench runs publishers and subscribers against a MQTT broker.
+//
+// Example:
+//     b := bench.NewBench(bench.Dialer(dial), bench.Publishers(4), bench.Subscribers(2), bench.QoS(1))
+//     result, err := b.Run(ctx)
+//
+type Bench struct {
+	options BenchOptions
+	runID   uint64
+
+	sent       int64
+	received   int64
+	errors     int64
+	lastArrive int64 // UnixNano of the last received message
+	ackLatency Histogram
+	rcvLatency Histogram
+	timeline   *timeline
+}
+
+// BenchOptions contains options for a Bench
+//
+type BenchOptions struct {
+	Dialer         func() (net.Conn, error) // gives a new connection to the broker for each session
+	ClientName     string                   // the client ID of a session is ClientName followed by "-pub-<n>" or "-sub-<n>"
+	Topic          string                   // publisher n publishes to Topic/n
+	Publishers     int
+	Subscribers    int
+	QoS            int
+	PayloadSize    int
+	Rate           int           // the number of messages per second of each publisher (0 is as fast as possible)
+	InFlight       int           // the maximum number of QoS 1 and 2 messages of each publisher in flight
+	Duration       time.Duration // the time to publish
+	Wait           time.Duration // the time to wait for messages after publishing has ended
+	ConnectOptions []mqtt.ConnectOption
+}
+
+// BenchOption is an Options-modifying-function
+type BenchOption func(*BenchOptions) error
+
+// DefaultBenchOptions returns the default options for a Bench (client name "mezquit-bench", topic
+// "mezquit/bench", 1 publisher, 1 subscriber, QoS 0, 64 byte payload, 100 messages per second, 100 messages in
+// flight, 10s duration, and 2s wait). A Dialer must be given.
+//
+func DefaultBenchOptions() BenchOptions {
+	return BenchOptions{
+		ClientName:  "mezquit-bench",
+		Topic:       "mezquit/bench",
+		Publishers:  1,
+		Subscribers: 1,
+		PayloadSize: 64,
+		Rate:        100,
+		InFlight:    100,
+		Duration:    10 * time.Second,
+		Wait:        2 * time.Second,
+	}
+}
+
+// Dialer returns a BenchOption for the function giving a new connection to the broker
+func Dialer(dial func() (net.Conn, error)) BenchOption {
+	return func(o *BenchOptions) error {
+		o.Dialer = dial
+		return nil
+	}
+}
+
+// ClientName returns a BenchOption for the name the client IDs of the sessions are based on
+func ClientName(name string) BenchOption {
+	if name == "" {
+		panic("ClientName of a bench cannot be empty")
+	}
+	return func(o *BenchOptions) error {
+		o.ClientName = name
+		return nil
+	}
+}
+
+// Topic returns a BenchOption for the topic the publishers publish below
+func Topic(topic string) BenchOption {
+	if err := mqtt.ValidateTopicName(topic); err != nil {
+		panic(err.Error())
+	}
+	return func(o *BenchOptions) error {
+		o.Topic = topic
+		return nil
+	}
+}
+
+// Publishers returns a BenchOption for the number of publishing sessions
+func Publishers(count int) BenchOption {
+	if count < 1 {
+		panic("There must be at least one publisher")
+	}
+	return func(o *BenchOptions) error {
+		o.Publishers = count
+		return nil
+	}
+}
+
+// Subscribers returns a BenchOption for the number of subscribing sessions (which may be 0)
+func Subscribers(count int) BenchOption {
+	if count < 0 {
+		panic("The number of subscribers cannot be negative")
+	}
+	return func(o *BenchOptions) error {
+		o.Subscribers = count
+		return nil
+	}
+}
+
+// QoS returns a BenchOption for the QoS to publish and subscribe with
+func QoS(qos int) BenchOption {
+	if qos < 0 || qos > 2 {
+		panic(fmt.Sprintf("QoS must be 0, 1, or 2, got %d", qos))
+	}
+	return func(o *BenchOptions) error {
+		o.QoS = qos
+		return nil
+	}
+}
+
+// PayloadSize returns a BenchOption for the number of bytes in each message (at least MinPayloadSize)
+func PayloadSize(size int) BenchOption {
+	if size < MinPayloadSize {
+		panic(fmt.Sprintf("PayloadSize must be at least %d", MinPayloadSize))
+	}
+	return func(o *BenchOptions) error {
+		o.PayloadSize = size
+		return nil
+	}
+}
+
+// Rate returns a BenchOption for the number of messages per second of each publisher (0 is as fast as possible)
+func Rate(rate int) BenchOption {
+	if rate < 0 {
+		panic("Rate cannot be negative")
+	}
+	return func(o *BenchOptions) error {
+		o.Rate = rate
+		return nil
+	}
+}
+
+// InFlight returns a BenchOption for the maximum number of QoS 1 and 2 messages of each publisher that are sent
+// but not yet acknowledged by the broker
+//
+func InFlight(count int) BenchOption {
+	if count < 1 || count > 0xFFFF {
+		panic(fmt.Sprintf("InFlight must be between 1 and %d", 0xFFFF))
+	}
+	return func(o *BenchOptions) error {
+		o.InFlight = count
+		return nil
+	}
+}
+
+// Duration returns a BenchOption for the time to publish
+func Duration(d time.Duration) BenchOption {
+	if d <= 0 {
+		panic("Duration must be positive")
+	}
+	return func(o *BenchOptions) error {
+		o.Duration = d
+		return nil
+	}
+}
+
+// Wait returns a BenchOption for the time to wait for messages to be received after publishing has ended
+func Wait(d time.Duration) BenchOption {
+	if d < 0 {
+		panic("Wait cannot be negative")
+	}
+	return func(o *BenchOptions) error {
+		o.Wait = d
+		return nil
+	}
+}
+
+// ConnectOptions returns a BenchOption adding options for connecting each session - for example UserName and
+// Password
+//
+func ConnectOptions(options ...mqtt.ConnectOption) BenchOption {
+	return func(o *BenchOptions) error {
+		o.ConnectOptions = append(o.ConnectOptions, options...)
+		return nil
+	}
+}
+
+// NewBench creates a Bench. Nothing is connected until Run() is called.
+//
+func NewBench(options ...BenchOption) *Bench {
+	opts := DefaultBenchOptions()
+	for _, fOpt := range options {
+		if err := fOpt(&opts); err != nil {
+			log.Fatalf("Bench option apply failure: %s", err)
+		}
+	}
+	return &Bench{options: opts, runID: uint64(time.Now().UnixNano()), timeline: newTimeline(timelineInterval(opts.Duration))}
+}
+
+// Result is the outcome of a Bench run. Throughputs are in messages per second. The timeline has what happened
+// in each interval of the run, including the time waiting for messages after publishing ended.
+//
+type Result struct {
+	Label             string        `json:"label,omitempty"` // names the run, for example by the broker address
+	Publishers        int           `json:"publishers"`
+	Subscribers       int           `json:"subscribers"`
+	QoS               int           `json:"qos"`
+	PayloadSize       int           `json:"payload_size"`
+	Rate              int           `json:"rate"`
+	Duration          time.Duration `json:"duration"` // the time publishing took, in nanoseconds
+	Sent              int64         `json:"sent"`
+	Expected          int64         `json:"expected"` // the number of messages sent times the number of subscribers
+	Received          int64         `json:"received"`
+	Lost              int64         `json:"lost"` // expected but not received (never negative)
+	Errors            int64         `json:"errors"`
+	PublishThroughput float64       `json:"publish_throughput"`
+	ReceiveThroughput float64       `json:"receive_throughput"`
+	AckLatency        LatencyStats  `json:"ack_latency"`
+	ReceiveLatency    LatencyStats  `json:"receive_latency"`
+	Interval          time.Duration `json:"interval"` // the length of each interval of the timeline, in nanoseconds
+	Timeline          []Interval    `json:"timeline,omitempty"`
+}
+
+// Run connects the sessions, publishes for the Duration, waits for the messages to be received, disconnects, and
+// returns the result. An error is returned if a session could not be connected or subscribe. A publisher stops
+// at its first failed publish - the failure is counted in the errors of the result. Run can only be called once.
+//
+func (b *Bench) Run(ctx context.Context) (*Result, error) {
+	if b.options.Dialer == nil {
+		panic("A Bench requires a Dialer")
+	}
+	var sessions []*mqtt.Session
+	defer func() {
+		for _, s := range sessions {
+			s.Disconnect(1)
+		}
+	}()
+
+	for i := 0; i < b.options.Subscribers; i++ {
+		s, err := b.connect("sub", i, mqtt.MessageHandler(b.receive))
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+		granted, err := s.SubscribeContext(ctx, mqtt.TopicFilter(b.options.Topic+"/#", b.options.QoS))
+		if err != nil {
+			return nil, err
+		}
+		if granted[0] == mqtt.SubAckFailure {
+			return nil, fmt.Errorf("The subscription to %s/# was refused", b.options.Topic)
+		}
+	}
+	publishers := []*mqtt.Session{}
+	windows := []*window{}
+	for i := 0; i < b.options.Publishers; i++ {
+		w := newWindow(b.options.InFlight, &b.ackLatency)
+		s, err := b.connect("pub", i, mqtt.Observe(w))
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+		publishers = append(publishers, s)
+		windows = append(windows, w)
+	}
+
+	start := time.Now()
+	b.timeline.begin(start)
+	var wg sync.WaitGroup
+	for i, s := range publishers {
+		wg.Add(1)
+		go func(s *mqtt.Session, w *window, topic string) {
+			defer wg.Done()
+			b.publish(ctx, s, w, topic, start)
+		}(s, windows[i], b.options.Topic+"/"+strconv.Itoa(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	expected := atomic.LoadInt64(&b.sent) * int64(b.options.Subscribers)
+	deadline := time.After(b.options.Wait)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+waiting:
+	for atomic.LoadInt64(&b.received) < expected {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			break waiting
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return b.result(start, elapsed, expected), nil
+}
+
+// connect connects a new session with the given role ("pub" or "sub") and number
+func (b *Bench) connect(role string, n int, options ...mqtt.SessionOption) (*mqtt.Session, error) {
+	conn, err := b.options.Dialer()
+	if err != nil {
+		return nil, err
+	}
+	clientID := fmt.Sprintf("%s-%s-%d", b.options.ClientName, role, n)
+	options = append(options, mqtt.ClientID(clientID), mqtt.Connection(conn))
+	s := mqtt.NewSession(options...)
+	if err := s.Connect(b.options.ConnectOptions...); err != nil {
+		return nil, fmt.Errorf("Cannot connect %s: %s", clientID, err)
+	}
+	return s, nil
+}
+
+// publish publishes to the given topic at the rate until the duration has passed, and then waits (at most Wait)
+// for the messages in flight to be acknowledged. A QoS 1 or 2 message is published as soon as the window has room
+// for it - its ack latency is recorded by the window. The schedule of the rate is fixed: the n:th message is
+// published at start + n * interval, and a time in the schedule that has passed while waiting for room in the window
+// is skipped rather than made up for.
+//
+func (b *Bench) publish(ctx context.Context, s *mqtt.Session, w *window, topic string, start time.Time) {
+	end := start.Add(b.options.Duration)
+	var interval time.Duration
+	if b.options.Rate > 0 {
+		interval = time.Second / time.Duration(b.options.Rate)
+	}
+	next := start
+	for {
+		if interval > 0 {
+			if wait := time.Until(next); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		if b.options.QoS > 0 && !w.acquire(ctx.Done()) {
+			break
+		}
+		now := time.Now()
+		if !now.Before(end) || ctx.Err() != nil {
+			if b.options.QoS > 0 {
+				w.release()
+			}
+			break
+		}
+		payload := make([]byte, b.options.PayloadSize)
+		binary.BigEndian.PutUint64(payload, b.runID)
+		binary.BigEndian.PutUint64(payload[8:], uint64(now.UnixNano()))
+		var err error
+		if b.options.QoS > 0 {
+			err = s.Publish(mqtt.Topic(topic), mqtt.Message(payload), mqtt.QoS(b.options.QoS))
+		} else {
+			err = s.PublishContext(ctx, mqtt.Topic(topic), mqtt.Message(payload))
+		}
+		if err != nil {
+			atomic.AddInt64(&b.errors, 1)
+			log.Errorf("Publish to %s failed: %s", topic, err)
+			return
+		}
+		if b.options.QoS == 0 {
+			// A QoS 0 message is regarded as acknowledged once it has been queued for sending
+			b.ackLatency.Record(time.Since(now))
+		}
+		b.timeline.sent(now)
+		atomic.AddInt64(&b.sent, 1)
+		if interval > 0 {
+			next = next.Add(interval)
+			if behind := now.Sub(next); behind >= 0 {
+				next = next.Add((behind/interval + 1) * interval)
+			}
+		}
+	}
+	if b.options.QoS > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, b.options.Wait)
+		defer cancel()
+		if !w.drain(waitCtx.Done()) {
+			log.Warnf("Not all messages published to %s were acknowledged", topic)
+		}
+	}
+}
+
+// receive records the latency of a received message
+func (b *Bench) receive(msg *mqtt.PublishRequest) {
+	now := time.Now()
+	payload := msg.Options().Message
+	if len(payload) < MinPayloadSize || binary.BigEndian.Uint64(payload) != b.runID {
+		return
+	}
+	sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(payload[8:])))
+	b.rcvLatency.Record(now.Sub(sentAt))
+	b.timeline.received(now, now.Sub(sentAt))
+	atomic.AddInt64(&b.received, 1)
+	atomic.StoreInt64(&b.lastArrive, now.UnixNano())
+}
+
+func (b *Bench) result(start time.Time, elapsed time.Duration, expected int64) *Result {
+	r := &Result{
+		Publishers:     b.options.Publishers,
+		Subscribers:    b.options.Subscribers,
+		QoS:            b.options.QoS,
+		PayloadSize:    b.options.PayloadSize,
+		Rate:           b.options.Rate,
+		Duration:       elapsed,
+		Sent:           atomic.LoadInt64(&b.sent),
+		Expected:       expected,
+		Received:       atomic.LoadInt64(&b.received),
+		Errors:         atomic.LoadInt64(&b.errors),
+		AckLatency:     b.ackLatency.Stats(),
+		ReceiveLatency: b.rcvLatency.Stats(),
+		Interval:       b.timeline.interval,
+		Timeline:       b.timeline.intervals(),
+	}
+	if r.Received < r.Expected {
+		r.Lost = r.Expected - r.Received
+	}
+	if elapsed > 0 {
+		r.PublishThroughput = float64(r.Sent) / elapsed.Seconds()
+	}
+	if last := atomic.LoadInt64(&b.lastArrive); last > 0 {
+		if receiving := time.Unix(0, last).Sub(start); receiving > 0 {
+			r.ReceiveThroughput = float64(r.Received) / receiving.Seconds()
+		}
+	}
+	return r
+}
+
+// ReadResult reads a result saved as JSON
+//
+func ReadResult(fileName string) (*Result, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	r := &Result{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	return r, nil
+}
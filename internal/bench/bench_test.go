@@ -0,0 +1,160 @@
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/broker"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func Test_Histogram_gives_nearest_rank_percentiles(t *testing.T) {
+	h := &Histogram{}
+	testutils.CheckEqual(LatencyStats{}, h.Stats(), t)
+	for i := 100; i >= 1; i-- {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	stats := h.Stats()
+	testutils.CheckEqual(int64(100), stats.Count, t)
+	testutils.CheckEqual(time.Microsecond, stats.Min, t)
+	testutils.CheckEqual(50*time.Microsecond, stats.P50, t)
+	testutils.CheckEqual(90*time.Microsecond, stats.P90, t)
+	testutils.CheckEqual(99*time.Microsecond, stats.P99, t)
+	testutils.CheckEqual(100*time.Microsecond, stats.Max, t)
+	testutils.CheckEqual(50500*time.Nanosecond, stats.Mean, t)
+
+	// 1, 2, 3-4, 5-8, 9-16, 17-32, 33-64, 65-128 microseconds
+	testutils.CheckEqual(8, len(stats.Buckets), t)
+	testutils.CheckEqual(Bucket{UpTo: time.Microsecond, Count: 1}, stats.Buckets[0], t)
+	testutils.CheckEqual(Bucket{UpTo: 4 * time.Microsecond, Count: 2}, stats.Buckets[2], t)
+	testutils.CheckEqual(Bucket{UpTo: 128 * time.Microsecond, Count: 36}, stats.Buckets[7], t)
+}
+
+func Test_Bench_measures_publishing_and_receiving(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	dial := func() (net.Conn, error) {
+		conn := mqtt.NewMockConnection()
+		go b.ServeConn(conn.RemoteConn())
+		return conn, nil
+	}
+
+	bench := NewBench(Dialer(dial), Publishers(2), Subscribers(3), QoS(1), PayloadSize(100),
+		Rate(200), Duration(200*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := bench.Run(ctx)
+	testutils.CheckNotError(err, t)
+
+	// The rate limits each publisher to 40 messages
+	testutils.CheckTrue(r.Sent > 0 && r.Sent <= 80, t)
+	testutils.CheckEqual(3*r.Sent, r.Expected, t)
+	testutils.CheckEqual(r.Expected, r.Received, t)
+	testutils.CheckEqual(int64(0), r.Lost, t)
+	testutils.CheckEqual(int64(0), r.Errors, t)
+	testutils.CheckEqual(r.Sent, r.AckLatency.Count, t)
+	testutils.CheckEqual(r.Received, r.ReceiveLatency.Count, t)
+	testutils.CheckTrue(r.ReceiveLatency.Min <= r.ReceiveLatency.P50, t)
+	testutils.CheckTrue(r.ReceiveLatency.P99 <= r.ReceiveLatency.Max, t)
+	testutils.CheckTrue(r.PublishThroughput > 0 && r.PublishThroughput < 420, t)
+	testutils.CheckTrue(r.ReceiveThroughput > 0, t)
+
+	testutils.CheckEqual(10*time.Millisecond, r.Interval, t)
+	testutils.CheckTrue(len(r.Timeline) >= 20, t)
+	var sent, received int64
+	for i, interval := range r.Timeline {
+		testutils.CheckEqual(time.Duration(i)*r.Interval, interval.Start, t)
+		testutils.CheckEqual(interval.Received, interval.ReceiveLatency.Count, t)
+		sent += interval.Sent
+		received += interval.Received
+	}
+	testutils.CheckEqual(r.Sent, sent, t)
+	testutils.CheckEqual(r.Received, received, t)
+}
+
+func Test_Bench_keeps_messages_in_flight_without_waiting_for_each_ack(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	dial := func() (net.Conn, error) {
+		conn := mqtt.NewMockConnection()
+		go b.ServeConn(conn.RemoteConn())
+		return conn, nil
+	}
+
+	bench := NewBench(Dialer(dial), Publishers(1), Subscribers(1), QoS(2), Rate(0), InFlight(8),
+		Duration(100*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := bench.Run(ctx)
+	testutils.CheckNotError(err, t)
+
+	testutils.CheckTrue(r.Sent > 0, t)
+	testutils.CheckEqual(int64(0), r.Errors, t)
+	testutils.CheckEqual(r.Sent, r.AckLatency.Count, t)
+	testutils.CheckEqual(r.Sent, r.Received, t)
+}
+
+func Test_window_waits_for_room_and_records_the_ack_latency(t *testing.T) {
+	latency := &Histogram{}
+	w := newWindow(1, latency)
+	done := make(chan struct{})
+	testutils.CheckTrue(w.acquire(done), t)
+
+	payload := make([]byte, MinPayloadSize)
+	binary.BigEndian.PutUint64(payload[8:], uint64(time.Now().Add(-time.Second).UnixNano()))
+	w.OnPacketSent(mqtt.NewPublishRequest(mqtt.Topic("a"), mqtt.Message(payload), mqtt.QoS(1), mqtt.PacketID(7)).MakeMessage())
+
+	acquired := make(chan bool)
+	go func() { acquired <- w.acquire(done) }()
+	select {
+	case <-acquired:
+		t.Fatalf("expected acquire to wait while the window is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	w.OnPublishAcknowledged(7)
+	testutils.CheckTrue(<-acquired, t)
+	testutils.CheckEqual(1, latency.Count(), t)
+	testutils.CheckTrue(latency.Stats().Min >= time.Second, t)
+
+	// An ack of a packet ID that is not in flight is ignored
+	w.OnPublishAcknowledged(8)
+	testutils.CheckEqual(1, latency.Count(), t)
+
+	w.OnConnectionLost(nil)
+	testutils.CheckTrue(!w.acquire(done), t)
+}
+
+func Test_ReadResult_reads_a_result_saved_as_JSON(t *testing.T) {
+	r := &Result{Label: "a", Sent: 2, Timeline: []Interval{{Sent: 2}}, ReceiveLatency: LatencyStats{P50: time.Millisecond}}
+	data, err := json.Marshal(r)
+	testutils.CheckNotError(err, t)
+	dir, err := ioutil.TempDir("", "bench")
+	testutils.CheckNotError(err, t)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "result.json")
+	testutils.CheckNotError(ioutil.WriteFile(fileName, data, 0644), t)
+
+	read, err := ReadResult(fileName)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(*r, *read, t)
+
+	testutils.CheckNotError(ioutil.WriteFile(fileName, []byte("{"), 0644), t)
+	_, err = ReadResult(fileName)
+	testutils.CheckError(err, t)
+}
+
+func Test_Bench_fails_when_a_session_cannot_connect(t *testing.T) {
+	dial := func() (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Err: context.DeadlineExceeded}
+	}
+	_, err := NewBench(Dialer(dial)).Run(context.Background())
+	testutils.CheckError(err, t)
+}
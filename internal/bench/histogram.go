@@ -0,0 +1,109 @@
+package bench
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Histogram collects latencies. It is safe to record from several goroutines.
+//
+type Histogram struct {
+	mutex   sync.Mutex
+	samples []time.Duration
+}
+
+// Bucket is the number of latencies in a range of a histogram - from the UpTo of the previous bucket (exclusive)
+// up to this UpTo (inclusive)
+//
+type Bucket struct {
+	UpTo  time.Duration `json:"up_to"`
+	Count int64         `json:"count"`
+}
+
+// LatencyStats summarizes a Histogram. The durations are in nanoseconds in JSON. The buckets have upper bounds
+// that are powers of two microseconds - from the bucket with the smallest to the one with the largest latency.
+//
+type LatencyStats struct {
+	Count   int64         `json:"count"`
+	Min     time.Duration `json:"min"`
+	Mean    time.Duration `json:"mean"`
+	P50     time.Duration `json:"p50"`
+	P90     time.Duration `json:"p90"`
+	P99     time.Duration `json:"p99"`
+	Max     time.Duration `json:"max"`
+	Buckets []Bucket      `json:"buckets,omitempty"`
+}
+
+// Record adds a latency to the histogram
+//
+func (h *Histogram) Record(latency time.Duration) {
+	h.mutex.Lock()
+	h.samples = append(h.samples, latency)
+	h.mutex.Unlock()
+}
+
+// Count returns the number of recorded latencies
+//
+func (h *Histogram) Count() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.samples)
+}
+
+// Stats returns the summary of the recorded latencies. The percentiles are of the nearest rank - the p50 is the
+// smallest latency that at least 50% of the latencies are less than or equal to. All values are zero if nothing
+// was recorded.
+//
+func (h *Histogram) Stats() LatencyStats {
+	h.mutex.Lock()
+	samples := make([]time.Duration, len(h.samples))
+	copy(samples, h.samples)
+	h.mutex.Unlock()
+
+	if len(samples) == 0 {
+		return LatencyStats{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var sum time.Duration
+	for _, s := range samples {
+		sum += s
+	}
+	return LatencyStats{
+		Count:   int64(len(samples)),
+		Min:     samples[0],
+		Mean:    sum / time.Duration(len(samples)),
+		P50:     percentile(samples, 50),
+		P90:     percentile(samples, 90),
+		P99:     percentile(samples, 99),
+		Max:     samples[len(samples)-1],
+		Buckets: buckets(samples),
+	}
+}
+
+// percentile returns the nearest rank percentile of the given sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// buckets returns the power of two microsecond buckets of the given sorted samples
+func buckets(sorted []time.Duration) []Bucket {
+	result := []Bucket{}
+	upTo := time.Microsecond
+	for upTo < sorted[0] {
+		upTo *= 2
+	}
+	current := Bucket{UpTo: upTo}
+	for _, s := range sorted {
+		for s > current.UpTo {
+			result = append(result, current)
+			current = Bucket{UpTo: current.UpTo * 2}
+		}
+		current.Count++
+	}
+	return append(result, current)
+}
@@ -0,0 +1,97 @@
+package bench
+
+import (
+	"sync"
+	"time"
+)
+
+// Interval is what happened during one interval of a run - the messages sent and received, and the latency of the
+// received messages (without buckets)
+//
+type Interval struct {
+	Start          time.Duration `json:"start"` // from the start of publishing, in nanoseconds
+	Sent           int64         `json:"sent"`
+	Received       int64         `json:"received"`
+	ReceiveLatency LatencyStats  `json:"receive_latency"`
+}
+
+// timeline collects what happens in each interval of a run. It is safe to use from several goroutines.
+//
+type timeline struct {
+	mutex    sync.Mutex
+	start    time.Time
+	interval time.Duration
+	slots    []*timelineSlot
+}
+
+type timelineSlot struct {
+	sent     int64
+	received int64
+	latency  Histogram
+}
+
+// timelineInterval returns the interval of the timeline of a run with the given duration - about 50 intervals,
+// but not shorter than 10ms
+//
+func timelineInterval(duration time.Duration) time.Duration {
+	interval := (duration / 50).Truncate(time.Millisecond)
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+func newTimeline(interval time.Duration) *timeline {
+	return &timeline{interval: interval}
+}
+
+// begin sets the start of the first interval
+func (t *timeline) begin(start time.Time) {
+	t.mutex.Lock()
+	t.start = start
+	t.mutex.Unlock()
+}
+
+// slot returns the slot of the interval of the given time
+func (t *timeline) slot(at time.Time) *timelineSlot {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	i := 0
+	if at.After(t.start) {
+		i = int(at.Sub(t.start) / t.interval)
+	}
+	for len(t.slots) <= i {
+		t.slots = append(t.slots, &timelineSlot{})
+	}
+	return t.slots[i]
+}
+
+// sent records a message sent at the given time
+func (t *timeline) sent(at time.Time) {
+	s := t.slot(at)
+	t.mutex.Lock()
+	s.sent++
+	t.mutex.Unlock()
+}
+
+// received records a message received at the given time with the given latency
+func (t *timeline) received(at time.Time, latency time.Duration) {
+	s := t.slot(at)
+	t.mutex.Lock()
+	s.received++
+	t.mutex.Unlock()
+	s.latency.Record(latency)
+}
+
+// intervals returns the recorded intervals
+func (t *timeline) intervals() []Interval {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	result := make([]Interval, len(t.slots))
+	for i, s := range t.slots {
+		stats := s.latency.Stats()
+		stats.Buckets = nil
+		result[i] = Interval{Start: time.Duration(i) * t.interval, Sent: s.sent, Received: s.received, ReceiveLatency: stats}
+	}
+	return result
+}
@@ -0,0 +1,100 @@
+package bench
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+)
+
+// window limits the number of QoS 1 and QoS 2 messages a publisher has in flight (sent but not yet acknowledged
+// by the broker), and records the ack latency. It is the Observer of the session of the publisher - the time a
+// message was published is taken from its payload when it is sent, and the latency is recorded when the broker
+// acknowledges the packet ID.
+//
+type window struct {
+	mqtt.NopObserver
+	latency *Histogram
+	slots   chan struct{} // holds a value for each message in flight
+
+	mutex  sync.Mutex
+	sentAt map[int]time.Time // publish time by packet ID of the messages in flight
+
+	lost     chan struct{} // closed when the connection is lost
+	lostOnce sync.Once
+}
+
+func newWindow(size int, latency *Histogram) *window {
+	return &window{
+		latency: latency,
+		slots:   make(chan struct{}, size),
+		sentAt:  make(map[int]time.Time),
+		lost:    make(chan struct{}),
+	}
+}
+
+// acquire waits for room for one more message in flight and returns false if the connection was lost or the
+// given channel was closed first
+//
+func (w *window) acquire(done <-chan struct{}) bool {
+	select {
+	case w.slots <- struct{}{}:
+		return true
+	case <-w.lost:
+	case <-done:
+	}
+	return false
+}
+
+// release makes room for one more message in flight
+func (w *window) release() {
+	<-w.slots
+}
+
+// drain waits until all messages in flight have been acknowledged and returns false if the connection was lost or
+// the given channel was closed first
+//
+func (w *window) drain(done <-chan struct{}) bool {
+	for i := 0; i < cap(w.slots); i++ {
+		if !w.acquire(done) {
+			return false
+		}
+	}
+	return true
+}
+
+// OnPacketSent registers the publish time of a QoS 1 or QoS 2 message
+func (w *window) OnPacketSent(packet *mqtt.GenericMessage) {
+	if packet.Type() != mqtt.PublishType || packet.Flags()&(mqtt.QoSOne|mqtt.QoSTwo) == 0 {
+		return
+	}
+	pr, err := mqtt.DecodePublish(packet)
+	if err != nil || len(pr.Options().Message) < MinPayloadSize {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, resent := w.sentAt[pr.Options().PacketID]; !resent {
+		w.sentAt[pr.Options().PacketID] = time.Unix(0, int64(binary.BigEndian.Uint64(pr.Options().Message[8:])))
+	}
+}
+
+// OnPublishAcknowledged records the ack latency of the message and makes room for another
+func (w *window) OnPublishAcknowledged(packetID int) {
+	now := time.Now()
+	w.mutex.Lock()
+	sentAt, ok := w.sentAt[packetID]
+	delete(w.sentAt, packetID)
+	w.mutex.Unlock()
+	if !ok {
+		return
+	}
+	w.latency.Record(now.Sub(sentAt))
+	w.release()
+}
+
+// OnConnectionLost stops waiting for room in the window
+func (w *window) OnConnectionLost(err error) {
+	w.lostOnce.Do(func() { close(w.lost) })
+}
@@ -0,0 +1,233 @@
+// Package benchplot renders charts of bench results with gonum/plot.
+//
+// An image has three charts, one above the other: the distribution of the latencies, the latency over time, and
+// the throughput over time. Each given result is drawn in its own color in every chart - this compares the runs
+// (for example against different brokers) side by side.
+//
+package benchplot
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hlindberg/mezquit/internal/bench"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+	"gonum.org/v1/plot/vg/vgimg"
+	"gonum.org/v1/plot/vg/vgsvg"
+)
+
+// Width and Height are the size of a rendered image
+const (
+	Width  = 20 * vg.Centimeter
+	Height = 30 * vg.Centimeter
+)
+
+// Charts returns the three charts of the given results: latency distribution, latency over time, and throughput
+// over time. A result is labeled with its Label, or "run <n>" if it has none.
+//
+func Charts(results []*bench.Result) ([]*plot.Plot, error) {
+	distribution, err := newPlot("Latency distribution", "latency (µs)", "% of messages")
+	if err != nil {
+		return nil, err
+	}
+	distribution.X.Scale = plot.LogScale{}
+	distribution.X.Tick.Marker = plot.LogTicks{}
+
+	latency, err := newPlot("Receive latency over time", "time (s)", "latency (ms)")
+	if err != nil {
+		return nil, err
+	}
+	throughput, err := newPlot("Throughput over time", "time (s)", "messages/s")
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range results {
+		label := r.Label
+		if label == "" {
+			label = fmt.Sprintf("run %d", i+1)
+		}
+		add := func(p *plot.Plot, name string, dashed bool, xys plotter.XYs) error {
+			if len(xys) == 0 {
+				return nil
+			}
+			line, err := plotter.NewLine(xys)
+			if err != nil {
+				return err
+			}
+			line.Color = plotutil.Color(i)
+			if dashed {
+				line.Dashes = plotutil.Dashes(1)
+			}
+			p.Add(line)
+			p.Legend.Add(label+" "+name, line)
+			return nil
+		}
+		if err := add(distribution, "receive", false, distributionXYs(r.ReceiveLatency)); err != nil {
+			return nil, err
+		}
+		if err := add(distribution, "ack", true, distributionXYs(r.AckLatency)); err != nil {
+			return nil, err
+		}
+		p50, p99 := latencyXYs(r)
+		if err := add(latency, "p50", false, p50); err != nil {
+			return nil, err
+		}
+		if err := add(latency, "p99", true, p99); err != nil {
+			return nil, err
+		}
+		received, sent := throughputXYs(r)
+		if err := add(throughput, "received", false, received); err != nil {
+			return nil, err
+		}
+		if err := add(throughput, "sent", true, sent); err != nil {
+			return nil, err
+		}
+	}
+	charts := []*plot.Plot{distribution, latency, throughput}
+	for _, p := range charts {
+		// An empty chart (no result has data for it) has no range - it must have one to be drawn
+		if p.X.Min > p.X.Max {
+			p.X.Min, p.X.Max = 1, 10
+			p.Y.Min, p.Y.Max = 0, 1
+		}
+	}
+	return charts, nil
+}
+
+func newPlot(title, x, y string) (*plot.Plot, error) {
+	p, err := plot.New()
+	if err != nil {
+		return nil, err
+	}
+	p.Title.Text = title
+	p.X.Label.Text = x
+	p.Y.Label.Text = y
+	p.Legend.Top = true
+	p.Add(plotter.NewGrid())
+	return p, nil
+}
+
+// distributionXYs returns the percentage of messages in each bucket of the given stats, at the upper bound of the
+// bucket in microseconds
+//
+func distributionXYs(stats bench.LatencyStats) plotter.XYs {
+	if stats.Count == 0 {
+		return nil
+	}
+	xys := make(plotter.XYs, len(stats.Buckets))
+	for i, b := range stats.Buckets {
+		xys[i].X = float64(b.UpTo.Microseconds())
+		xys[i].Y = 100 * float64(b.Count) / float64(stats.Count)
+	}
+	return xys
+}
+
+// latencyXYs returns the p50 and p99 receive latency in milliseconds of each interval with received messages
+func latencyXYs(r *bench.Result) (plotter.XYs, plotter.XYs) {
+	var p50, p99 plotter.XYs
+	for _, interval := range r.Timeline {
+		if interval.Received == 0 {
+			continue
+		}
+		x := interval.Start.Seconds()
+		p50 = append(p50, plotter.XY{X: x, Y: float64(interval.ReceiveLatency.P50.Microseconds()) / 1000})
+		p99 = append(p99, plotter.XY{X: x, Y: float64(interval.ReceiveLatency.P99.Microseconds()) / 1000})
+	}
+	return p50, p99
+}
+
+// throughputXYs returns the received and sent messages per second of each interval
+func throughputXYs(r *bench.Result) (plotter.XYs, plotter.XYs) {
+	if r.Interval <= 0 || len(r.Timeline) == 0 {
+		return nil, nil
+	}
+	seconds := r.Interval.Seconds()
+	received := make(plotter.XYs, len(r.Timeline))
+	sent := make(plotter.XYs, len(r.Timeline))
+	for i, interval := range r.Timeline {
+		x := interval.Start.Seconds()
+		received[i] = plotter.XY{X: x, Y: float64(interval.Received) / seconds}
+		sent[i] = plotter.XY{X: x, Y: float64(interval.Sent) / seconds}
+	}
+	return received, sent
+}
+
+// Render writes an image with the charts of the given results in the given format ("svg" or "png")
+//
+func Render(w io.Writer, format string, results ...*bench.Result) error {
+	var canvas interface {
+		vg.CanvasSizer
+		io.WriterTo
+	}
+	switch format {
+	case "svg":
+		canvas = vgsvg.New(Width, Height)
+	case "png":
+		canvas = vgimg.PngCanvas{Canvas: vgimg.New(Width, Height)}
+	default:
+		return fmt.Errorf("Cannot render format '%s' - only svg and png are supported", format)
+	}
+
+	charts, err := Charts(results)
+	if err != nil {
+		return err
+	}
+	tiles := draw.Tiles{
+		Rows:      len(charts),
+		Cols:      1,
+		PadX:      vg.Centimeter,
+		PadY:      vg.Centimeter,
+		PadTop:    vg.Centimeter / 2,
+		PadBottom: vg.Centimeter / 2,
+		PadLeft:   vg.Centimeter / 2,
+		PadRight:  vg.Centimeter / 2,
+	}
+	plots := make([][]*plot.Plot, len(charts))
+	for i, chart := range charts {
+		plots[i] = []*plot.Plot{chart}
+	}
+	canvases := plot.Align(plots, tiles, draw.New(canvas))
+	for i, chart := range charts {
+		chart.Draw(canvases[i][0])
+	}
+	_, err = canvas.WriteTo(w)
+	return err
+}
+
+// Format returns the format ("svg" or "png") given by the extension of the given file name, or an error if it has
+// another extension
+//
+func Format(fileName string) (string, error) {
+	format := strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+	if format != "svg" && format != "png" {
+		return "", fmt.Errorf("Cannot plot to '%s' - the file name must end with .svg or .png", fileName)
+	}
+	return format, nil
+}
+
+// Save writes an image with the charts of the given results to the given file - the format is given by the
+// extension of the file name (.svg or .png)
+//
+func Save(fileName string, results ...*bench.Result) error {
+	format, err := Format(fileName)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := Render(f, format, results...); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,77 @@
+package benchplot
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/bench"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func testhelperResult(label string, latency time.Duration) *bench.Result {
+	h := &bench.Histogram{}
+	for i := 1; i <= 100; i++ {
+		h.Record(latency * time.Duration(i) / 50)
+	}
+	r := &bench.Result{Label: label, Sent: 100, Received: 100, AckLatency: h.Stats(), ReceiveLatency: h.Stats()}
+	r.Interval = 100 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		r.Timeline = append(r.Timeline, bench.Interval{
+			Start:          time.Duration(i) * r.Interval,
+			Sent:           10,
+			Received:       10,
+			ReceiveLatency: bench.LatencyStats{Count: 10, P50: latency, P99: 2 * latency},
+		})
+	}
+	return r
+}
+
+func Test_Render_draws_the_charts_of_each_result_as_svg(t *testing.T) {
+	var buf bytes.Buffer
+	err := Render(&buf, "svg", testhelperResult("broker-a", time.Millisecond), testhelperResult("", 3*time.Millisecond))
+	testutils.CheckNotError(err, t)
+	svg := buf.String()
+	testutils.CheckTrue(strings.HasPrefix(svg, "<?xml"), t)
+	for _, text := range []string{
+		"Latency distribution", "Receive latency over time", "Throughput over time",
+		"broker-a receive", "broker-a p99", "broker-a sent", "run 2 ack", "run 2 received",
+	} {
+		if !strings.Contains(svg, text) {
+			t.Errorf("Expected the svg to contain '%s'", text)
+		}
+	}
+}
+
+func Test_Render_draws_results_without_data(t *testing.T) {
+	var buf bytes.Buffer
+	testutils.CheckNotError(Render(&buf, "svg", &bench.Result{}), t)
+	testutils.CheckTrue(strings.Contains(buf.String(), "Throughput over time"), t)
+}
+
+func Test_Render_rejects_an_unknown_format(t *testing.T) {
+	var buf bytes.Buffer
+	testutils.CheckError(Render(&buf, "gif", testhelperResult("a", time.Millisecond)), t)
+	testutils.CheckEqual(0, buf.Len(), t)
+}
+
+func Test_Save_writes_the_format_given_by_the_extension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "benchplot")
+	testutils.CheckNotError(err, t)
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "bench.PNG")
+	testutils.CheckNotError(Save(fileName, testhelperResult("a", time.Millisecond)), t)
+	data, err := ioutil.ReadFile(fileName)
+	testutils.CheckNotError(err, t)
+	testutils.CheckTrue(bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")), t)
+
+	fileName = filepath.Join(dir, "bench.jpeg")
+	testutils.CheckError(Save(fileName, testhelperResult("a", time.Millisecond)), t)
+	_, err = os.Stat(fileName)
+	testutils.CheckTrue(os.IsNotExist(err), t)
+}
@@ -0,0 +1,277 @@
+package bridge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Bridge forwards the messages published on one broker (from) to another broker (to). It subscribes to topic
+// filters with one Session, and republishes each received message with another Session.
+//
+// Forwarding is at least once: a message is acknowledged to the from broker only after it has been acknowledged
+// by the to broker. If a message cannot be forwarded the connection to the from broker is closed without
+// acknowledging the message - as the from session is not clean, the from broker sends the message again when the
+// bridge connects again.
+//
+// The topic of a forwarded message can be rewritten by removing one prefix and adding another. A message with a
+// topic that already starts with the added prefix has been forwarded by a bridge and is not forwarded again - this
+// prevents a message from looping when from and to are the same broker, or when there are bridges in both
+// directions.
+//
+// Example:
+//     b := bridge.NewBridge(fromConn, toConn, bridge.Topics("sensors/#"), bridge.Prefix("site1/"))
+//     err := b.Start()
+//     ...
+//     <-b.Done()
+//
+type Bridge struct {
+	options  BridgeOptions
+	fromConn net.Conn
+	from     *mqtt.Session
+	to       *mqtt.Session
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{} // closed when the bridge has stopped forwarding
+
+	mutex sync.Mutex
+	err   error // the error that ended the bridge
+}
+
+// BridgeOptions contains options for a Bridge
+//
+type BridgeOptions struct {
+	ClientName  string   // the client ID is ClientName followed by "-from" and "-to"
+	Topics      []string // the topic filters to forward messages for
+	QoS         int      // the maximum QoS of forwarded messages
+	StripPrefix string   // removed from the topic of a forwarded message (if the topic starts with it)
+	Prefix      string   // added to the topic of a forwarded message
+	KeepAlive   int      // the keep alive seconds of both connections - a broker that does not respond in time ends the bridge
+}
+
+// BridgeOption is an Options-modifying-function
+type BridgeOption func(*BridgeOptions) error
+
+// DefaultBridgeOptions returns the default options for a Bridge (client name "mezquit-bridge", QoS 1, no topic
+// rewriting, and a keep alive of 60 seconds). At least one topic filter must be given.
+//
+func DefaultBridgeOptions() BridgeOptions {
+	return BridgeOptions{ClientName: "mezquit-bridge", QoS: 1, KeepAlive: 60}
+}
+
+// ClientName returns a BridgeOption for the name the client IDs of the bridge are based on
+func ClientName(name string) BridgeOption {
+	if name == "" {
+		panic("ClientName of a bridge cannot be empty")
+	}
+	return func(o *BridgeOptions) error {
+		o.ClientName = name
+		return nil
+	}
+}
+
+// Topics returns a BridgeOption adding topic filters to forward messages for
+func Topics(filters ...string) BridgeOption {
+	for _, filter := range filters {
+		if err := mqtt.ValidateTopicFilter(filter); err != nil {
+			panic(err.Error())
+		}
+	}
+	return func(o *BridgeOptions) error {
+		o.Topics = append(o.Topics, filters...)
+		return nil
+	}
+}
+
+// QoS returns a BridgeOption for the maximum QoS of forwarded messages. A message is forwarded with the QoS it was
+// received with - which is at most the QoS of the subscriptions. Only QoS 1 and 2 are forwarded at least once.
+//
+func QoS(qos int) BridgeOption {
+	if qos < 0 || qos > 2 {
+		panic(fmt.Sprintf("QoS must be 0, 1, or 2, got %d", qos))
+	}
+	return func(o *BridgeOptions) error {
+		o.QoS = qos
+		return nil
+	}
+}
+
+// StripPrefix returns a BridgeOption for a prefix that is removed from the topic of forwarded messages
+func StripPrefix(prefix string) BridgeOption {
+	return func(o *BridgeOptions) error {
+		o.StripPrefix = prefix
+		return nil
+	}
+}
+
+// Prefix returns a BridgeOption for a prefix that is added to the topic of forwarded messages
+func Prefix(prefix string) BridgeOption {
+	return func(o *BridgeOptions) error {
+		o.Prefix = prefix
+		return nil
+	}
+}
+
+// KeepAlive returns a BridgeOption for the keep alive seconds of the connections to both brokers (0 turns keep
+// alive off). A connection to a broker that does not respond to PINGREQ within the keep alive is regarded as lost,
+// which stops the bridge.
+//
+func KeepAlive(seconds int) BridgeOption {
+	if seconds < 0 || seconds > 0xff {
+		panic(fmt.Sprintf("KeepAlive must be between 0 and 255, got %d", seconds))
+	}
+	return func(o *BridgeOptions) error {
+		o.KeepAlive = seconds
+		return nil
+	}
+}
+
+// NewBridge creates a Bridge forwarding from the broker connected by fromConn to the broker connected by toConn.
+// The bridge does not connect to the brokers until Start() is called.
+//
+func NewBridge(fromConn, toConn net.Conn, options ...BridgeOption) *Bridge {
+	opts := DefaultBridgeOptions()
+	for _, fOpt := range options {
+		if err := fOpt(&opts); err != nil {
+			log.Fatalf("Bridge option apply failure: %s", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Bridge{options: opts, fromConn: fromConn, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	b.from = mqtt.NewSession(mqtt.ClientID(opts.ClientName+"-from"), mqtt.Connection(fromConn), mqtt.MessageHandler(b.forward))
+	b.to = mqtt.NewSession(mqtt.ClientID(opts.ClientName+"-to"), mqtt.Connection(toConn))
+	return b
+}
+
+// Start connects to both brokers and subscribes to the topic filters. Messages are forwarded until Close() is
+// called, or a connection ends. An error is returned if the bridge could not be started - the connections are
+// then closed.
+//
+func (b *Bridge) Start() error {
+	started := false
+	defer func() {
+		if !started {
+			close(b.done)
+		}
+	}()
+	if len(b.options.Topics) == 0 {
+		return fmt.Errorf("A bridge requires at least one topic filter")
+	}
+	if err := b.to.Connect(mqtt.KeepAliveSeconds(b.options.KeepAlive)); err != nil {
+		b.fromConn.Close()
+		return fmt.Errorf("Cannot connect to the broker to forward to: %s", err)
+	}
+	if err := b.from.Connect(mqtt.CleanSession(false), mqtt.KeepAliveSeconds(b.options.KeepAlive)); err != nil {
+		b.to.Disconnect(1)
+		return fmt.Errorf("Cannot connect to the broker to forward from: %s", err)
+	}
+
+	filters := []mqtt.SubscribeOption{}
+	for _, filter := range b.options.Topics {
+		filters = append(filters, mqtt.TopicFilter(filter, b.options.QoS))
+	}
+	granted, err := b.from.Subscribe(filters...)
+	if err == nil {
+		for i, rc := range granted {
+			if rc == mqtt.SubAckFailure {
+				err = fmt.Errorf("The subscription to %s was refused", b.options.Topics[i])
+				break
+			}
+		}
+	}
+	if err != nil {
+		b.Close()
+		return err
+	}
+
+	started = true
+	fromDone, toDone := b.from.Done(), b.to.Done()
+	go func() {
+		select {
+		case <-fromDone:
+		case <-toDone:
+		}
+		close(b.done)
+	}()
+	return nil
+}
+
+// Done returns a channel that is closed when the bridge has stopped forwarding - because a connection ended, or
+// Close() was called. The channel is closed at once if the bridge could not be started.
+//
+func (b *Bridge) Done() <-chan struct{} {
+	return b.done
+}
+
+// Err returns the error that made the bridge stop forwarding, or nil if the bridge is forwarding or was closed
+//
+func (b *Bridge) Err() error {
+	b.mutex.Lock()
+	err := b.err
+	b.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = b.from.Err(); err != nil {
+		return err
+	}
+	return b.to.Err()
+}
+
+// Close disconnects from both brokers. A message that is being forwarded is given a second to be acknowledged by
+// the to broker - it is otherwise not acknowledged to the from broker.
+//
+func (b *Bridge) Close() error {
+	giveUp := time.AfterFunc(time.Second, b.cancel)
+	defer giveUp.Stop()
+	defer b.cancel()
+	err := b.from.Disconnect(1)
+	if toErr := b.to.Disconnect(1); err == nil {
+		err = toErr
+	}
+	return err
+}
+
+// forward is the MessageHandler of the from session - it returns when the message has been acknowledged by the
+// to broker, which makes the from session acknowledge it to the from broker
+//
+func (b *Bridge) forward(msg *mqtt.PublishRequest) {
+	opts := msg.Options()
+	topic, ok := b.rewrite(opts.Topic)
+	if !ok {
+		log.Debugf("Bridge: not forwarding %s - it has already been forwarded", opts.Topic)
+		return
+	}
+	if topic == "" {
+		log.Warnf("Bridge: not forwarding %s - the topic is empty without the prefix", opts.Topic)
+		return
+	}
+	log.Debugf("Bridge: forwarding %s as %s with QoS %d", opts.Topic, topic, opts.QoS)
+	err := b.to.PublishContext(b.ctx, mqtt.Topic(topic), mqtt.Message(opts.Message), mqtt.QoS(opts.QoS), mqtt.Retain(opts.Retain))
+	if err != nil {
+		// Closing the connection makes the acknowledgement of the message fail
+		log.Errorf("Bridge: cannot forward %s - closing the connection it was received on: %s", opts.Topic, err)
+		b.mutex.Lock()
+		if b.err == nil && b.ctx.Err() == nil {
+			b.err = fmt.Errorf("Cannot forward %s: %s", opts.Topic, err)
+		}
+		b.mutex.Unlock()
+		b.fromConn.Close()
+	}
+}
+
+// rewrite returns the topic a message received for the given topic is forwarded to, or false if the message
+// should not be forwarded since its topic has the prefix added by the bridge
+//
+func (b *Bridge) rewrite(topic string) (string, bool) {
+	if b.options.Prefix != "" && strings.HasPrefix(topic, b.options.Prefix) {
+		return "", false
+	}
+	return b.options.Prefix + strings.TrimPrefix(topic, b.options.StripPrefix), true
+}
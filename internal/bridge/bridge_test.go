@@ -0,0 +1,133 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/broker"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+// testhelperConn returns a MockConnection served by the given broker
+func testhelperConn(b *broker.Broker) *mqtt.MockConnection {
+	conn := mqtt.NewMockConnection()
+	go b.ServeConn(conn.RemoteConn())
+	return conn
+}
+
+// testhelperSubscribe connects a session to the given broker and returns a channel with the messages received for
+// the given topic filter
+func testhelperSubscribe(b *broker.Broker, filter string, t *testing.T) (*mqtt.Session, <-chan mqtt.PublishOptions) {
+	t.Helper()
+	messages := make(chan mqtt.PublishOptions, 10)
+	session := mqtt.NewSession(mqtt.ClientID("subscriber"), mqtt.Connection(testhelperConn(b)),
+		mqtt.MessageHandler(func(msg *mqtt.PublishRequest) { messages <- msg.Options() }))
+	testutils.CheckNotError(session.Connect(), t)
+	_, err := session.Subscribe(mqtt.TopicFilter(filter, 2))
+	testutils.CheckNotError(err, t)
+	return session, messages
+}
+
+func testhelperPublish(b *broker.Broker, topic, message string, qos int, t *testing.T) {
+	t.Helper()
+	session := mqtt.NewSession(mqtt.ClientID("publisher"), mqtt.Connection(testhelperConn(b)))
+	testutils.CheckNotError(session.Connect(), t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	testutils.CheckNotError(session.PublishContext(ctx, mqtt.Topic(topic), mqtt.Message([]byte(message)), mqtt.QoS(qos)), t)
+	testutils.CheckNotError(session.Disconnect(1), t)
+}
+
+func testhelperReceive(messages <-chan mqtt.PublishOptions, t *testing.T) mqtt.PublishOptions {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a message to be received")
+	}
+	return mqtt.PublishOptions{}
+}
+
+func Test_Bridge_forwards_messages_with_rewritten_topics(t *testing.T) {
+	from := broker.NewBroker()
+	defer from.Close()
+	to := broker.NewBroker()
+	defer to.Close()
+	_, messages := testhelperSubscribe(to, "#", t)
+
+	b := NewBridge(testhelperConn(from), testhelperConn(to),
+		Topics("old/sensors/#"), QoS(1), StripPrefix("old/"), Prefix("new/"))
+	testutils.CheckNotError(b.Start(), t)
+
+	testhelperPublish(from, "old/sensors/1", "21", 2, t)
+	msg := testhelperReceive(messages, t)
+	testutils.CheckEqual("new/sensors/1", msg.Topic, t)
+	testutils.CheckEqual("21", string(msg.Message), t)
+	testutils.CheckEqual(1, msg.QoS, t)
+
+	testutils.CheckNotError(b.Close(), t)
+	<-b.Done()
+	testutils.CheckNotError(b.Err(), t)
+}
+
+func Test_Bridge_does_not_forward_messages_it_has_forwarded(t *testing.T) {
+	single := broker.NewBroker()
+	defer single.Close()
+	_, messages := testhelperSubscribe(single, "#", t)
+
+	b := NewBridge(testhelperConn(single), testhelperConn(single), Topics("#"), Prefix("bridged/"))
+	testutils.CheckNotError(b.Start(), t)
+	defer b.Close()
+
+	testhelperPublish(single, "a", "1", 1, t)
+	testutils.CheckEqual("a", testhelperReceive(messages, t).Topic, t)
+	testutils.CheckEqual("bridged/a", testhelperReceive(messages, t).Topic, t)
+	time.Sleep(100 * time.Millisecond)
+	testutils.CheckEqual(0, len(messages), t)
+}
+
+func Test_Bridge_acknowledges_a_message_only_when_it_has_been_forwarded(t *testing.T) {
+	from := broker.NewBroker()
+	defer from.Close()
+	unavailable := broker.NewBroker()
+
+	b := NewBridge(testhelperConn(from), testhelperConn(unavailable), Topics("a"))
+	testutils.CheckNotError(b.Start(), t)
+	unavailable.Close()
+	testhelperPublish(from, "a", "1", 1, t)
+	<-b.Done()
+	testutils.CheckError(b.Err(), t)
+
+	// The message was not acknowledged - the from broker sends it again to the restarted bridge
+	to := broker.NewBroker()
+	defer to.Close()
+	_, messages := testhelperSubscribe(to, "a", t)
+	b = NewBridge(testhelperConn(from), testhelperConn(to), Topics("a"))
+	testutils.CheckNotError(b.Start(), t)
+	defer b.Close()
+	msg := testhelperReceive(messages, t)
+	testutils.CheckEqual("1", string(msg.Message), t)
+}
+
+func Test_Bridge_stops_when_the_from_broker_does_not_respond_within_the_keep_alive(t *testing.T) {
+	from := broker.NewBroker()
+	defer from.Close()
+	to := broker.NewBroker()
+	defer to.Close()
+
+	// Nothing more is read from the from broker after CONNACK (4 bytes) and SUBACK (5 bytes) - as for a connection
+	// that has become half open
+	fromConn := mqtt.NewFaultyConnection(testhelperConn(from), mqtt.StallReads(9, 0))
+	b := NewBridge(fromConn, testhelperConn(to), Topics("a"), KeepAlive(1))
+	testutils.CheckNotError(b.Start(), t)
+	defer b.Close()
+	select {
+	case <-b.Done():
+	case <-time.After(4 * time.Second):
+		t.Fatalf("Expected the bridge to stop when the from broker does not respond")
+	}
+	testutils.CheckError(b.Err(), t)
+}
@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"strings"
+)
+
+// Authenticator decides if a client may connect to the broker
+//
+type Authenticator interface {
+	// Authenticate returns mqtt.ConnectionAccepted if the client with the given ID, user name, and password (nil if
+	// none was given) may connect, or the CONNACK return code refusing the connection (for example
+	// mqtt.ConnectionRefusedBadUserPassword or mqtt.ConnectionRefusedNotAuthorized).
+	Authenticate(clientID, userName string, password *[]byte) int
+}
+
+// Authorizer decides what a connected client may publish and subscribe to
+//
+type Authorizer interface {
+	// CanPublish returns true if the client with the given ID and user name may publish to the given topic
+	CanPublish(clientID, userName, topic string) bool
+
+	// CanSubscribe returns true if the client with the given ID and user name may subscribe to the given topic filter
+	CanSubscribe(clientID, userName, filter string) bool
+}
+
+// filterCovers returns true if every topic matched by the given topic filter is also matched by the given rule
+// (a topic filter). A rule "a/#" covers "a/b/+", but a rule "a/+" does not cover "a/#".
+//
+func filterCovers(rule, filter string) bool {
+	ruleLevels := strings.Split(rule, "/")
+	filterLevels := strings.Split(filter, "/")
+	for i, r := range ruleLevels {
+		if r == "#" {
+			// SPEC: "#" also matches the parent level - "a/#" matches "a"
+			return i > 0 || !strings.HasPrefix(filter, "$")
+		}
+		if i >= len(filterLevels) {
+			return false
+		}
+		f := filterLevels[i]
+		switch {
+		case r == "+":
+			if f == "#" || (i == 0 && strings.HasPrefix(f, "$")) {
+				return false
+			}
+		case r != f:
+			return false
+		}
+	}
+	return len(ruleLevels) == len(filterLevels)
+}
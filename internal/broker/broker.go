@@ -0,0 +1,388 @@
+package broker
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Broker is a MQTT 3.1.1 broker that serves clients on given net.Conn connections, or on connections accepted
+// from a net.Listener. It routes published messages to the subscribing clients at QoS 0, 1, and 2, and keeps the
+// state of sessions that are not clean between connections. Retained messages are delivered to new subscriptions,
+// and the will message of a client is published when its connection ends without a DISCONNECT, or when the client
+// misses its keep alive.
+//
+// MQTT 5 clients are served as MQTT 3.1.1 clients that honor the Session Expiry Interval and the Will Delay
+// Interval - other properties are ignored, and the broker sends no properties.
+//
+// A Broker can be embedded in tests - a MockConnection can be served by giving its RemoteConn() to ServeConn(),
+// and the hooks given as BrokerOptions make it possible to inspect the packets received from, and sent to, clients.
+//
+// Example:
+//     b := broker.NewBroker(broker.OnReceived(func(clientID string, packet *mqtt.GenericMessage) { ... }))
+//     conn := mqtt.NewMockConnection()
+//     go b.ServeConn(conn.RemoteConn())
+//     session := mqtt.NewSession(mqtt.ClientID("test"), mqtt.Connection(conn))
+//
+type Broker struct {
+	options   BrokerOptions
+	mutex     sync.Mutex
+	sessions  map[string]*session    // sessions by client ID
+	clients   map[*client]bool       // connected clients
+	wills     map[string]*time.Timer // delayed will publications by client ID
+	listeners map[net.Listener]bool
+	closed    bool
+	serving   sync.WaitGroup // connections being served
+}
+
+// PacketHandlerFunc is a function that is given a packet received from, or sent to, the client with the given ID.
+// The client ID is empty for a packet received before the CONNECT has been processed.
+// The function is called from the goroutine reading from, or writing to, the client - it should not block, and must
+// not modify the packet.
+//
+type PacketHandlerFunc func(clientID string, packet *mqtt.GenericMessage)
+
+// BrokerOptions contains options for a Broker
+//
+type BrokerOptions struct {
+	OnReceived PacketHandlerFunc // called for each packet received from a client
+	OnSent     PacketHandlerFunc // called for each packet sent to a client
+	Retained   *RetainedStore    // where retained messages are kept
+	// the longest Will Delay Interval honored - a longer delay requested by a client is shortened (0 is no limit)
+	MaxWillDelay time.Duration
+
+	Authenticator Authenticator // decides if a client may connect (nil accepts all clients)
+	Authorizer    Authorizer    // decides what a client may publish and subscribe to (nil allows everything)
+}
+
+// BrokerOption is an Options-modifying-function
+type BrokerOption func(*BrokerOptions) error
+
+// DefaultBrokerOptions returns the default options for a Broker (no hooks, and retained messages kept in memory)
+func DefaultBrokerOptions() BrokerOptions {
+	retained, _ := NewRetainedStore("") // cannot fail without a file
+	return BrokerOptions{Retained: retained}
+}
+
+// OnReceived returns a BrokerOption for a function that is given each packet received from a client
+func OnReceived(handler PacketHandlerFunc) BrokerOption {
+	return func(o *BrokerOptions) error {
+		o.OnReceived = handler
+		return nil
+	}
+}
+
+// OnSent returns a BrokerOption for a function that is given each packet sent to a client
+func OnSent(handler PacketHandlerFunc) BrokerOption {
+	return func(o *BrokerOptions) error {
+		o.OnSent = handler
+		return nil
+	}
+}
+
+// Retained returns a BrokerOption for the store where the broker keeps retained messages
+func Retained(store *RetainedStore) BrokerOption {
+	if store == nil {
+		panic("A RetainedStore is required")
+	}
+	return func(o *BrokerOptions) error {
+		o.Retained = store
+		return nil
+	}
+}
+
+// MaxWillDelay returns a BrokerOption for the longest Will Delay Interval the broker honors. An MQTT 5 client gives
+// the Will Delay Interval in its CONNECT - a longer delay is shortened to the given maximum (0 is no limit).
+//
+func MaxWillDelay(delay time.Duration) BrokerOption {
+	if delay < 0 {
+		panic("MaxWillDelay cannot be negative")
+	}
+	return func(o *BrokerOptions) error {
+		o.MaxWillDelay = delay
+		return nil
+	}
+}
+
+// Authentication returns a BrokerOption for the Authenticator deciding if a client may connect
+func Authentication(authenticator Authenticator) BrokerOption {
+	return func(o *BrokerOptions) error {
+		o.Authenticator = authenticator
+		return nil
+	}
+}
+
+// Authorization returns a BrokerOption for the Authorizer deciding what a client may publish and subscribe to
+func Authorization(authorizer Authorizer) BrokerOption {
+	return func(o *BrokerOptions) error {
+		o.Authorizer = authorizer
+		return nil
+	}
+}
+
+// NewBroker creates a Broker from default options plus given options. The broker does not serve any clients until
+// ServeConn() or Serve() is called.
+//
+func NewBroker(options ...BrokerOption) *Broker {
+	opts := DefaultBrokerOptions()
+	for _, fOpt := range options {
+		if err := fOpt(&opts); err != nil {
+			log.Fatalf("Broker option apply failure: %s", err)
+		}
+	}
+	return &Broker{
+		options:   opts,
+		sessions:  make(map[string]*session),
+		clients:   make(map[*client]bool),
+		wills:     make(map[string]*time.Timer),
+		listeners: make(map[net.Listener]bool),
+	}
+}
+
+// Serve accepts connections from the given listener and serves each in a goroutine until the listener is closed,
+// or the broker is closed. The error from the listener is returned, or nil if the broker was closed.
+//
+func (b *Broker) Serve(listener net.Listener) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		listener.Close()
+		return nil
+	}
+	b.listeners[listener] = true
+	b.mutex.Unlock()
+
+	defer func() {
+		b.mutex.Lock()
+		delete(b.listeners, listener)
+		b.mutex.Unlock()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			b.mutex.Lock()
+			closed := b.closed
+			b.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go b.ServeConn(conn)
+	}
+}
+
+// ServeConn serves one client on the given connection and returns when the connection has ended.
+// The connection is closed when it ends.
+//
+func (b *Broker) ServeConn(conn net.Conn) {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	c := newClient(b, conn)
+	b.clients[c] = true
+	b.serving.Add(1)
+	b.mutex.Unlock()
+
+	defer func() {
+		b.mutex.Lock()
+		delete(b.clients, c)
+		b.mutex.Unlock()
+		b.serving.Done()
+	}()
+	c.serve()
+}
+
+// Close closes all listeners and client connections, and waits until all connections have ended.
+// Session state and delayed wills are dropped, and the broker cannot be used after it has been closed.
+//
+func (b *Broker) Close() error {
+	b.mutex.Lock()
+	b.closed = true
+	for clientID, timer := range b.wills {
+		timer.Stop()
+		delete(b.wills, clientID)
+	}
+	for _, s := range b.sessions {
+		if s.expiryTimer != nil {
+			s.expiryTimer.Stop()
+		}
+	}
+	for listener := range b.listeners {
+		listener.Close()
+	}
+	for c := range b.clients {
+		c.conn.Close()
+	}
+	b.mutex.Unlock()
+
+	b.serving.Wait()
+	return nil
+}
+
+// attach makes the given connected client the client of the session for its client ID and queues the CONNACK
+// accepting the connection. A client already connected with the same ID is disconnected. For a clean session (a
+// clean start in MQTT 5) any existing session state is discarded, otherwise messages in flight are resent after the
+// CONNACK. A delayed will of an earlier connection with the same client ID is not published.
+//
+func (b *Broker) attach(c *client, cleanSession bool) *session {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if timer := b.wills[c.id]; timer != nil {
+		log.Debugf("Broker: client %s connected again - dropping its delayed will", c.id)
+		timer.Stop()
+		delete(b.wills, c.id)
+	}
+
+	s := b.sessions[c.id]
+	if s != nil {
+		if s.expiryTimer != nil {
+			s.expiryTimer.Stop()
+			s.expiryTimer = nil
+		}
+		if previous := s.setClient(nil); previous != nil {
+			log.Infof("Broker: client %s connected again - closing the earlier connection", c.id)
+			previous.conn.Close()
+		}
+	}
+	present := s != nil && !cleanSession
+	if !present {
+		s = newSession(c.id)
+		b.sessions[c.id] = s
+	}
+	s.expiry = c.sessionExpiry
+
+	c.send(mqtt.NewConnAckMessage(present, mqtt.ConnectionAccepted))
+	s.setClient(c)
+	return s
+}
+
+// detach removes the given client from its session when the connection of the client has ended.
+// The state of a session that expires with its connection is discarded, and the state of a session with a Session
+// Expiry Interval is discarded when the interval has passed - unless a client connects to the session before that.
+//
+func (b *Broker) detach(c *client, s *session) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !s.release(c) || b.sessions[c.id] != s {
+		return // another connection has taken over the session
+	}
+	switch {
+	case s.expiry == 0:
+		delete(b.sessions, c.id)
+	case s.expiry > 0 && !b.closed:
+		log.Debugf("Broker: session of client %s expires in %s unless it connects again", c.id, s.expiry)
+		var timer *time.Timer
+		timer = time.AfterFunc(s.expiry, func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			if s.expiryTimer == timer && b.sessions[s.clientID] == s {
+				log.Debugf("Broker: session of client %s expired", s.clientID)
+				delete(b.sessions, s.clientID)
+			}
+		})
+		s.expiryTimer = timer
+	}
+}
+
+// publishWill publishes the will message (if any) of the given client when its connection has ended without a
+// DISCONNECT. Wills are not published when the broker is closing.
+//
+// SPEC: (MQTT 5) The will is published when the Will Delay Interval has passed, or when the session ends, whichever
+// happens first - a clean session ends with its connection. The will is not published if a new connection is made
+// to the session before the delay has passed. An MQTT 3.1.1 client has no Will Delay Interval.
+//
+func (b *Broker) publishWill(c *client, s *session) {
+	if c.will == nil {
+		return
+	}
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return
+	}
+	delay := c.willDelay
+	if max := b.options.MaxWillDelay; max > 0 && delay > max {
+		delay = max
+	}
+	if s.expiry >= 0 && s.expiry < delay {
+		delay = s.expiry
+	}
+	if delay == 0 {
+		b.mutex.Unlock()
+		log.Debugf("Broker: publishing will of client %s to %s", c.id, c.will.Options().Topic)
+		b.route(c.will)
+		return
+	}
+	defer b.mutex.Unlock()
+	if connected := s.connected(); connected != nil && connected != c {
+		log.Debugf("Broker: client %s connected again - dropping its will", c.id)
+		return
+	}
+
+	log.Debugf("Broker: publishing will of client %s in %s unless it connects again", c.id, delay)
+	if previous := b.wills[c.id]; previous != nil {
+		previous.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		b.mutex.Lock()
+		pending := b.wills[c.id] == timer
+		if pending {
+			delete(b.wills, c.id)
+		}
+		b.mutex.Unlock()
+		if pending {
+			log.Debugf("Broker: publishing delayed will of client %s to %s", c.id, c.will.Options().Topic)
+			b.route(c.will)
+		}
+	})
+	b.wills[c.id] = timer
+}
+
+// route delivers the given published message to all sessions with a matching subscription.
+// A session with several matching subscriptions gets the message once, at the highest QoS granted.
+//
+// A message with the retain flag set replaces the retained message for its topic (an empty message removes it).
+// SPEC: The retain flag is not set when the message is delivered to already established subscriptions.
+//
+func (b *Broker) route(msg *mqtt.PublishRequest) {
+	opts := msg.Options()
+	type delivery struct {
+		session *session
+		qos     int
+	}
+	var deliveries []delivery
+
+	if opts.Retain {
+		if err := b.options.Retained.Retain(msg); err != nil {
+			log.Errorf("Broker: cannot store retained message for %s: %s", opts.Topic, err)
+		}
+	}
+
+	b.mutex.Lock()
+	for _, s := range b.sessions {
+		if qos, ok := s.matches(opts.Topic); ok {
+			deliveries = append(deliveries, delivery{session: s, qos: qos})
+		}
+	}
+	b.mutex.Unlock()
+
+	log.Debugf("Broker: PUBLISH to %s matches %d session(s)", opts.Topic, len(deliveries))
+	for _, d := range deliveries {
+		qos := opts.QoS
+		if d.qos < qos {
+			qos = d.qos
+		}
+		d.session.publish(opts.Topic, opts.Message, qos, false)
+	}
+}
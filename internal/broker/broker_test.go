@@ -0,0 +1,529 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+// testhelperConnect connects a new session with the given client ID to the broker using a MockConnection
+func testhelperConnect(b *Broker, clientID string, t *testing.T, options ...mqtt.SessionOption) *mqtt.Session {
+	t.Helper()
+	conn := mqtt.NewMockConnection()
+	go b.ServeConn(conn.RemoteConn())
+	options = append(options, mqtt.ClientID(clientID), mqtt.Connection(conn))
+	session := mqtt.NewSession(options...)
+	testutils.CheckNotError(session.Connect(), t)
+	return session
+}
+
+// testhelperReceiver returns a SessionOption for a MessageHandler sending the received messages on the returned channel
+func testhelperReceiver() (mqtt.SessionOption, <-chan mqtt.PublishOptions) {
+	messages := make(chan mqtt.PublishOptions, 10)
+	return mqtt.MessageHandler(func(msg *mqtt.PublishRequest) { messages <- msg.Options() }), messages
+}
+
+func testhelperReceive(messages <-chan mqtt.PublishOptions, t *testing.T) mqtt.PublishOptions {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a message to be received")
+	}
+	return mqtt.PublishOptions{}
+}
+
+func Test_Broker_routes_messages_between_sessions_at_all_QoS_levels(t *testing.T) {
+	before := runtime.NumGoroutine()
+	b := NewBroker()
+	handler, messages := testhelperReceiver()
+	subscriber := testhelperConnect(b, "subscriber", t, handler)
+	publisher := testhelperConnect(b, "publisher", t)
+
+	granted, err := subscriber.Subscribe(mqtt.TopicFilter("sensors/+/temperature", 2), mqtt.TopicFilter("alarms/#", 1))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(2, len(granted), t)
+	testutils.CheckEqual(2, granted[0], t)
+	testutils.CheckEqual(1, granted[1], t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for qos := 0; qos <= 2; qos++ {
+		err = publisher.PublishContext(ctx, mqtt.Topic("sensors/kitchen/temperature"), mqtt.Message([]byte("21")), mqtt.QoS(qos))
+		testutils.CheckNotError(err, t)
+		msg := testhelperReceive(messages, t)
+		testutils.CheckEqual("sensors/kitchen/temperature", msg.Topic, t)
+		testutils.CheckEqual("21", string(msg.Message), t)
+		testutils.CheckEqual(qos, msg.QoS, t)
+	}
+
+	// Delivered at the QoS granted for the subscription
+	err = publisher.PublishContext(ctx, mqtt.Topic("alarms/fire"), mqtt.Message([]byte("!")), mqtt.QoS(2))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(1, testhelperReceive(messages, t).QoS, t)
+
+	testutils.CheckNotError(publisher.Disconnect(1), t)
+	testutils.CheckNotError(subscriber.Disconnect(1), t)
+	testutils.CheckNotError(b.Close(), t)
+	testutils.CheckNoGoroutineLeak(before, t)
+}
+
+func Test_Broker_serves_connections_from_a_listener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	testutils.CheckNotError(err, t)
+	b := NewBroker()
+	served := make(chan error, 1)
+	go func() { served <- b.Serve(listener) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	testutils.CheckNotError(err, t)
+	handler, messages := testhelperReceiver()
+	session := mqtt.NewSession(mqtt.ClientID("tcp-client"), mqtt.Connection(conn), handler)
+	testutils.CheckNotError(session.Connect(), t)
+	_, err = session.Subscribe(mqtt.TopicFilter("echo", 1))
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(session.Publish(mqtt.Topic("echo"), mqtt.Message([]byte("hello")), mqtt.QoS(1)), t)
+	testutils.CheckEqual("hello", string(testhelperReceive(messages, t).Message), t)
+	testutils.CheckNotError(session.Disconnect(1), t)
+
+	testutils.CheckNotError(b.Close(), t)
+	testutils.CheckNotError(<-served, t)
+}
+
+// connectedObserver records the session present flag of each OnConnected
+type connectedObserver struct {
+	mqtt.NopObserver
+	sessionPresent []bool
+}
+
+func (o *connectedObserver) OnConnected(sessionPresent bool) {
+	o.sessionPresent = append(o.sessionPresent, sessionPresent)
+}
+
+func Test_Broker_keeps_subscriptions_and_messages_of_a_session_that_is_not_clean(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	publisher := testhelperConnect(b, "publisher", t)
+
+	handler, messages := testhelperReceiver()
+	observer := &connectedObserver{}
+	conn := mqtt.NewMockConnection()
+	go b.ServeConn(conn.RemoteConn())
+	subscriber := mqtt.NewSession(mqtt.ClientID("subscriber"), mqtt.Connection(conn), handler, mqtt.Observe(observer))
+	testutils.CheckNotError(subscriber.Connect(mqtt.CleanSession(false)), t)
+	_, err := subscriber.Subscribe(mqtt.TopicFilter("news", 1))
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(subscriber.Disconnect(1), t)
+
+	// Published while the subscriber is not connected
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = publisher.PublishContext(ctx, mqtt.Topic("news"), mqtt.Message([]byte("extra")), mqtt.QoS(1))
+	testutils.CheckNotError(err, t)
+
+	conn = mqtt.NewMockConnection()
+	go b.ServeConn(conn.RemoteConn())
+	subscriber.ReEstablish(mqtt.Connection(conn))
+	testutils.CheckNotError(subscriber.Connect(mqtt.CleanSession(false)), t)
+	msg := testhelperReceive(messages, t)
+	testutils.CheckEqual("extra", string(msg.Message), t)
+	testutils.CheckNotError(subscriber.Disconnect(1), t)
+
+	testutils.CheckEqual(2, len(observer.sessionPresent), t)
+	testutils.CheckFalse(observer.sessionPresent[0], t)
+	testutils.CheckTrue(observer.sessionPresent[1], t)
+}
+
+func Test_Broker_gives_received_and_sent_packets_to_the_hooks(t *testing.T) {
+	var mutex sync.Mutex
+	received := []string{}
+	sent := []string{}
+	record := func(to *[]string) PacketHandlerFunc {
+		return func(clientID string, packet *mqtt.GenericMessage) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			*to = append(*to, mqtt.PacketTypeName(packet.Type()))
+		}
+	}
+	b := NewBroker(OnReceived(record(&received)), OnSent(record(&sent)))
+	session := testhelperConnect(b, "hooked", t)
+	_, err := session.Subscribe(mqtt.TopicFilter("a/#/b", 0))
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(session.Disconnect(1), t)
+	testutils.CheckNotError(b.Close(), t)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	testutils.CheckEqual("[CONNECT SUBSCRIBE DISCONNECT]", testhelperString(received), t)
+	testutils.CheckEqual("[CONNACK SUBACK]", testhelperString(sent), t)
+}
+
+func Test_Broker_refuses_an_invalid_topic_filter(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	session := testhelperConnect(b, "client", t)
+	granted, err := session.Subscribe(mqtt.TopicFilter("a/#/b", 1), mqtt.TopicFilter("a/+/b", 1))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(mqtt.SubAckFailure, granted[0], t)
+	testutils.CheckEqual(1, granted[1], t)
+	testutils.CheckNotError(session.Disconnect(1), t)
+}
+
+func Test_Broker_refuses_an_unsupported_protocol_level(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	conn := mqtt.NewMockConnection()
+	go b.ServeConn(conn.RemoteConn())
+
+	// A CONNECT for MQTT 3.1.1 changed to protocol level 6
+	connect := mqtt.NewConnectRequest(mqtt.ClientName("client")).MakeMessage().Body()
+	connect[6] = 6
+	_, err := mqtt.NewGenericMessage(mqtt.ConnectType, 0, connect).WriteTo(conn)
+	testutils.CheckNotError(err, t)
+	connAck, err := mqtt.ReadMessage(conn)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual([]byte{0, mqtt.ConnectionRefusedRejectedVersion}, connAck.Body(), t)
+}
+
+// testhelperConnect5 connects an MQTT 5 client to the broker with the given options using a MockConnection, and
+// returns the connection after having checked the CONNACK
+func testhelperConnect5(b *Broker, sessionPresent bool, t *testing.T, options ...mqtt.ConnectOption) *mqtt.MockConnection {
+	t.Helper()
+	conn := mqtt.NewMockConnection()
+	go b.ServeConn(conn.RemoteConn())
+	options = append([]mqtt.ConnectOption{mqtt.Level(5), mqtt.KeepAliveSeconds(0)}, options...)
+	_, err := mqtt.NewConnectRequest(options...).MakeMessage().WriteTo(conn)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual([]byte{0x20, 3, testhelperFlag(sessionPresent), 0, 0}, testhelperReadPacket(conn, t), t)
+	return conn
+}
+
+func testhelperFlag(flag bool) byte {
+	if flag {
+		return 1
+	}
+	return 0
+}
+
+// testhelperReadPacket reads a packet from the connection and returns all its bytes
+func testhelperReadPacket(conn *mqtt.MockConnection, t *testing.T) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, err := mqtt.ReadMessage(conn)
+	testutils.CheckNotError(err, t)
+	var buffer bytes.Buffer
+	msg.WriteTo(&buffer)
+	return buffer.Bytes()
+}
+
+func Test_Broker_routes_messages_to_and_from_MQTT_5_clients(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	handler, messages := testhelperReceiver()
+	subscriber := testhelperConnect(b, "subscriber", t, handler)
+	_, err := subscriber.Subscribe(mqtt.TopicFilter("from5", 1))
+	testutils.CheckNotError(err, t)
+
+	conn := testhelperConnect5(b, false, t, mqtt.ClientName("client5"))
+	// SUBSCRIBE(1) with no properties to "to5" with No Local and QoS 1 - SUBACK has no properties
+	conn.Write([]byte{0x82, 9, 0, 1, 0, 0, 3, 't', 'o', '5', 0x05})
+	testutils.CheckEqual([]byte{0x90, 4, 0, 1, 0, 1}, testhelperReadPacket(conn, t), t)
+
+	// A PUBLISH with a message expiry interval property from the MQTT 5 client
+	conn.Write([]byte{0x32, 17, 0, 5, 'f', 'r', 'o', 'm', '5', 0, 9, 5, 0x02, 0, 0, 0, 60, 'h', 'i'})
+	testutils.CheckEqual([]byte{0x40, 2, 0, 9}, testhelperReadPacket(conn, t), t)
+	msg := testhelperReceive(messages, t)
+	testutils.CheckEqual("from5", msg.Topic, t)
+	testutils.CheckEqual("hi", string(msg.Message), t)
+
+	// A PUBLISH to the MQTT 5 client has no properties, and a PUBACK with a reason code is accepted
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	testutils.CheckNotError(subscriber.PublishContext(ctx, mqtt.Topic("to5"), mqtt.Message([]byte("yo")), mqtt.QoS(1)), t)
+	testutils.CheckEqual([]byte{0x32, 10, 0, 3, 't', 'o', '5', 0, 1, 0, 'y', 'o'}, testhelperReadPacket(conn, t), t)
+	conn.Write([]byte{0x40, 4, 0, 1, 0x10, 0})
+
+	// UNSUBACK has a reason code per topic filter
+	conn.Write([]byte{0xA2, 13, 0, 2, 0, 0, 3, 't', 'o', '5', 0, 3, 'n', 'o', 't'})
+	testutils.CheckEqual([]byte{0xB0, 5, 0, 2, 0, 0, mqtt.UnsubAckNoSubscriptionExisted}, testhelperReadPacket(conn, t), t)
+	testutils.CheckNotError(subscriber.Disconnect(1), t)
+}
+
+func testhelperString(values []string) string {
+	result := "["
+	for i, v := range values {
+		if i > 0 {
+			result += " "
+		}
+		result += v
+	}
+	return result + "]"
+}
+
+func Test_Broker_delivers_retained_messages_to_new_subscriptions(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	publisher := testhelperConnect(b, "publisher", t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := publisher.PublishContext(ctx, mqtt.Topic("status/a"), mqtt.Message([]byte("up")), mqtt.QoS(1), mqtt.Retain(true))
+	testutils.CheckNotError(err, t)
+	err = publisher.PublishContext(ctx, mqtt.Topic("status/b"), mqtt.Message([]byte("up")), mqtt.QoS(1), mqtt.Retain(true))
+	testutils.CheckNotError(err, t)
+
+	// An empty retained message removes the retained message for the topic
+	err = publisher.PublishContext(ctx, mqtt.Topic("status/b"), mqtt.Message([]byte{}), mqtt.QoS(1), mqtt.Retain(true))
+	testutils.CheckNotError(err, t)
+
+	handler, messages := testhelperReceiver()
+	subscriber := testhelperConnect(b, "subscriber", t, handler)
+	_, err = subscriber.Subscribe(mqtt.TopicFilter("status/+", 0))
+	testutils.CheckNotError(err, t)
+	msg := testhelperReceive(messages, t)
+	testutils.CheckEqual("status/a", msg.Topic, t)
+	testutils.CheckTrue(msg.Retain, t)
+	testutils.CheckEqual(0, msg.QoS, t)
+
+	// Delivered to the established subscription without the retain flag
+	err = publisher.PublishContext(ctx, mqtt.Topic("status/a"), mqtt.Message([]byte("down")), mqtt.QoS(1), mqtt.Retain(true))
+	testutils.CheckNotError(err, t)
+	msg = testhelperReceive(messages, t)
+	testutils.CheckEqual("down", string(msg.Message), t)
+	testutils.CheckFalse(msg.Retain, t)
+	testutils.CheckEqual(0, len(messages), t)
+}
+
+func Test_Broker_publishes_the_will_when_a_connection_ends_without_DISCONNECT(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	handler, messages := testhelperReceiver()
+	subscriber := testhelperConnect(b, "subscriber", t, handler)
+	_, err := subscriber.Subscribe(mqtt.TopicFilter("wills/#", 1))
+	testutils.CheckNotError(err, t)
+
+	connectWithWill := func(clientID string) (*mqtt.Session, *mqtt.MockConnection) {
+		conn := mqtt.NewMockConnection()
+		go b.ServeConn(conn.RemoteConn())
+		session := mqtt.NewSession(mqtt.ClientID(clientID), mqtt.Connection(conn))
+		err := session.Connect(mqtt.WillTopic("wills/"+clientID), mqtt.WillMessage([]byte("gone")), mqtt.WillQoS(1))
+		testutils.CheckNotError(err, t)
+		return session, conn
+	}
+
+	// A DISCONNECT discards the will
+	polite, _ := connectWithWill("polite")
+	testutils.CheckNotError(polite.Disconnect(1), t)
+
+	_, conn := connectWithWill("rude")
+	conn.Close()
+	msg := testhelperReceive(messages, t)
+	testutils.CheckEqual("wills/rude", msg.Topic, t)
+	testutils.CheckEqual("gone", string(msg.Message), t)
+	testutils.CheckEqual(0, len(messages), t)
+}
+
+func Test_RetainedStore_keeps_retained_messages_in_its_file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retained")
+	testutils.CheckNotError(err, t)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "retained.json")
+
+	store, err := NewRetainedStore(fileName)
+	testutils.CheckNotError(err, t)
+	retain := func(topic, message string) {
+		msg := mqtt.NewPublishRequest(mqtt.Topic(topic), mqtt.Message([]byte(message)), mqtt.QoS(1), mqtt.Retain(true))
+		testutils.CheckNotError(store.Retain(msg), t)
+	}
+	retain("status/b", "up")
+	retain("status/a", "up")
+	retain("status/c", "up")
+	retain("status/c", "")
+	retain("status/a", "down")
+
+	// A restarted broker gets the retained messages from the file
+	store, err = NewRetainedStore(fileName)
+	testutils.CheckNotError(err, t)
+	matching := store.Matching("status/#")
+	testutils.CheckEqual(2, len(matching), t)
+	testutils.CheckEqual("status/a", matching[0].Topic, t)
+	testutils.CheckEqual("down", string(matching[0].Message), t)
+	testutils.CheckEqual(1, matching[0].QoS, t)
+	testutils.CheckEqual("status/b", matching[1].Topic, t)
+	testutils.CheckEqual(0, len(store.Matching("other")), t)
+
+	testutils.CheckNotError(ioutil.WriteFile(fileName, []byte("not json"), 0644), t)
+	_, err = NewRetainedStore(fileName)
+	testutils.CheckError(err, t)
+}
+
+func Test_Broker_publishes_the_will_when_a_client_misses_its_keep_alive(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	handler, messages := testhelperReceiver()
+	subscriber := testhelperConnect(b, "subscriber", t, handler)
+	_, err := subscriber.Subscribe(mqtt.TopicFilter("wills/#", 1))
+	testutils.CheckNotError(err, t)
+
+	// The session does not send PINGREQ - the broker closes the connection after 1.5 seconds
+	conn := mqtt.NewMockConnection()
+	go b.ServeConn(conn.RemoteConn())
+	silent := mqtt.NewSession(mqtt.ClientID("silent"), mqtt.Connection(conn))
+	err = silent.Connect(mqtt.KeepAliveSeconds(1), mqtt.XNoPingReq(true), mqtt.WillTopic("wills/silent"), mqtt.WillMessage([]byte("gone")))
+	testutils.CheckNotError(err, t)
+	started := time.Now()
+	msg := testhelperReceive(messages, t)
+	testutils.CheckEqual("wills/silent", msg.Topic, t)
+	testutils.CheckTrue(time.Since(started) >= time.Second, t)
+}
+
+func Test_Broker_delays_the_will_by_the_Will_Delay_Interval_and_drops_it_if_the_client_connects_again(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	handler, messages := testhelperReceiver()
+	subscriber := testhelperConnect(b, "subscriber", t, handler)
+	_, err := subscriber.Subscribe(mqtt.TopicFilter("wills/#", 1))
+	testutils.CheckNotError(err, t)
+
+	willDelay := func(clientID string, seconds int64) []mqtt.ConnectOption {
+		return []mqtt.ConnectOption{mqtt.ClientName(clientID), mqtt.CleanSession(false), mqtt.SessionExpiry(mqtt.SessionNeverExpires),
+			mqtt.WillTopic("wills/" + clientID), mqtt.WillMessage([]byte("gone")), mqtt.WillQoS(1), mqtt.WillDelay(seconds)}
+	}
+
+	// An MQTT 3.1.1 client has no Will Delay Interval
+	conn := mqtt.NewMockConnection()
+	go b.ServeConn(conn.RemoteConn())
+	session := mqtt.NewSession(mqtt.ClientID("v3"), mqtt.Connection(conn))
+	testutils.CheckNotError(session.Connect(mqtt.CleanSession(false), mqtt.WillTopic("wills/v3"), mqtt.WillMessage([]byte("gone"))), t)
+	conn.Close()
+	testutils.CheckEqual("wills/v3", testhelperReceive(messages, t).Topic, t)
+
+	testhelperConnect5(b, false, t, willDelay("returning", 1)...).Close()
+	testhelperConnect5(b, false, t, willDelay("delayed", 1)...).Close()
+	time.Sleep(500 * time.Millisecond)
+	testutils.CheckEqual(0, len(messages), t)
+	testhelperConnect5(b, true, t, willDelay("returning", 1)...)
+
+	started := time.Now()
+	testutils.CheckEqual("wills/delayed", testhelperReceive(messages, t).Topic, t)
+	testutils.CheckTrue(time.Since(started) >= 300*time.Millisecond, t)
+	time.Sleep(600 * time.Millisecond)
+	testutils.CheckEqual(0, len(messages), t)
+}
+
+func Test_Broker_publishes_the_will_when_the_session_expires_before_the_Will_Delay_Interval(t *testing.T) {
+	b := NewBroker(MaxWillDelay(200 * time.Millisecond))
+	defer b.Close()
+	handler, messages := testhelperReceiver()
+	subscriber := testhelperConnect(b, "subscriber", t, handler)
+	_, err := subscriber.Subscribe(mqtt.TopicFilter("wills/#", 1))
+	testutils.CheckNotError(err, t)
+	will := func(clientID string) []mqtt.ConnectOption {
+		return []mqtt.ConnectOption{mqtt.ClientName(clientID), mqtt.WillTopic("wills/" + clientID), mqtt.WillMessage([]byte("gone")),
+			mqtt.WillDelay(3600)}
+	}
+
+	// A session without a Session Expiry Interval ends with its connection
+	testhelperConnect5(b, false, t, will("ended")...).Close()
+	testutils.CheckEqual("wills/ended", testhelperReceive(messages, t).Topic, t)
+
+	// The delay is limited by MaxWillDelay
+	started := time.Now()
+	testhelperConnect5(b, false, t, append(will("limited"), mqtt.SessionExpiry(3600))...).Close()
+	testutils.CheckEqual("wills/limited", testhelperReceive(messages, t).Topic, t)
+	testutils.CheckTrue(time.Since(started) >= 200*time.Millisecond, t)
+
+	testutils.CheckNotError(subscriber.Disconnect(1), t)
+	b.Close()
+
+	// The session expires after a second - and the will is published then
+	b = NewBroker()
+	subscriber = testhelperConnect(b, "subscriber", t, handler)
+	_, err = subscriber.Subscribe(mqtt.TopicFilter("wills/#", 1))
+	testutils.CheckNotError(err, t)
+	started = time.Now()
+	testhelperConnect5(b, false, t, mqtt.ClientName("expiring"), mqtt.CleanSession(false), mqtt.SessionExpiry(1),
+		mqtt.WillTopic("wills/expiring"), mqtt.WillMessage([]byte("gone")), mqtt.WillDelay(3600)).Close()
+	testutils.CheckEqual("wills/expiring", testhelperReceive(messages, t).Topic, t)
+	testutils.CheckTrue(time.Since(started) >= 900*time.Millisecond, t)
+
+	// The session has been dropped
+	time.Sleep(100 * time.Millisecond)
+	testhelperConnect5(b, false, t, mqtt.ClientName("expiring"), mqtt.CleanSession(false)).Close()
+	b.Close()
+}
+
+func Test_Broker_publishes_the_will_when_an_MQTT_5_client_disconnects_with_will_message(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	handler, messages := testhelperReceiver()
+	subscriber := testhelperConnect(b, "subscriber", t, handler)
+	_, err := subscriber.Subscribe(mqtt.TopicFilter("wills/#", 1))
+	testutils.CheckNotError(err, t)
+
+	conn := testhelperConnect5(b, false, t, mqtt.ClientName("leaving"), mqtt.WillTopic("wills/leaving"), mqtt.WillMessage([]byte("bye")))
+	conn.Write([]byte{mqtt.DisconnectType << 4, 1, mqtt.DisconnectWithWillMessage})
+	testutils.CheckEqual("bye", string(testhelperReceive(messages, t).Message), t)
+}
+
+// allowAuth is an Authenticator and Authorizer accepting the user "allowed", and allowing only topics starting with
+// "allowed"
+type allowAuth struct{}
+
+func (allowAuth) Authenticate(clientID, userName string, password *[]byte) int {
+	if userName != "allowed" {
+		return mqtt.ConnectionRefusedNotAuthorized
+	}
+	return mqtt.ConnectionAccepted
+}
+
+func (allowAuth) CanPublish(clientID, userName, topic string) bool {
+	return strings.HasPrefix(topic, "allowed")
+}
+
+func (allowAuth) CanSubscribe(clientID, userName, filter string) bool {
+	return strings.HasPrefix(filter, "allowed")
+}
+
+func Test_Broker_refuses_clients_and_topics_that_are_not_authorized(t *testing.T) {
+	b := NewBroker(Authentication(allowAuth{}), Authorization(allowAuth{}))
+	defer b.Close()
+
+	conn := mqtt.NewMockConnection()
+	go b.ServeConn(conn.RemoteConn())
+	refused := mqtt.NewSession(mqtt.ClientID("refused"), mqtt.Connection(conn))
+	err := refused.Connect(mqtt.UserName("other"))
+	testutils.CheckError(err, t)
+	testutils.CheckTrue(strings.HasSuffix(err.Error(), "got 5"), t)
+
+	handler, messages := testhelperReceiver()
+	conn = mqtt.NewMockConnection()
+	go b.ServeConn(conn.RemoteConn())
+	session := mqtt.NewSession(mqtt.ClientID("client"), mqtt.Connection(conn), handler)
+	testutils.CheckNotError(session.Connect(mqtt.UserName("allowed")), t)
+	granted, err := session.Subscribe(mqtt.TopicFilter("allowed/#", 1), mqtt.TopicFilter("other/#", 1))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(1, granted[0], t)
+	testutils.CheckEqual(mqtt.SubAckFailure, granted[1], t)
+
+	// A PUBLISH that is not authorized is acknowledged but not routed
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	testutils.CheckNotError(session.PublishContext(ctx, mqtt.Topic("allowed/not"), mqtt.Message([]byte("1")), mqtt.QoS(1)), t)
+	testutils.CheckNotError(session.PublishContext(ctx, mqtt.Topic("other/x"), mqtt.Message([]byte("2")), mqtt.QoS(1)), t)
+	testutils.CheckNotError(session.PublishContext(ctx, mqtt.Topic("allowed/yes"), mqtt.Message([]byte("3")), mqtt.QoS(1)), t)
+	testutils.CheckEqual("1", string(testhelperReceive(messages, t).Message), t)
+	testutils.CheckEqual("3", string(testhelperReceive(messages, t).Message), t)
+	testutils.CheckNotError(session.Disconnect(1), t)
+}
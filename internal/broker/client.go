@@ -0,0 +1,388 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// connectTimeOut is the time a client has to send CONNECT after the connection has been established
+const connectTimeOut = 10 * time.Second
+
+// errDisconnect ends the serving of a client that sent DISCONNECT
+var errDisconnect = errors.New("DISCONNECT")
+
+// client is one connection served by the broker. Packets from the client are read and processed by the goroutine
+// serving the connection, while packets to the client are queued and written by a writer goroutine. Queueing
+// never blocks - a slow client does not hold up the clients publishing to it.
+//
+type client struct {
+	broker *Broker
+	conn   net.Conn
+	id     string               // the client ID - set before the writer is started
+	user   string               // the user name given in CONNECT (empty if none was given)
+	level  byte                 // the protocol level of the client - 4 (MQTT 3.1.1) or 5 (MQTT 5)
+	will   *mqtt.PublishRequest // published if the connection ends without DISCONNECT (nil if there is no will)
+
+	// how long the session is kept after the connection has ended - 0 ends it with the connection, and a negative
+	// duration keeps it until the broker is closed
+	sessionExpiry time.Duration
+	willDelay     time.Duration // the MQTT 5 Will Delay Interval given by the client
+
+	// the time the client may be silent before the connection is closed (0 if there is no keep alive)
+	keepAlive time.Duration
+
+	queueMutex sync.Mutex
+	queue      []*mqtt.GenericMessage // packets waiting to be written
+	wakeup     chan struct{}          // signals that packets have been queued
+	quit       chan struct{}          // closed to make the writer write what is queued and return
+	ended      chan struct{}          // closed when the writer has returned
+}
+
+func newClient(b *Broker, conn net.Conn) *client {
+	return &client{
+		broker: b,
+		conn:   conn,
+		wakeup: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		ended:  make(chan struct{}),
+	}
+}
+
+// serve handles the connection of the client from CONNECT until it ends
+//
+func (c *client) serve() {
+	defer c.conn.Close()
+
+	s, err := c.connect()
+	if err != nil {
+		log.Warnf("Broker: refusing connection from %s: %s", c.conn.RemoteAddr(), err)
+		return
+	}
+	log.Debugf("Broker: client %s connected", c.id)
+	go c.writeLoop()
+	defer func() {
+		close(c.quit)
+		<-c.ended
+		c.broker.detach(c, s)
+	}()
+
+	for {
+		if c.keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive))
+		}
+		msg, err := mqtt.ReadMessage(c.conn)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Infof("Broker: client %s missed its keep alive - closing connection", c.id)
+			} else {
+				log.Debugf("Broker: client %s connection lost: %s", c.id, err)
+			}
+			c.broker.publishWill(c, s)
+			return
+		}
+		c.received(msg)
+		reasonCode := 0
+		if c.level == 5 {
+			if msg, reasonCode, err = mqtt.FromLevel5(msg); err != nil {
+				log.Warnf("Broker: client %s: %s - closing connection", c.id, err)
+				c.broker.publishWill(c, s)
+				return
+			}
+		}
+		if err := c.process(s, msg, reasonCode); err != nil {
+			if err == errDisconnect {
+				log.Debugf("Broker: client %s disconnected", c.id)
+			} else {
+				log.Warnf("Broker: client %s: %s - closing connection", c.id, err)
+				c.broker.publishWill(c, s)
+			}
+			return
+		}
+	}
+}
+
+// connect reads and processes the CONNECT from the client and returns the session of the client. An error is
+// returned if the connection is refused - a refusing CONNACK has then been written if required.
+//
+func (c *client) connect() (*session, error) {
+	c.conn.SetReadDeadline(time.Now().Add(connectTimeOut))
+	msg, err := mqtt.ReadMessage(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	c.received(msg)
+
+	request, err := mqtt.DecodeConnect(msg)
+	if err == mqtt.ErrUnsupportedLevel {
+		c.write(mqtt.NewConnAckMessage(false, mqtt.ConnectionRefusedRejectedVersion))
+		return nil, fmt.Errorf("Protocol level %d is not supported", request.Options().Level)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	opts := request.Options()
+	c.level = opts.Level
+	// SPEC: the connection is closed if nothing is received from the client within one and a half times the
+	// keep alive
+	c.keepAlive = time.Duration(opts.KeepAliveSeconds) * time.Second * 3 / 2
+	c.id = opts.ClientName
+	if c.id == "" {
+		// SPEC: (MQTT 5) an assigned client ID must be returned in a CONNACK property - such clients are refused as
+		// the broker does not send properties
+		if !opts.CleanSession || c.level == 5 {
+			c.write(mqtt.NewConnAckMessage(false, mqtt.ConnectionRefusedRejectedIdentifier))
+			return nil, fmt.Errorf("An empty client ID requires a clean session (and MQTT 3.1.1)")
+		}
+		c.id = mqtt.RandomClientID()
+		log.Debugf("Broker: assigned client ID %s", c.id)
+	}
+	c.user = opts.UserName
+	switch {
+	case c.level == 4 && opts.CleanSession, c.level == 5 && opts.SessionExpirySeconds == 0:
+		c.sessionExpiry = 0
+	case c.level == 4, opts.SessionExpirySeconds == mqtt.SessionNeverExpires:
+		c.sessionExpiry = -1
+	default:
+		c.sessionExpiry = time.Duration(opts.SessionExpirySeconds) * time.Second
+	}
+	c.willDelay = time.Duration(opts.WillDelaySeconds) * time.Second
+	if authenticator := c.broker.options.Authenticator; authenticator != nil {
+		if rc := authenticator.Authenticate(c.id, c.user, opts.Password); rc != mqtt.ConnectionAccepted {
+			c.write(mqtt.NewConnAckMessage(false, rc))
+			return nil, fmt.Errorf("Client %s (user '%s') was refused with return code %d", c.id, c.user, rc)
+		}
+	}
+	if opts.WillTopic != "" {
+		if err := mqtt.ValidateTopicName(opts.WillTopic); err != nil {
+			return nil, err
+		}
+		if c.canPublish(opts.WillTopic) {
+			c.will = mqtt.NewPublishRequest(mqtt.Topic(opts.WillTopic), mqtt.Message(opts.WillMessage),
+				mqtt.QoS(opts.WillQoS), mqtt.Retain(opts.WillRetain))
+		} else {
+			log.Warnf("Broker: client %s is not authorized to publish its will to %s - ignoring the will", c.id, opts.WillTopic)
+		}
+	}
+	return c.broker.attach(c, opts.CleanSession), nil
+}
+
+// process performs the actions required by a packet received from the client - in its MQTT 3.1.1 form, with the
+// MQTT 5 reason code of an acknowledgement or DISCONNECT (0 if there is none). An error is returned if the
+// connection should be closed.
+//
+func (c *client) process(s *session, msg *mqtt.GenericMessage, reasonCode int) error {
+	switch msg.Type() {
+	case mqtt.PublishType:
+		return c.processPublish(s, msg)
+
+	case mqtt.PublishReleaseType:
+		packetID, err := mqtt.AckPacketID(msg, mqtt.PublishReleaseType)
+		if err != nil {
+			return err
+		}
+		s.releasedQoS2Publish(packetID)
+		c.send(mqtt.NewAckMessage(mqtt.PublishCompleteType, packetID))
+
+	case mqtt.PublishAckType, mqtt.PublishReceivedType, mqtt.PublishCompleteType:
+		packetID, err := mqtt.AckPacketID(msg, msg.Type())
+		if err != nil {
+			return err
+		}
+		reply, err := s.acknowledged(msg.Type(), packetID)
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			c.send(reply)
+		}
+
+	case mqtt.SubscribeType:
+		request, err := mqtt.DecodeSubscribe(msg)
+		if err != nil {
+			return err
+		}
+		opts := request.Options()
+		returnCodes := make([]byte, len(opts.Subscriptions))
+		for i, sub := range opts.Subscriptions {
+			if err := mqtt.ValidateTopicFilter(sub.TopicFilter); err != nil {
+				log.Warnf("Broker: client %s: %s", c.id, err)
+				returnCodes[i] = mqtt.SubAckFailure
+				continue
+			}
+			if authorizer := c.broker.options.Authorizer; authorizer != nil && !authorizer.CanSubscribe(c.id, c.user, sub.TopicFilter) {
+				log.Warnf("Broker: client %s is not authorized to subscribe to %s", c.id, sub.TopicFilter)
+				returnCodes[i] = mqtt.SubAckFailure
+				continue
+			}
+			s.subscribe(sub.TopicFilter, sub.QoS)
+			returnCodes[i] = byte(sub.QoS)
+		}
+		c.send(mqtt.NewSubAckMessage(opts.PacketID, returnCodes))
+
+		// SPEC: retained messages matching a new subscription are sent with the retain flag set
+		for i, sub := range opts.Subscriptions {
+			if returnCodes[i] == mqtt.SubAckFailure {
+				continue
+			}
+			for _, r := range c.broker.options.Retained.Matching(sub.TopicFilter) {
+				qos := r.QoS
+				if sub.QoS < qos {
+					qos = sub.QoS
+				}
+				s.publish(r.Topic, r.Message, qos, true)
+			}
+		}
+
+	case mqtt.UnsubscribeType:
+		packetID, filters, err := mqtt.DecodeUnsubscribe(msg)
+		if err != nil {
+			return err
+		}
+		reasonCodes := make([]byte, len(filters))
+		for i, filter := range filters {
+			if !s.unsubscribe(filter) {
+				reasonCodes[i] = mqtt.UnsubAckNoSubscriptionExisted
+			}
+		}
+		if c.level == 5 {
+			c.send(mqtt.NewUnsubAckMessage(packetID, reasonCodes))
+		} else {
+			c.send(mqtt.NewAckMessage(mqtt.UnsubAckType, packetID))
+		}
+
+	case mqtt.PingReqType:
+		c.send(mqtt.NewPingResponseMessage())
+
+	case mqtt.DisconnectType:
+		if reasonCode == mqtt.DisconnectWithWillMessage {
+			c.broker.publishWill(c, s)
+		}
+		return errDisconnect
+
+	default:
+		return fmt.Errorf("Unexpected %s from client", mqtt.PacketTypeName(msg.Type()))
+	}
+	return nil
+}
+
+// processPublish routes a PUBLISH from the client and acknowledges it as required by its QoS
+//
+func (c *client) processPublish(s *session, msg *mqtt.GenericMessage) error {
+	request, err := mqtt.DecodePublish(msg)
+	if err != nil {
+		return err
+	}
+	opts := request.Options()
+	if err := mqtt.ValidateTopicName(opts.Topic); err != nil {
+		return err
+	}
+	// SPEC: (3.1.1) There is no way to tell the client that it is not authorized to publish - the message is
+	// acknowledged as usual but not routed
+	authorized := c.canPublish(opts.Topic)
+	if !authorized {
+		log.Warnf("Broker: client %s is not authorized to publish to %s - dropping the message", c.id, opts.Topic)
+	}
+	switch opts.QoS {
+	case 0:
+		if authorized {
+			c.broker.route(request)
+		}
+	case 1:
+		if authorized {
+			c.broker.route(request)
+		}
+		c.send(mqtt.NewAckMessage(mqtt.PublishAckType, opts.PacketID))
+	case 2:
+		// The message is routed when first received - a resent duplicate is only acknowledged
+		if s.receivedQoS2Publish(opts.PacketID) && authorized {
+			c.broker.route(request)
+		}
+		c.send(mqtt.NewAckMessage(mqtt.PublishReceivedType, opts.PacketID))
+	}
+	return nil
+}
+
+// canPublish returns true if the client is authorized to publish to the given topic
+//
+func (c *client) canPublish(topic string) bool {
+	authorizer := c.broker.options.Authorizer
+	return authorizer == nil || authorizer.CanPublish(c.id, c.user, topic)
+}
+
+// send queues the given packet for writing to the client
+//
+func (c *client) send(msg *mqtt.GenericMessage) {
+	c.queueMutex.Lock()
+	c.queue = append(c.queue, msg)
+	c.queueMutex.Unlock()
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop writes queued packets until quit is closed, or a write fails
+//
+func (c *client) writeLoop() {
+	defer close(c.ended)
+	for {
+		select {
+		case <-c.wakeup:
+			if !c.flush() {
+				return
+			}
+		case <-c.quit:
+			c.flush()
+			return
+		}
+	}
+}
+
+// flush writes all queued packets and returns false if a write failed (the connection is then closed)
+//
+func (c *client) flush() bool {
+	c.queueMutex.Lock()
+	queue := c.queue
+	c.queue = nil
+	c.queueMutex.Unlock()
+
+	for _, msg := range queue {
+		if err := c.write(msg); err != nil {
+			log.Debugf("Broker: error while writing to client %s: %s", c.id, err)
+			c.conn.Close()
+			return false
+		}
+	}
+	return true
+}
+
+// write writes the given packet (in its MQTT 3.1.1 form) to the client and gives what was written to the OnSent hook
+//
+func (c *client) write(msg *mqtt.GenericMessage) error {
+	if c.level == 5 {
+		msg = mqtt.ToLevel5(msg)
+	}
+	if _, err := msg.WriteTo(c.conn); err != nil {
+		return err
+	}
+	if c.broker.options.OnSent != nil {
+		c.broker.options.OnSent(c.id, msg)
+	}
+	return nil
+}
+
+// received gives a packet received from the client to the OnReceived hook
+//
+func (c *client) received(msg *mqtt.GenericMessage) {
+	if c.broker.options.OnReceived != nil {
+		c.broker.options.OnReceived(c.id, msg)
+	}
+}
@@ -0,0 +1,255 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FileAuth is an Authenticator and Authorizer reading users and topic rules from a file. The file has one entry
+// per line, blank lines and lines starting with '#' are ignored. A "user", "anonymous", or "all" line starts a
+// section, and the "publish", "subscribe", and "readwrite" lines that follow give topic filter rules for it:
+//
+//     # rules for every client
+//     all
+//     readwrite clients/%c/#
+//
+//     # clients that connect without user name - if there is no such section they are not authorized
+//     anonymous
+//     subscribe public/#
+//
+//     user alice $2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy
+//     publish sensors/%u/#
+//     subscribe sensors/#
+//
+//     user bob sha256:pepper:<hex encoded SHA-256 of "pepper" followed by the password>
+//     subscribe sensors/+/temperature
+//
+// The password of a user is given as a bcrypt hash, or as "sha256:<salt>:<hex digest>" where the digest is the
+// SHA-256 of the salt followed by the password. In a rule %c is replaced by the client ID, and %u by the user name.
+// A rule is ignored for a client where the substitution would be empty, or would contain '/', '+', or '#'.
+//
+// A client may publish to a topic matched by one of its publish rules, and subscribe to a topic filter that only
+// matches topics matched by one of its subscribe rules. "readwrite" is a rule for both.
+//
+type FileAuth struct {
+	fileName string
+	mutex    sync.RWMutex
+	users    map[string]*authSection
+	anon     *authSection // nil if anonymous clients are not authorized
+	all      *authSection
+}
+
+// authSection is the password and the rules of one section of an auth file
+type authSection struct {
+	password  string
+	publish   []string
+	subscribe []string
+}
+
+// NewFileAuth returns a FileAuth for the file with the given name. An error is returned if the file cannot be
+// read, or is not valid.
+//
+func NewFileAuth(fileName string) (*FileAuth, error) {
+	a := &FileAuth{fileName: fileName}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the file again and replaces all users and rules. If the file cannot be read, or is not valid, an
+// error is returned and the earlier users and rules are kept.
+//
+func (a *FileAuth) Reload() error {
+	f, err := os.Open(a.fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]*authSection)
+	var anon *authSection
+	all := &authSection{}
+	var current *authSection
+	lineNo := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", a.fileName, lineNo, fmt.Sprintf(format, args...))
+		}
+		keyword := fields[0]
+		switch keyword {
+		case "user":
+			if len(fields) != 3 {
+				return fail("expected 'user <name> <password hash>'")
+			}
+			if users[fields[1]] != nil {
+				return fail("user %s is already defined", fields[1])
+			}
+			if err := checkPasswordHash(fields[2]); err != nil {
+				return fail("user %s: %s", fields[1], err)
+			}
+			current = &authSection{password: fields[2]}
+			users[fields[1]] = current
+		case "anonymous", "all":
+			if len(fields) != 1 {
+				return fail("expected '%s' on a line of its own", keyword)
+			}
+			if keyword == "all" {
+				current = all
+			} else {
+				if anon == nil {
+					anon = &authSection{}
+				}
+				current = anon
+			}
+		case "publish", "subscribe", "readwrite":
+			if len(fields) != 2 {
+				return fail("expected '%s <topic filter>'", keyword)
+			}
+			if current == nil {
+				return fail("'%s' must follow 'user', 'anonymous', or 'all'", keyword)
+			}
+			if err := mqtt.ValidateTopicFilter(fields[1]); err != nil {
+				return fail("%s", err)
+			}
+			if keyword != "subscribe" {
+				current.publish = append(current.publish, fields[1])
+			}
+			if keyword != "publish" {
+				current.subscribe = append(current.subscribe, fields[1])
+			}
+		default:
+			return fail("unknown keyword '%s'", keyword)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.users = users
+	a.anon = anon
+	a.all = all
+	return nil
+}
+
+// Authenticate accepts a client without user name if the file has an "anonymous" section, and a client with the
+// user name and password of a user in the file. An anonymous client is otherwise refused as not authorized, and a
+// client with an unknown user name or a wrong password is refused with bad user name or password.
+//
+func (a *FileAuth) Authenticate(clientID, userName string, password *[]byte) int {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if userName == "" {
+		if a.anon == nil {
+			return mqtt.ConnectionRefusedNotAuthorized
+		}
+		return mqtt.ConnectionAccepted
+	}
+	user := a.users[userName]
+	if user == nil || password == nil || !passwordMatches(user.password, *password) {
+		return mqtt.ConnectionRefusedBadUserPassword
+	}
+	return mqtt.ConnectionAccepted
+}
+
+// CanPublish returns true if one of the publish rules for the client matches the given topic
+//
+func (a *FileAuth) CanPublish(clientID, userName, topic string) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, rule := range a.rules(userName, func(s *authSection) []string { return s.publish }) {
+		if rule, ok := substitute(rule, clientID, userName); ok && mqtt.TopicMatches(rule, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanSubscribe returns true if one of the subscribe rules for the client covers the given topic filter
+//
+func (a *FileAuth) CanSubscribe(clientID, userName, filter string) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, rule := range a.rules(userName, func(s *authSection) []string { return s.subscribe }) {
+		if rule, ok := substitute(rule, clientID, userName); ok && filterCovers(rule, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// rules returns the rules selected from the "all" section and the section for the given user name (the anonymous
+// section for an empty user name). The caller must hold the mutex.
+//
+func (a *FileAuth) rules(userName string, selected func(s *authSection) []string) []string {
+	result := selected(a.all)
+	section := a.anon
+	if userName != "" {
+		section = a.users[userName]
+	}
+	if section != nil {
+		result = append(append([]string{}, result...), selected(section)...)
+	}
+	return result
+}
+
+// substitute replaces %c with the client ID and %u with the user name in the given rule. Both are replaced in one
+// pass - a client ID containing "%u" is not in turn replaced with the user name. False is returned if a substituted
+// value is empty or contains a topic level separator or wildcard.
+//
+func substitute(rule, clientID, userName string) (string, bool) {
+	for _, s := range []struct{ pattern, value string }{{"%c", clientID}, {"%u", userName}} {
+		if strings.Contains(rule, s.pattern) && (s.value == "" || strings.ContainsAny(s.value, "/+#")) {
+			return "", false
+		}
+	}
+	return strings.NewReplacer("%c", clientID, "%u", userName).Replace(rule), true
+}
+
+// checkPasswordHash returns an error if the given password hash is not in a supported format
+//
+func checkPasswordHash(hash string) error {
+	if strings.HasPrefix(hash, "$2") {
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	}
+	parts := strings.Split(hash, ":")
+	if len(parts) != 3 || parts[0] != "sha256" {
+		return fmt.Errorf("password hash must be a bcrypt hash, or 'sha256:<salt>:<hex digest>'")
+	}
+	digest, err := hex.DecodeString(parts[2])
+	if err != nil || len(digest) != sha256.Size {
+		return fmt.Errorf("password hash has an invalid SHA-256 digest")
+	}
+	return nil
+}
+
+// passwordMatches returns true if the given password matches the given (valid) password hash
+//
+func passwordMatches(hash string, password []byte) bool {
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+	}
+	parts := strings.Split(hash, ":")
+	expected, _ := hex.DecodeString(parts[2])
+	digest := sha256.Sum256(bytes.Join([][]byte{[]byte(parts[1]), password}, nil))
+	return subtle.ConstantTimeCompare(expected, digest[:]) == 1
+}
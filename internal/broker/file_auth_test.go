@@ -0,0 +1,135 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/testutils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testhelperAuthFile writes the given content to a file in a new temporary directory and returns the name of the
+// file, and a function removing the directory
+func testhelperAuthFile(content string, t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "auth")
+	testutils.CheckNotError(err, t)
+	fileName := filepath.Join(dir, "auth")
+	testutils.CheckNotError(ioutil.WriteFile(fileName, []byte(content), 0600), t)
+	return fileName, func() { os.RemoveAll(dir) }
+}
+
+func testhelperSha256(salt, password string) string {
+	digest := sha256.Sum256([]byte(salt + password))
+	return "sha256:" + salt + ":" + hex.EncodeToString(digest[:])
+}
+
+func testhelperPassword(password string) *[]byte {
+	result := []byte(password)
+	return &result
+}
+
+func Test_FileAuth_authenticates_users_with_bcrypt_and_sha256_passwords(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	testutils.CheckNotError(err, t)
+	fileName, remove := testhelperAuthFile(
+		"# users\nuser alice "+string(hash)+"\n\nuser bob "+testhelperSha256("pepper", "hunter2")+"\n", t)
+	defer remove()
+	auth, err := NewFileAuth(fileName)
+	testutils.CheckNotError(err, t)
+
+	testutils.CheckEqual(mqtt.ConnectionAccepted, auth.Authenticate("c", "alice", testhelperPassword("secret")), t)
+	testutils.CheckEqual(mqtt.ConnectionAccepted, auth.Authenticate("c", "bob", testhelperPassword("hunter2")), t)
+	testutils.CheckEqual(mqtt.ConnectionRefusedBadUserPassword, auth.Authenticate("c", "alice", testhelperPassword("hunter2")), t)
+	testutils.CheckEqual(mqtt.ConnectionRefusedBadUserPassword, auth.Authenticate("c", "bob", nil), t)
+	testutils.CheckEqual(mqtt.ConnectionRefusedBadUserPassword, auth.Authenticate("c", "eve", testhelperPassword("secret")), t)
+
+	// There is no anonymous section
+	testutils.CheckEqual(mqtt.ConnectionRefusedNotAuthorized, auth.Authenticate("c", "", nil), t)
+}
+
+func Test_FileAuth_authorizes_by_rules_with_substitutions(t *testing.T) {
+	fileName, remove := testhelperAuthFile(`
+all
+readwrite clients/%c/#
+
+anonymous
+subscribe public/#
+
+user alice sha256::`+hex.EncodeToString(make([]byte, 32))+`
+publish sensors/%u/+
+subscribe sensors/#
+`, t)
+	defer remove()
+	auth, err := NewFileAuth(fileName)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(mqtt.ConnectionAccepted, auth.Authenticate("c", "", nil), t)
+
+	testutils.CheckTrue(auth.CanPublish("c1", "alice", "sensors/alice/temperature"), t)
+	testutils.CheckFalse(auth.CanPublish("c1", "alice", "sensors/bob/temperature"), t)
+	testutils.CheckFalse(auth.CanPublish("c1", "alice", "sensors/alice/a/b"), t)
+	testutils.CheckTrue(auth.CanPublish("c1", "alice", "clients/c1/status"), t)
+	testutils.CheckTrue(auth.CanPublish("c2", "", "clients/c2/status"), t)
+	testutils.CheckFalse(auth.CanPublish("c2", "", "clients/c1/status"), t)
+	testutils.CheckFalse(auth.CanPublish("c2", "", "public/news"), t)
+
+	// A substitution containing a wildcard or level separator does not give access
+	testutils.CheckFalse(auth.CanPublish("#", "", "clients/#/status"), t)
+	testutils.CheckFalse(auth.CanPublish("a/b", "", "clients/a/b/status"), t)
+
+	// A client ID containing %u is not replaced with the user name
+	testutils.CheckFalse(auth.CanPublish("%u", "alice", "clients/alice/status"), t)
+	testutils.CheckTrue(auth.CanPublish("%u", "alice", "clients/%u/status"), t)
+
+	testutils.CheckTrue(auth.CanSubscribe("c1", "alice", "sensors/+/temperature"), t)
+	testutils.CheckTrue(auth.CanSubscribe("c1", "alice", "sensors/#"), t)
+	testutils.CheckFalse(auth.CanSubscribe("c1", "alice", "#"), t)
+	testutils.CheckFalse(auth.CanSubscribe("c1", "alice", "public/news"), t)
+	testutils.CheckTrue(auth.CanSubscribe("c2", "", "public/news"), t)
+	testutils.CheckTrue(auth.CanSubscribe("c2", "", "clients/c2/#"), t)
+	testutils.CheckFalse(auth.CanSubscribe("c2", "", "clients/+/status"), t)
+}
+
+func Test_FileAuth_reload_keeps_the_rules_if_the_file_is_not_valid(t *testing.T) {
+	fileName, remove := testhelperAuthFile("anonymous\nsubscribe a\n", t)
+	defer remove()
+	auth, err := NewFileAuth(fileName)
+	testutils.CheckNotError(err, t)
+	testutils.CheckTrue(auth.CanSubscribe("c", "", "a"), t)
+
+	testutils.CheckNotError(ioutil.WriteFile(fileName, []byte("anonymous\nsubscribe b\n"), 0600), t)
+	testutils.CheckNotError(auth.Reload(), t)
+	testutils.CheckFalse(auth.CanSubscribe("c", "", "a"), t)
+	testutils.CheckTrue(auth.CanSubscribe("c", "", "b"), t)
+
+	for _, content := range []string{
+		"subscribe b\n",
+		"anonymous\nsubscribe a/#/b\n",
+		"user alice\n",
+		"user alice sha256:salt:abc\n",
+		"user alice $2a$nonsense\n",
+		"anonymous\nlisten b\n",
+	} {
+		testutils.CheckNotError(ioutil.WriteFile(fileName, []byte(content), 0600), t)
+		testutils.CheckError(auth.Reload(), t)
+	}
+	testutils.CheckTrue(auth.CanSubscribe("c", "", "b"), t)
+}
+
+func Test_filterCovers(t *testing.T) {
+	testutils.CheckTrue(filterCovers("#", "a/b"), t)
+	testutils.CheckTrue(filterCovers("a/#", "a"), t)
+	testutils.CheckTrue(filterCovers("a/#", "a/+/c"), t)
+	testutils.CheckTrue(filterCovers("a/+", "a/+"), t)
+	testutils.CheckTrue(filterCovers("a/+", "a/b"), t)
+	testutils.CheckFalse(filterCovers("a/+", "a/#"), t)
+	testutils.CheckFalse(filterCovers("a/+", "a/b/c"), t)
+	testutils.CheckFalse(filterCovers("a/b", "a/+"), t)
+	testutils.CheckFalse(filterCovers("#", "$SYS/#"), t)
+	testutils.CheckFalse(filterCovers("+/b", "$SYS/b"), t)
+}
@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+)
+
+// RetainedMessage is a message retained by a broker for its topic
+//
+type RetainedMessage struct {
+	Topic   string
+	Message []byte
+	QoS     int
+}
+
+// RetainedStore keeps the last retained message for each topic. If the store has a file, every change is written to
+// the file and the messages in the file are loaded when the store is created - this way retained messages survive a
+// restart of the broker.
+//
+type RetainedStore struct {
+	mutex    sync.Mutex
+	messages map[string]RetainedMessage
+	fileName string
+}
+
+// NewRetainedStore returns a new RetainedStore persisted in the file with the given name, or a store kept only in
+// memory if the name is empty. An error is returned if an existing file cannot be read.
+//
+func NewRetainedStore(fileName string) (*RetainedStore, error) {
+	s := &RetainedStore{messages: make(map[string]RetainedMessage), fileName: fileName}
+	if fileName == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var messages []RetainedMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		s.messages[m.Topic] = m
+	}
+	return s, nil
+}
+
+// Retain stores the given message as the retained message for its topic. A message that is empty removes the
+// retained message for the topic.
+// An error is returned if the store could not be written to its file (the change is still made in memory).
+//
+func (s *RetainedStore) Retain(msg *mqtt.PublishRequest) error {
+	opts := msg.Options()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(opts.Message) == 0 {
+		if _, ok := s.messages[opts.Topic]; !ok {
+			return nil
+		}
+		delete(s.messages, opts.Topic)
+	} else {
+		s.messages[opts.Topic] = RetainedMessage{Topic: opts.Topic, Message: opts.Message, QoS: opts.QoS}
+	}
+	return s.save()
+}
+
+// Matching returns the retained messages with a topic matching the given topic filter, in topic order
+//
+func (s *RetainedStore) Matching(filter string) []RetainedMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := []RetainedMessage{}
+	for topic, m := range s.messages {
+		if mqtt.TopicMatches(filter, topic) {
+			result = append(result, m)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Topic < result[j].Topic })
+	return result
+}
+
+// save writes all messages to the file of the store (if any). The file is replaced by renaming a new file so that
+// it is never left half written. The caller must hold the mutex.
+//
+func (s *RetainedStore) save() error {
+	if s.fileName == "" {
+		return nil
+	}
+	messages := make([]RetainedMessage, 0, len(s.messages))
+	for _, m := range s.messages {
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Topic < messages[j].Topic })
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.fileName), filepath.Base(s.fileName)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.fileName)
+}
@@ -0,0 +1,205 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// session is the state the broker keeps for a client ID. The state of a session that does not expire with its
+// connection outlives the connection of the client - subscriptions are kept, and messages in flight to the client are resent when the
+// client connects again.
+//
+type session struct {
+	mutex         sync.Mutex
+	clientID      string
+	client        *client                      // the connected client (nil when not connected)
+	subscriptions map[string]int               // granted QoS by topic filter
+	inFlight      map[int]*mqtt.GenericMessage // PUBLISH or PUBREL to the client waiting for acknowledgement
+	order         []int                        // packet IDs of inFlight in the order they were sent
+	lastPacketID  int
+	receivedQoS2  map[int]bool // packet IDs of QoS 2 messages from the client waiting for PUBREL
+
+	// how long the state is kept after the connection has ended - 0 ends it with the connection, and a negative
+	// duration keeps it until the broker is closed (guarded by the mutex of the broker)
+	expiry      time.Duration
+	expiryTimer *time.Timer // drops the session when it expires (guarded by the mutex of the broker)
+}
+
+func newSession(clientID string) *session {
+	return &session{
+		clientID:      clientID,
+		subscriptions: make(map[string]int),
+		inFlight:      make(map[int]*mqtt.GenericMessage),
+		receivedQoS2:  make(map[int]bool),
+	}
+}
+
+// setClient sets the connected client of the session and returns the client it replaced (if any).
+// Messages in flight are resent (as duplicates) to the given client.
+//
+func (s *session) setClient(c *client) *client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := s.client
+	s.client = c
+	if c != nil {
+		for _, packetID := range s.order {
+			log.Debugf("Broker: resending packet ID %d to %s", packetID, s.clientID)
+			c.send(s.inFlight[packetID].Duplicate())
+		}
+	}
+	return previous
+}
+
+// release removes the given client from the session and returns true, or returns false if the given client is not
+// the client of the session.
+//
+func (s *session) release(c *client) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != c {
+		return false
+	}
+	s.client = nil
+	return true
+}
+
+// connected returns the connected client of the session, or nil if no client is connected
+func (s *session) connected() *client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.client
+}
+
+// subscribe adds (or replaces) a subscription for the given topic filter
+func (s *session) subscribe(filter string, qos int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscriptions[filter] = qos
+}
+
+// unsubscribe removes the subscription for the given topic filter and returns false if there was no such subscription
+func (s *session) unsubscribe(filter string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, existed := s.subscriptions[filter]
+	delete(s.subscriptions, filter)
+	return existed
+}
+
+// matches returns the highest QoS granted by a subscription matching the given topic, and false if no
+// subscription matches.
+//
+func (s *session) matches(topic string) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := -1
+	for filter, qos := range s.subscriptions {
+		if qos > result && mqtt.TopicMatches(filter, topic) {
+			result = qos
+		}
+	}
+	return result, result >= 0
+}
+
+// publish sends a message to the client of the session. A QoS 1 or 2 message is kept in flight until acknowledged,
+// while a QoS 0 message is dropped if the client is not connected.
+//
+func (s *session) publish(topic string, message []byte, qos int, retain bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	options := []mqtt.PublishOption{mqtt.Topic(topic), mqtt.Message(message), mqtt.QoS(qos), mqtt.Retain(retain)}
+	if qos > 0 {
+		packetID := s.nextPacketID()
+		if packetID == 0 {
+			log.Warnf("Broker: all packet IDs in flight to %s - dropping message for %s", s.clientID, topic)
+			return
+		}
+		options = append(options, mqtt.PacketID(packetID))
+		msg := mqtt.NewPublishRequest(options...).MakeMessage()
+		s.inFlight[packetID] = msg
+		s.order = append(s.order, packetID)
+		if s.client != nil {
+			s.client.send(msg)
+		}
+		return
+	}
+	if s.client != nil {
+		s.client.send(mqtt.NewPublishRequest(options...).MakeMessage())
+	}
+}
+
+// nextPacketID returns the next packet ID not in flight, or 0 if all are in flight.
+// The caller must hold the mutex.
+//
+func (s *session) nextPacketID() int {
+	for i := 0; i < 0xFFFF; i++ {
+		s.lastPacketID = s.lastPacketID%0xFFFF + 1
+		if s.inFlight[s.lastPacketID] == nil {
+			return s.lastPacketID
+		}
+	}
+	return 0
+}
+
+// acknowledged releases the message in flight with the given packet ID when the client has sent the given
+// acknowledgement (PUBACK for a QoS 1 PUBLISH, and PUBCOMP for a PUBREL). A PUBREC replaces a QoS 2 PUBLISH in flight
+// with a PUBREL which is returned. An error is returned if the acknowledgement does not match what is in flight.
+//
+func (s *session) acknowledged(ackType int, packetID int) (*mqtt.GenericMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	msg := s.inFlight[packetID]
+	expected := mqtt.PublishAckType
+	switch {
+	case msg == nil:
+		return nil, fmt.Errorf("%s(%d) for a packet ID that is not in flight", mqtt.PacketTypeName(ackType), packetID)
+	case msg.Type() == mqtt.PublishReleaseType:
+		expected = mqtt.PublishCompleteType
+	case msg.Flags()&mqtt.QoSTwo != 0:
+		expected = mqtt.PublishReceivedType
+	}
+	if ackType != expected {
+		return nil, fmt.Errorf("%s(%d) when waiting for %s", mqtt.PacketTypeName(ackType), packetID, mqtt.PacketTypeName(expected))
+	}
+
+	if ackType == mqtt.PublishReceivedType {
+		release := mqtt.NewAckMessage(mqtt.PublishReleaseType, packetID)
+		s.inFlight[packetID] = release
+		return release, nil
+	}
+	delete(s.inFlight, packetID)
+	for i, id := range s.order {
+		if id == packetID {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return nil, nil
+}
+
+// receivedQoS2Publish registers the packet ID of a QoS 2 PUBLISH from the client and returns true if it was not
+// already registered (i.e. the message should be routed, and not a resent duplicate).
+//
+func (s *session) receivedQoS2Publish(packetID int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.receivedQoS2[packetID] {
+		return false
+	}
+	s.receivedQoS2[packetID] = true
+	return true
+}
+
+// releasedQoS2Publish forgets the packet ID of a QoS 2 PUBLISH from the client when it sends PUBREL
+func (s *session) releasedQoS2Publish(packetID int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.receivedQoS2, packetID)
+}
@@ -0,0 +1,285 @@
+// Package conformance checks how a MQTT broker behaves in situations the MQTT 3.1.1 specification has rules for -
+// for example that unacknowledged messages are delivered again when a session is resumed, or that the will of a
+// client is published when its connection ends without a DISCONNECT.
+//
+// A Suite runs named scenarios against a broker. Each scenario connects the clients it needs, makes them do what
+// the situation requires, and checks what the broker does. The Report tells which scenarios passed, why the
+// others failed, and has the trace of the packets sent and received by the clients of each scenario.
+//
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Suite runs scenarios against a MQTT broker.
+//
+// Example:
+//     s := conformance.NewSuite(conformance.Dialer(dial))
+//     report, err := s.Run(ctx)                       // all scenarios
+//     report, err = s.Run(ctx, "retained-delivery")  // only the named scenarios
+//
+type Suite struct {
+	options SuiteOptions
+}
+
+// SuiteOptions contains options for a Suite
+//
+type SuiteOptions struct {
+	Dialer         func() (net.Conn, error) // gives a new connection to the broker for each connect of a client
+	ClientName     string                   // the client IDs are ClientName followed by "-<run ID>-<client>"
+	Topic          string                   // the topics of a scenario are below Topic/<run ID>
+	Timeout        time.Duration            // the time to wait for something the broker is expected to do
+	Quiet          time.Duration            // the time to wait to conclude that the broker does not do something
+	ConnectOptions []mqtt.ConnectOption
+}
+
+// SuiteOption is an Options-modifying-function
+type SuiteOption func(*SuiteOptions) error
+
+// DefaultSuiteOptions returns the default options for a Suite (client name "mezquit", topic "mezquit/conformance",
+// 5s timeout, and 500ms quiet time). A Dialer must be given.
+//
+func DefaultSuiteOptions() SuiteOptions {
+	return SuiteOptions{
+		ClientName: "mezquit",
+		Topic:      "mezquit/conformance",
+		Timeout:    5 * time.Second,
+		Quiet:      500 * time.Millisecond,
+	}
+}
+
+// Dialer returns a SuiteOption for the function giving a new connection to the broker
+func Dialer(dial func() (net.Conn, error)) SuiteOption {
+	return func(o *SuiteOptions) error {
+		o.Dialer = dial
+		return nil
+	}
+}
+
+// ClientName returns a SuiteOption for the name the client IDs are based on. The client IDs are at most 23
+// characters long (the length a broker must accept) if the name is at most 7 characters long.
+//
+func ClientName(name string) SuiteOption {
+	if name == "" {
+		panic("ClientName of a suite cannot be empty")
+	}
+	return func(o *SuiteOptions) error {
+		o.ClientName = name
+		return nil
+	}
+}
+
+// Topic returns a SuiteOption for the topic the topics of the scenarios are below
+func Topic(topic string) SuiteOption {
+	if err := mqtt.ValidateTopicName(topic); err != nil {
+		panic(err.Error())
+	}
+	return func(o *SuiteOptions) error {
+		o.Topic = topic
+		return nil
+	}
+}
+
+// Timeout returns a SuiteOption for the time to wait for something the broker is expected to do - for example
+// to deliver a message
+//
+func Timeout(d time.Duration) SuiteOption {
+	if d <= 0 {
+		panic("Timeout must be positive")
+	}
+	return func(o *SuiteOptions) error {
+		o.Timeout = d
+		return nil
+	}
+}
+
+// Quiet returns a SuiteOption for the time to wait to conclude that the broker does not do something - for
+// example that it does not deliver a message
+//
+func Quiet(d time.Duration) SuiteOption {
+	if d <= 0 {
+		panic("Quiet must be positive")
+	}
+	return func(o *SuiteOptions) error {
+		o.Quiet = d
+		return nil
+	}
+}
+
+// ConnectOptions returns a SuiteOption adding options for connecting each client - for example UserName and
+// Password
+//
+func ConnectOptions(options ...mqtt.ConnectOption) SuiteOption {
+	return func(o *SuiteOptions) error {
+		o.ConnectOptions = append(o.ConnectOptions, options...)
+		return nil
+	}
+}
+
+// NewSuite creates a Suite. Nothing is connected until Run() is called.
+//
+func NewSuite(options ...SuiteOption) *Suite {
+	opts := DefaultSuiteOptions()
+	for _, fOpt := range options {
+		if err := fOpt(&opts); err != nil {
+			log.Fatalf("Suite option apply failure: %s", err)
+		}
+	}
+	return &Suite{options: opts}
+}
+
+// Run runs the scenarios with the given names in the order of the catalogue (all scenarios if no name is given),
+// and returns the report. An error is returned (and nothing is run) if a name is not the name of a scenario.
+// Scenarios that have not been run when the given context is done are reported as failed.
+//
+func (s *Suite) Run(ctx context.Context, names ...string) (*Report, error) {
+	scenarios, err := selectScenarios(names)
+	if err != nil {
+		return nil, err
+	}
+	return s.RunScenarios(ctx, scenarios...), nil
+}
+
+// RunScenarios runs the given scenarios in the given order - for example scenarios read with ReadScript - and
+// returns the report. Scenarios that have not been run when the given context is done are reported as failed.
+//
+func (s *Suite) RunScenarios(ctx context.Context, scenarios ...Scenario) *Report {
+	if s.options.Dialer == nil {
+		panic("A Suite requires a Dialer")
+	}
+
+	// The run ID makes the client IDs and topics of this run differ from those of earlier runs
+	runID := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond)%(36*36*36*36*36*36), 36)
+	report := &Report{Started: time.Now()}
+	for i, scenario := range scenarios {
+		r := &run{
+			suite: s,
+			id:    fmt.Sprintf("%s%d", runID, i),
+			trace: &trace{start: time.Now()},
+		}
+		result := &Result{Scenario: scenario.Name, Description: scenario.Description}
+		if err := ctx.Err(); err != nil {
+			result.Failure = fmt.Sprintf("Not run: %s", err)
+		} else {
+			log.Debugf("Conformance: running %s", scenario.Name)
+			if err := scenario.run(ctx, r); err != nil {
+				result.Failure = err.Error()
+			}
+			r.close()
+		}
+		result.Passed = result.Failure == ""
+		result.Duration = time.Since(r.trace.start)
+		result.Trace = r.trace.entries()
+		report.Results = append(report.Results, result)
+	}
+	report.Duration = time.Since(report.Started)
+	return report
+}
+
+// selectScenarios returns the scenarios with the given names in the order of the catalogue
+func selectScenarios(names []string) ([]Scenario, error) {
+	if len(names) == 0 {
+		return Scenarios(), nil
+	}
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		if _, ok := scenarioByName(name); !ok {
+			return nil, fmt.Errorf("There is no scenario named '%s'", name)
+		}
+		wanted[name] = true
+	}
+	var result []Scenario
+	for _, scenario := range catalogue {
+		if wanted[scenario.Name] {
+			result = append(result, scenario)
+		}
+	}
+	return result, nil
+}
+
+// run is the state of one scenario being run - its clients and its trace
+//
+type run struct {
+	suite *Suite
+	id    string // unique for each scenario of each run
+	trace *trace
+	peers []*peer
+}
+
+// within returns a context that is done when the timeout of the suite has passed
+func (r *run) within(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, r.suite.options.Timeout)
+}
+
+// topic returns the topic with the given name for the scenario
+func (r *run) topic(name string) string {
+	return r.suite.options.Topic + "/" + r.id + "/" + name
+}
+
+// payload returns a payload for a message of the scenario
+func (r *run) payload(text string) []byte {
+	return []byte("mezquit-conformance " + r.id + " " + text)
+}
+
+// peer returns a new client of the scenario with the given name (used in its client ID and in the trace)
+func (r *run) peer(name string) *peer {
+	return r.peerWithID(name, r.suite.options.ClientName+"-"+r.id+"-"+name)
+}
+
+// peerWithID returns a new client of the scenario with the given name and client ID
+func (r *run) peerWithID(name, clientID string) *peer {
+	p := newPeer(r, name, clientID)
+	r.peers = append(r.peers, p)
+	return p
+}
+
+// close disconnects the clients of the scenario, and discards the state of their sessions that are not clean
+func (r *run) close() {
+	ctx, cancel := r.within(context.Background())
+	defer cancel()
+	for _, p := range r.peers {
+		p.discard(ctx)
+	}
+}
+
+// trace records what the clients of a scenario do. It is safe to use from several goroutines.
+//
+type trace struct {
+	mutex   sync.Mutex
+	start   time.Time
+	records []TraceEntry
+}
+
+func (t *trace) add(client, format string, args ...interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.records = append(t.records, TraceEntry{At: time.Since(t.start), Client: client, Text: fmt.Sprintf(format, args...)})
+}
+
+func (t *trace) entries() []TraceEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]TraceEntry{}, t.records...)
+}
+
+// TraceEntry is a packet sent or received by a client of a scenario, or something else that happened to it
+//
+type TraceEntry struct {
+	At     time.Duration // from the start of the scenario
+	Client string
+	Text   string // "-> packet" for a sent packet, "<- packet" for a received packet
+}
+
+// String returns the entry as one line, for example "  0.012s  sub    -> SUBSCRIBE(id=1, a/b qos=1)"
+func (e TraceEntry) String() string {
+	return fmt.Sprintf("%7.3fs  %-6s %s", e.At.Seconds(), e.Client, e.Text)
+}
@@ -0,0 +1,147 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/broker"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+// testhelperDialer returns a Dialer for connections to the given broker. The mangle function (if any) is given
+// each packet the broker sends, and returns the packet to give to the client instead.
+//
+func testhelperDialer(b *broker.Broker, mangle func(packet *mqtt.GenericMessage) *mqtt.GenericMessage) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		conn := mqtt.NewMockConnection()
+		go b.ServeConn(conn.RemoteConn())
+		if mangle == nil {
+			return conn, nil
+		}
+		client, proxy := net.Pipe()
+		go func() {
+			defer conn.Close()
+			for {
+				packet, err := mqtt.ReadMessage(proxy)
+				if err != nil {
+					return
+				}
+				if _, err := packet.WriteTo(conn); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer proxy.Close()
+			for {
+				packet, err := mqtt.ReadMessage(conn)
+				if err != nil {
+					return
+				}
+				if _, err := mangle(packet).WriteTo(proxy); err != nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	}
+}
+
+func testhelperRun(s *Suite, t *testing.T, names ...string) *Report {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	report, err := s.Run(ctx, names...)
+	testutils.CheckNotError(err, t)
+	return report
+}
+
+func Test_Suite_passes_all_scenarios_against_the_broker(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	s := NewSuite(Dialer(testhelperDialer(b, nil)), Timeout(2*time.Second), Quiet(100*time.Millisecond))
+
+	report := testhelperRun(s, t)
+	testutils.CheckEqual(len(Scenarios()), len(report.Results), t)
+	for _, result := range report.Results {
+		if !result.Passed {
+			var text bytes.Buffer
+			report.WriteText(&text, false)
+			t.Fatalf("Expected all scenarios to pass, got:\n%s", text.String())
+		}
+		testutils.CheckTrue(len(result.Trace) > 0, t)
+	}
+	testutils.CheckTrue(report.Passed(), t)
+}
+
+func Test_Suite_reports_a_failed_scenario_with_its_trace(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	withoutRetain := func(packet *mqtt.GenericMessage) *mqtt.GenericMessage {
+		pr, err := mqtt.DecodePublish(packet)
+		if packet.Type() != mqtt.PublishType || err != nil {
+			return packet
+		}
+		o := pr.Options()
+		return mqtt.NewPublishRequest(mqtt.Topic(o.Topic), mqtt.Message(o.Message), mqtt.QoS(o.QoS),
+			mqtt.PacketID(o.PacketID), mqtt.IsDuplicate(o.IsDuplicate), mqtt.Retain(false)).MakeMessage()
+	}
+	s := NewSuite(Dialer(testhelperDialer(b, withoutRetain)), Timeout(2*time.Second), Quiet(100*time.Millisecond))
+
+	report := testhelperRun(s, t, "wildcard-matching", "retained-delivery")
+	testutils.CheckEqual(2, len(report.Results), t)
+	testutils.CheckEqual("retained-delivery", report.Results[0].Scenario, t)
+	testutils.CheckFalse(report.Passed(), t)
+	testutils.CheckEqual(1, report.Failures(), t)
+	failed := report.Results[0]
+	testutils.CheckFalse(failed.Passed, t)
+	testutils.CheckEqual("A retained message delivered to a new subscription must have RETAIN set", failed.Failure, t)
+	testutils.CheckTrue(report.Results[1].Passed, t)
+
+	var text bytes.Buffer
+	testutils.CheckNotError(report.WriteText(&text, false), t)
+	lines := strings.Split(text.String(), "\n")
+	testutils.CheckTrue(strings.HasPrefix(lines[0], "FAIL  retained-delivery  "), t)
+	testutils.CheckEqual("      A retained message delivered to a new subscription must have RETAIN set", lines[1], t)
+	testutils.CheckTrue(strings.Contains(text.String(), "late   <- PUBLISH(id=1, qos=1, topic="), t)
+	testutils.CheckTrue(strings.Contains(text.String(), "PASS  wildcard-matching   "), t)
+	testutils.CheckTrue(strings.HasSuffix(text.String(), "1 passed  1 failed  "+report.Duration.Round(time.Millisecond).String()+"\n"), t)
+
+	var junit bytes.Buffer
+	testutils.CheckNotError(report.WriteJUnit(&junit, "broker"), t)
+	var parsed junitSuites
+	testutils.CheckNotError(xml.Unmarshal(junit.Bytes(), &parsed), t)
+	suite := parsed.Suites[0]
+	testutils.CheckEqual("broker", suite.Name, t)
+	testutils.CheckEqual(2, suite.Tests, t)
+	testutils.CheckEqual(1, suite.Failures, t)
+	testutils.CheckEqual(failed.Failure, suite.Cases[0].Failure.Message, t)
+	testutils.CheckTrue(strings.Contains(suite.Cases[0].Failure.Trace, "-> CONNECT(client=mezquit-"), t)
+	testutils.CheckTrue(suite.Cases[1].Failure == nil, t)
+}
+
+func Test_Suite_does_not_run_unknown_scenarios(t *testing.T) {
+	s := NewSuite(Dialer(func() (net.Conn, error) {
+		t.Fatalf("Nothing should be dialed")
+		return nil, nil
+	}))
+	_, err := s.Run(context.Background(), "retained-delivery", "no-such-scenario")
+	testutils.CheckError(err, t)
+}
+
+func Test_Suite_reports_scenarios_not_run_when_the_context_is_done(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	s := NewSuite(Dialer(testhelperDialer(b, nil)))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := s.Run(ctx, "session-resume")
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual("Not run: context canceled", report.Results[0].Failure, t)
+}
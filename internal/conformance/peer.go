@@ -0,0 +1,343 @@
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// peer is a client taking part in a scenario. It is a Session that connects with a new connection from the
+// Dialer each time, and records the packets it sends and receives in the trace of the scenario. It can be made
+// to close its connection when a packet of a given type arrives - before the packet is processed (and
+// acknowledged), and to ignore a number of packets of a given type.
+//
+type peer struct {
+	mqtt.NopObserver
+	run      *run
+	name     string
+	id       string
+	session  *mqtt.Session
+	received chan *mqtt.GenericMessage // the packets received from the broker
+
+	mutex          sync.Mutex
+	conn           net.Conn
+	dropOn         int         // the type of packet that makes the peer close its connection (0 for none)
+	ignoring       map[int]int // packet type -> the number of packets of the type to ignore
+	sessionPresent bool        // the Session Present flag of the last CONNACK
+	persistent     bool        // if the last connect was not a clean session
+}
+
+func newPeer(r *run, name, clientID string) *peer {
+	return &peer{
+		run:      r,
+		name:     name,
+		id:       clientID,
+		received: make(chan *mqtt.GenericMessage, 1000),
+		ignoring: make(map[int]int),
+	}
+}
+
+// connect connects the peer with a new connection, with a clean session or not.
+//
+func (p *peer) connect(ctx context.Context, clean bool, options ...mqtt.ConnectOption) error {
+	conn, err := p.run.suite.options.Dialer()
+	if err != nil {
+		return fmt.Errorf("%s could not connect: %s", p.name, err)
+	}
+	p.mutex.Lock()
+	p.conn = conn
+	p.persistent = !clean
+	p.mutex.Unlock()
+	if p.session == nil {
+		p.session = mqtt.NewSession(mqtt.ClientID(p.id), mqtt.Connection(conn), mqtt.Observe(p),
+			mqtt.IgnoreReceived(p.ignored))
+	} else {
+		p.session.ReEstablish(mqtt.Connection(conn))
+	}
+
+	opts := append([]mqtt.ConnectOption{}, p.run.suite.options.ConnectOptions...)
+	opts = append(opts, options...)
+	opts = append(opts, mqtt.CleanSession(clean))
+	ctx, cancel := p.run.within(ctx)
+	defer cancel()
+	if err := p.session.ConnectContext(ctx, opts...); err != nil {
+		conn.Close()
+		return fmt.Errorf("%s could not connect: %s", p.name, err)
+	}
+	return nil
+}
+
+// connected returns true if the connection of the peer has not ended
+func (p *peer) connected() bool {
+	if p.session == nil {
+		return false
+	}
+	select {
+	case <-p.session.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// hasSessionPresent returns the Session Present flag of the last CONNACK
+func (p *peer) hasSessionPresent() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.sessionPresent
+}
+
+// dropOnNext makes the peer close its connection when the next packet of the given type arrives
+func (p *peer) dropOnNext(packetType int) {
+	p.mutex.Lock()
+	p.dropOn = packetType
+	p.mutex.Unlock()
+}
+
+// ignoreNext makes the peer ignore the given number of packets of the given type - they are not processed (and
+// not acknowledged)
+//
+func (p *peer) ignoreNext(packetType, count int) {
+	p.mutex.Lock()
+	p.ignoring[packetType] += count
+	p.mutex.Unlock()
+}
+
+// ignored returns true if the given packet should be ignored
+func (p *peer) ignored(packet *mqtt.GenericMessage) bool {
+	p.mutex.Lock()
+	ignore := p.ignoring[packet.Type()] > 0
+	if ignore {
+		p.ignoring[packet.Type()]--
+	}
+	p.mutex.Unlock()
+	if ignore {
+		p.run.trace.add(p.name, "ignored %s", mqtt.PacketTypeName(packet.Type()))
+	}
+	return ignore
+}
+
+// subscribe subscribes to the given topic filters with the given QoS, and returns an error if the broker
+// refuses a subscription
+//
+func (p *peer) subscribe(ctx context.Context, qos int, filters ...string) error {
+	var options []mqtt.SubscribeOption
+	for _, filter := range filters {
+		options = append(options, mqtt.TopicFilter(filter, qos))
+	}
+	ctx, cancel := p.run.within(ctx)
+	defer cancel()
+	returnCodes, err := p.session.SubscribeContext(ctx, options...)
+	if err != nil {
+		return fmt.Errorf("%s could not subscribe: %s", p.name, err)
+	}
+	for i, rc := range returnCodes {
+		if rc == mqtt.SubAckFailure {
+			return fmt.Errorf("The broker refused the subscription of %s to %s", p.name, filters[i])
+		}
+	}
+	return nil
+}
+
+// publish publishes a message and waits until the broker has acknowledged it
+func (p *peer) publish(ctx context.Context, topic string, qos int, retain bool, payload []byte) error {
+	ctx, cancel := p.run.within(ctx)
+	defer cancel()
+	err := p.session.PublishContext(ctx, mqtt.Topic(topic), mqtt.Message(payload), mqtt.QoS(qos), mqtt.Retain(retain))
+	if err != nil {
+		return fmt.Errorf("%s could not publish to %s: %s", p.name, topic, err)
+	}
+	return nil
+}
+
+// send publishes a message without waiting for it to be acknowledged
+func (p *peer) send(topic string, qos int, retain bool, payload []byte) error {
+	err := p.session.Publish(mqtt.Topic(topic), mqtt.Message(payload), mqtt.QoS(qos), mqtt.Retain(retain))
+	if err != nil {
+		return fmt.Errorf("%s could not publish to %s: %s", p.name, topic, err)
+	}
+	return nil
+}
+
+// expect returns the next received packet that the given function accepts. Other packets are skipped. An error
+// saying that the peer did not receive what is described by the given text is returned if no such packet arrives
+// before the timeout of the suite.
+//
+func (p *peer) expect(ctx context.Context, what string, accept func(packet *mqtt.GenericMessage) bool) (*mqtt.GenericMessage, error) {
+	return p.expectWithin(ctx, p.run.suite.options.Timeout, what, accept)
+}
+
+// expectWithin is like expect but waits for the given time instead of the timeout of the suite
+func (p *peer) expectWithin(ctx context.Context, within time.Duration, what string, accept func(packet *mqtt.GenericMessage) bool) (*mqtt.GenericMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, within)
+	defer cancel()
+	for {
+		select {
+		case packet := <-p.received:
+			if accept(packet) {
+				return packet, nil
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s did not receive %s within %s", p.name, what, within)
+		}
+	}
+}
+
+// expectPublish returns the next received PUBLISH to the given topic (any topic if empty)
+func (p *peer) expectPublish(ctx context.Context, topic string) (*mqtt.PublishRequest, error) {
+	what := "a message"
+	if topic != "" {
+		what = "a message on " + topic
+	}
+	packet, err := p.expect(ctx, what, func(packet *mqtt.GenericMessage) bool {
+		return packet.Type() == mqtt.PublishType && (topic == "" || publishTopic(packet) == topic)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mqtt.DecodePublish(packet)
+}
+
+// expectNone returns an error if a packet that the given function accepts arrives within the given time. Other
+// packets are skipped.
+//
+func (p *peer) expectNone(ctx context.Context, within time.Duration, accept func(packet *mqtt.GenericMessage) bool) error {
+	timer := time.NewTimer(within)
+	defer timer.Stop()
+	for {
+		select {
+		case packet := <-p.received:
+			if accept(packet) {
+				return fmt.Errorf("%s received an unexpected %s", p.name, packet)
+			}
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// expectNoPublish returns an error if a PUBLISH to the given topic (any topic if empty) arrives before the quiet
+// time of the suite has passed
+//
+func (p *peer) expectNoPublish(ctx context.Context, topic string) error {
+	return p.expectNone(ctx, p.run.suite.options.Quiet, func(packet *mqtt.GenericMessage) bool {
+		return packet.Type() == mqtt.PublishType && (topic == "" || publishTopic(packet) == topic)
+	})
+}
+
+// publishTopic returns the topic of the given PUBLISH (empty if it cannot be decoded)
+func publishTopic(packet *mqtt.GenericMessage) string {
+	pr, err := mqtt.DecodePublish(packet)
+	if err != nil {
+		return ""
+	}
+	return pr.Options().Topic
+}
+
+// expectLost waits until the connection of the peer has ended and returns an error with the given text if it has
+// not ended within the given time
+//
+func (p *peer) expectLost(ctx context.Context, within time.Duration, failure string) error {
+	ctx, cancel := context.WithTimeout(ctx, within)
+	defer cancel()
+	select {
+	case <-p.session.Done():
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s", failure)
+	}
+}
+
+// close closes the connection of the peer without a DISCONNECT
+func (p *peer) close() {
+	p.mutex.Lock()
+	conn := p.conn
+	p.mutex.Unlock()
+	p.run.trace.add(p.name, "closes its connection without DISCONNECT")
+	conn.Close()
+}
+
+// disconnect disconnects the peer with a DISCONNECT. Packets still in flight (for example because their
+// acknowledgements were ignored) are not regarded as an error - they remain in flight in the session.
+//
+func (p *peer) disconnect() error {
+	err := p.session.Disconnect(1)
+	p.mutex.Lock()
+	p.conn.Close()
+	p.mutex.Unlock()
+	if unacknowledged, ok := err.(*mqtt.UnacknowledgedError); ok {
+		p.run.trace.add(p.name, "disconnected with packets in flight: %v", unacknowledged.PacketIDs)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s did not disconnect cleanly: %s", p.name, err)
+	}
+	return nil
+}
+
+// discard disconnects the peer if it is connected, and makes the broker discard the state of its session if
+// it is not clean - by connecting with a clean session
+//
+func (p *peer) discard(ctx context.Context) {
+	if p.connected() {
+		p.disconnect()
+	}
+	p.mutex.Lock()
+	persistent := p.persistent
+	p.mutex.Unlock()
+	if !persistent {
+		return
+	}
+	if err := p.connect(ctx, true); err != nil {
+		log.Debugf("Conformance: cannot discard the session of %s: %s", p.id, err)
+		return
+	}
+	p.disconnect()
+}
+
+// OnConnected records the Session Present flag
+func (p *peer) OnConnected(sessionPresent bool) {
+	p.mutex.Lock()
+	p.sessionPresent = sessionPresent
+	p.mutex.Unlock()
+}
+
+// OnConnectionLost adds the error ending the connection to the trace
+func (p *peer) OnConnectionLost(err error) {
+	p.run.trace.add(p.name, "connection lost: %s", err)
+}
+
+// OnPacketSent adds the packet to the trace
+func (p *peer) OnPacketSent(packet *mqtt.GenericMessage) {
+	p.run.trace.add(p.name, "-> %s", packet)
+}
+
+// OnPacketReceived adds the packet to the trace and to the received packets, and closes the connection if it is
+// of the type to drop on
+//
+func (p *peer) OnPacketReceived(packet *mqtt.GenericMessage) {
+	p.run.trace.add(p.name, "<- %s", packet)
+	select {
+	case p.received <- packet:
+	default:
+		log.Debugf("Conformance: %s has too many unhandled packets - dropping %s", p.name, packet)
+	}
+
+	p.mutex.Lock()
+	drop := p.dropOn != 0 && packet.Type() == p.dropOn
+	if drop {
+		p.dropOn = 0
+		p.conn.Close()
+	}
+	p.mutex.Unlock()
+	if drop {
+		p.run.trace.add(p.name, "closed its connection before processing %s", mqtt.PacketTypeName(packet.Type()))
+	}
+}
@@ -0,0 +1,157 @@
+package conformance
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Report is the outcome of running scenarios
+//
+type Report struct {
+	Started  time.Time
+	Duration time.Duration
+	Results  []*Result // in the order the scenarios were run
+}
+
+// Result is the outcome of one scenario. The trace is kept also when the scenario passed.
+//
+type Result struct {
+	Scenario    string
+	Description string
+	Passed      bool
+	Failure     string // why the scenario failed (empty if it passed)
+	Duration    time.Duration
+	Trace       []TraceEntry
+}
+
+// Passed returns true if all scenarios passed
+func (r *Report) Passed() bool {
+	return r.Failures() == 0
+}
+
+// Failures returns the number of scenarios that failed
+func (r *Report) Failures() int {
+	failures := 0
+	for _, result := range r.Results {
+		if !result.Passed {
+			failures++
+		}
+	}
+	return failures
+}
+
+// WriteText writes one line per scenario telling if it passed, followed by why it failed and its trace for a
+// failed scenario, and a summary at the end. The traces of the scenarios that passed are written if allTraces
+// is true.
+//
+func (r *Report) WriteText(w io.Writer, allTraces bool) error {
+	width := 0
+	for _, result := range r.Results {
+		if len(result.Scenario) > width {
+			width = len(result.Scenario)
+		}
+	}
+	var b strings.Builder
+	for _, result := range r.Results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "%s  %-*s  %6.2fs  %s\n", status, width, result.Scenario, result.Duration.Seconds(), result.Description)
+		if !result.Passed {
+			fmt.Fprintf(&b, "      %s\n", result.Failure)
+		}
+		if (!result.Passed || allTraces) && len(result.Trace) > 0 {
+			b.WriteString(traceText(result, "      "))
+			b.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&b, "\n%d passed  %d failed  %s\n", len(r.Results)-r.Failures(), r.Failures(),
+		r.Duration.Round(time.Millisecond))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// traceText returns the trace of the given result as lines starting with the given indent
+func traceText(result *Result, indent string) string {
+	var b strings.Builder
+	for _, e := range result.Trace {
+		b.WriteString(indent)
+		b.WriteString(e.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// junitSuites and the types below are the JUnit XML format understood by CI servers
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut *junitOutput  `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Trace   string `xml:",cdata"`
+}
+
+type junitOutput struct {
+	Text string `xml:",cdata"`
+}
+
+// WriteJUnit writes the report in JUnit XML format as a test suite with the given name. A scenario is a test case
+// - a failed one has the reason as the message of its failure and the trace as its text. The trace of a scenario
+// that passed is written as its system-out.
+//
+func (r *Report) WriteJUnit(w io.Writer, name string) error {
+	suite := junitSuite{
+		Name:      name,
+		Tests:     len(r.Results),
+		Failures:  r.Failures(),
+		Time:      junitSeconds(r.Duration),
+		Timestamp: r.Started.Format("2006-01-02T15:04:05"),
+	}
+	for _, result := range r.Results {
+		c := junitCase{Name: result.Scenario, ClassName: "conformance", Time: junitSeconds(result.Duration)}
+		if result.Passed {
+			c.SystemOut = &junitOutput{Text: traceText(result, "")}
+		} else {
+			c.Failure = &junitFailure{Message: result.Failure, Trace: traceText(result, "")}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitSuites{Suites: []junitSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,493 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+)
+
+// Scenario is a named situation, and the checks of what the broker does in it
+//
+type Scenario struct {
+	Name        string
+	Description string
+	run         func(ctx context.Context, r *run) error
+}
+
+// catalogue has all scenarios in the order they are run
+var catalogue = []Scenario{
+	{
+		Name:        "qos1-redelivery",
+		Description: "an unacknowledged QoS 1 message is delivered again, with DUP set, when the session is resumed",
+		run:         qos1Redelivery,
+	},
+	{
+		Name:        "qos2-redelivery",
+		Description: "an unacknowledged QoS 2 PUBLISH, and then an unacknowledged PUBREL, is sent again when the session is resumed",
+		run:         qos2Redelivery,
+	},
+	{
+		Name:        "will-on-unclean-close",
+		Description: "the will is published when a connection ends without DISCONNECT, and not after a DISCONNECT",
+		run:         willOnUncleanClose,
+	},
+	{
+		Name:        "retained-delivery",
+		Description: "a retained message is delivered with RETAIN set to new subscriptions, and an empty one clears it",
+		run:         retainedDelivery,
+	},
+	{
+		Name:        "session-resume",
+		Description: "a session that is not clean keeps its subscriptions and queues QoS 1 messages while disconnected",
+		run:         sessionResume,
+	},
+	{
+		Name:        "wildcard-matching",
+		Description: "the + and # wildcards of topic filters match the topics they should, and only those",
+		run:         wildcardMatching,
+	},
+	{
+		Name:        "client-id-takeover",
+		Description: "the connection of a client is closed when another client connects with the same client ID",
+		run:         clientIDTakeover,
+	},
+	{
+		Name:        "keep-alive-expiry",
+		Description: "a client silent for 1.5 times its keep alive is disconnected, and its will is published",
+		run:         keepAliveExpiry,
+	},
+}
+
+// Scenarios returns all scenarios in the order they are run
+//
+func Scenarios() []Scenario {
+	return append([]Scenario{}, catalogue...)
+}
+
+// scenarioByName returns the scenario with the given name
+func scenarioByName(name string) (Scenario, bool) {
+	for _, scenario := range catalogue {
+		if scenario.Name == name {
+			return scenario, true
+		}
+	}
+	return Scenario{}, false
+}
+
+// checkMessage returns an error if the given message does not have the given payload
+func checkMessage(msg *mqtt.PublishRequest, payload []byte) error {
+	if got := msg.Options().Message; !bytes.Equal(got, payload) {
+		return fmt.Errorf("Expected the message '%s' on %s, got '%s'", payload, msg.Options().Topic, got)
+	}
+	return nil
+}
+
+func qos1Redelivery(ctx context.Context, r *run) error {
+	topic := r.topic("qos1")
+	payload := r.payload("qos1")
+	sub := r.peer("sub")
+	if err := sub.connect(ctx, false); err != nil {
+		return err
+	}
+	if err := sub.subscribe(ctx, 1, topic); err != nil {
+		return err
+	}
+	pub := r.peer("pub")
+	if err := pub.connect(ctx, true); err != nil {
+		return err
+	}
+
+	// The subscriber closes its connection instead of sending PUBACK
+	sub.dropOnNext(mqtt.PublishType)
+	if err := pub.publish(ctx, topic, 1, false, payload); err != nil {
+		return err
+	}
+	first, err := sub.expectPublish(ctx, topic)
+	if err != nil {
+		return err
+	}
+	if err := sub.expectLost(ctx, r.suite.options.Timeout, "sub did not close its connection"); err != nil {
+		return err
+	}
+
+	if err := sub.connect(ctx, false); err != nil {
+		return err
+	}
+	again, err := sub.expectPublish(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("The unacknowledged message was not delivered again: %s", err)
+	}
+	if err := checkMessage(again, payload); err != nil {
+		return err
+	}
+	if !again.Options().IsDuplicate {
+		return fmt.Errorf("The message delivered again does not have DUP set")
+	}
+	if again.Options().PacketID != first.Options().PacketID {
+		return fmt.Errorf("The message delivered again has packet ID %d - expected the original %d",
+			again.Options().PacketID, first.Options().PacketID)
+	}
+	return nil
+}
+
+func qos2Redelivery(ctx context.Context, r *run) error {
+	topic := r.topic("qos2")
+	payload := r.payload("qos2")
+	sub := r.peer("sub")
+	if err := sub.connect(ctx, false); err != nil {
+		return err
+	}
+	if err := sub.subscribe(ctx, 2, topic); err != nil {
+		return err
+	}
+	pub := r.peer("pub")
+	if err := pub.connect(ctx, true); err != nil {
+		return err
+	}
+
+	// The subscriber closes its connection instead of sending PUBREC
+	sub.dropOnNext(mqtt.PublishType)
+	if err := pub.publish(ctx, topic, 2, false, payload); err != nil {
+		return err
+	}
+	first, err := sub.expectPublish(ctx, topic)
+	if err != nil {
+		return err
+	}
+	packetID := first.Options().PacketID
+	if err := sub.expectLost(ctx, r.suite.options.Timeout, "sub did not close its connection"); err != nil {
+		return err
+	}
+
+	// The PUBLISH is sent again - the subscriber sends PUBREC, and closes its connection instead of sending PUBCOMP
+	sub.dropOnNext(mqtt.PublishReleaseType)
+	if err := sub.connect(ctx, false); err != nil {
+		return err
+	}
+	again, err := sub.expectPublish(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("The PUBLISH without PUBREC was not sent again: %s", err)
+	}
+	if err := checkMessage(again, payload); err != nil {
+		return err
+	}
+	if !again.Options().IsDuplicate || again.Options().PacketID != packetID {
+		return fmt.Errorf("The PUBLISH sent again must have DUP set and the packet ID %d", packetID)
+	}
+	isRelease := func(packet *mqtt.GenericMessage) bool {
+		id, err := mqtt.AckPacketID(packet, mqtt.PublishReleaseType)
+		return err == nil && id == packetID
+	}
+	if _, err := sub.expect(ctx, fmt.Sprintf("PUBREL(%d)", packetID), isRelease); err != nil {
+		return err
+	}
+	if err := sub.expectLost(ctx, r.suite.options.Timeout, "sub did not close its connection"); err != nil {
+		return err
+	}
+
+	// The PUBREL is sent again, and the PUBLISH is not
+	if err := sub.connect(ctx, false); err != nil {
+		return err
+	}
+	what := fmt.Sprintf("PUBREL(%d)", packetID)
+	packet, err := sub.expect(ctx, what, func(packet *mqtt.GenericMessage) bool {
+		return isRelease(packet) || packet.Type() == mqtt.PublishType
+	})
+	if err != nil {
+		return fmt.Errorf("The PUBREL without PUBCOMP was not sent again: %s", err)
+	}
+	if packet.Type() == mqtt.PublishType {
+		return fmt.Errorf("The PUBLISH was sent again after it had been acknowledged with PUBREC - expected %s", what)
+	}
+	return nil
+}
+
+func willOnUncleanClose(ctx context.Context, r *run) error {
+	topic := r.topic("will")
+	watcher := r.peer("sub")
+	if err := watcher.connect(ctx, true); err != nil {
+		return err
+	}
+	if err := watcher.subscribe(ctx, 1, topic); err != nil {
+		return err
+	}
+
+	unclean := r.peer("will")
+	payload := r.payload("will of an unclean close")
+	if err := unclean.connect(ctx, true, mqtt.WillTopic(topic), mqtt.WillMessage(payload), mqtt.WillQoS(1)); err != nil {
+		return err
+	}
+	unclean.close()
+	msg, err := watcher.expectPublish(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("The will was not published: %s", err)
+	}
+	if err := checkMessage(msg, payload); err != nil {
+		return err
+	}
+
+	clean := r.peer("bye")
+	payload = r.payload("will of a DISCONNECT")
+	if err := clean.connect(ctx, true, mqtt.WillTopic(topic), mqtt.WillMessage(payload), mqtt.WillQoS(1)); err != nil {
+		return err
+	}
+	if err := clean.disconnect(); err != nil {
+		return err
+	}
+	if err := watcher.expectNoPublish(ctx, topic); err != nil {
+		return fmt.Errorf("The will was published after a DISCONNECT: %s", err)
+	}
+	return nil
+}
+
+func retainedDelivery(ctx context.Context, r *run) error {
+	topic := r.topic("retained")
+	payload := r.payload("retained")
+	live := r.peer("live")
+	if err := live.connect(ctx, true); err != nil {
+		return err
+	}
+	if err := live.subscribe(ctx, 1, topic); err != nil {
+		return err
+	}
+	pub := r.peer("pub")
+	if err := pub.connect(ctx, true); err != nil {
+		return err
+	}
+	if err := pub.publish(ctx, topic, 1, true, payload); err != nil {
+		return err
+	}
+	defer func() {
+		// Leave no retained message behind, even if the scenario fails
+		if pub.connected() {
+			pub.publish(ctx, topic, 1, true, []byte{})
+		}
+	}()
+
+	msg, err := live.expectPublish(ctx, topic)
+	if err != nil {
+		return err
+	}
+	if err := checkMessage(msg, payload); err != nil {
+		return err
+	}
+	if msg.Options().Retain {
+		return fmt.Errorf("A message delivered to an existing subscription must not have RETAIN set")
+	}
+
+	late := r.peer("late")
+	if err := late.connect(ctx, true); err != nil {
+		return err
+	}
+	if err := late.subscribe(ctx, 1, topic); err != nil {
+		return err
+	}
+	msg, err = late.expectPublish(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("The retained message was not delivered to a new subscription: %s", err)
+	}
+	if err := checkMessage(msg, payload); err != nil {
+		return err
+	}
+	if !msg.Options().Retain {
+		return fmt.Errorf("A retained message delivered to a new subscription must have RETAIN set")
+	}
+
+	// An empty retained message clears the retained message
+	if err := pub.publish(ctx, topic, 1, true, []byte{}); err != nil {
+		return err
+	}
+	if _, err := live.expectPublish(ctx, topic); err != nil {
+		return err
+	}
+	after := r.peer("after")
+	if err := after.connect(ctx, true); err != nil {
+		return err
+	}
+	if err := after.subscribe(ctx, 1, topic); err != nil {
+		return err
+	}
+	if err := after.expectNoPublish(ctx, topic); err != nil {
+		return fmt.Errorf("The retained message was not cleared by an empty retained message: %s", err)
+	}
+	return nil
+}
+
+func sessionResume(ctx context.Context, r *run) error {
+	topic := r.topic("resume")
+	payload := r.payload("queued")
+	sub := r.peer("sub")
+	if err := sub.connect(ctx, false); err != nil {
+		return err
+	}
+	if sub.hasSessionPresent() {
+		return fmt.Errorf("The CONNACK of a new session has Session Present set")
+	}
+	if err := sub.subscribe(ctx, 1, topic); err != nil {
+		return err
+	}
+	if err := sub.disconnect(); err != nil {
+		return err
+	}
+
+	pub := r.peer("pub")
+	if err := pub.connect(ctx, true); err != nil {
+		return err
+	}
+	if err := pub.publish(ctx, topic, 1, false, payload); err != nil {
+		return err
+	}
+
+	if err := sub.connect(ctx, false); err != nil {
+		return err
+	}
+	if !sub.hasSessionPresent() {
+		return fmt.Errorf("The CONNACK of a resumed session does not have Session Present set")
+	}
+	msg, err := sub.expectPublish(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("The message published while disconnected was not delivered: %s", err)
+	}
+	if err := checkMessage(msg, payload); err != nil {
+		return err
+	}
+	if err := sub.disconnect(); err != nil {
+		return err
+	}
+
+	// A clean session discards the state
+	if err := sub.connect(ctx, true); err != nil {
+		return err
+	}
+	if sub.hasSessionPresent() {
+		return fmt.Errorf("The CONNACK of a clean session has Session Present set")
+	}
+	return nil
+}
+
+func wildcardMatching(ctx context.Context, r *run) error {
+	base := r.topic("wildcard")
+	sub := r.peer("sub")
+	if err := sub.connect(ctx, true); err != nil {
+		return err
+	}
+	if err := sub.subscribe(ctx, 1, base+"/+/b", base+"/m/#"); err != nil {
+		return err
+	}
+	pub := r.peer("pub")
+	if err := pub.connect(ctx, true); err != nil {
+		return err
+	}
+
+	topics := map[string]bool{ // topic below the base -> if it matches a filter
+		"a/b":     true,
+		"x/b":     true,
+		"m":       true, // # also matches the parent
+		"m/n":     true,
+		"m/n/o":   true,
+		"a/c":     false,
+		"a/b/c":   false,
+		"a":       false,
+		"mm":      false,
+		"mm/n":    false,
+		"a/m/n/o": false,
+	}
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	expected := 0
+	for _, name := range names {
+		if err := pub.publish(ctx, base+"/"+name, 1, false, r.payload(name)); err != nil {
+			return err
+		}
+		if topics[name] {
+			expected++
+		}
+	}
+
+	received := make(map[string]int)
+	var errs []string
+	for i := 0; i < expected; i++ {
+		msg, err := sub.expectPublish(ctx, "")
+		if err != nil {
+			break
+		}
+		received[strings.TrimPrefix(msg.Options().Topic, base+"/")]++
+	}
+	if err := sub.expectNoPublish(ctx, ""); err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, name := range names {
+		switch count := received[name]; {
+		case topics[name] && count == 0:
+			errs = append(errs, fmt.Sprintf("%s/%s was not delivered", base, name))
+		case !topics[name] && count > 0:
+			errs = append(errs, fmt.Sprintf("%s/%s was delivered but matches no filter", base, name))
+		case count > 1:
+			errs = append(errs, fmt.Sprintf("%s/%s was delivered %d times", base, name, count))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func clientIDTakeover(ctx context.Context, r *run) error {
+	first := r.peer("first")
+	if err := first.connect(ctx, true); err != nil {
+		return err
+	}
+	second := r.peerWithID("second", first.id)
+	if err := second.connect(ctx, true); err != nil {
+		return err
+	}
+	failure := "The connection of the first client was not closed when a client connected with the same client ID"
+	if err := first.expectLost(ctx, r.suite.options.Timeout, failure); err != nil {
+		return err
+	}
+	if err := second.subscribe(ctx, 1, r.topic("takeover")); err != nil {
+		return fmt.Errorf("The client taking over the client ID does not work: %s", err)
+	}
+	return nil
+}
+
+func keepAliveExpiry(ctx context.Context, r *run) error {
+	topic := r.topic("keepalive")
+	watcher := r.peer("sub")
+	if err := watcher.connect(ctx, true); err != nil {
+		return err
+	}
+	if err := watcher.subscribe(ctx, 1, topic); err != nil {
+		return err
+	}
+
+	idle := r.peer("idle")
+	payload := r.payload("will of an expired keep alive")
+	options := []mqtt.ConnectOption{
+		mqtt.KeepAliveSeconds(1), mqtt.XNoPingReq(true), mqtt.WillTopic(topic), mqtt.WillMessage(payload), mqtt.WillQoS(1),
+	}
+	if err := idle.connect(ctx, true, options...); err != nil {
+		return err
+	}
+	start := time.Now()
+	failure := "The connection of a client silent for 1.5 times its keep alive of 1s was not closed"
+	if err := idle.expectLost(ctx, 1500*time.Millisecond+r.suite.options.Timeout, failure); err != nil {
+		return err
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		return fmt.Errorf("The connection of a client with a keep alive of 1s was closed after only %s", elapsed.Round(time.Millisecond))
+	}
+	msg, err := watcher.expectPublish(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("The will was not published: %s", err)
+	}
+	return checkMessage(msg, payload)
+}
@@ -0,0 +1,588 @@
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"gopkg.in/yaml.v2"
+)
+
+// A script is a scenario written in YAML - a name, an optional description, and steps performed in order by
+// named clients. A step is a map with one key, the action, for example:
+//
+//     name: qos1-resend-after-ignored-puback
+//     steps:
+//       - connect: {client: sub}
+//       - subscribe: {client: sub, topic: "${topic}/a", qos: 1}
+//       - connect: {client: pub, clean: false}
+//       - ignore: {client: pub, packet: PUBACK}
+//       - publish: {client: pub, topic: "${topic}/a", message: hello, qos: 1}
+//       - expect: {client: pub, packet: PUBACK}
+//       - drop: {client: pub}
+//       - reconnect: {client: pub}
+//       - expect: {client: sub, packet: PUBLISH, topic: "${topic}/a", message: hello}
+//
+// The actions are:
+//
+//     connect        connect the client - client_id, clean (default true), keep_alive (default 0), username,
+//                    password, and will (topic, message, qos, retain)
+//     reconnect      connect a client that has been connected before, continuing its session - as connect but
+//                    clean is false by default
+//     subscribe      subscribe to topic with qos
+//     publish        publish message to topic with qos and retain - without waiting for acknowledgement
+//     ignore         do not process (or acknowledge) the next count (default 1) received packets of type packet
+//     drop_on        close the connection when the next packet of type packet arrives - before processing it
+//     drop           close the connection without DISCONNECT
+//     disconnect     disconnect with DISCONNECT (messages still in flight are not an error)
+//     wait           wait for the given duration, for example "wait: 500ms"
+//     expect         wait (at most within, default the timeout of the suite) for a received packet of type packet -
+//                    a PUBLISH can be required to have topic, message, qos, dup, retain, and packet_id, an
+//                    acknowledgement to have packet_id, and a CONNACK to have session_present
+//     expect_none    as expect, but fails if such a packet arrives within the given time (default the quiet time)
+//     expect_closed  wait (at most within) for the connection of the client to end
+//
+// The client of a step is "main" if not given. In topics, messages, and client IDs "${topic}" is replaced by a
+// topic that is unique for each run, and "${run}" by the ID of the run.
+//
+type script struct {
+	Name        string       `yaml:"name"`
+	Description string       `yaml:"description"`
+	Steps       []scriptStep `yaml:"steps"`
+}
+
+type scriptStep struct {
+	Connect      *connectStep   `yaml:"connect"`
+	Reconnect    *connectStep   `yaml:"reconnect"`
+	Subscribe    *subscribeStep `yaml:"subscribe"`
+	Publish      *publishStep   `yaml:"publish"`
+	Ignore       *packetStep    `yaml:"ignore"`
+	DropOn       *packetStep    `yaml:"drop_on"`
+	Drop         *clientStep    `yaml:"drop"`
+	Disconnect   *clientStep    `yaml:"disconnect"`
+	Wait         *time.Duration `yaml:"wait"`
+	Expect       *expectStep    `yaml:"expect"`
+	ExpectNone   *expectStep    `yaml:"expect_none"`
+	ExpectClosed *clientStep    `yaml:"expect_closed"`
+}
+
+type clientStep struct {
+	Client string        `yaml:"client"`
+	Within time.Duration `yaml:"within"`
+}
+
+type connectStep struct {
+	Client    string    `yaml:"client"`
+	ClientID  string    `yaml:"client_id"`
+	Clean     *bool     `yaml:"clean"`
+	KeepAlive int       `yaml:"keep_alive"`
+	UserName  string    `yaml:"username"`
+	Password  string    `yaml:"password"`
+	Will      *willStep `yaml:"will"`
+}
+
+type willStep struct {
+	Topic   string `yaml:"topic"`
+	Message string `yaml:"message"`
+	QoS     int    `yaml:"qos"`
+	Retain  bool   `yaml:"retain"`
+}
+
+type subscribeStep struct {
+	Client string `yaml:"client"`
+	Topic  string `yaml:"topic"`
+	QoS    int    `yaml:"qos"`
+}
+
+type publishStep struct {
+	Client  string `yaml:"client"`
+	Topic   string `yaml:"topic"`
+	Message string `yaml:"message"`
+	QoS     int    `yaml:"qos"`
+	Retain  bool   `yaml:"retain"`
+}
+
+type packetStep struct {
+	Client string `yaml:"client"`
+	Packet string `yaml:"packet"`
+	Count  int    `yaml:"count"`
+}
+
+type expectStep struct {
+	Client         string        `yaml:"client"`
+	Packet         string        `yaml:"packet"`
+	Topic          *string       `yaml:"topic"`
+	Message        *string       `yaml:"message"`
+	QoS            *int          `yaml:"qos"`
+	Dup            *bool         `yaml:"dup"`
+	Retain         *bool         `yaml:"retain"`
+	PacketID       *int          `yaml:"packet_id"`
+	SessionPresent *bool         `yaml:"session_present"`
+	Within         time.Duration `yaml:"within"`
+}
+
+// stepFunc performs a step of a script
+type stepFunc func(ctx context.Context, r *run) error
+
+// ReadScript reads a scenario written in YAML from the given file. The name of the scenario is the name of the
+// file without extension if the script does not have a name.
+//
+func ReadScript(fileName string) (Scenario, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return Scenario{}, err
+	}
+	scenario, err := ParseScript(data)
+	if err != nil {
+		return Scenario{}, fmt.Errorf("%s: %s", fileName, err)
+	}
+	if scenario.Name == "" {
+		scenario.Name = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	}
+	return scenario, nil
+}
+
+// ParseScript returns the scenario written in YAML in the given data. An error is returned if the YAML has
+// unknown keys, or a step is not valid.
+//
+func ParseScript(data []byte) (Scenario, error) {
+	var s script
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return Scenario{}, err
+	}
+	if len(s.Steps) == 0 {
+		return Scenario{}, fmt.Errorf("A script must have at least one step")
+	}
+	steps := make([]stepFunc, len(s.Steps))
+	names := make([]string, len(s.Steps))
+	for i, step := range s.Steps {
+		var err error
+		names[i], steps[i], err = compileStep(step)
+		if err != nil {
+			return Scenario{}, fmt.Errorf("step %d: %s", i+1, err)
+		}
+	}
+
+	run := func(ctx context.Context, r *run) error {
+		for i, step := range steps {
+			r.trace.add("script", "step %d: %s", i+1, names[i])
+			if err := step(ctx, r); err != nil {
+				return fmt.Errorf("step %d (%s): %s", i+1, names[i], err)
+			}
+		}
+		return nil
+	}
+	return Scenario{Name: s.Name, Description: s.Description, run: run}, nil
+}
+
+// compileStep returns the name of the action of the given step and the function performing it
+func compileStep(step scriptStep) (string, stepFunc, error) {
+	var names []string
+	var f stepFunc
+	var err error
+	if step.Connect != nil {
+		names = append(names, "connect")
+		f, err = compileConnect(step.Connect, true, false)
+	}
+	if step.Reconnect != nil {
+		names = append(names, "reconnect")
+		f, err = compileConnect(step.Reconnect, false, true)
+	}
+	if step.Subscribe != nil {
+		names = append(names, "subscribe")
+		f, err = compileSubscribe(step.Subscribe)
+	}
+	if step.Publish != nil {
+		names = append(names, "publish")
+		f, err = compilePublish(step.Publish)
+	}
+	if step.Ignore != nil {
+		names = append(names, "ignore")
+		f, err = compileIgnore(step.Ignore)
+	}
+	if step.DropOn != nil {
+		names = append(names, "drop_on")
+		f, err = compileDropOn(step.DropOn)
+	}
+	if step.Drop != nil {
+		names = append(names, "drop")
+		f, err = compileDrop(step.Drop)
+	}
+	if step.Disconnect != nil {
+		names = append(names, "disconnect")
+		f, err = compileDisconnect(step.Disconnect)
+	}
+	if step.Wait != nil {
+		names = append(names, "wait")
+		f, err = compileWait(*step.Wait)
+	}
+	if step.Expect != nil {
+		names = append(names, "expect")
+		f, err = compileExpect(step.Expect, false)
+	}
+	if step.ExpectNone != nil {
+		names = append(names, "expect_none")
+		f, err = compileExpect(step.ExpectNone, true)
+	}
+	if step.ExpectClosed != nil {
+		names = append(names, "expect_closed")
+		f, err = compileExpectClosed(step.ExpectClosed)
+	}
+	switch {
+	case len(names) == 0:
+		return "", nil, fmt.Errorf("A step must have an action")
+	case len(names) > 1:
+		return "", nil, fmt.Errorf("A step must have one action, got %s", strings.Join(names, " and "))
+	case err != nil:
+		return "", nil, fmt.Errorf("%s: %s", names[0], err)
+	}
+	return names[0], f, nil
+}
+
+// clientName returns the given client name, or "main" if it is empty
+func clientName(name string) string {
+	if name == "" {
+		return "main"
+	}
+	return name
+}
+
+// expand replaces ${topic} and ${run} in the given text
+func (r *run) expand(text string) string {
+	text = strings.Replace(text, "${topic}", r.suite.options.Topic+"/"+r.id, -1)
+	return strings.Replace(text, "${run}", r.id, -1)
+}
+
+// findPeer returns the client of the scenario with the given name (nil if there is none)
+func (r *run) findPeer(name string) *peer {
+	for _, p := range r.peers {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// connectedPeer returns the client of the scenario with the given name, or an error if it is not connected
+func (r *run) connectedPeer(name string) (*peer, error) {
+	p := r.findPeer(name)
+	if p == nil || !p.connected() {
+		return nil, fmt.Errorf("%s is not connected", name)
+	}
+	return p, nil
+}
+
+// checkQoS returns an error if the given QoS is not 0, 1, or 2
+func checkQoS(qos int) error {
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("qos must be 0, 1, or 2, got %d", qos)
+	}
+	return nil
+}
+
+// packetType returns the type of the packet with the given name (for example PUBREC)
+func packetType(name string) (int, error) {
+	for t := mqtt.ConnectType; t <= mqtt.DisconnectType; t++ {
+		if mqtt.PacketTypeName(t) == strings.ToUpper(name) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("packet must be the name of a MQTT packet type (for example PUBREC), got '%s'", name)
+}
+
+func compileConnect(step *connectStep, clean, reconnect bool) (stepFunc, error) {
+	if step.Clean != nil {
+		clean = *step.Clean
+	}
+	if step.KeepAlive < 0 || step.KeepAlive > 0xff {
+		return nil, fmt.Errorf("keep_alive must be between 0 and 255, got %d", step.KeepAlive)
+	}
+	if reconnect && step.ClientID != "" {
+		return nil, fmt.Errorf("a client reconnects with the client ID it connected with - client_id cannot be given")
+	}
+	if step.Will != nil {
+		if step.Will.Topic == "" {
+			return nil, fmt.Errorf("a will must have a topic")
+		}
+		if err := checkQoS(step.Will.QoS); err != nil {
+			return nil, err
+		}
+	}
+	name := clientName(step.Client)
+	return func(ctx context.Context, r *run) error {
+		options := []mqtt.ConnectOption{mqtt.KeepAliveSeconds(step.KeepAlive)}
+		if step.UserName != "" {
+			options = append(options, mqtt.UserName(step.UserName))
+		}
+		if step.Password != "" {
+			options = append(options, mqtt.Password([]byte(step.Password)))
+		}
+		if w := step.Will; w != nil {
+			if err := mqtt.ValidateTopicName(r.expand(w.Topic)); err != nil {
+				return err
+			}
+			options = append(options, mqtt.WillTopic(r.expand(w.Topic)), mqtt.WillMessage([]byte(r.expand(w.Message))),
+				mqtt.WillQoS(w.QoS), mqtt.WillRetain(w.Retain))
+		}
+
+		p := r.findPeer(name)
+		switch {
+		case p == nil && reconnect:
+			return fmt.Errorf("%s has not been connected before", name)
+		case p == nil && step.ClientID != "":
+			p = r.peerWithID(name, r.expand(step.ClientID))
+		case p == nil:
+			p = r.peer(name)
+		case p.connected():
+			return fmt.Errorf("%s is already connected", name)
+		}
+		return p.connect(ctx, clean, options...)
+	}, nil
+}
+
+func compileSubscribe(step *subscribeStep) (stepFunc, error) {
+	if step.Topic == "" {
+		return nil, fmt.Errorf("topic is required")
+	}
+	if err := checkQoS(step.QoS); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, r *run) error {
+		p, err := r.connectedPeer(clientName(step.Client))
+		if err != nil {
+			return err
+		}
+		return p.subscribe(ctx, step.QoS, r.expand(step.Topic))
+	}, nil
+}
+
+func compilePublish(step *publishStep) (stepFunc, error) {
+	if step.Topic == "" {
+		return nil, fmt.Errorf("topic is required")
+	}
+	if err := checkQoS(step.QoS); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, r *run) error {
+		p, err := r.connectedPeer(clientName(step.Client))
+		if err != nil {
+			return err
+		}
+		topic := r.expand(step.Topic)
+		if err := mqtt.ValidateTopicName(topic); err != nil {
+			return err
+		}
+		return p.send(topic, step.QoS, step.Retain, []byte(r.expand(step.Message)))
+	}, nil
+}
+
+func compileIgnore(step *packetStep) (stepFunc, error) {
+	t, err := packetType(step.Packet)
+	if err != nil {
+		return nil, err
+	}
+	count := step.Count
+	if count == 0 {
+		count = 1
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("count cannot be negative")
+	}
+	return func(ctx context.Context, r *run) error {
+		p := r.findPeer(clientName(step.Client))
+		if p == nil {
+			return fmt.Errorf("%s has not been connected", clientName(step.Client))
+		}
+		p.ignoreNext(t, count)
+		return nil
+	}, nil
+}
+
+func compileDropOn(step *packetStep) (stepFunc, error) {
+	t, err := packetType(step.Packet)
+	if err != nil {
+		return nil, err
+	}
+	if step.Count != 0 {
+		return nil, fmt.Errorf("count cannot be given - the connection is closed on the first packet")
+	}
+	return func(ctx context.Context, r *run) error {
+		p, err := r.connectedPeer(clientName(step.Client))
+		if err != nil {
+			return err
+		}
+		p.dropOnNext(t)
+		return nil
+	}, nil
+}
+
+func compileDrop(step *clientStep) (stepFunc, error) {
+	if step.Within != 0 {
+		return nil, fmt.Errorf("within cannot be given")
+	}
+	return func(ctx context.Context, r *run) error {
+		p, err := r.connectedPeer(clientName(step.Client))
+		if err != nil {
+			return err
+		}
+		p.close()
+		return p.expectLost(ctx, r.suite.options.Timeout, fmt.Sprintf("the connection of %s did not end", p.name))
+	}, nil
+}
+
+func compileDisconnect(step *clientStep) (stepFunc, error) {
+	if step.Within != 0 {
+		return nil, fmt.Errorf("within cannot be given")
+	}
+	return func(ctx context.Context, r *run) error {
+		p, err := r.connectedPeer(clientName(step.Client))
+		if err != nil {
+			return err
+		}
+		return p.disconnect()
+	}, nil
+}
+
+func compileWait(d time.Duration) (stepFunc, error) {
+	if d <= 0 {
+		return nil, fmt.Errorf("the duration must be positive, for example 500ms")
+	}
+	return func(ctx context.Context, r *run) error {
+		select {
+		case <-time.After(d):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}, nil
+}
+
+func compileExpectClosed(step *clientStep) (stepFunc, error) {
+	return func(ctx context.Context, r *run) error {
+		name := clientName(step.Client)
+		p := r.findPeer(name)
+		if p == nil || p.session == nil {
+			return fmt.Errorf("%s has not been connected", name)
+		}
+		within := step.Within
+		if within == 0 {
+			within = r.suite.options.Timeout
+		}
+		return p.expectLost(ctx, within, fmt.Sprintf("the connection of %s did not end within %s", name, within))
+	}, nil
+}
+
+func compileExpect(step *expectStep, none bool) (stepFunc, error) {
+	t, err := packetType(step.Packet)
+	if err != nil {
+		return nil, err
+	}
+	publishOnly := step.Topic != nil || step.Message != nil || step.QoS != nil || step.Dup != nil || step.Retain != nil
+	if publishOnly && t != mqtt.PublishType {
+		return nil, fmt.Errorf("topic, message, qos, dup, and retain can only be expected of a PUBLISH")
+	}
+	if step.SessionPresent != nil && t != mqtt.ConnAckType {
+		return nil, fmt.Errorf("session_present can only be expected of a CONNACK")
+	}
+	if step.PacketID != nil {
+		switch t {
+		case mqtt.PublishType, mqtt.PublishAckType, mqtt.PublishReceivedType, mqtt.PublishReleaseType,
+			mqtt.PublishCompleteType, mqtt.SubAckType, mqtt.UnsubAckType:
+		default:
+			return nil, fmt.Errorf("packet_id cannot be expected of a %s", mqtt.PacketTypeName(t))
+		}
+	}
+	if step.Within < 0 {
+		return nil, fmt.Errorf("within cannot be negative")
+	}
+
+	return func(ctx context.Context, r *run) error {
+		name := clientName(step.Client)
+		p := r.findPeer(name)
+		if p == nil {
+			return fmt.Errorf("%s has not been connected", name)
+		}
+		accept, what := step.matcher(r, t)
+		if none {
+			within := step.Within
+			if within == 0 {
+				within = r.suite.options.Quiet
+			}
+			return p.expectNone(ctx, within, accept)
+		}
+		within := step.Within
+		if within == 0 {
+			within = r.suite.options.Timeout
+		}
+		_, err := p.expectWithin(ctx, within, what, accept)
+		return err
+	}, nil
+}
+
+// matcher returns a function accepting the packets of the given type that the step expects, and a description
+// of those packets
+//
+func (step *expectStep) matcher(r *run, t int) (func(packet *mqtt.GenericMessage) bool, string) {
+	var conditions []string
+	var topic, message string
+	if step.Topic != nil {
+		topic = r.expand(*step.Topic)
+		conditions = append(conditions, "topic="+topic)
+	}
+	if step.Message != nil {
+		message = r.expand(*step.Message)
+		conditions = append(conditions, fmt.Sprintf("message='%s'", message))
+	}
+	if step.QoS != nil {
+		conditions = append(conditions, fmt.Sprintf("qos=%d", *step.QoS))
+	}
+	if step.Dup != nil {
+		conditions = append(conditions, fmt.Sprintf("dup=%v", *step.Dup))
+	}
+	if step.Retain != nil {
+		conditions = append(conditions, fmt.Sprintf("retain=%v", *step.Retain))
+	}
+	if step.PacketID != nil {
+		conditions = append(conditions, fmt.Sprintf("id=%d", *step.PacketID))
+	}
+	if step.SessionPresent != nil {
+		conditions = append(conditions, fmt.Sprintf("sp=%v", *step.SessionPresent))
+	}
+	what := mqtt.PacketTypeName(t)
+	if len(conditions) > 0 {
+		what += "(" + strings.Join(conditions, ", ") + ")"
+	}
+
+	accept := func(packet *mqtt.GenericMessage) bool {
+		if packet.Type() != t {
+			return false
+		}
+		switch t {
+		case mqtt.PublishType:
+			pr, err := mqtt.DecodePublish(packet)
+			if err != nil {
+				return false
+			}
+			o := pr.Options()
+			return (step.Topic == nil || o.Topic == topic) &&
+				(step.Message == nil || string(o.Message) == message) &&
+				(step.QoS == nil || o.QoS == *step.QoS) &&
+				(step.Dup == nil || o.IsDuplicate == *step.Dup) &&
+				(step.Retain == nil || o.Retain == *step.Retain) &&
+				(step.PacketID == nil || o.QoS > 0 && o.PacketID == *step.PacketID)
+		case mqtt.ConnAckType:
+			body := packet.Body()
+			return step.SessionPresent == nil || len(body) == 2 && (body[0]&1 == 1) == *step.SessionPresent
+		}
+		if step.PacketID != nil {
+			body := packet.Body()
+			return len(body) >= 2 && int(body[0])<<8|int(body[1]) == *step.PacketID
+		}
+		return true
+	}
+	return accept, what
+}
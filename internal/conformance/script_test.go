@@ -0,0 +1,115 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/broker"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func testhelperRunScript(t *testing.T, text string) *Result {
+	t.Helper()
+	scenario, err := ParseScript([]byte(text))
+	testutils.CheckNotError(err, t)
+	b := broker.NewBroker()
+	defer b.Close()
+	s := NewSuite(Dialer(testhelperDialer(b, nil)), Timeout(2*time.Second), Quiet(100*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	report := s.RunScenarios(ctx, scenario)
+	testutils.CheckEqual(1, len(report.Results), t)
+	return report.Results[0]
+}
+
+func testhelperCheckPassed(result *Result, t *testing.T) {
+	t.Helper()
+	if !result.Passed {
+		var text bytes.Buffer
+		(&Report{Results: []*Result{result}}).WriteText(&text, false)
+		t.Fatalf("Expected the script to pass, got:\n%s", text.String())
+	}
+}
+
+func Test_Script_resends_a_QoS_2_message_whose_PUBREC_was_ignored(t *testing.T) {
+	result := testhelperRunScript(t, `
+name: qos2-ignored-pubrec
+description: An unacknowledged QoS 2 message is sent again as a duplicate
+steps:
+  - connect: {client: sub}
+  - subscribe: {client: sub, topic: "${topic}/a", qos: 2}
+  - connect: {client: pub, clean: false}
+  - ignore: {client: pub, packet: PUBREC}
+  - publish: {client: pub, topic: "${topic}/a", message: "hello ${run}", qos: 2}
+  - expect: {client: pub, packet: pubrec}
+  - expect: {client: sub, packet: PUBLISH, topic: "${topic}/a", qos: 2, dup: false}
+  - drop: {client: pub}
+  - reconnect: {client: pub}
+  - expect: {client: pub, packet: PUBCOMP, packet_id: 1}
+  - expect_none: {client: sub, packet: PUBLISH}
+  - disconnect: {client: sub}
+`)
+	testhelperCheckPassed(result, t)
+	testutils.CheckEqual("qos2-ignored-pubrec", result.Scenario, t)
+	testutils.CheckEqual("An unacknowledged QoS 2 message is sent again as a duplicate", result.Description, t)
+
+	var trace []string
+	for _, e := range result.Trace {
+		trace = append(trace, e.Client+" "+e.Text)
+	}
+	text := strings.Join(trace, "\n")
+	testutils.CheckTrue(strings.Contains(text, "script step 4: ignore"), t)
+	testutils.CheckTrue(strings.Contains(text, "pub ignored PUBREC"), t)
+	testutils.CheckTrue(strings.Contains(text, "pub -> PUBLISH(id=1, qos=2, dup, topic="), t)
+}
+
+func Test_Script_reports_the_failed_step(t *testing.T) {
+	result := testhelperRunScript(t, `
+steps:
+  - connect: {}
+  - subscribe: {topic: "${topic}/#", qos: 1}
+  - publish: {topic: "${topic}/a", message: one, qos: 1}
+  - expect: {packet: PUBLISH, message: two, within: 200ms}
+`)
+	testutils.CheckFalse(result.Passed, t)
+	testutils.CheckEqual("step 4 (expect): main did not receive PUBLISH(message='two') within 200ms", result.Failure, t)
+}
+
+func Test_Script_expects_a_will_and_a_closed_connection(t *testing.T) {
+	result := testhelperRunScript(t, `
+steps:
+  - connect: {client: watcher}
+  - subscribe: {client: watcher, topic: "${topic}/will"}
+  - connect: {keep_alive: 1, will: {topic: "${topic}/will", message: gone}}
+  - drop_on: {packet: PINGRESP}
+  - expect_closed: {within: 3s}
+  - expect: {client: watcher, packet: PUBLISH, message: gone}
+`)
+	testhelperCheckPassed(result, t)
+}
+
+func Test_ParseScript_rejects_invalid_scripts(t *testing.T) {
+	for _, c := range []struct{ script, err string }{
+		{`name: x`, "A script must have at least one step"},
+		{`steps: [{}]`, "step 1: A step must have an action"},
+		{`steps: [{connect: {}, drop: {}}]`, "step 1: A step must have one action, got connect and drop"},
+		{`steps: [{connect: {}}, {publish: {qos: 1}}]`, "step 2: publish: topic is required"},
+		{`steps: [{subscribe: {topic: a, qos: 3}}]`, "step 1: subscribe: qos must be 0, 1, or 2, got 3"},
+		{`steps: [{ignore: {packet: PUBFOO}}]`, "step 1: ignore: packet must be the name of a MQTT packet type (for example PUBREC), got 'PUBFOO'"},
+		{`steps: [{expect: {packet: PUBACK, topic: a}}]`, "step 1: expect: topic, message, qos, dup, and retain can only be expected of a PUBLISH"},
+		{`steps: [{expect: {packet: PINGRESP, packet_id: 1}}]`, "step 1: expect: packet_id cannot be expected of a PINGRESP"},
+		{`steps: [{reconnect: {client_id: x}}]`, "step 1: reconnect: a client reconnects with the client ID it connected with - client_id cannot be given"},
+		{`steps: [{wait: 0s}]`, "step 1: wait: the duration must be positive, for example 500ms"},
+	} {
+		_, err := ParseScript([]byte(c.script))
+		testutils.CheckError(err, t)
+		testutils.CheckEqual(c.err, err.Error(), t)
+	}
+
+	_, err := ParseScript([]byte(`steps: [{connect: {clientid: x}}]`))
+	testutils.CheckError(err, t)
+	testutils.CheckTrue(strings.Contains(err.Error(), "field clientid not found"), t)
+}
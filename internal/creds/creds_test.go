@@ -0,0 +1,160 @@
+package creds
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func testhelperKeyPair(prefix byte, t *testing.T) *KeyPair {
+	t.Helper()
+	kp, err := CreateKeyPair(prefix)
+	testutils.CheckNotError(err, t)
+	return kp
+}
+
+func Test_KeyPair_is_encoded_with_the_prefix_of_its_type(t *testing.T) {
+	// A seed of zero bytes gives the same keys as the NATS nkeys library
+	kp, err := createKeyPair(PrefixUser, bytes.NewReader(make([]byte, 32)))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual("SUAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAEQ", kp.Seed(), t)
+	testutils.CheckEqual("UA5WUJ54Z23KILLCUOUNAKTPBVZWKMQVO4O6EQ5GHLAERIMLLHNCTYM5", kp.PublicKey(), t)
+
+	for prefix, start := range map[byte]string{PrefixOperator: "O", PrefixAccount: "A", PrefixUser: "U"} {
+		kp := testhelperKeyPair(prefix, t)
+		testutils.CheckTrue(strings.HasPrefix(kp.PublicKey(), start), t)
+		testutils.CheckTrue(strings.HasPrefix(kp.Seed(), "S"+start), t)
+
+		decoded, err := FromSeed(kp.Seed())
+		testutils.CheckNotError(err, t)
+		testutils.CheckEqual(prefix, decoded.Prefix(), t)
+		testutils.CheckEqual(kp.PublicKey(), decoded.PublicKey(), t)
+
+		decodedPrefix, _, err := DecodePublicKey(kp.PublicKey())
+		testutils.CheckNotError(err, t)
+		testutils.CheckEqual(prefix, decodedPrefix, t)
+	}
+	_, err = CreateKeyPair(1)
+	testutils.CheckError(err, t)
+}
+
+func Test_KeyPair_signatures_are_verified_with_the_public_key(t *testing.T) {
+	kp := testhelperKeyPair(PrefixAccount, t)
+	signature := kp.Sign([]byte("data"))
+	testutils.CheckNotError(Verify(kp.PublicKey(), []byte("data"), signature), t)
+	testutils.CheckError(Verify(kp.PublicKey(), []byte("other"), signature), t)
+	testutils.CheckError(Verify(testhelperKeyPair(PrefixAccount, t).PublicKey(), []byte("data"), signature), t)
+}
+
+func Test_decoding_detects_invalid_keys(t *testing.T) {
+	kp := testhelperKeyPair(PrefixUser, t)
+
+	// A changed character fails the checksum
+	seed := []byte(kp.Seed())
+	if seed[10] == 'B' {
+		seed[10] = 'C'
+	} else {
+		seed[10] = 'B'
+	}
+	_, err := FromSeed(string(seed))
+	testutils.CheckError(err, t)
+
+	_, err = FromSeed(kp.PublicKey())
+	testutils.CheckError(err, t)
+	_, _, err = DecodePublicKey(kp.Seed())
+	testutils.CheckError(err, t)
+	_, _, err = DecodePublicKey("not a key")
+	testutils.CheckError(err, t)
+}
+
+func Test_UserClaims_are_signed_and_decoded(t *testing.T) {
+	account := testhelperKeyPair(PrefixAccount, t)
+	user := testhelperKeyPair(PrefixUser, t)
+	claims := NewUserClaims(user.PublicKey())
+	claims.Name = "sensor"
+	claims.Nats.Pub.Allow = []string{"sensors.>"}
+	claims.Nats.Sub.Deny = []string{">"}
+	claims.Nats.BearerToken = true
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+
+	token, err := EncodeUserClaims(claims, account)
+	testutils.CheckNotError(err, t)
+	testutils.CheckTrue(strings.HasPrefix(token, "eyJ"), t)
+
+	decoded, err := DecodeUserClaims(token)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(account.PublicKey(), decoded.Issuer, t)
+	testutils.CheckEqual(user.PublicKey(), decoded.Subject, t)
+	testutils.CheckEqual("sensor", decoded.Name, t)
+	testutils.CheckEqual(claims.Id, decoded.Id, t)
+	testutils.CheckEqual("sensors.>", decoded.Nats.Pub.Allow[0], t)
+	testutils.CheckEqual(">", decoded.Nats.Sub.Deny[0], t)
+	testutils.CheckTrue(decoded.Nats.BearerToken, t)
+	testutils.CheckEqual(int64(-1), decoded.Nats.Subs, t)
+	testutils.CheckEqual(claims.ExpiresAt, decoded.Expires().Unix(), t)
+}
+
+func Test_UserClaims_are_refused_when_invalid(t *testing.T) {
+	account := testhelperKeyPair(PrefixAccount, t)
+	user := testhelperKeyPair(PrefixUser, t)
+
+	_, err := EncodeUserClaims(NewUserClaims(user.PublicKey()), user)
+	testutils.CheckError(err, t)
+	_, err = EncodeUserClaims(NewUserClaims(account.PublicKey()), account)
+	testutils.CheckError(err, t)
+
+	// Expired claims are returned with the error
+	claims := NewUserClaims(user.PublicKey())
+	claims.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	token, err := EncodeUserClaims(claims, account)
+	testutils.CheckNotError(err, t)
+	decoded, err := DecodeUserClaims(token)
+	testutils.CheckError(err, t)
+	testutils.CheckEqual(user.PublicKey(), decoded.Subject, t)
+
+	// A changed payload does not match the signature
+	token, err = EncodeUserClaims(NewUserClaims(user.PublicKey()), account)
+	testutils.CheckNotError(err, t)
+	parts := strings.Split(token, ".")
+	other, err := EncodeUserClaims(NewUserClaims(testhelperKeyPair(PrefixUser, t).PublicKey()), account)
+	testutils.CheckNotError(err, t)
+	parts[1] = strings.Split(other, ".")[1]
+	_, err = DecodeUserClaims(strings.Join(parts, "."))
+	testutils.CheckError(err, t)
+
+	_, err = DecodeUserClaims("not.a.jwt")
+	testutils.CheckError(err, t)
+}
+
+func Test_ReadCreds_reads_a_formatted_creds_file(t *testing.T) {
+	account := testhelperKeyPair(PrefixAccount, t)
+	user := testhelperKeyPair(PrefixUser, t)
+	token, err := EncodeUserClaims(NewUserClaims(user.PublicKey()), account)
+	testutils.CheckNotError(err, t)
+
+	dir, err := ioutil.TempDir("", "creds")
+	testutils.CheckNotError(err, t)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "user.creds")
+	testutils.CheckNotError(ioutil.WriteFile(fileName, FormatCreds(token, user.Seed()), 0600), t)
+
+	readToken, kp, err := ReadCreds(fileName)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(token, readToken, t)
+	testutils.CheckEqual(user.PublicKey(), kp.PublicKey(), t)
+
+	// The seed must be the key of the user
+	other := testhelperKeyPair(PrefixUser, t)
+	testutils.CheckNotError(ioutil.WriteFile(fileName, FormatCreds(token, other.Seed()), 0600), t)
+	_, _, err = ReadCreds(fileName)
+	testutils.CheckError(err, t)
+
+	_, _, err = ParseCreds([]byte("-----BEGIN NATS USER JWT-----\n" + token + "\n------END NATS USER JWT------\n"))
+	testutils.CheckError(err, t)
+}
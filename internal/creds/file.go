@@ -0,0 +1,78 @@
+package creds
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// FormatCreds returns a creds file with the given user JWT and user seed, in the format used by the NATS tools
+//
+func FormatCreds(token, seed string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "-----BEGIN NATS USER JWT-----\n%s\n------END NATS USER JWT------\n\n", token)
+	b.WriteString("************************* IMPORTANT *************************\n")
+	b.WriteString("NKEY Seed printed below can be used to sign and prove identity.\n")
+	b.WriteString("NKEYs are sensitive and should be treated as secrets.\n\n")
+	fmt.Fprintf(&b, "-----BEGIN USER NKEY SEED-----\n%s\n------END USER NKEY SEED------\n\n", seed)
+	b.WriteString("*************************************************************\n")
+	return b.Bytes()
+}
+
+// ParseCreds returns the user JWT and user seed of the given creds file content. The JWT is the first, and the
+// seed the second value enclosed in "-----BEGIN" and "-----END" lines.
+//
+func ParseCreds(data []byte) (string, string, error) {
+	values := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	begun := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "---") && strings.Contains(line, "BEGIN"):
+			begun = true
+		case begun && line != "":
+			values = append(values, line)
+			begun = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if len(values) < 2 {
+		return "", "", fmt.Errorf("Creds must contain a user JWT and a user seed")
+	}
+	return values[0], values[1], nil
+}
+
+// ReadCreds returns the user JWT and user key pair of the given creds file. An error is returned if the seed is
+// not a user seed, or if it is not the key of the subject of the JWT. If the claims of the JWT are not valid (for
+// example expired) the JWT and key pair are returned together with the error.
+//
+func ReadCreds(fileName string) (string, *KeyPair, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", nil, err
+	}
+	token, seed, err := ParseCreds(data)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	kp, err := FromSeed(seed)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	if kp.Prefix() != PrefixUser {
+		return "", nil, fmt.Errorf("%s: the seed is not a user seed", fileName)
+	}
+	claims, err := DecodeUserClaims(token)
+	if claims == nil {
+		return "", nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	if claims.Subject != kp.PublicKey() {
+		return "", nil, fmt.Errorf("%s: the seed is not the key of the user of the JWT", fileName)
+	}
+	return token, kp, err
+}
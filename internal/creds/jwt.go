@@ -0,0 +1,168 @@
+package creds
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodNkey signs a JWT with an nkey - the signing method of NATS JWTs
+//
+var SigningMethodNkey = &signingMethodNkey{}
+
+type signingMethodNkey struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodNkey.Alg(), func() jwt.SigningMethod { return SigningMethodNkey })
+}
+
+// Alg returns "ed25519-nkey"
+func (m *signingMethodNkey) Alg() string {
+	return "ed25519-nkey"
+}
+
+// Sign signs with a *KeyPair
+func (m *signingMethodNkey) Sign(signingString string, key interface{}) (string, error) {
+	kp, ok := key.(*KeyPair)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(kp.Sign([]byte(signingString))), nil
+}
+
+// Verify verifies with an ed25519.PublicKey
+func (m *signingMethodNkey) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// Permission allows and denies subjects (which may contain wildcards). A subject that is allowed and not denied is
+// permitted - all subjects are allowed if none are given.
+//
+type Permission struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// User contains the NATS specific claims of a user JWT
+//
+type User struct {
+	Pub         Permission `json:"pub,omitempty"`
+	Sub         Permission `json:"sub,omitempty"`
+	Subs        int64      `json:"subs"`    // the maximum number of subscriptions (-1 is no limit)
+	Data        int64      `json:"data"`    // the maximum number of bytes (-1 is no limit)
+	Payload     int64      `json:"payload"` // the maximum message payload (-1 is no limit)
+	BearerToken bool       `json:"bearer_token,omitempty"`
+	Type        string     `json:"type"`
+	Version     int        `json:"version"`
+}
+
+// UserClaims are the claims of a NATS user JWT. The subject is the public key of the user, and the issuer is the
+// public key of the account that signed it.
+//
+type UserClaims struct {
+	jwt.StandardClaims
+	Name string `json:"name,omitempty"`
+	Nats User   `json:"nats"`
+}
+
+// NewUserClaims returns the claims of a user JWT for the given user public key - without limits, permissions, or
+// expiry
+//
+func NewUserClaims(userPublicKey string) *UserClaims {
+	claims := &UserClaims{Nats: User{Subs: -1, Data: -1, Payload: -1, Type: "user", Version: 2}}
+	claims.Subject = userPublicKey
+	return claims
+}
+
+// Valid returns an error if the claims are expired or not yet valid, or are not the claims of a user
+//
+func (c *UserClaims) Valid() error {
+	if err := c.StandardClaims.Valid(); err != nil {
+		return err
+	}
+	if c.Nats.Type != "user" {
+		return fmt.Errorf("The JWT is not a user JWT - its type is '%s'", c.Nats.Type)
+	}
+	if prefix, _, err := DecodePublicKey(c.Subject); err != nil || prefix != PrefixUser {
+		return fmt.Errorf("The subject of a user JWT must be a user public key - got '%s'", c.Subject)
+	}
+	return nil
+}
+
+// Expires returns the time the claims expire, or the zero time if they do not expire
+//
+func (c *UserClaims) Expires() time.Time {
+	if c.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// EncodeUserClaims returns the given claims as a JWT signed by the given account key pair. The issuer, the time of
+// issue (unless set), and the ID of the claims are set.
+//
+func EncodeUserClaims(claims *UserClaims, account *KeyPair) (string, error) {
+	if account.Prefix() != PrefixAccount {
+		return "", fmt.Errorf("A user JWT must be signed by an account key - got a %s key", PrefixName(account.Prefix()))
+	}
+	if prefix, _, err := DecodePublicKey(claims.Subject); err != nil || prefix != PrefixUser {
+		return "", fmt.Errorf("The subject of a user JWT must be a user public key - got '%s'", claims.Subject)
+	}
+	claims.Issuer = account.PublicKey()
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = time.Now().Unix()
+	}
+	// Like NATS the ID is the hash of the claims without an ID
+	claims.Id = ""
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	hash := sha512.Sum512_256(data)
+	claims.Id = encoding.EncodeToString(hash[:])
+
+	return jwt.NewWithClaims(SigningMethodNkey, claims).SignedString(account)
+}
+
+// DecodeUserClaims returns the claims of the given user JWT. An error is returned if the JWT is not signed by the
+// account key it claims as issuer, or if the claims are not valid - the claims are also returned if they could be
+// decoded, for example when the JWT has expired.
+//
+func DecodeUserClaims(token string) (*UserClaims, error) {
+	claims := &UserClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != SigningMethodNkey {
+			return nil, fmt.Errorf("Unexpected signing method '%v'", t.Header["alg"])
+		}
+		prefix, key, err := DecodePublicKey(claims.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		if prefix != PrefixAccount {
+			return nil, fmt.Errorf("The issuer of a user JWT must be an account - got a %s key", PrefixName(prefix))
+		}
+		return key, nil
+	})
+	if err != nil {
+		if claims.Subject == "" {
+			return nil, err
+		}
+		return claims, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,195 @@
+// Package creds creates the credentials used by NATS - nkeys, user JWTs, and creds files. NATS server with MQTT
+// support enabled accepts a user JWT as the password of a MQTT CONNECT.
+//
+// An nkey is an ed25519 key pair. Its public key and its seed (the private key) are encoded as text with base32,
+// where the first character tells the type of key - for example a user public key starts with 'U' and its seed
+// with "SU". The encoding ends with a CRC16 checksum.
+//
+package creds
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// PrefixOperator is the prefix byte of an operator key (encoded as 'O')
+	PrefixOperator byte = 14 << 3
+
+	// PrefixAccount is the prefix byte of an account key (encoded as 'A')
+	PrefixAccount byte = 0
+
+	// PrefixUser is the prefix byte of a user key (encoded as 'U')
+	PrefixUser byte = 20 << 3
+
+	// prefixSeed is the prefix byte of a seed (encoded as 'S')
+	prefixSeed byte = 18 << 3
+)
+
+// prefixNames are the names of the valid public key prefix bytes
+var prefixNames = map[byte]string{
+	PrefixOperator: "operator",
+	PrefixAccount:  "account",
+	PrefixUser:     "user",
+}
+
+// PrefixName returns the name of the type of key with the given prefix byte ("operator", "account", or "user"),
+// or "unknown"
+//
+func PrefixName(prefix byte) string {
+	if name, ok := prefixNames[prefix]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// encoding is base32 without padding
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// KeyPair is an nkey - an ed25519 key pair of a given type
+//
+type KeyPair struct {
+	prefix byte
+	seed   []byte
+	key    ed25519.PrivateKey
+}
+
+// CreateKeyPair creates a new KeyPair with the given prefix byte (PrefixOperator, PrefixAccount, or PrefixUser)
+//
+func CreateKeyPair(prefix byte) (*KeyPair, error) {
+	return createKeyPair(prefix, rand.Reader)
+}
+
+func createKeyPair(prefix byte, random io.Reader) (*KeyPair, error) {
+	if _, ok := prefixNames[prefix]; !ok {
+		return nil, fmt.Errorf("Invalid nkey prefix byte %d", prefix)
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(random, seed); err != nil {
+		return nil, err
+	}
+	return &KeyPair{prefix: prefix, seed: seed, key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// FromSeed returns the KeyPair of the given encoded seed
+//
+func FromSeed(seed string) (*KeyPair, error) {
+	raw, err := decode(seed)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid nkey seed: %s", err)
+	}
+	if raw[0]&248 != prefixSeed || len(raw) != 2+ed25519.SeedSize {
+		return nil, fmt.Errorf("Invalid nkey seed: not a seed")
+	}
+	prefix := (raw[0]&7)<<5 | (raw[1]&248)>>3
+	if _, ok := prefixNames[prefix]; !ok {
+		return nil, fmt.Errorf("Invalid nkey seed: unknown key type")
+	}
+	raw = raw[2:]
+	return &KeyPair{prefix: prefix, seed: raw, key: ed25519.NewKeyFromSeed(raw)}, nil
+}
+
+// Prefix returns the prefix byte of the type of key
+//
+func (kp *KeyPair) Prefix() byte {
+	return kp.prefix
+}
+
+// Seed returns the encoded seed - the private key
+//
+func (kp *KeyPair) Seed() string {
+	raw := []byte{prefixSeed | kp.prefix>>5, (kp.prefix & 31) << 3}
+	return encode(append(raw, kp.seed...))
+}
+
+// PublicKey returns the encoded public key
+//
+func (kp *KeyPair) PublicKey() string {
+	return encode(append([]byte{kp.prefix}, kp.key.Public().(ed25519.PublicKey)...))
+}
+
+// Sign returns the ed25519 signature of the given data
+//
+func (kp *KeyPair) Sign(data []byte) []byte {
+	return ed25519.Sign(kp.key, data)
+}
+
+// DecodePublicKey returns the prefix byte and the ed25519 public key of the given encoded public key
+//
+func DecodePublicKey(publicKey string) (byte, ed25519.PublicKey, error) {
+	raw, err := decode(publicKey)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Invalid nkey public key: %s", err)
+	}
+	if _, ok := prefixNames[raw[0]]; !ok || len(raw) != 1+ed25519.PublicKeySize {
+		return 0, nil, fmt.Errorf("Invalid nkey public key '%s'", publicKey)
+	}
+	return raw[0], ed25519.PublicKey(raw[1:]), nil
+}
+
+// Verify returns an error if the given signature of the given data was not made with the key of the given encoded
+// public key
+//
+func Verify(publicKey string, data, signature []byte) error {
+	_, key, err := DecodePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return fmt.Errorf("Invalid signature")
+	}
+	return nil
+}
+
+// encode returns the given raw bytes followed by their checksum as base32
+func encode(raw []byte) string {
+	checksum := make([]byte, 2)
+	binary.LittleEndian.PutUint16(checksum, crc16(raw))
+	return encoding.EncodeToString(append(raw, checksum...))
+}
+
+// decode returns the raw bytes of the given base32 text after verifying the checksum
+func decode(text string) ([]byte, error) {
+	raw, err := encoding.DecodeString(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 3 {
+		return nil, fmt.Errorf("too short")
+	}
+	raw, checksum := raw[:len(raw)-2], raw[len(raw)-2:]
+	if binary.LittleEndian.Uint16(checksum) != crc16(raw) {
+		return nil, fmt.Errorf("invalid checksum")
+	}
+	return raw, nil
+}
+
+// crc16Table is the table of the CRC16 (XMODEM) checksum
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 returns the CRC16 (XMODEM) checksum of the given data
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
@@ -0,0 +1,145 @@
+package decode
+
+import "github.com/hlindberg/mezquit/internal/mqtt"
+
+// Conversation decodes the packets of both directions of an MQTT connection from the data as it was sent, and reports
+// packets that violate the protocol in the conversation - for example a client that does not start with CONNECT, or
+// a broker sending a packet only clients send. The offsets of the packets are from the start of their direction.
+//
+type Conversation struct {
+	decoder *Decoder
+	streams [2]stream // from the client, and from the broker
+}
+
+// stream is a direction of a conversation
+type stream struct {
+	buffer       []byte // data of a packet that is not complete
+	offset       int    // the offset of the first byte of the buffer
+	count        int    // the number of decoded packets
+	skipped      bool   // true if data was not captured
+	broken       bool   // true after a malformed remaining length - where the packets start is then unknown
+	disconnected bool   // true after a DISCONNECT
+}
+
+// clientPackets are the packet types only a client sends, and brokerPackets those only a broker sends
+var (
+	clientPackets = map[int]bool{mqtt.ConnectType: true, mqtt.SubscribeType: true, mqtt.UnsubscribeType: true,
+		mqtt.PingReqType: true}
+	brokerPackets = map[int]bool{mqtt.ConnAckType: true, mqtt.SubAckType: true, mqtt.UnsubAckType: true,
+		mqtt.PingRespType: true}
+)
+
+// NewConversation returns a Conversation decoding packets as the given protocol level until it decodes a CONNECT
+func NewConversation(protocolLevel int) *Conversation {
+	return &Conversation{decoder: NewDecoder(protocolLevel)}
+}
+
+// Add adds data sent by the client (or else by the broker) and returns the packets it completes
+func (c *Conversation) Add(fromClient bool, data []byte) []*Packet {
+	s := &c.streams[index(fromClient)]
+	if s.broken {
+		s.offset += len(data)
+		return nil
+	}
+	s.buffer = append(s.buffer, data...)
+	var packets []*Packet
+	for len(s.buffer) > 0 {
+		n, complete := packetLength(s.buffer)
+		if !complete {
+			break
+		}
+		p, n := c.decoder.Decode(s.buffer[:n], s.offset)
+		if p.RemainingLength < 0 {
+			s.broken = true
+		}
+		c.check(fromClient, p)
+		packets = append(packets, p)
+		s.buffer = s.buffer[n:]
+		s.offset += n
+	}
+	if len(s.buffer) == 0 {
+		s.buffer = nil
+	}
+	return packets
+}
+
+// Skip tells the conversation that the given number of bytes sent by the client (or else by the broker) were not
+// captured. The data of an incomplete packet is dropped, and the number of its bytes is returned. Decoding resumes
+// with the next added data, which is taken to start a packet.
+//
+func (c *Conversation) Skip(fromClient bool, missing int) int {
+	s := &c.streams[index(fromClient)]
+	dropped := len(s.buffer)
+	s.offset += dropped + missing
+	s.buffer = nil
+	s.skipped = true
+	s.broken = false
+	return dropped
+}
+
+// Close returns the incomplete packet at the end of the data sent by the client (or else by the broker), decoded as
+// far as possible - nil if there is none
+//
+func (c *Conversation) Close(fromClient bool) *Packet {
+	s := &c.streams[index(fromClient)]
+	if len(s.buffer) == 0 || s.broken {
+		return nil
+	}
+	p, _ := c.decoder.Decode(s.buffer, s.offset)
+	s.offset += len(s.buffer)
+	s.buffer = nil
+	return p
+}
+
+// check reports a packet that violates the protocol in the conversation
+func (c *Conversation) check(fromClient bool, p *Packet) {
+	s := &c.streams[index(fromClient)]
+	s.count++
+	switch {
+	case fromClient && brokerPackets[p.Type]:
+		p.Problems = append(p.Problems, Problem{p.Offset, "a client must not send " + p.Name()})
+	case !fromClient && clientPackets[p.Type]:
+		p.Problems = append(p.Problems, Problem{p.Offset, "a broker must not send " + p.Name()})
+	case !fromClient && p.Type == mqtt.DisconnectType && p.ProtocolLevel < 5:
+		p.Problems = append(p.Problems, Problem{p.Offset, "a broker must not send DISCONNECT before MQTT 5"})
+	case s.skipped:
+	case fromClient && s.count == 1 && p.Type != mqtt.ConnectType:
+		p.Problems = append(p.Problems, Problem{p.Offset, "the first packet of a client must be CONNECT"})
+	case fromClient && s.count > 1 && p.Type == mqtt.ConnectType:
+		p.Problems = append(p.Problems, Problem{p.Offset, "a client must not send CONNECT more than once"})
+	case !fromClient && s.count == 1 && p.Type != mqtt.ConnAckType:
+		p.Problems = append(p.Problems, Problem{p.Offset, "the first packet of a broker must be CONNACK"})
+	}
+	if s.disconnected {
+		p.Problems = append(p.Problems, Problem{p.Offset, p.Name() + " was sent after DISCONNECT"})
+	}
+	if p.Type == mqtt.DisconnectType {
+		s.disconnected = true
+	}
+}
+
+// packetLength returns the length of the packet at the start of the given data, and false if the data does not have
+// all of it. The length of all of the data is returned if the remaining length is malformed.
+//
+func packetLength(data []byte) (int, bool) {
+	length := 0
+	multiplier := 1
+	for i := 1; i < 5; i++ {
+		if i == len(data) {
+			return 0, false
+		}
+		length += int(data[i]&127) * multiplier
+		if data[i]&128 == 0 {
+			return i + 1 + length, i+1+length <= len(data)
+		}
+		multiplier *= 128
+	}
+	return len(data), true
+}
+
+func index(fromClient bool) int {
+	if fromClient {
+		return 0
+	}
+	return 1
+}
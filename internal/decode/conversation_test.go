@@ -0,0 +1,51 @@
+package decode
+
+import (
+	"testing"
+
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func Test_Conversation_decodes_packets_split_over_data(t *testing.T) {
+	c := NewConversation(4)
+	connect := []byte{0x10, 0x0d, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, 0x00, 0x01, 'c'}
+	testutils.CheckEqual(0, len(c.Add(true, connect[:5])), t)
+	packets := c.Add(true, append(connect[5:], 0xc0, 0x00, 0xe0))
+	testutils.CheckEqual(2, len(packets), t)
+	testutils.CheckEqual("CONNECT", packets[0].Name(), t)
+	testutils.CheckFalse(packets[0].Malformed(), t)
+	testutils.CheckEqual(15, packets[1].Offset, t)
+	packets = c.Add(false, []byte{0x20, 0x02, 0x00, 0x00})
+	testutils.CheckEqual(1, len(packets), t)
+	testutils.CheckFalse(packets[0].Malformed(), t)
+
+	// the DISCONNECT started above is completed, and a PINGREQ after it is reported
+	packets = c.Add(true, []byte{0x00, 0xc0, 0x00})
+	testutils.CheckEqual(2, len(packets), t)
+	testutils.CheckEqual(Problem{19, "PINGREQ was sent after DISCONNECT"}, packets[1].Problems[0], t)
+}
+
+func Test_Conversation_reports_packets_violating_the_protocol(t *testing.T) {
+	c := NewConversation(4)
+	packets := c.Add(true, []byte{0xc0, 0x00, 0x20, 0x02, 0x00, 0x00})
+	testutils.CheckEqual(Problem{0, "the first packet of a client must be CONNECT"}, packets[0].Problems[0], t)
+	testutils.CheckEqual(Problem{2, "a client must not send CONNACK"}, packets[1].Problems[0], t)
+	packets = c.Add(false, []byte{0xd0, 0x00, 0xe0, 0x00})
+	testutils.CheckEqual(Problem{0, "the first packet of a broker must be CONNACK"}, packets[0].Problems[0], t)
+	testutils.CheckEqual(Problem{2, "a broker must not send DISCONNECT before MQTT 5"}, packets[1].Problems[0], t)
+}
+
+func Test_Conversation_resumes_after_data_that_was_not_captured(t *testing.T) {
+	c := NewConversation(4)
+	c.Add(true, []byte{0x30, 0x05, 0x00, 0x01})
+	testutils.CheckEqual(4, c.Skip(true, 3), t)
+	packets := c.Add(true, []byte{0xc0, 0x00, 0x30, 0x03})
+	testutils.CheckEqual(1, len(packets), t)
+	testutils.CheckEqual(7, packets[0].Offset, t)
+	testutils.CheckFalse(packets[0].Malformed(), t)
+
+	p := c.Close(true)
+	testutils.CheckEqual("PUBLISH", p.Name(), t)
+	testutils.CheckEqual(Problem{11, "truncated - the remaining length is 3 but 0 byte(s) follow"}, p.Problems[0], t)
+	testutils.CheckTrue(c.Close(true) == nil, t)
+}
@@ -0,0 +1,575 @@
+// Package decode decodes MQTT control packets field by field for inspection. Malformed packets are decoded as far
+// as possible, and what is wrong with them is reported with the byte offset of the offending field.
+//
+package decode
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+)
+
+// AuthType is the MQTT 5 control packet type AUTH (reserved in MQTT 3.1.1)
+const AuthType = 15
+
+// Part is the part of a packet a field is in
+type Part int
+
+const (
+	// FixedHeader is the packet type, flags, and remaining length
+	FixedHeader Part = iota
+
+	// VariableHeader is the fields between the fixed header and the properties or payload
+	VariableHeader
+
+	// Properties are the MQTT 5 properties (of the variable header, or of the will of a CONNECT)
+	Properties
+
+	// Payload is the payload of the packet
+	Payload
+)
+
+// String returns the name of the part
+func (p Part) String() string {
+	switch p {
+	case FixedHeader:
+		return "fixed header"
+	case VariableHeader:
+		return "variable header"
+	case Properties:
+		return "properties"
+	}
+	return "payload"
+}
+
+// Field is a decoded field of a packet
+type Field struct {
+	Offset int    // the offset of the first byte of the field
+	Length int    // the number of bytes of the field
+	Part   Part   // the part of the packet the field is in
+	Name   string // the name of the field, for example "packet id"
+	Value  string // the value of the field for display
+}
+
+// Problem is something that is malformed or violates the protocol in a packet
+type Problem struct {
+	Offset int    // the offset of the offending byte
+	Reason string // what is wrong
+}
+
+// String returns the problem as "offset N: reason"
+func (p Problem) String() string {
+	return fmt.Sprintf("offset %d: %s", p.Offset, p.Reason)
+}
+
+// Packet is a decoded MQTT control packet
+type Packet struct {
+	Offset          int       // the offset of the first byte of the packet
+	Data            []byte    // the bytes of the packet (those there were if it is truncated)
+	Type            int       // the control packet type, for example mqtt.PublishType
+	Flags           byte      // the lower 4 bits of the fixed header
+	RemainingLength int       // the remaining length of the fixed header (-1 if it is malformed)
+	ProtocolLevel   int       // the protocol level the packet was decoded as (4 for MQTT 3.1.1, 5 for MQTT 5)
+	Fields          []Field   // the decoded fields in the order of the packet
+	Problems        []Problem // what is malformed, in the order of the packet
+}
+
+// Name returns the name of the type of the packet, for example "PUBLISH"
+func (p *Packet) Name() string {
+	if p.Type == AuthType && p.ProtocolLevel >= 5 {
+		return "AUTH"
+	}
+	return mqtt.PacketTypeName(p.Type)
+}
+
+// Malformed returns true if the packet has problems
+func (p *Packet) Malformed() bool {
+	return len(p.Problems) > 0
+}
+
+// Decoder decodes packets of a connection. The protocol level of a decoded CONNECT is used for the packets decoded
+// after it - MQTT 5 packets have properties and reason codes that MQTT 3.1.1 packets do not have.
+//
+type Decoder struct {
+	level int
+}
+
+// NewDecoder returns a Decoder decoding packets as the given protocol level (3 for MQTT 3.1, 4 for MQTT 3.1.1,
+// or 5 for MQTT 5) until it decodes a CONNECT
+//
+func NewDecoder(protocolLevel int) *Decoder {
+	if protocolLevel < 3 || protocolLevel > 5 {
+		panic(fmt.Sprintf("Protocol level must be 3, 4, or 5, got %d", protocolLevel))
+	}
+	return &Decoder{level: protocolLevel}
+}
+
+// ProtocolLevel returns the protocol level packets are decoded as
+func (d *Decoder) ProtocolLevel() int {
+	return d.level
+}
+
+// DecodeAll decodes the packets in the given data, where the first byte is at the given offset. The decoding stops
+// at a packet with a malformed remaining length since where the next packet starts is then unknown.
+//
+func (d *Decoder) DecodeAll(data []byte, offset int) []*Packet {
+	var packets []*Packet
+	for pos := 0; pos < len(data); {
+		p, n := d.Decode(data[pos:], offset+pos)
+		packets = append(packets, p)
+		pos += n
+	}
+	return packets
+}
+
+// Decode decodes the packet at the start of the given data, where the first byte is at the given offset, and returns
+// it and the number of bytes it has. All of the data is taken to be the packet if its remaining length is malformed.
+// The data must not be empty.
+//
+func (d *Decoder) Decode(data []byte, offset int) (*Packet, int) {
+	p := &Packet{
+		Offset:          offset,
+		Type:            int(data[0] >> 4),
+		Flags:           data[0] & 0x0F,
+		RemainingLength: -1,
+		ProtocolLevel:   d.level,
+	}
+	r := &reader{packet: p, data: data, end: len(data), base: offset, part: FixedHeader}
+	r.add(0, 1, "type", fmt.Sprintf("%d (%s)", p.Type, p.Name()))
+	r.add(0, 1, "flags", d.flags(r))
+	r.pos = 1
+
+	length, pos, ok := r.varint("remaining length")
+	if !ok {
+		p.Data = data
+		return p, len(data)
+	}
+	p.RemainingLength = length
+	r.add(pos, r.pos-pos, "remaining length", strconv.Itoa(length))
+	if r.pos+length > len(data) {
+		r.problem(len(data), "truncated - the remaining length is %d but %d byte(s) follow", length, len(data)-r.pos)
+		r.truncated = true
+	} else {
+		r.end = r.pos + length
+	}
+	p.Data = data[:r.end]
+
+	r.part = VariableHeader
+	switch p.Type {
+	case mqtt.ConnectType:
+		d.decodeConnect(r)
+	case mqtt.ConnAckType:
+		d.decodeConnAck(r)
+	case mqtt.PublishType:
+		d.decodePublish(r)
+	case mqtt.PublishAckType, mqtt.PublishReceivedType, mqtt.PublishReleaseType, mqtt.PublishCompleteType:
+		d.decodeAck(r)
+	case mqtt.SubscribeType:
+		d.decodeSubscribe(r)
+	case mqtt.SubAckType, mqtt.UnsubAckType:
+		d.decodeSubAck(r)
+	case mqtt.UnsubscribeType:
+		d.decodeUnsubscribe(r)
+	case mqtt.DisconnectType, AuthType:
+		if d.level >= 5 {
+			d.decodeReason(r)
+		}
+	}
+	if !r.failed && r.pos < r.end {
+		r.problem(r.pos, "%d unexpected byte(s) at the end of the packet", r.end-r.pos)
+		r.add(r.pos, r.end-r.pos, "unexpected", hex.EncodeToString(data[r.pos:r.end]))
+	}
+	sort.SliceStable(p.Problems, func(i, j int) bool { return p.Problems[i].Offset < p.Problems[j].Offset })
+	return p, r.end
+}
+
+// flags returns the description of the flags of the fixed header, and reports flags that are not valid for the type
+func (d *Decoder) flags(r *reader) string {
+	p := r.packet
+	value := fmt.Sprintf("0x%x", p.Flags)
+	switch p.Type {
+	case mqtt.PublishType:
+		qos := int(p.Flags>>1) & 3
+		parts := []string{fmt.Sprintf("qos=%d", qos)}
+		if p.Flags&mqtt.DupBit != 0 {
+			parts = append(parts, "dup")
+			if qos == 0 {
+				r.problem(0, "the DUP flag must not be set when QoS is 0")
+			}
+		}
+		if p.Flags&mqtt.RetainBit != 0 {
+			parts = append(parts, "retain")
+		}
+		if qos == 3 {
+			r.problem(0, "QoS 3 is not valid")
+		}
+		return value + " (" + strings.Join(parts, ", ") + ")"
+
+	case mqtt.PublishReleaseType, mqtt.SubscribeType, mqtt.UnsubscribeType:
+		if p.Flags != 2 {
+			r.problem(0, "the flags of %s must be 0x2", p.Name())
+		}
+	case mqtt.Reserved:
+		r.problem(0, "packet type 0 is reserved")
+	case AuthType:
+		if d.level < 5 {
+			r.problem(0, "packet type 15 is reserved before MQTT 5")
+		} else if p.Flags != 0 {
+			r.problem(0, "the flags of %s must be 0", p.Name())
+		}
+	default:
+		if p.Flags != 0 {
+			r.problem(0, "the flags of %s must be 0", p.Name())
+		}
+	}
+	return value
+}
+
+func (d *Decoder) decodeConnect(r *reader) {
+	name, namePos, ok := r.stringField("protocol name")
+	if !ok {
+		return
+	}
+	level, levelPos, ok := r.byte("protocol level")
+	if !ok {
+		return
+	}
+	switch {
+	case level < 3 || level > 5:
+		r.add(levelPos, 1, "protocol level", strconv.Itoa(int(level)))
+		r.problem(levelPos, "unsupported protocol level %d", level)
+	default:
+		r.add(levelPos, 1, "protocol level", fmt.Sprintf("%d (%s)", level, protocolNames[level]))
+		if expected := protocolName(int(level)); name != expected {
+			r.problem(namePos, "the protocol name of protocol level %d is '%s', got '%s'", level, expected, name)
+		}
+		d.level = int(level)
+		r.packet.ProtocolLevel = d.level
+	}
+
+	flags, flagsPos, ok := r.byte("connect flags")
+	if !ok {
+		return
+	}
+	r.add(flagsPos, 1, "connect flags", d.connectFlags(r, flagsPos, flags))
+	keepAlive, pos, ok := r.uint16("keep alive")
+	if !ok {
+		return
+	}
+	r.add(pos, 2, "keep alive", fmt.Sprintf("%d s", keepAlive))
+	if d.level >= 5 && !r.properties("") {
+		return
+	}
+
+	r.part = Payload
+	if _, _, ok := r.stringField("client id"); !ok {
+		return
+	}
+	if flags&mqtt.WillFlag != 0 {
+		if d.level >= 5 && !r.properties("will ") {
+			return
+		}
+		topic, pos, ok := r.stringField("will topic")
+		if !ok {
+			return
+		}
+		if err := mqtt.ValidateTopicName(topic); err != nil {
+			r.problem(pos, "the will topic is not valid: %s", err)
+		}
+		message, pos, ok := r.bytes("will message")
+		if !ok {
+			return
+		}
+		r.add(pos, r.pos-pos, "will message", payload(message))
+	}
+	if flags&mqtt.UserNameFlag != 0 {
+		if _, _, ok := r.stringField("user name"); !ok {
+			return
+		}
+	}
+	if flags&mqtt.PasswordFlag != 0 {
+		password, pos, ok := r.bytes("password")
+		if !ok {
+			return
+		}
+		r.add(pos, r.pos-pos, "password", fmt.Sprintf("(%d bytes)", len(password)))
+	}
+}
+
+// connectFlags returns the description of the flags of a CONNECT, and reports flags that are not valid
+func (d *Decoder) connectFlags(r *reader, pos int, flags byte) string {
+	var parts []string
+	names := []struct {
+		bit  byte
+		name string
+	}{
+		{mqtt.UserNameFlag, "user name"},
+		{mqtt.PasswordFlag, "password"},
+		{mqtt.WillRetainFlag, "will retain"},
+		{mqtt.WillFlag, "will"},
+		{mqtt.CleanSessionFlag, "clean session"},
+	}
+	for _, n := range names {
+		if flags&n.bit != 0 {
+			parts = append(parts, n.name)
+		}
+	}
+	willQoS := int(flags>>3) & 3
+	if willQoS != 0 {
+		parts = append(parts, fmt.Sprintf("will qos=%d", willQoS))
+	}
+	if flags&1 != 0 {
+		r.problem(pos, "the reserved connect flag must be 0")
+	}
+	if willQoS == 3 {
+		r.problem(pos, "will QoS 3 is not valid")
+	}
+	if flags&mqtt.WillFlag == 0 && (willQoS != 0 || flags&mqtt.WillRetainFlag != 0) {
+		r.problem(pos, "will QoS and will retain must be 0 when there is no will")
+	}
+	if d.level < 5 && flags&mqtt.PasswordFlag != 0 && flags&mqtt.UserNameFlag == 0 {
+		r.problem(pos, "a password requires a user name before MQTT 5")
+	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("0x%02x", flags)
+	}
+	return fmt.Sprintf("0x%02x (%s)", flags, strings.Join(parts, ", "))
+}
+
+func (d *Decoder) decodeConnAck(r *reader) {
+	flags, pos, ok := r.byte("acknowledge flags")
+	if !ok {
+		return
+	}
+	if flags&1 != 0 {
+		r.add(pos, 1, "acknowledge flags", fmt.Sprintf("0x%02x (session present)", flags))
+	} else {
+		r.add(pos, 1, "acknowledge flags", fmt.Sprintf("0x%02x", flags))
+	}
+	if flags&0xFE != 0 {
+		r.problem(pos, "the reserved acknowledge flags must be 0")
+	}
+	if d.level < 5 {
+		code, pos, ok := r.byte("return code")
+		if !ok {
+			return
+		}
+		name, known := connAckCodes[code]
+		if !known {
+			name = "unknown"
+			r.problem(pos, "unknown return code %d", code)
+		}
+		r.add(pos, 1, "return code", fmt.Sprintf("%d (%s)", code, name))
+		return
+	}
+	if !r.reasonCode() {
+		return
+	}
+	r.properties("")
+}
+
+func (d *Decoder) decodePublish(r *reader) {
+	topic, pos, ok := r.stringField("topic name")
+	if !ok {
+		return
+	}
+	// MQTT 5 allows an empty topic name when a topic alias is used
+	if topic != "" || d.level < 5 {
+		if err := mqtt.ValidateTopicName(topic); err != nil {
+			r.problem(pos, "the topic name is not valid: %s", err)
+		}
+	}
+	if int(r.packet.Flags>>1)&3 != 0 {
+		if !r.packetID() {
+			return
+		}
+	}
+	if d.level >= 5 && !r.properties("") {
+		return
+	}
+	r.part = Payload
+	message := r.data[r.pos:r.end]
+	r.add(r.pos, len(message), "message", payload(message))
+	r.pos = r.end
+}
+
+// decodeAck decodes a PUBACK, PUBREC, PUBREL, or PUBCOMP
+func (d *Decoder) decodeAck(r *reader) {
+	if !r.packetID() {
+		return
+	}
+	if d.level >= 5 && r.pos < r.end {
+		d.decodeReason(r)
+	}
+}
+
+// decodeReason decodes the optional reason code and properties of an MQTT 5 PUBACK, PUBREC, PUBREL, PUBCOMP,
+// DISCONNECT, or AUTH
+//
+func (d *Decoder) decodeReason(r *reader) {
+	if r.pos < r.end && !r.reasonCode() {
+		return
+	}
+	if r.pos < r.end {
+		r.properties("")
+	}
+}
+
+func (d *Decoder) decodeSubscribe(r *reader) {
+	if !r.packetID() {
+		return
+	}
+	if d.level >= 5 && !r.properties("") {
+		return
+	}
+	r.part = Payload
+	if r.pos == r.end && !r.truncated {
+		r.problem(r.pos, "a SUBSCRIBE must have at least one topic filter")
+	}
+	for r.pos < r.end {
+		if !r.topicFilter() {
+			return
+		}
+		options, pos, ok := r.byte("subscription options")
+		if !ok {
+			return
+		}
+		r.add(pos, 1, "subscription options", d.subscriptionOptions(r, pos, options))
+	}
+}
+
+// subscriptionOptions returns the description of the options of a subscription, and reports options that are not
+// valid
+//
+func (d *Decoder) subscriptionOptions(r *reader, pos int, options byte) string {
+	qos := options & 3
+	parts := []string{fmt.Sprintf("qos=%d", qos)}
+	if qos == 3 {
+		r.problem(pos, "QoS 3 is not valid")
+	}
+	reserved := byte(0xFC)
+	if d.level >= 5 {
+		reserved = 0xC0
+		if options&0x04 != 0 {
+			parts = append(parts, "no local")
+		}
+		if options&0x08 != 0 {
+			parts = append(parts, "retain as published")
+		}
+		handling := options >> 4 & 3
+		parts = append(parts, fmt.Sprintf("retain handling=%d", handling))
+		if handling == 3 {
+			r.problem(pos, "retain handling 3 is not valid")
+		}
+	}
+	if options&reserved != 0 {
+		r.problem(pos, "the reserved bits of the subscription options must be 0")
+	}
+	return fmt.Sprintf("0x%02x (%s)", options, strings.Join(parts, ", "))
+}
+
+// decodeSubAck decodes a SUBACK, or UNSUBACK
+func (d *Decoder) decodeSubAck(r *reader) {
+	if !r.packetID() {
+		return
+	}
+	if r.packet.Type == mqtt.UnsubAckType && d.level < 5 {
+		return
+	}
+	if d.level >= 5 && !r.properties("") {
+		return
+	}
+	r.part = Payload
+	if r.pos == r.end && !r.truncated {
+		r.problem(r.pos, "a %s must have at least one reason code", r.packet.Name())
+	}
+	for r.pos < r.end {
+		if d.level >= 5 {
+			if !r.reasonCode() {
+				return
+			}
+			continue
+		}
+		code, pos, _ := r.byte("return code")
+		switch {
+		case code <= 2:
+			r.add(pos, 1, "return code", fmt.Sprintf("%d (granted qos=%d)", code, code))
+		case code == mqtt.SubAckFailure:
+			r.add(pos, 1, "return code", fmt.Sprintf("0x%02x (failure)", code))
+		default:
+			r.add(pos, 1, "return code", fmt.Sprintf("0x%02x (unknown)", code))
+			r.problem(pos, "unknown return code 0x%02x", code)
+		}
+	}
+}
+
+func (d *Decoder) decodeUnsubscribe(r *reader) {
+	if !r.packetID() {
+		return
+	}
+	if d.level >= 5 && !r.properties("") {
+		return
+	}
+	r.part = Payload
+	if r.pos == r.end && !r.truncated {
+		r.problem(r.pos, "an UNSUBSCRIBE must have at least one topic filter")
+	}
+	for r.pos < r.end {
+		if !r.topicFilter() {
+			return
+		}
+	}
+}
+
+// protocolNames are the names of the protocol levels
+var protocolNames = map[byte]string{3: "MQTT 3.1", 4: "MQTT 3.1.1", 5: "MQTT 5"}
+
+// protocolName returns the protocol name a CONNECT of the given protocol level must have
+func protocolName(level int) string {
+	if level == 3 {
+		return "MQIsdp"
+	}
+	return "MQTT"
+}
+
+// connAckCodes are the names of the return codes of an MQTT 3.1.1 CONNACK
+var connAckCodes = map[byte]string{
+	mqtt.ConnectionAccepted:                  "connection accepted",
+	mqtt.ConnectionRefusedRejectedVersion:    "unacceptable protocol version",
+	mqtt.ConnectionRefusedRejectedIdentifier: "identifier rejected",
+	mqtt.ConnectionRefusedServerUnavailable:  "server unavailable",
+	mqtt.ConnectionRefusedBadUserPassword:    "bad user name or password",
+	mqtt.ConnectionRefusedNotAuthorized:      "not authorized",
+}
+
+// payload returns the given bytes for display - as a quoted string if they are printable UTF-8 text, and otherwise
+// as a hex dump
+//
+func payload(data []byte) string {
+	if len(data) == 0 {
+		return "(empty)"
+	}
+	if isText(data) {
+		return strconv.Quote(string(data))
+	}
+	return fmt.Sprintf("(%d bytes)\n%s", len(data), strings.TrimSuffix(hex.Dump(data), "\n"))
+}
+
+// isText returns true if the given bytes are UTF-8 text without control characters other than white space
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, c := range string(data) {
+		if !unicode.IsPrint(c) && !unicode.IsSpace(c) {
+			return false
+		}
+	}
+	return true
+}
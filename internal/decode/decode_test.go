@@ -0,0 +1,126 @@
+package decode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+// testhelperField returns the value of the field with the given name in the packet (fails the test if there is none)
+func testhelperField(p *Packet, name string, t *testing.T) Field {
+	t.Helper()
+	for _, f := range p.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	t.Fatalf("Expected a field named '%s' in %s", name, p.Format())
+	return Field{}
+}
+
+func Test_Decoder_decodes_the_fields_of_packets_written_by_the_library(t *testing.T) {
+	var data bytes.Buffer
+	mqtt.NewConnectRequest(mqtt.ClientName("decoded"), mqtt.KeepAliveSeconds(30)).MakeMessage().WriteTo(&data)
+	mqtt.NewPublishRequest(mqtt.Topic("a/b"), mqtt.Message([]byte("hello")), mqtt.QoS(1), mqtt.PacketID(7)).MakeMessage().WriteTo(&data)
+	// a SUBSCRIBE gets its packet ID from the session
+	data.Write([]byte{0x82, 0x08, 0x00, 0x05, 0x00, 0x03, 'c', '/', '#', 0x02})
+
+	packets := NewDecoder(4).DecodeAll(data.Bytes(), 0)
+	testutils.CheckEqual(3, len(packets), t)
+	for _, p := range packets {
+		testutils.CheckFalse(p.Malformed(), t)
+	}
+	testutils.CheckEqual(`"decoded"`, testhelperField(packets[0], "client id", t).Value, t)
+	testutils.CheckEqual("30 s", testhelperField(packets[0], "keep alive", t).Value, t)
+	testutils.CheckEqual("0x2 (qos=1)", testhelperField(packets[1], "flags", t).Value, t)
+	testutils.CheckEqual("7", testhelperField(packets[1], "packet id", t).Value, t)
+	message := testhelperField(packets[1], "message", t)
+	testutils.CheckEqual(`"hello"`, message.Value, t)
+	testutils.CheckEqual(Payload, message.Part, t)
+	testutils.CheckEqual(packets[1].Offset+len(packets[1].Data)-5, message.Offset, t)
+	testutils.CheckEqual(`"c/#"`, testhelperField(packets[2], "topic filter", t).Value, t)
+	testutils.CheckEqual("0x02 (qos=2)", testhelperField(packets[2], "subscription options", t).Value, t)
+}
+
+func Test_Decoder_reports_malformed_fields_with_their_offset(t *testing.T) {
+	for _, c := range []struct {
+		data    []byte
+		problem Problem
+	}{
+		{[]byte{0x36, 0x00}, Problem{0, "QoS 3 is not valid"}},
+		{[]byte{0x60, 0x02, 0x00, 0x01}, Problem{0, "the flags of PUBREL must be 0x2"}},
+		{[]byte{0x40, 0x02, 0x00, 0x00}, Problem{2, "the packet id must not be 0"}},
+		{[]byte{0x40, 0x03, 0x00, 0x01, 0x00}, Problem{4, "1 unexpected byte(s) at the end of the packet"}},
+		{[]byte{0x30, 0x05, 0x00, 0x03, 'a'}, Problem{5, "truncated - the remaining length is 5 but 3 byte(s) follow"}},
+		{[]byte{0x30, 0x03, 0x00, 0x03, 'a'}, Problem{4, "expected 3 byte(s) of topic name but 1 remain"}},
+		{[]byte{0x30, 0x04, 0x00, 0x02, 'a', '#'}, Problem{2, "the topic name is not valid: " + mqtt.ValidateTopicName("a#").Error()}},
+		{[]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, Problem{1, "malformed remaining length - more than 4 bytes"}},
+		{[]byte{0x82, 0x02, 0x00, 0x01}, Problem{4, "a SUBSCRIBE must have at least one topic filter"}},
+		{[]byte{0x20, 0x02, 0x02, 0x06}, Problem{2, "the reserved acknowledge flags must be 0"}},
+	} {
+		p, _ := NewDecoder(4).Decode(c.data, 0)
+		testutils.CheckTrue(p.Malformed(), t)
+		testutils.CheckEqual(c.problem, p.Problems[0], t)
+	}
+}
+
+func Test_Decoder_decodes_as_the_protocol_level_of_a_CONNECT(t *testing.T) {
+	data, err := ParseHex(`
+		10 10 00 04 4d 51 54 54 05 02 00 3c 03 21 00 0a 00 00
+		40 08 00 01 87 04 1f 00 01 78`)
+	testutils.CheckNotError(err, t)
+	d := NewDecoder(4)
+	packets := d.DecodeAll(data, 0)
+	testutils.CheckEqual(5, d.ProtocolLevel(), t)
+	testutils.CheckEqual(2, len(packets), t)
+	testutils.CheckEqual("10", testhelperField(packets[0], "receive maximum", t).Value, t)
+	testutils.CheckEqual(Properties, testhelperField(packets[0], "receive maximum", t).Part, t)
+	testutils.CheckEqual("0x87 (not authorized)", testhelperField(packets[1], "reason code", t).Value, t)
+	testutils.CheckEqual(`"x"`, testhelperField(packets[1], "reason string", t).Value, t)
+	testutils.CheckFalse(packets[1].Malformed(), t)
+
+	// the same PUBACK is malformed in MQTT 3.1.1
+	p, _ := NewDecoder(4).Decode(data[18:], 18)
+	testutils.CheckEqual(Problem{22, "6 unexpected byte(s) at the end of the packet"}, p.Problems[0], t)
+}
+
+func Test_Format_lists_the_fields_by_part_and_the_problems(t *testing.T) {
+	p, _ := NewDecoder(4).Decode([]byte{0x32, 0x08, 0x00, 0x01, 'a', 0x00, 0x00, 0xff, 0x00, 0x01}, 0)
+	testutils.CheckEqual(strings.Join([]string{
+		"PUBLISH at offset 0 (10 bytes) MALFORMED",
+		"  fixed header",
+		"         0  type              3 (PUBLISH)",
+		"         0  flags             0x2 (qos=1)",
+		"         1  remaining length  8",
+		"  variable header",
+		"         2  topic name        \"a\"",
+		"         5  packet id         0",
+		"  payload",
+		"         7  message           (3 bytes)",
+		"                              00000000  ff 00 01                                          |...|",
+		"  ! offset 5: the packet id must not be 0",
+		"",
+	}, "\n"), p.Format(), t)
+}
+
+func Test_ParseHex_accepts_separators_and_hex_dumps(t *testing.T) {
+	expected := []byte{0x30, 0x05, 0x00, 0x01, 0x61, 0xab}
+	for _, text := range []string{
+		"30050001 61ab",
+		"0x30, 0x05, 0x00, 0x01, 0x61, 0xAB",
+		"30:05:00:01:61:ab\n",
+		"0000   30 05 00 01 61 ab                                 0...a.",
+		"00000000  30 05 00 01 61 ab                                 |0...a.|",
+	} {
+		data, err := ParseHex(text)
+		testutils.CheckNotError(err, t)
+		testutils.CheckEqual(expected, data, t)
+	}
+	_, err := ParseHex("30 0")
+	testutils.CheckEqual("line 1: odd number of hex digits in '0'", err.Error(), t)
+	_, err = ParseHex("30 zz")
+	testutils.CheckEqual("line 1: 'zz' is not hex", err.Error(), t)
+}
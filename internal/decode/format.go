@@ -0,0 +1,126 @@
+package decode
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+)
+
+// Format returns the packet as text - a line with the type and size of the packet followed by its fields grouped by
+// part, each with its offset, and then the problems. Values of more than one line (hex dumps) are indented.
+//
+func (p *Packet) Format() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s at offset %d (%d bytes)", p.Name(), p.Offset, len(p.Data))
+	if p.Malformed() {
+		b.WriteString(" MALFORMED")
+	}
+	b.WriteString("\n")
+
+	width := 0
+	for _, f := range p.Fields {
+		if len(f.Name) > width {
+			width = len(f.Name)
+		}
+	}
+	part := Part(-1)
+	for _, f := range p.Fields {
+		if f.Part != part {
+			part = f.Part
+			fmt.Fprintf(&b, "  %s\n", part)
+		}
+		lines := strings.Split(f.Value, "\n")
+		fmt.Fprintf(&b, "    %6d  %-*s  %s\n", f.Offset, width, f.Name, lines[0])
+		for _, line := range lines[1:] {
+			fmt.Fprintf(&b, "    %6s  %-*s  %s\n", "", width, "", line)
+		}
+	}
+	for _, problem := range p.Problems {
+		fmt.Fprintf(&b, "  ! %s\n", problem)
+	}
+	return b.String()
+}
+
+// maxSummaryValue is the longest value of a field in a summary
+const maxSummaryValue = 40
+
+// Summary returns a line describing the packet with the values of its fields, for example
+// `PUBLISH 0x2 (qos=1) topic name="a/b", packet id=7, message="hello"`. Lengths are left out, and long values are
+// shortened.
+//
+func (p *Packet) Summary() string {
+	var b strings.Builder
+	b.WriteString(p.Name())
+	separator := " "
+	for _, f := range p.Fields {
+		switch {
+		case f.Part == FixedHeader:
+			if f.Name == "flags" && p.Type == mqtt.PublishType {
+				b.WriteString(" " + f.Value)
+			}
+			continue
+		case strings.HasSuffix(f.Name, "property length"):
+			continue
+		}
+		value := strings.SplitN(f.Value, "\n", 2)[0]
+		if len(value) > maxSummaryValue {
+			value = value[:maxSummaryValue-3] + "..."
+		}
+		b.WriteString(separator + f.Name + "=" + value)
+		separator = ", "
+	}
+	return b.String()
+}
+
+// dumpLine matches a line of a hex dump from Wireshark ("Copy as Hex Dump") or hexdump -C - an offset followed by
+// at least two spaces
+//
+var dumpLine = regexp.MustCompile(`^[0-9a-fA-F]{4,8}\s{2,}`)
+
+// ParseHex returns the bytes of the given hex. The hex may have white space, commas, colons, and dashes between
+// bytes, and 0x in front of bytes. A hex dump from Wireshark or hexdump -C, where each line starts with an offset
+// and may end with the bytes as characters, is also accepted.
+//
+func ParseHex(text string) ([]byte, error) {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	dump := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" && !dumpLine.MatchString(line) {
+			dump = false
+			break
+		}
+	}
+
+	var result bytes.Buffer
+	for i, line := range lines {
+		if dump {
+			line = dumpLine.ReplaceAllString(line, "")
+			// the characters start with a | in hexdump -C, and after 3 spaces in Wireshark
+			if at := strings.Index(line, "|"); at >= 0 {
+				line = line[:at]
+			}
+			if at := strings.Index(line, "   "); at >= 0 {
+				line = line[:at]
+			}
+		}
+		digits := strings.NewReplacer("0x", " ", "0X", " ", ",", " ", ":", " ", "-", " ").Replace(line)
+		for _, word := range strings.Fields(digits) {
+			if len(word)%2 != 0 {
+				return nil, fmt.Errorf("line %d: odd number of hex digits in '%s'", i+1, word)
+			}
+			data, err := hex.DecodeString(word)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: '%s' is not hex", i+1, word)
+			}
+			result.Write(data)
+		}
+	}
+	if result.Len() == 0 {
+		return nil, fmt.Errorf("there is no hex")
+	}
+	return result.Bytes(), nil
+}
@@ -0,0 +1,117 @@
+package decode
+
+import "github.com/hlindberg/mezquit/internal/mqtt"
+
+// propertyKind is the data type of the value of an MQTT 5 property
+type propertyKind int
+
+const (
+	byteProperty propertyKind = iota
+	twoByteProperty
+	fourByteProperty
+	varintProperty
+	stringProperty
+	binaryProperty
+	stringPairProperty
+)
+
+// property describes an MQTT 5 property
+type property struct {
+	name       string
+	kind       propertyKind
+	repeatable bool // true if the property may be given more than once
+}
+
+// properties are the MQTT 5 properties by identifier
+var properties = map[int]property{
+	0x01: {"payload format indicator", byteProperty, false},
+	0x02: {"message expiry interval", fourByteProperty, false},
+	0x03: {"content type", stringProperty, false},
+	0x08: {"response topic", stringProperty, false},
+	0x09: {"correlation data", binaryProperty, false},
+	0x0B: {"subscription identifier", varintProperty, true},
+	0x11: {"session expiry interval", fourByteProperty, false},
+	0x12: {"assigned client identifier", stringProperty, false},
+	0x13: {"server keep alive", twoByteProperty, false},
+	0x15: {"authentication method", stringProperty, false},
+	0x16: {"authentication data", binaryProperty, false},
+	0x17: {"request problem information", byteProperty, false},
+	0x18: {"will delay interval", fourByteProperty, false},
+	0x19: {"request response information", byteProperty, false},
+	0x1A: {"response information", stringProperty, false},
+	0x1C: {"server reference", stringProperty, false},
+	0x1F: {"reason string", stringProperty, false},
+	0x21: {"receive maximum", twoByteProperty, false},
+	0x22: {"topic alias maximum", twoByteProperty, false},
+	0x23: {"topic alias", twoByteProperty, false},
+	0x24: {"maximum qos", byteProperty, false},
+	0x25: {"retain available", byteProperty, false},
+	0x26: {"user property", stringPairProperty, true},
+	0x27: {"maximum packet size", fourByteProperty, false},
+	0x28: {"wildcard subscription available", byteProperty, false},
+	0x29: {"subscription identifier available", byteProperty, false},
+	0x2A: {"shared subscription available", byteProperty, false},
+}
+
+// reasonCodes are the names of the MQTT 5 reason codes (0x00 - 0x02 depend on the packet type)
+var reasonCodes = map[byte]string{
+	0x04: "disconnect with will message",
+	0x10: "no matching subscribers",
+	0x11: "no subscription existed",
+	0x18: "continue authentication",
+	0x19: "re-authenticate",
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8A: "banned",
+	0x8B: "server shutting down",
+	0x8C: "bad authentication method",
+	0x8D: "keep alive timeout",
+	0x8E: "session taken over",
+	0x8F: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x92: "packet identifier not found",
+	0x93: "receive maximum exceeded",
+	0x94: "topic alias invalid",
+	0x95: "packet too large",
+	0x96: "message rate too high",
+	0x97: "quota exceeded",
+	0x98: "administrative action",
+	0x99: "payload format invalid",
+	0x9A: "retain not supported",
+	0x9B: "qos not supported",
+	0x9C: "use another server",
+	0x9D: "server moved",
+	0x9E: "shared subscriptions not supported",
+	0x9F: "connection rate exceeded",
+	0xA0: "maximum connect time",
+	0xA1: "subscription identifiers not supported",
+	0xA2: "wildcard subscriptions not supported",
+}
+
+// reasonName returns the name of the given MQTT 5 reason code in a packet of the given type, and false if the code
+// is not known
+//
+func reasonName(packetType int, code byte) (string, bool) {
+	switch {
+	case packetType == mqtt.SubAckType && code <= 2:
+		return [...]string{"granted qos=0", "granted qos=1", "granted qos=2"}[code], true
+	case code == 0 && packetType == mqtt.DisconnectType:
+		return "normal disconnection", true
+	case code == 0:
+		return "success", true
+	}
+	name, ok := reasonCodes[code]
+	if !ok {
+		return "unknown", false
+	}
+	return name, true
+}
@@ -0,0 +1,258 @@
+package decode
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+)
+
+// reader reads the fields of a packet, and adds them and the problems found to the packet. Positions are indexes
+// in the data of the packet - they are reported as offsets from the base.
+//
+type reader struct {
+	packet    *Packet
+	data      []byte // the bytes of the packet
+	pos       int    // the position of the next byte to read
+	end       int    // the end of the packet (or of its properties when reading those)
+	base      int    // the offset of the first byte of the data
+	part      Part   // the part added fields are in
+	truncated bool   // true if the packet is truncated (reading past its end is then not reported)
+	failed    bool   // true when a field could not be read - the rest of the packet is then not decoded
+}
+
+// add adds a field at the given position with the given length to the packet
+func (r *reader) add(pos, length int, name, value string) {
+	r.packet.Fields = append(r.packet.Fields,
+		Field{Offset: r.base + pos, Length: length, Part: r.part, Name: name, Value: value})
+}
+
+// problem adds a problem at the given position to the packet
+func (r *reader) problem(pos int, format string, values ...interface{}) {
+	r.packet.Problems = append(r.packet.Problems, Problem{Offset: r.base + pos, Reason: fmt.Sprintf(format, values...)})
+}
+
+// take consumes n bytes and returns the position of the first. The reader fails if there are not that many bytes
+// left.
+//
+func (r *reader) take(n int, what string) (int, bool) {
+	if r.failed {
+		return 0, false
+	}
+	if r.pos+n > r.end {
+		if !r.truncated || r.end < len(r.data) {
+			r.problem(r.pos, "expected %d byte(s) of %s but %d remain", n, what, r.end-r.pos)
+		}
+		r.failed = true
+		return 0, false
+	}
+	pos := r.pos
+	r.pos += n
+	return pos, true
+}
+
+func (r *reader) byte(what string) (byte, int, bool) {
+	pos, ok := r.take(1, what)
+	if !ok {
+		return 0, 0, false
+	}
+	return r.data[pos], pos, true
+}
+
+func (r *reader) uint16(what string) (int, int, bool) {
+	pos, ok := r.take(2, what)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(r.data[pos])<<8 | int(r.data[pos+1]), pos, true
+}
+
+func (r *reader) uint32(what string) (int, int, bool) {
+	pos, ok := r.take(4, what)
+	if !ok {
+		return 0, 0, false
+	}
+	d := r.data[pos:]
+	return int(d[0])<<24 | int(d[1])<<16 | int(d[2])<<8 | int(d[3]), pos, true
+}
+
+// varint reads a variable byte integer of at most 4 bytes
+func (r *reader) varint(what string) (int, int, bool) {
+	start := r.pos
+	value := 0
+	multiplier := 1
+	for i := 0; i < 4; i++ {
+		pos, ok := r.take(1, what)
+		if !ok {
+			return 0, 0, false
+		}
+		value += int(r.data[pos]&127) * multiplier
+		if r.data[pos]&128 == 0 {
+			return value, start, true
+		}
+		multiplier *= 128
+	}
+	r.problem(start, "malformed %s - more than 4 bytes", what)
+	r.failed = true
+	return 0, 0, false
+}
+
+// bytes reads binary data - a 16 bit length followed by that many bytes
+func (r *reader) bytes(what string) ([]byte, int, bool) {
+	length, pos, ok := r.uint16(what + " length")
+	if !ok {
+		return nil, 0, false
+	}
+	if _, ok := r.take(length, what); !ok {
+		return nil, 0, false
+	}
+	return r.data[pos+2 : r.pos], pos, true
+}
+
+// string reads a UTF-8 string and reports it if it is not valid UTF-8 or contains U+0000
+func (r *reader) string(what string) (string, int, bool) {
+	data, pos, ok := r.bytes(what)
+	if !ok {
+		return "", 0, false
+	}
+	switch {
+	case !utf8.Valid(data):
+		r.problem(pos, "%s is not valid UTF-8", what)
+	case strings.ContainsRune(string(data), 0):
+		r.problem(pos, "%s contains U+0000", what)
+	}
+	return string(data), pos, true
+}
+
+// stringField reads a UTF-8 string and adds it as a field
+func (r *reader) stringField(name string) (string, int, bool) {
+	value, pos, ok := r.string(name)
+	if ok {
+		r.add(pos, r.pos-pos, name, strconv.Quote(value))
+	}
+	return value, pos, ok
+}
+
+// packetID reads a packet id and adds it as a field. A packet id of 0 is reported.
+func (r *reader) packetID() bool {
+	id, pos, ok := r.uint16("packet id")
+	if !ok {
+		return false
+	}
+	r.add(pos, 2, "packet id", strconv.Itoa(id))
+	if id == 0 {
+		r.problem(pos, "the packet id must not be 0")
+	}
+	return true
+}
+
+// topicFilter reads a topic filter and adds it as a field. A filter that is not valid is reported.
+func (r *reader) topicFilter() bool {
+	filter, pos, ok := r.stringField("topic filter")
+	if !ok {
+		return false
+	}
+	if err := mqtt.ValidateTopicFilter(filter); err != nil {
+		r.problem(pos, "the topic filter is not valid: %s", err)
+	}
+	return true
+}
+
+// reasonCode reads an MQTT 5 reason code and adds it as a field. An unknown reason code is reported.
+func (r *reader) reasonCode() bool {
+	code, pos, ok := r.byte("reason code")
+	if !ok {
+		return false
+	}
+	name, known := reasonName(r.packet.Type, code)
+	r.add(pos, 1, "reason code", fmt.Sprintf("0x%02x (%s)", code, name))
+	if !known {
+		r.problem(pos, "unknown reason code 0x%02x", code)
+	}
+	return true
+}
+
+// properties reads MQTT 5 properties and adds them as fields with names starting with the given prefix. A property
+// that is not known, or not allowed more than once is reported.
+//
+func (r *reader) properties(prefix string) bool {
+	part := r.part
+	r.part = Properties
+	defer func() { r.part = part }()
+
+	length, pos, ok := r.varint(prefix + "property length")
+	if !ok {
+		return false
+	}
+	r.add(pos, r.pos-pos, prefix+"property length", strconv.Itoa(length))
+	if r.pos+length > r.end {
+		if !r.truncated {
+			r.problem(pos, "the %sproperty length %d exceeds the remaining %d byte(s)", prefix, length, r.end-r.pos)
+		}
+		r.failed = true
+		return false
+	}
+	end := r.end
+	r.end = r.pos + length
+	defer func() { r.end = end }()
+
+	seen := make(map[int]bool)
+	for r.pos < r.end {
+		id, pos, ok := r.varint("property identifier")
+		if !ok {
+			return false
+		}
+		p, known := properties[id]
+		if !known {
+			r.problem(pos, "unknown property identifier 0x%02x", id)
+			r.pos = r.end // the length of its value is unknown
+			return true
+		}
+		if seen[id] && !p.repeatable {
+			r.problem(pos, "the %s property must not be given more than once", p.name)
+		}
+		seen[id] = true
+		value, ok := r.propertyValue(p)
+		if !ok {
+			return false
+		}
+		r.add(pos, r.pos-pos, prefix+p.name, value)
+	}
+	return true
+}
+
+// propertyValue reads the value of the given property and returns it for display
+func (r *reader) propertyValue(p property) (string, bool) {
+	switch p.kind {
+	case byteProperty:
+		value, _, ok := r.byte(p.name)
+		return strconv.Itoa(int(value)), ok
+	case twoByteProperty:
+		value, _, ok := r.uint16(p.name)
+		return strconv.Itoa(value), ok
+	case fourByteProperty:
+		value, _, ok := r.uint32(p.name)
+		return strconv.Itoa(value), ok
+	case varintProperty:
+		value, _, ok := r.varint(p.name)
+		return strconv.Itoa(value), ok
+	case stringProperty:
+		value, _, ok := r.string(p.name)
+		return strconv.Quote(value), ok
+	case binaryProperty:
+		value, _, ok := r.bytes(p.name)
+		if isText(value) {
+			return strconv.Quote(string(value)), ok
+		}
+		return hex.EncodeToString(value), ok
+	}
+	key, _, ok := r.string(p.name + " key")
+	if !ok {
+		return "", false
+	}
+	value, _, ok := r.string(p.name + " value")
+	return fmt.Sprintf("%q = %q", key, value), ok
+}
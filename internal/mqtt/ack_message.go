@@ -0,0 +1,58 @@
+package mqtt
+
+import "bytes"
+
+// NewAckMessage returns a new message of the given acknowledgement type (PublishAckType, PublishReceivedType,
+// PublishReleaseType, PublishCompleteType, or UnsubAckType) for the given packet ID.
+//
+func NewAckMessage(ackType int, packetID int) *GenericMessage {
+	var buffer bytes.Buffer
+	Encode16BitIntTo(packetID, &buffer)
+	fixedHeader := byte(ackType << 4)
+	if ackType == PublishReleaseType {
+		fixedHeader |= PublishReleaseReserved
+	}
+	return &GenericMessage{fixedHeader: fixedHeader, body: buffer.Bytes()}
+}
+
+// NewConnAckMessage returns a new CONNACK message with the given Session Present flag and return code
+// (for example ConnectionAccepted).
+//
+func NewConnAckMessage(sessionPresent bool, returnCode int) *GenericMessage {
+	flags := byte(0)
+	if sessionPresent {
+		flags = 1
+	}
+	return &GenericMessage{fixedHeader: ConnAckType << 4, body: []byte{flags, byte(returnCode)}}
+}
+
+// NewSubAckMessage returns a new SUBACK message for the given packet ID with the given return codes - one per
+// subscription in the SUBSCRIBE; the granted QoS (0-2) or SubAckFailure.
+//
+func NewSubAckMessage(packetID int, returnCodes []byte) *GenericMessage {
+	var buffer bytes.Buffer
+	Encode16BitIntTo(packetID, &buffer)
+	buffer.Write(returnCodes)
+	return &GenericMessage{fixedHeader: SubAckType << 4, body: buffer.Bytes()}
+}
+
+// AckPacketID returns the packet ID of an acknowledgement (PUBACK, PUBREC, PUBREL, PUBCOMP, UNSUBACK) of the given type.
+// A *ProtocolError is returned if the message is not a valid acknowledgement of that type.
+//
+func AckPacketID(msg *GenericMessage, ackType int) (int, error) {
+	if int(msg.fixedHeader>>4) != ackType {
+		return 0, newProtocolError(msg, "expected %s but got packet type %d", PacketTypeName(ackType), msg.fixedHeader>>4)
+	}
+	reserved := byte(0)
+	if ackType == PublishReleaseType {
+		reserved = PublishReleaseReserved
+	}
+	if msg.fixedHeader&0x0F != reserved {
+		return 0, newProtocolError(msg, "%s reserved flags must be 0x%x", PacketTypeName(ackType), reserved)
+	}
+	body := msg.body
+	if len(body) != 2 {
+		return 0, newProtocolError(msg, "%s expects 2 bytes packet ID as the body - got %d", PacketTypeName(ackType), len(body))
+	}
+	return int(body[0])<<8 | int(body[1]), nil
+}
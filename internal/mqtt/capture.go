@@ -0,0 +1,181 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// CaptureFormat is the name of the capture format in the first line of a capture
+const CaptureFormat = "mezquit-capture"
+
+// maxCaptureLine is the longest line of a capture - a packet of the largest size MQTT allows in hex
+const maxCaptureLine = 2*(5+268435455) + 64
+
+// A capture is the packets sent and received on connections, as lines of JSON. The first line describes the
+// capture, and each following line is a packet:
+//
+//     {"format":"mezquit-capture","version":1,"started":"2020-04-01T12:00:00.000000001Z"}
+//     {"at_us":120,"dir":"sent","data":"101800044d515454..."}
+//     {"at_us":1543,"dir":"received","data":"20020000"}
+//
+// at_us is the number of microseconds since the capture started, dir tells if the packet was sent or received by
+// the side that was recorded, and data is the bytes of the packet in hex.
+//
+type captureHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Started time.Time `json:"started"`
+}
+
+type captureLine struct {
+	At   int64  `json:"at_us"`
+	Dir  string `json:"dir"`
+	Data string `json:"data"`
+}
+
+// Capture is the packets sent and received on connections, in the order they were recorded
+//
+type Capture struct {
+	Started time.Time
+	Records []CaptureRecord
+}
+
+// CaptureRecord is a packet in a capture
+//
+type CaptureRecord struct {
+	At   time.Duration // since the capture started
+	Sent bool          // true if the packet was sent by the recorded side, false if it was received
+	Data []byte        // the packet - a part of a packet if the connection ended in the middle of one
+}
+
+// Message returns the packet of the record. An error is returned if the data is not one complete packet.
+func (r *CaptureRecord) Message() (*GenericMessage, error) {
+	reader := bytes.NewReader(r.Data)
+	msg, err := ReadMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Len() > 0 {
+		return nil, fmt.Errorf("%d bytes after the end of the packet", reader.Len())
+	}
+	return msg, nil
+}
+
+// Direction returns "sent" or "received"
+func (r *CaptureRecord) Direction() string {
+	if r.Sent {
+		return "sent"
+	}
+	return "received"
+}
+
+// ReadCaptureFile reads a capture from the given file
+func ReadCaptureFile(fileName string) (*Capture, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	capture, err := ReadCapture(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	return capture, nil
+}
+
+// ReadCapture reads a capture. An error with the line number is returned if a line is not valid.
+func ReadCapture(reader io.Reader) (*Capture, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxCaptureLine)
+	lineNumber := 0
+	var capture *Capture
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if capture == nil {
+			var header captureHeader
+			if err := json.Unmarshal(line, &header); err != nil || header.Format != CaptureFormat {
+				return nil, fmt.Errorf("line %d: not a %s header", lineNumber, CaptureFormat)
+			}
+			if header.Version != 1 {
+				return nil, fmt.Errorf("line %d: unsupported %s version %d", lineNumber, CaptureFormat, header.Version)
+			}
+			capture = &Capture{Started: header.Started}
+			continue
+		}
+		var l captureLine
+		if err := json.Unmarshal(line, &l); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		if l.Dir != "sent" && l.Dir != "received" {
+			return nil, fmt.Errorf("line %d: dir must be 'sent' or 'received', got '%s'", lineNumber, l.Dir)
+		}
+		data, err := hex.DecodeString(l.Data)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: data is not hex: %s", lineNumber, err)
+		}
+		capture.Records = append(capture.Records, CaptureRecord{
+			At:   time.Duration(l.At) * time.Microsecond,
+			Sent: l.Dir == "sent",
+			Data: data,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %s", lineNumber+1, err)
+	}
+	if capture == nil {
+		return nil, fmt.Errorf("not a %s - it is empty", CaptureFormat)
+	}
+	return capture, nil
+}
+
+// CaptureWriter writes a capture. It is safe to use from several goroutines - records are written in the order
+// they are given.
+//
+type CaptureWriter struct {
+	mutex   sync.Mutex
+	writer  io.Writer
+	started time.Time
+	header  bool  // if the header has been written
+	err     error // the first error writing the capture
+}
+
+// NewCaptureWriter returns a CaptureWriter writing to the given writer. The capture starts now.
+func NewCaptureWriter(writer io.Writer) *CaptureWriter {
+	return &CaptureWriter{writer: writer, started: time.Now()}
+}
+
+// Record writes a record of the given packet, sent or received now. Once writing has failed, the error is returned
+// without writing anything more.
+//
+func (c *CaptureWriter) Record(sent bool, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	if !c.header {
+		encoder.Encode(captureHeader{Format: CaptureFormat, Version: 1, Started: c.started.UTC()})
+		c.header = true
+	}
+	r := CaptureRecord{Sent: sent}
+	encoder.Encode(captureLine{
+		At:   time.Since(c.started).Microseconds(),
+		Dir:  r.Direction(),
+		Data: hex.EncodeToString(data),
+	})
+	_, c.err = c.writer.Write(b.Bytes())
+	return c.err
+}
@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func Test_Capture_written_by_CaptureWriter_can_be_read(t *testing.T) {
+	var b bytes.Buffer
+	w := NewCaptureWriter(&b)
+	testutils.CheckNotError(w.Record(true, []byte{0xc0, 0x00}), t)
+	testutils.CheckNotError(w.Record(false, []byte{0xd0, 0x00}), t)
+	testutils.CheckTrue(strings.HasPrefix(b.String(), `{"format":"mezquit-capture","version":1,"started":"`), t)
+
+	capture, err := ReadCapture(&b)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(w.started.UTC(), capture.Started, t)
+	testutils.CheckEqual(2, len(capture.Records), t)
+	testutils.CheckTrue(capture.Records[0].Sent, t)
+	testutils.CheckEqual("received", capture.Records[1].Direction(), t)
+	testutils.CheckTrue(capture.Records[0].At <= capture.Records[1].At, t)
+	msg, err := capture.Records[1].Message()
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(PingRespType, msg.Type(), t)
+}
+
+func Test_ReadCapture_reports_the_line_of_an_error(t *testing.T) {
+	header := `{"format":"mezquit-capture","version":1,"started":"2020-04-01T12:00:00Z"}` + "\n"
+	for _, c := range []struct{ text, err string }{
+		{"", "not a mezquit-capture - it is empty"},
+		{`{"format":"other"}`, "line 1: not a mezquit-capture header"},
+		{`{"format":"mezquit-capture","version":2}`, "line 1: unsupported mezquit-capture version 2"},
+		{header + `{"at_us":1,"dir":"up","data":"c000"}`, "line 2: dir must be 'sent' or 'received', got 'up'"},
+		{header + "\n" + `{"at_us":1,"dir":"sent","data":"c0x0"}`, "line 3: data is not hex: encoding/hex: invalid byte: U+0078 'x'"},
+	} {
+		_, err := ReadCapture(strings.NewReader(c.text))
+		testutils.CheckError(err, t)
+		testutils.CheckEqual(c.err, err.Error(), t)
+	}
+}
+
+func Test_RecordingConnection_records_complete_packets_in_each_direction(t *testing.T) {
+	var b bytes.Buffer
+	mock := NewMockConnection()
+	conn := NewRecordingConnection(mock, NewCaptureWriter(&b))
+
+	// a PUBACK written in two parts followed by a PINGREQ, and a PINGRESP read one byte at a time
+	conn.Write([]byte{0x40, 0x02, 0x00})
+	conn.Write([]byte{0x01, 0xc0, 0x00})
+	mock.RemoteWrite([]byte{0xd0, 0x00})
+	buf := make([]byte, 1)
+	conn.Read(buf)
+	conn.Read(buf)
+	// a part of a PUBLISH is recorded on close
+	conn.Write([]byte{0x30, 0x05, 0x00})
+	conn.Close()
+
+	capture, err := ReadCapture(&b)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(4, len(capture.Records), t)
+	testutils.CheckEqual([]byte{0x40, 0x02, 0x00, 0x01}, capture.Records[0].Data, t)
+	testutils.CheckEqual([]byte{0xc0, 0x00}, capture.Records[1].Data, t)
+	testutils.CheckFalse(capture.Records[2].Sent, t)
+	testutils.CheckEqual([]byte{0xd0, 0x00}, capture.Records[2].Data, t)
+	testutils.CheckTrue(capture.Records[3].Sent, t)
+	_, err = capture.Records[3].Message()
+	testutils.CheckError(err, t)
+}
@@ -2,6 +2,7 @@ package mqtt
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 
 	log "github.com/sirupsen/logrus"
@@ -78,9 +79,9 @@ func (r *ConnectRequest) connectBits() byte {
 	return connectBits
 }
 
-// WriteTo writes the ConnectRequest to the given io.Writer
+// MakeMessage returns the CONNECT message for the request
 //
-func (r *ConnectRequest) makeMessage() *GenericMessage {
+func (r *ConnectRequest) MakeMessage() *GenericMessage {
 	var data bytes.Buffer // 64 bytes in the first Grow which should be enough unless client ID is very long (not worth optimizing)
 
 	connectBits := r.connectBits()
@@ -98,6 +99,9 @@ func (r *ConnectRequest) makeMessage() *GenericMessage {
 	data.WriteByte(connectBits)            // (8)    Connect Bits
 	data.WriteByte(byte(keepAlive >> 8))   // (9)    Keep Alive Seconds MSB
 	data.WriteByte(byte(keepAlive & 0xFF)) // (9-10) Keep Alive Seconds LSB
+	if r.options.Level == 5 {
+		encodeFourByteProperties(&data, SessionExpiryIntervalProperty, r.options.SessionExpirySeconds)
+	}
 
 	// PAYLOAD
 	// A Client ID is required as the first element of the payload.
@@ -108,6 +112,9 @@ func (r *ConnectRequest) makeMessage() *GenericMessage {
 	// Output rest of optional payload in required order
 	//
 	if connectBits&WillFlag != 0 {
+		if r.options.Level == 5 {
+			encodeFourByteProperties(&data, WillDelayIntervalProperty, r.options.WillDelaySeconds)
+		}
 		EncodeStringTo(r.options.WillTopic, &data)
 		EncodeBytesTo(r.options.WillMessage, &data)
 	}
@@ -145,6 +152,99 @@ func (r *ConnectRequest) IsCleanSession() bool {
 	return r.options.CleanSession
 }
 
+// Options returns the options of the ConnectRequest. For a decoded CONNECT these describe the received request.
+//
+func (r *ConnectRequest) Options() ConnectOptions {
+	return r.options
+}
+
+// ErrUnsupportedLevel is returned from DecodeConnect when the protocol level of the CONNECT is not supported
+var ErrUnsupportedLevel = errors.New("Unsupported protocol level")
+
+// DecodeConnect decodes a CONNECT message into a ConnectRequest. MQTT 3.1.1 (level 4) and MQTT 5 (level 5) are
+// supported - for another level the returned request has the Level of the CONNECT and the error is
+// ErrUnsupportedLevel. Of the MQTT 5 properties only the Session Expiry Interval and the Will Delay Interval are
+// kept, the others are only checked for being well formed.
+//
+func DecodeConnect(msg *GenericMessage) (*ConnectRequest, error) {
+	if int(msg.fixedHeader>>4) != ConnectType || msg.fixedHeader&0x0F != 0 {
+		return nil, fmt.Errorf("Expected CONNECT with reserved flags 0 - got fixed header 0x%x", msg.fixedHeader)
+	}
+	protocolName, body, err := decodeString(msg.body)
+	if err != nil {
+		return nil, fmt.Errorf("CONNECT protocol name: %s", err)
+	}
+	if protocolName != "MQTT" {
+		return nil, fmt.Errorf("CONNECT protocol name must be 'MQTT' - got '%s'", protocolName)
+	}
+	if len(body) < 4 {
+		return nil, fmt.Errorf("CONNECT too short for level, flags and keep alive")
+	}
+	opts := ConnectOptions{Level: body[0]}
+	if opts.Level != 4 && opts.Level != 5 {
+		return &ConnectRequest{options: opts}, ErrUnsupportedLevel
+	}
+	connectBits := body[1]
+	if connectBits&1 != 0 {
+		return nil, fmt.Errorf("CONNECT reserved connect flag must be 0")
+	}
+	opts.CleanSession = connectBits&CleanSessionFlag != 0
+	opts.KeepAliveSeconds = int(body[2])<<8 | int(body[3])
+	opts.WillQoS = int(connectBits>>3) & 3
+	opts.WillRetain = connectBits&WillRetainFlag != 0
+	body = body[4:]
+	if opts.Level == 5 {
+		var properties map[int]int64
+		if properties, body, err = decodeProperties(body); err != nil {
+			return nil, fmt.Errorf("CONNECT %s", err)
+		}
+		opts.SessionExpirySeconds = properties[SessionExpiryIntervalProperty]
+	}
+
+	if opts.ClientName, body, err = decodeString(body); err != nil {
+		return nil, fmt.Errorf("CONNECT client ID: %s", err)
+	}
+	if connectBits&WillFlag != 0 {
+		if opts.WillQoS == 3 {
+			return nil, fmt.Errorf("CONNECT will QoS 3 is not allowed")
+		}
+		if opts.Level == 5 {
+			var properties map[int]int64
+			if properties, body, err = decodeProperties(body); err != nil {
+				return nil, fmt.Errorf("CONNECT will %s", err)
+			}
+			opts.WillDelaySeconds = properties[WillDelayIntervalProperty]
+		}
+		if opts.WillTopic, body, err = decodeString(body); err != nil {
+			return nil, fmt.Errorf("CONNECT will topic: %s", err)
+		}
+		if opts.WillMessage, body, err = decodeBytes(body); err != nil {
+			return nil, fmt.Errorf("CONNECT will message: %s", err)
+		}
+	} else if opts.WillQoS != 0 || opts.WillRetain {
+		return nil, fmt.Errorf("CONNECT will QoS and will retain must be 0 when there is no will")
+	}
+	if connectBits&UserNameFlag != 0 {
+		if opts.UserName, body, err = decodeString(body); err != nil {
+			return nil, fmt.Errorf("CONNECT user name: %s", err)
+		}
+	} else if connectBits&PasswordFlag != 0 && opts.Level == 4 {
+		// SPEC: MQTT 5 allows a password without a user name
+		return nil, fmt.Errorf("CONNECT with a password must have a user name")
+	}
+	if connectBits&PasswordFlag != 0 {
+		var password []byte
+		if password, body, err = decodeBytes(body); err != nil {
+			return nil, fmt.Errorf("CONNECT password: %s", err)
+		}
+		opts.Password = &password
+	}
+	if len(body) != 0 {
+		return nil, fmt.Errorf("CONNECT has %d unexpected trailing bytes", len(body))
+	}
+	return &ConnectRequest{options: opts}, nil
+}
+
 // DefaultConnectOptions returns the default options for making a MQTT connect using 3.1.1,
 // a clean session, and with 10 seconds keep alive. ClientName is set to an empty string
 // which may not be honored by all MQTT brokers. Use RandomClientID() function to produce
@@ -170,6 +270,11 @@ type ConnectOptions struct {
 	ConnectTimeOut   int  // seconds to wait for a connect to complete (spec says should wait "reasonable time" and then close)
 	XIgnorePubAck    bool // eXceptional behavior - ignore PUBACKs and PUBRECs and let the set of inFligh messages grow
 	XIgnorePubComp   bool // eXceptional behavior - ignore PUBCOMPs and let the set of inFligh messages grow
+	XNoPingReq       bool // eXceptional behavior - do not send PINGREQ, and let the broker find the client silent
+
+	// MQTT 5: seconds the session is kept after the connection has ended (SessionNeverExpires keeps it forever)
+	SessionExpirySeconds int64
+	WillDelaySeconds     int64 // MQTT 5: seconds the publication of the will is delayed after the connection has ended
 }
 
 // ConnectOption is an Options-modifying-function
@@ -204,7 +309,10 @@ func CleanSession(flag bool) ConnectOption {
 	}
 }
 
-// KeepAliveSeconds returns a ConnectionOption for KeepAliveSeconds
+// KeepAliveSeconds returns a ConnectionOption for KeepAliveSeconds. The session sends PINGREQ when nothing else has
+// been sent for that long, and regards the connection as lost if the PINGRESP does not arrive in time (0 turns keep
+// alive off).
+//
 func KeepAliveSeconds(value int) ConnectOption {
 	if value < 0 {
 		panic("KeepAliveSeconds cannot be negative")
@@ -278,6 +386,28 @@ func Password(value []byte) ConnectOption {
 	}
 }
 
+// SessionExpiry returns a ConnectionOption for the MQTT 5 Session Expiry Interval in seconds
+func SessionExpiry(seconds int64) ConnectOption {
+	if seconds < 0 || seconds > SessionNeverExpires {
+		panic(fmt.Sprintf("SessionExpiry must be in range 0 - 0x%x, got %d", SessionNeverExpires, seconds))
+	}
+	return func(o *ConnectOptions) error {
+		o.SessionExpirySeconds = seconds
+		return nil
+	}
+}
+
+// WillDelay returns a ConnectionOption for the MQTT 5 Will Delay Interval in seconds
+func WillDelay(seconds int64) ConnectOption {
+	if seconds < 0 || seconds > 0xFFFFFFFF {
+		panic(fmt.Sprintf("WillDelay must be in range 0 - 0xffffffff, got %d", seconds))
+	}
+	return func(o *ConnectOptions) error {
+		o.WillDelaySeconds = seconds
+		return nil
+	}
+}
+
 // XIgnorePubAck is an exceptional behavior flag that makes the session ignore all PUBACK and PUBREC
 //
 func XIgnorePubAck(flag bool) ConnectOption {
@@ -296,6 +426,16 @@ func XIgnorePubComp(flag bool) ConnectOption {
 	}
 }
 
+// XNoPingReq is an exceptional behavior flag that makes the session not send PINGREQ - the KeepAliveSeconds are
+// still given to the broker, which can thereby be tested for closing the connection of a silent client
+//
+func XNoPingReq(flag bool) ConnectOption {
+	return func(o *ConnectOptions) error {
+		o.XNoPingReq = flag
+		return nil
+	}
+}
+
 // ConnectTimeOut returns a ConnectOption setting the connection time out
 func ConnectTimeOut(timeoutSec int) ConnectOption {
 	return func(o *ConnectOptions) error {
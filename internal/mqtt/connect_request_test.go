@@ -10,8 +10,60 @@ import (
 func Test_ConnectRequest_makeMessage_and_WriteTo(t *testing.T) {
 
 	connectionRequest := NewConnectRequest(ClientName("MqttUnitTest"))
-	msg := connectionRequest.makeMessage()
+	msg := connectionRequest.MakeMessage()
 	var buf2 bytes.Buffer
 	msg.WriteTo(&buf2)
 	testutils.CheckEqual(26, buf2.Len(), t)
 }
+
+func Test_DecodeConnect_decodes_what_MakeMessage_produces(t *testing.T) {
+	request := NewConnectRequest(ClientName("MqttUnitTest"), CleanSession(false), KeepAliveSeconds(30),
+		WillTopic("will"), WillMessage([]byte("bye")), WillQoS(1), WillRetain(true),
+		UserName("user"), Password([]byte("secret")))
+	decoded, err := DecodeConnect(request.MakeMessage())
+	testutils.CheckNotError(err, t)
+	opts := decoded.Options()
+	testutils.CheckEqual("MqttUnitTest", opts.ClientName, t)
+	testutils.CheckFalse(opts.CleanSession, t)
+	testutils.CheckEqual(30, opts.KeepAliveSeconds, t)
+	testutils.CheckEqual("will", opts.WillTopic, t)
+	testutils.CheckEqual("bye", string(opts.WillMessage), t)
+	testutils.CheckEqual(1, opts.WillQoS, t)
+	testutils.CheckTrue(opts.WillRetain, t)
+	testutils.CheckEqual("user", opts.UserName, t)
+	testutils.CheckEqual("secret", string(*opts.Password), t)
+}
+
+func Test_DecodeConnect_decodes_the_MQTT_5_session_expiry_and_will_delay(t *testing.T) {
+	request := NewConnectRequest(ClientName("MqttUnitTest"), Level(5), SessionExpiry(3600),
+		WillTopic("will"), WillMessage([]byte("bye")), WillDelay(30), Password([]byte("secret")))
+	decoded, err := DecodeConnect(request.MakeMessage())
+	testutils.CheckNotError(err, t)
+	opts := decoded.Options()
+	testutils.CheckEqual(byte(5), opts.Level, t)
+	testutils.CheckEqual(int64(3600), opts.SessionExpirySeconds, t)
+	testutils.CheckEqual(int64(30), opts.WillDelaySeconds, t)
+	testutils.CheckEqual("will", opts.WillTopic, t)
+	testutils.CheckEqual("bye", string(opts.WillMessage), t)
+	testutils.CheckEqual("secret", string(*opts.Password), t)
+
+	// Without a will, and without the properties
+	decoded, err = DecodeConnect(NewConnectRequest(ClientName("MqttUnitTest"), Level(5)).MakeMessage())
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(int64(0), decoded.Options().SessionExpirySeconds, t)
+}
+
+func Test_DecodeConnect_returns_ErrUnsupportedLevel_for_MQTT_3_1(t *testing.T) {
+	msg := NewConnectRequest(ClientName("MqttUnitTest")).MakeMessage()
+	msg.body[6] = 3
+	decoded, err := DecodeConnect(msg)
+	testutils.CheckEqual(ErrUnsupportedLevel, err, t)
+	testutils.CheckEqual(byte(3), decoded.Options().Level, t)
+}
+
+func Test_DecodeConnect_refuses_truncated_message(t *testing.T) {
+	msg := NewConnectRequest(ClientName("MqttUnitTest")).MakeMessage()
+	msg.body = msg.body[:len(msg.body)-1]
+	_, err := DecodeConnect(msg)
+	testutils.CheckError(err, t)
+}
@@ -0,0 +1,252 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// connection is the state of one network connection of a Session to a broker.
+//
+// The connection is owned by the goroutine running its event loop (see Session.run()). All writes to the network
+// connection are made by the event loop, and all reads are made by a reader goroutine started and stopped by the
+// event loop. When the ended channel is closed all goroutines of the connection have ended (or are about to
+// return).
+//
+type connection struct {
+	conn     net.Conn
+	outgoing chan *GenericMessage // messages queued for sending to the broker
+	stop     chan stopRequest     // asks the event loop to stop
+	ended    chan struct{}        // closed when the event loop has ended
+	err      error                // the error that ended the connection (nil if stopped) - set before ended is closed
+
+	keepAlive time.Duration // a PINGREQ is sent when nothing has been written for this long (0 turns it off)
+	lastWrite time.Time     // when a packet was last written - only used by the event loop
+
+	unacknowledged []int // IDs of packets in flight when stopped - set before ended is closed
+}
+
+// stopRequest is sent to the event loop to make it stop
+//
+type stopRequest struct {
+	ctx            context.Context // incoming messages are processed until nothing is in flight or the ctx is done
+	sendDisconnect bool            // if a DISCONNECT should be sent after queued messages have been sent
+}
+
+func newConnection(conn net.Conn, keepAlive time.Duration) *connection {
+	return &connection{
+		conn:      conn,
+		outgoing:  make(chan *GenericMessage, 100),
+		stop:      make(chan stopRequest),
+		ended:     make(chan struct{}),
+		keepAlive: keepAlive,
+		lastWrite: time.Now(),
+	}
+}
+
+// send queues the given message for sending to the broker. An error is returned if the connection has ended or
+// if the given context is done before the message could be queued.
+//
+func (c *connection) send(ctx context.Context, msg *GenericMessage) error {
+	select {
+	case c.outgoing <- msg:
+		return nil
+	case <-c.ended:
+		return c.endedError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// endedError returns the error that ended the connection or an error stating that it has ended.
+// Must only be called after ended has been closed.
+//
+func (c *connection) endedError() error {
+	if c.err != nil {
+		return c.err
+	}
+	return fmt.Errorf("Connection to broker has ended")
+}
+
+// readLoop reads messages from the network connection and hands them to the event loop until there is an error,
+// or the event loop closes quit. The error ending the loop is sent on readErr.
+//
+func (c *connection) readLoop(messages chan<- *GenericMessage, readErr chan<- error, quit <-chan struct{}) {
+	for {
+		msg, err := ReadMessage(c.conn)
+		if err != nil {
+			readErr <- err
+			return
+		}
+		select {
+		case messages <- msg:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// run runs the event loop of the given connection and transitions the session to DISCONNECTED if the
+// connection ends without a Disconnect. Observers are notified if the connection ended with an error.
+//
+func (s *Session) run(c *connection) {
+	c.err = s.loop(c)
+	close(c.ended)
+
+	s.mutex.Lock()
+	if s.connection == c && s.state == CONNECTED {
+		s.disconnected(c.err)
+	}
+	s.mutex.Unlock()
+
+	if c.err != nil {
+		s.notify(func(o Observer) { o.OnConnectionLost(c.err) })
+	}
+}
+
+// write writes the given message to the network connection and notifies observers that it was sent
+//
+func (s *Session) write(c *connection, msg *GenericMessage) error {
+	if _, err := msg.WriteTo(c.conn); err != nil {
+		return err
+	}
+	c.lastWrite = time.Now()
+	s.notify(func(o Observer) { o.OnPacketSent(msg) })
+	return nil
+}
+
+// loop is the event loop of a connection. It processes incoming messages, writes outgoing messages, and handles
+// a request to stop. It returns nil when stopped by a request, and otherwise the error that ended it.
+// All goroutines started by the loop have ended when it returns.
+//
+func (s *Session) loop(c *connection) error {
+	messages := make(chan *GenericMessage)
+	readErr := make(chan error, 1)
+	quit := make(chan struct{})
+	readerEnded := make(chan struct{})
+	go func() {
+		defer close(readerEnded)
+		c.readLoop(messages, readErr, quit)
+	}()
+
+	// stopReader stops the reader goroutine - a blocked read is released by setting a read deadline in the past
+	stopReader := func() {
+		close(quit)
+		c.conn.SetReadDeadline(time.Now())
+		<-readerEnded
+		c.conn.SetReadDeadline(time.Time{})
+	}
+
+	// lost ends the loop because the connection can no longer be used
+	lost := func(err error) error {
+		log.Errorf("Session: %s - closing connection", err)
+		c.conn.Close()
+		stopReader()
+		return err
+	}
+
+	// finish ends the loop as requested - everything queued before the stop is written, then the optional DISCONNECT
+	finish := func(request stopRequest) error {
+		for queued := true; queued; {
+			select {
+			case msg := <-c.outgoing:
+				if err := s.write(c, msg); err != nil {
+					return lost(fmt.Errorf("Error while writing to broker: %s", err))
+				}
+			default:
+				queued = false
+			}
+		}
+		log.Debugf("Session: Queue to broker drained")
+		if request.sendDisconnect {
+			log.Debugf("Broker <- DISCONNECT")
+			if err := s.write(c, NewDisconnectMessage()); err != nil {
+				return lost(fmt.Errorf("Error while writing DISCONNECT to broker: %s", err))
+			}
+		}
+		stopReader()
+		return nil
+	}
+
+	// SPEC: the client must send a packet within the keep alive - a PINGREQ is sent when nothing else has been
+	// written for that long. The connection is regarded as lost if the PINGRESP does not arrive within the keep alive.
+	keepAliveTimer := time.NewTimer(c.keepAlive)
+	defer keepAliveTimer.Stop()
+	keepAlive := keepAliveTimer.C
+	if c.keepAlive == 0 {
+		keepAliveTimer.Stop()
+		keepAlive = nil
+	}
+	var pingResponse <-chan time.Time // fires if the PINGRESP to a sent PINGREQ has not arrived in time
+
+	var stopping <-chan struct{} // done channel of the context of a stop request
+	var request stopRequest
+	for {
+		select {
+		case msg := <-messages:
+			log.Debugf("Message Loop: msg type %x, length %d, bytes: %v", msg.fixedHeader, len(msg.body), msg.body)
+			s.notify(func(o Observer) { o.OnPacketReceived(msg) })
+			if s.options.IgnoreReceived != nil && s.options.IgnoreReceived(msg) {
+				log.Debugf("Session: ignoring %s", msg)
+				continue
+			}
+			reply, err := s.processMessage(msg)
+			if err != nil {
+				return lost(err)
+			}
+			if msg.Type() == PingRespType {
+				pingResponse = nil
+			}
+			if reply != nil {
+				if err := s.write(c, reply); err != nil {
+					return lost(fmt.Errorf("Error while writing to broker: %s", err))
+				}
+			}
+			if stopping != nil && !s.inFlight.hasWaiting() {
+				log.Debugf("Session: nothing in flight - stopping")
+				return finish(request)
+			}
+
+		case msg := <-c.outgoing:
+			if err := s.write(c, msg); err != nil {
+				return lost(fmt.Errorf("Error while writing to broker: %s", err))
+			}
+
+		case err := <-readErr:
+			return lost(fmt.Errorf("Connection to broker lost: %s", err))
+
+		case <-keepAlive:
+			if idle := time.Since(c.lastWrite); idle < c.keepAlive {
+				keepAliveTimer.Reset(c.keepAlive - idle)
+				continue
+			}
+			log.Debugf("Broker <- PINGREQ")
+			if err := s.write(c, NewPingRequestMessage()); err != nil {
+				return lost(fmt.Errorf("Error while writing PINGREQ to broker: %s", err))
+			}
+			keepAliveTimer.Reset(c.keepAlive)
+			if pingResponse == nil {
+				pingResponse = time.After(c.keepAlive)
+			}
+
+		case <-pingResponse:
+			return lost(fmt.Errorf("No PINGRESP from broker within the keep alive of %s", c.keepAlive))
+
+		case request = <-c.stop:
+			if !s.inFlight.hasWaiting() {
+				log.Debugf("Session: nothing in flight - stopping")
+				return finish(request)
+			}
+			log.Debugf("Session: event loop stops when nothing is in flight or context is done")
+			stopping = request.ctx.Done()
+
+		case <-stopping:
+			c.unacknowledged = s.inFlight.waitingPacketIDs()
+			log.Debugf("Session: stopping with packets in flight: %v", c.unacknowledged)
+			return finish(request)
+		}
+	}
+}
@@ -31,6 +31,30 @@ const (
 	// PublishCompleteType control message type (PUBCOMP)
 	PublishCompleteType = 7
 
+	// SubscribeType control message type
+	SubscribeType = 8
+
+	// SubscribeReserved bit 2 must be set in the reserved field
+	SubscribeReserved = 2
+
+	// SubAckType control message type (SUBACK)
+	SubAckType = 9
+
+	// UnsubscribeType control message type
+	UnsubscribeType = 10
+
+	// UnsubscribeReserved bit 2 must be set in the reserved field
+	UnsubscribeReserved = 2
+
+	// UnsubAckType control message type (UNSUBACK)
+	UnsubAckType = 11
+
+	// PingReqType control message type (PINGREQ)
+	PingReqType = 12
+
+	// PingRespType control message type (PINGRESP)
+	PingRespType = 13
+
 	// DisconnectType control message type
 	DisconnectType = 14
 
@@ -109,4 +133,29 @@ const (
 
 	// RetainBit sets the RETAIN bit to 1 (since it is 0 it isn't really needed)
 	RetainBit = 1
+
+	// Suback results
+	// --------------
+
+	// SubAckFailure is the SUBACK return code for a subscription that was refused (0 - 2 is the granted QoS)
+	SubAckFailure = 0x80
+
+	// MQTT 5
+	// ------
+
+	// SessionExpiryIntervalProperty is the MQTT 5 property with the seconds a session is kept after its connection
+	// has ended
+	SessionExpiryIntervalProperty = 0x11
+
+	// WillDelayIntervalProperty is the MQTT 5 will property with the seconds the publication of the will is delayed
+	WillDelayIntervalProperty = 0x18
+
+	// SessionNeverExpires is the Session Expiry Interval of a session that is kept until the broker drops it
+	SessionNeverExpires int64 = 0xFFFFFFFF
+
+	// DisconnectWithWillMessage is the MQTT 5 DISCONNECT reason code asking the broker to publish the will
+	DisconnectWithWillMessage = 0x04
+
+	// UnsubAckNoSubscriptionExisted is the MQTT 5 UNSUBACK reason code for a topic filter without a subscription
+	UnsubAckNoSubscriptionExisted = 0x11
 )
@@ -32,19 +32,20 @@ func EncodeVariableInt(value int) []byte {
 func DecodeVariableInt(reader io.Reader) (int, error) {
 	multiplier := 1
 	value := 0
+	buf := make([]byte, 1)
 	for {
-		buf := make([]byte, 1)
-		reader.Read(buf)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return 0, err
+		}
 		encodedByte := buf[0]
 		value += int((encodedByte & 127)) * multiplier
+		if (encodedByte & 128) == 0 {
+			break
+		}
 		multiplier *= 128
-
 		if multiplier > 128*128*128 {
 			return 0, fmt.Errorf("Malformed variable length")
 		}
-		if (encodedByte & 128) == 0 {
-			break
-		}
 	}
 	return value, nil
 }
@@ -89,3 +90,40 @@ func Encode16BitIntTo(value int, to *bytes.Buffer) {
 	to.WriteByte(byte(value >> 8))
 	to.WriteByte(byte(value & 0xFF))
 }
+
+// decodeString decodes a string (16 bit length + the content) at the start of the given data and returns the string
+// and the data following it
+//
+func decodeString(data []byte) (string, []byte, error) {
+	value, rest, err := decodeBytes(data)
+	return string(value), rest, err
+}
+
+// decodeBytes decodes a []byte (16 bit length + the content) at the start of the given data and returns the content
+// and the data following it
+//
+func decodeBytes(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("Expected 2 bytes length but only %d byte(s) remain", len(data))
+	}
+	length := int(data[0])<<8 | int(data[1])
+	data = data[2:]
+	if len(data) < length {
+		return nil, nil, fmt.Errorf("Length %d exceeds the remaining %d bytes", length, len(data))
+	}
+	return data[:length], data[length:], nil
+}
+
+// decodePacketID decodes a non zero 16 bit packet ID at the start of the given data and returns it and the data
+// following it
+//
+func decodePacketID(data []byte) (int, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, fmt.Errorf("Expected 2 bytes packet ID but only %d byte(s) remain", len(data))
+	}
+	packetID := int(data[0])<<8 | int(data[1])
+	if packetID == 0 {
+		return 0, nil, fmt.Errorf("Packet ID must not be 0")
+	}
+	return packetID, data[2:], nil
+}
@@ -0,0 +1,504 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FaultyConnection is a net.Conn that wraps another net.Conn and injects network faults into what is read and
+// written - latency and jitter, limited bandwidth, fragmentation, corrupted bytes, stalled reads, and a connection
+// that is dropped after a number of bytes or MQTT packets. It is given to a Session with Connection() like any other
+// net.Conn.
+//
+// Delays are not pipelined: a delayed write holds back later writes, and a delayed read holds back later reads.
+// A Read waiting for a delay or a stall returns a TimeoutError when the read deadline passes, and keeps the data
+// it has read for the next Read.
+//
+type FaultyConnection struct {
+	net.Conn
+	options FaultOptions
+	closed  chan struct{}
+
+	closeOnce sync.Once
+	readMutex sync.Mutex // serializes reads, and guards the pending data below
+	pending   []byte     // data read from the wrapped connection but not yet returned
+	due       time.Time  // when the pending data may be returned
+	dropAfter bool       // if the connection is dropped when the pending data has been returned
+
+	mutex           sync.Mutex // guards the below
+	random          *rand.Rand
+	in, out         faultDirection
+	bytes           int64         // the number of bytes read and written
+	packets         int           // the number of complete packets read and written
+	dropped         bool          // if the connection has been dropped
+	stallUntil      time.Time     // when a started stall ends (zero if it does not end)
+	stalled         bool          // if the stall has started
+	readDeadline    time.Time     // the read deadline given to SetReadDeadline or SetDeadline
+	deadlineChanged chan struct{} // closed (and replaced) when the read deadline changes
+}
+
+// faultDirection keeps track of what has been read or written
+type faultDirection struct {
+	counter packetCounter
+	start   time.Time // when the first byte was read or written
+	bytes   int64     // the number of bytes read or written
+}
+
+// ErrFaultDropped is the error returned by a FaultyConnection that has dropped the connection
+var ErrFaultDropped = errors.New("connection dropped by fault injection")
+
+var errFaultyConnectionClosed = errors.New("use of closed faulty connection")
+
+// FaultOptions describes the faults injected by a FaultyConnection. Zero values mean no fault.
+//
+type FaultOptions struct {
+	Latency          time.Duration // added delay of what is read and written
+	Jitter           time.Duration // a random delay up to this is added to the latency
+	BytesPerSecond   int           // the bandwidth in each direction (0 for unlimited)
+	FragmentSize     int           // reads and writes are split into fragments of at most this size
+	DropAfterBytes   int64         // the connection is dropped when this many bytes have been read and written
+	DropAfterPackets int           // the connection is dropped when this many packets have been read and written
+	CorruptRate      float64       // the probability that a byte is corrupted
+	StallAfterBytes  int64         // reads stall when this many bytes have been read (if StallReads)
+	StallDuration    time.Duration // how long reads stall (0 until the connection is closed)
+	StallReads       bool          // if reads stall
+	Seed             int64         // the seed of the random jitter and corruption
+}
+
+// FaultOption is an Options-modifying-function
+type FaultOption func(*FaultOptions) error
+
+// DefaultFaultOptions returns FaultOptions without faults, and a seed based on the current time
+func DefaultFaultOptions() FaultOptions {
+	return FaultOptions{Seed: time.Now().UnixNano()}
+}
+
+// NewFaultyConnection returns a FaultyConnection wrapping the given connection and injecting the faults described
+// by the given options
+//
+func NewFaultyConnection(conn net.Conn, options ...FaultOption) *FaultyConnection {
+	opts := DefaultFaultOptions()
+	for _, fOpt := range options {
+		if err := fOpt(&opts); err != nil {
+			log.Fatalf("Fault option apply failure: %s", err)
+		}
+	}
+	return &FaultyConnection{
+		Conn:            conn,
+		options:         opts,
+		closed:          make(chan struct{}),
+		random:          rand.New(rand.NewSource(opts.Seed)),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+// AddLatency returns a FaultOption delaying what is read and written by the given latency plus a random duration
+// up to the given jitter
+//
+func AddLatency(latency, jitter time.Duration) FaultOption {
+	if latency < 0 || jitter < 0 {
+		panic("Latency and jitter cannot be negative")
+	}
+	return func(o *FaultOptions) error {
+		o.Latency = latency
+		o.Jitter = jitter
+		return nil
+	}
+}
+
+// LimitBandwidth returns a FaultOption limiting the number of bytes per second read and written - in each direction
+func LimitBandwidth(bytesPerSecond int) FaultOption {
+	if bytesPerSecond < 1 {
+		panic(fmt.Sprintf("The bandwidth must be at least 1 byte per second, got %d", bytesPerSecond))
+	}
+	return func(o *FaultOptions) error {
+		o.BytesPerSecond = bytesPerSecond
+		return nil
+	}
+}
+
+// Fragment returns a FaultOption splitting each write into writes of at most the given number of bytes, and
+// returning at most the given number of bytes from each read
+//
+func Fragment(size int) FaultOption {
+	if size < 1 {
+		panic(fmt.Sprintf("The fragment size must be at least 1, got %d", size))
+	}
+	return func(o *FaultOptions) error {
+		o.FragmentSize = size
+		return nil
+	}
+}
+
+// DropAfterBytes returns a FaultOption dropping the connection when the given number of bytes have been read and
+// written (in total)
+//
+func DropAfterBytes(count int64) FaultOption {
+	if count < 1 {
+		panic(fmt.Sprintf("DropAfterBytes must be at least 1, got %d", count))
+	}
+	return func(o *FaultOptions) error {
+		o.DropAfterBytes = count
+		return nil
+	}
+}
+
+// DropAfterPackets returns a FaultOption dropping the connection when the given number of MQTT packets have been
+// read and written (in total) - right after the last byte of the last packet
+//
+func DropAfterPackets(count int) FaultOption {
+	if count < 1 {
+		panic(fmt.Sprintf("DropAfterPackets must be at least 1, got %d", count))
+	}
+	return func(o *FaultOptions) error {
+		o.DropAfterPackets = count
+		return nil
+	}
+}
+
+// CorruptBytes returns a FaultOption corrupting each byte read and written with the given probability
+func CorruptBytes(rate float64) FaultOption {
+	if rate < 0 || rate > 1 {
+		panic(fmt.Sprintf("The corruption rate must be between 0 and 1, got %g", rate))
+	}
+	return func(o *FaultOptions) error {
+		o.CorruptRate = rate
+		return nil
+	}
+}
+
+// StallReads returns a FaultOption making reads stall for the given duration when the given number of bytes have
+// been read. Reads stall until the connection is closed if the duration is 0.
+//
+func StallReads(afterBytes int64, duration time.Duration) FaultOption {
+	if afterBytes < 0 || duration < 0 {
+		panic("The bytes before a stall and the duration of a stall cannot be negative")
+	}
+	return func(o *FaultOptions) error {
+		o.StallReads = true
+		o.StallAfterBytes = afterBytes
+		o.StallDuration = duration
+		return nil
+	}
+}
+
+// FaultSeed returns a FaultOption for the seed of the random jitter and corruption - to make them repeatable
+func FaultSeed(seed int64) FaultOption {
+	return func(o *FaultOptions) error {
+		o.Seed = seed
+		return nil
+	}
+}
+
+// Read reads from the wrapped connection and returns what was read when it is due
+func (c *FaultyConnection) Read(b []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if len(c.pending) == 0 {
+		if err := c.stall(); err != nil {
+			return 0, err
+		}
+		buf := make([]byte, c.readLimit(len(b)))
+		n, err := c.Conn.Read(buf)
+		if n == 0 {
+			if c.isDropped() {
+				return 0, ErrFaultDropped
+			}
+			return 0, err
+		}
+		var drop bool
+		c.pending, drop = c.pass(&c.in, buf[:n])
+		c.pending = c.corrupt(c.pending)
+		c.due = c.schedule(&c.in, len(c.pending))
+		c.dropAfter = drop
+	}
+	if err := c.wait(c.due, true); err != nil {
+		return 0, err
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	if len(c.pending) == 0 && c.dropAfter {
+		c.drop()
+	}
+	return n, nil
+}
+
+// readLimit returns the number of bytes to read from the wrapped connection into a buffer of the given size
+func (c *FaultyConnection) readLimit(size int) int {
+	if c.options.FragmentSize > 0 && size > c.options.FragmentSize {
+		size = c.options.FragmentSize
+	}
+	if rate := c.options.BytesPerSecond; rate > 0 && size > rate/10+1 {
+		size = rate/10 + 1 // at most a tenth of a second of data at a time
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.options.StallReads && !c.stalled {
+		if left := c.options.StallAfterBytes - c.in.bytes; left > 0 && int64(size) > left {
+			size = int(left)
+		}
+	}
+	return size
+}
+
+// stall starts the stall of reads when enough bytes have been read, and waits until it has ended
+func (c *FaultyConnection) stall() error {
+	c.mutex.Lock()
+	if !c.options.StallReads || c.in.bytes < c.options.StallAfterBytes {
+		c.mutex.Unlock()
+		return nil
+	}
+	if !c.stalled {
+		c.stalled = true
+		if c.options.StallDuration > 0 {
+			c.stallUntil = time.Now().Add(c.options.StallDuration)
+		}
+		log.Debugf("FaultyConnection: reads stalled after %d bytes", c.in.bytes)
+	}
+	until := c.stallUntil
+	c.mutex.Unlock()
+	return c.wait(until, true)
+}
+
+// Write writes the given data to the wrapped connection when it is due - in fragments if the FragmentSize is set
+func (c *FaultyConnection) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		if c.isDropped() {
+			return written, ErrFaultDropped
+		}
+		chunk := b[written:]
+		if c.options.FragmentSize > 0 && len(chunk) > c.options.FragmentSize {
+			chunk = chunk[:c.options.FragmentSize]
+		}
+		if rate := c.options.BytesPerSecond; rate > 0 && len(chunk) > rate/10+1 {
+			chunk = chunk[:rate/10+1]
+		}
+		chunk, drop := c.pass(&c.out, chunk)
+		if err := c.wait(c.schedule(&c.out, len(chunk)), false); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(c.corrupt(chunk))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if drop {
+			c.drop()
+		}
+	}
+	return written, nil
+}
+
+// pass returns the part of the given data that passes before the connection is dropped, and true if the connection
+// is to be dropped after it
+//
+func (c *FaultyConnection) pass(dir *faultDirection, data []byte) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	drop := false
+	if limit := c.options.DropAfterBytes; limit > 0 && c.bytes+int64(len(data)) >= limit {
+		data = data[:limit-c.bytes]
+		drop = true
+	}
+	if limit := c.options.DropAfterPackets; limit > 0 {
+		n, completed := dir.counter.consume(data, limit-c.packets)
+		c.packets += completed
+		if c.packets >= limit {
+			data = data[:n]
+			drop = true
+		}
+	}
+	c.bytes += int64(len(data))
+	return data, drop
+}
+
+// schedule returns when the given number of bytes passing in the given direction are due
+func (c *FaultyConnection) schedule(dir *faultDirection, n int) time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if dir.start.IsZero() {
+		dir.start = now
+	}
+	dir.bytes += int64(n)
+	due := now
+	if rate := int64(c.options.BytesPerSecond); rate > 0 {
+		if t := dir.start.Add(time.Duration(dir.bytes * int64(time.Second) / rate)); t.After(due) {
+			due = t
+		}
+	}
+	due = due.Add(c.options.Latency)
+	if c.options.Jitter > 0 {
+		due = due.Add(time.Duration(c.random.Int63n(int64(c.options.Jitter) + 1)))
+	}
+	return due
+}
+
+// corrupt returns the given data, or a copy with corrupted bytes
+func (c *FaultyConnection) corrupt(data []byte) []byte {
+	if c.options.CorruptRate == 0 {
+		return data
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var corrupted []byte
+	for i := range data {
+		if c.random.Float64() >= c.options.CorruptRate {
+			continue
+		}
+		if corrupted == nil {
+			corrupted = append([]byte(nil), data...)
+		}
+		corrupted[i] ^= byte(1 + c.random.Intn(255))
+	}
+	if corrupted == nil {
+		return data
+	}
+	return corrupted
+}
+
+// wait waits until the given time (until the connection is closed if it is zero). An error is returned if the
+// connection is closed first, or - when waiting for a read - if the read deadline passes first.
+//
+func (c *FaultyConnection) wait(until time.Time, read bool) error {
+	if !until.IsZero() && !time.Now().Before(until) {
+		return nil
+	}
+	for {
+		c.mutex.Lock()
+		deadline := c.readDeadline
+		changed := c.deadlineChanged
+		c.mutex.Unlock()
+		end := until
+		timeout := false
+		if read && !deadline.IsZero() && (end.IsZero() || deadline.Before(end)) {
+			end = deadline
+			timeout = true
+		}
+		var fired <-chan time.Time
+		if !end.IsZero() {
+			timer := time.NewTimer(time.Until(end))
+			defer timer.Stop()
+			fired = timer.C
+		}
+		select {
+		case <-fired:
+			if timeout {
+				return &TimeoutError{}
+			}
+			return nil
+		case <-changed:
+		case <-c.closed:
+			if c.isDropped() {
+				return ErrFaultDropped
+			}
+			return errFaultyConnectionClosed
+		}
+	}
+}
+
+// isDropped returns true if the connection has been dropped
+func (c *FaultyConnection) isDropped() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.dropped
+}
+
+// drop closes the connection without telling the reader and writer why
+func (c *FaultyConnection) drop() {
+	c.mutex.Lock()
+	c.dropped = true
+	bytes, packets := c.bytes, c.packets
+	c.mutex.Unlock()
+	log.Debugf("FaultyConnection: dropping the connection after %d bytes and %d packets", bytes, packets)
+	c.Close()
+}
+
+// Close closes the wrapped connection and ends all waiting
+func (c *FaultyConnection) Close() error {
+	err := errFaultyConnectionClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// SetDeadline sets the read and write deadlines of the wrapped connection, and the read deadline of waiting reads
+func (c *FaultyConnection) SetDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the wrapped connection and of waiting reads
+func (c *FaultyConnection) SetReadDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *FaultyConnection) setReadDeadline(t time.Time) {
+	c.mutex.Lock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	c.mutex.Unlock()
+}
+
+// packetCounter counts the MQTT packets in a stream of bytes by following their fixed headers
+type packetCounter struct {
+	state      int // 0 before a packet, 1 in the remaining length, 2 in the rest of the packet
+	length     int // the remaining length read so far
+	multiplier int // of the next byte of the remaining length
+	remaining  int // the number of bytes left of the packet
+}
+
+// consume follows the given bytes and returns the number of them up to and including the last byte of the packet
+// completing the given number of packets (all of them if fewer packets are completed), and the number of completed
+// packets
+//
+func (p *packetCounter) consume(b []byte, limit int) (int, int) {
+	completed := 0
+	for i := 0; i < len(b); i++ {
+		switch p.state {
+		case 0:
+			p.state = 1
+			p.length = 0
+			p.multiplier = 1
+			continue
+		case 1:
+			p.length += int(b[i]&0x7f) * p.multiplier
+			p.multiplier *= 128
+			if b[i]&0x80 != 0 && p.multiplier <= 128*128*128 {
+				continue
+			}
+			if p.length > 0 {
+				p.state = 2
+				p.remaining = p.length
+				continue
+			}
+		case 2:
+			take := p.remaining
+			if left := len(b) - i; take > left {
+				take = left
+			}
+			p.remaining -= take
+			i += take - 1
+			if p.remaining > 0 {
+				continue
+			}
+		}
+		p.state = 0
+		completed++
+		if completed == limit {
+			return i + 1, completed
+		}
+	}
+	return len(b), completed
+}
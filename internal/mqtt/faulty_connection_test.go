@@ -0,0 +1,187 @@
+package mqtt
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+// testhelperWriteRecorder is a net.Conn recording each write
+type testhelperWriteRecorder struct {
+	*MockConnection
+	writes [][]byte
+}
+
+func (r *testhelperWriteRecorder) Write(b []byte) (int, error) {
+	r.writes = append(r.writes, append([]byte(nil), b...))
+	return r.MockConnection.Write(b)
+}
+
+func Test_FaultyConnection_implements_net_Conn(t *testing.T) {
+	defer testutils.ShouldNotPanic(t)
+	_ = net.Conn(NewFaultyConnection(NewMockConnection()))
+}
+
+func Test_FaultyConnection_without_faults_passes_data_through(t *testing.T) {
+	mock := NewMockConnection()
+	conn := NewFaultyConnection(mock)
+	n, err := conn.Write([]byte("hello"))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(5, n, t)
+	mock.RemoteWrite([]byte("world"))
+	buf := make([]byte, 10)
+	n, err = conn.Read(buf)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual("world", string(buf[:n]), t)
+	buf = make([]byte, 10)
+	n, _ = mock.RemoteRead(buf)
+	testutils.CheckEqual("hello", string(buf[:n]), t)
+}
+
+func Test_FaultyConnection_Fragment_splits_writes_and_reads(t *testing.T) {
+	recorder := &testhelperWriteRecorder{MockConnection: NewMockConnection()}
+	conn := NewFaultyConnection(recorder, Fragment(2))
+	n, err := conn.Write([]byte("hello"))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(5, n, t)
+	testutils.CheckEqual(3, len(recorder.writes), t)
+	testutils.CheckEqual("he", string(recorder.writes[0]), t)
+	testutils.CheckEqual("o", string(recorder.writes[2]), t)
+
+	recorder.RemoteWrite([]byte("world"))
+	buf := make([]byte, 10)
+	n, err = conn.Read(buf)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual("wo", string(buf[:n]), t)
+}
+
+func Test_FaultyConnection_AddLatency_delays_writes_and_reads(t *testing.T) {
+	mock := NewMockConnection()
+	conn := NewFaultyConnection(mock, AddLatency(50*time.Millisecond, 10*time.Millisecond))
+	start := time.Now()
+	conn.Write([]byte("x"))
+	testutils.CheckTrue(time.Since(start) >= 50*time.Millisecond, t)
+
+	mock.RemoteWrite([]byte("y"))
+	start = time.Now()
+	conn.Read(make([]byte, 1))
+	elapsed := time.Since(start)
+	testutils.CheckTrue(elapsed >= 50*time.Millisecond, t)
+	testutils.CheckTrue(elapsed < time.Second, t)
+}
+
+func Test_FaultyConnection_LimitBandwidth_throttles_writes(t *testing.T) {
+	mock := NewMockConnection()
+	conn := NewFaultyConnection(mock, LimitBandwidth(10000))
+	start := time.Now()
+	n, err := conn.Write(make([]byte, 2000))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(2000, n, t)
+	testutils.CheckTrue(time.Since(start) >= 190*time.Millisecond, t)
+}
+
+func Test_FaultyConnection_DropAfterPackets_drops_after_the_last_byte_of_the_packet(t *testing.T) {
+	mock := NewMockConnection()
+	conn := NewFaultyConnection(mock, DropAfterPackets(2))
+
+	// A PINGREQ written in two parts, and a PUBACK and a PINGREQ in one write
+	_, err := conn.Write([]byte{0xc0})
+	testutils.CheckNotError(err, t)
+	_, err = conn.Write([]byte{0x00})
+	testutils.CheckNotError(err, t)
+	n, err := conn.Write([]byte{0x40, 0x02, 0x00, 0x01, 0xc0, 0x00})
+	testutils.CheckEqual(4, n, t)
+	testutils.CheckEqual(ErrFaultDropped, err, t)
+
+	_, err = conn.Read(make([]byte, 1))
+	testutils.CheckEqual(ErrFaultDropped, err, t)
+	buf := make([]byte, 10)
+	n, _ = mock.RemoteRead(buf)
+	testutils.CheckEqual([]byte{0xc0, 0x00, 0x40, 0x02, 0x00, 0x01}, buf[:n], t)
+}
+
+func Test_FaultyConnection_DropAfterBytes_counts_bytes_read_and_written(t *testing.T) {
+	mock := NewMockConnection()
+	conn := NewFaultyConnection(mock, DropAfterBytes(5))
+	conn.Write([]byte("abc"))
+	mock.RemoteWrite([]byte("defgh"))
+	buf := make([]byte, 10)
+	n, err := conn.Read(buf)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual("de", string(buf[:n]), t)
+	_, err = conn.Read(buf)
+	testutils.CheckEqual(ErrFaultDropped, err, t)
+	_, err = conn.Write([]byte("x"))
+	testutils.CheckEqual(ErrFaultDropped, err, t)
+}
+
+func Test_FaultyConnection_CorruptBytes_changes_bytes(t *testing.T) {
+	mock := NewMockConnection()
+	conn := NewFaultyConnection(mock, CorruptBytes(1), FaultSeed(1))
+	data := []byte("hello")
+	conn.Write(data)
+	testutils.CheckEqual("hello", string(data), t)
+	buf := make([]byte, 10)
+	n, _ := mock.RemoteRead(buf)
+	testutils.CheckEqual(5, n, t)
+	for i := range data {
+		testutils.CheckTrue(buf[i] != data[i], t)
+	}
+
+	// the same seed corrupts the same way
+	other := NewMockConnection()
+	NewFaultyConnection(other, CorruptBytes(1), FaultSeed(1)).Write(data)
+	otherBuf := make([]byte, 10)
+	other.RemoteRead(otherBuf)
+	testutils.CheckTrue(bytes.Equal(buf, otherBuf), t)
+}
+
+func Test_FaultyConnection_StallReads_stalls_and_honors_the_read_deadline(t *testing.T) {
+	mock := NewMockConnection()
+	conn := NewFaultyConnection(mock, StallReads(2, 100*time.Millisecond))
+	mock.RemoteWrite([]byte("abcd"))
+	buf := make([]byte, 10)
+	n, err := conn.Read(buf)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual("ab", string(buf[:n]), t)
+
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = conn.Read(buf)
+	netErr, ok := err.(net.Error)
+	testutils.CheckTrue(ok && netErr.Timeout(), t)
+
+	conn.SetReadDeadline(time.Time{})
+	start := time.Now()
+	n, err = conn.Read(buf)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual("cd", string(buf[:n]), t)
+	testutils.CheckTrue(time.Since(start) >= 50*time.Millisecond, t)
+}
+
+func Test_FaultyConnection_Close_ends_a_stall_forever(t *testing.T) {
+	conn := NewFaultyConnection(NewMockConnection(), StallReads(0, 0))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+	}()
+	_, err := conn.Read(make([]byte, 1))
+	testutils.CheckError(err, t)
+}
+
+func Test_Session_connects_over_a_FaultyConnection(t *testing.T) {
+	mock := NewMockConnection()
+	conn := NewFaultyConnection(mock, Fragment(1), AddLatency(time.Millisecond, time.Millisecond))
+	s := NewSession(ClientID("faulty"), Connection(conn))
+	go func() {
+		remote := mock.RemoteConn()
+		if _, err := ReadMessage(remote); err == nil {
+			remote.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		}
+	}()
+	testutils.CheckNotError(s.Connect(KeepAliveSeconds(0)), t)
+	s.DisconnectWithoutMessage(1)
+	conn.Close()
+}
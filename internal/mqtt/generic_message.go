@@ -2,6 +2,7 @@ package mqtt
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 )
 
@@ -11,6 +12,13 @@ type GenericMessage struct {
 	body        []byte
 }
 
+// NewGenericMessage returns a message of the given control packet type with the given flags (the lower 4 bits of
+// the fixed header) and body
+//
+func NewGenericMessage(packetType int, flags byte, body []byte) *GenericMessage {
+	return &GenericMessage{fixedHeader: byte(packetType<<4) | flags&0x0F, body: body}
+}
+
 // WriteTo implements io.WriterTo for GenericMessage
 func (m *GenericMessage) WriteTo(writer io.Writer) (int64, error) {
 	var data bytes.Buffer // 64 bytes in the first Grow which should be enough unless client ID is very long (not worth optimizing)
@@ -29,9 +37,132 @@ func (m *GenericMessage) WriteTo(writer io.Writer) (int64, error) {
 // WriteDupTo sets the DUP bit for applicable messages and then writes to the given writer
 // The original message is unchanged
 func (m *GenericMessage) WriteDupTo(writer io.Writer) (int64, error) {
-	m2 := m
+	return m.Duplicate().WriteTo(writer)
+}
+
+// Duplicate returns the message to use when resending the message - a copy with the DUP bit set for a PUBLISH,
+// otherwise the message itself.
+//
+func (m *GenericMessage) Duplicate() *GenericMessage {
 	if m.fixedHeader>>4 == PublishType {
-		m2 = &GenericMessage{fixedHeader: m.fixedHeader | DupBit, body: m.body}
+		return &GenericMessage{fixedHeader: m.fixedHeader | DupBit, body: m.body}
+	}
+	return m
+}
+
+// Type returns the MQTT control packet type of the message (for example PublishType)
+func (m *GenericMessage) Type() int {
+	return int(m.fixedHeader >> 4)
+}
+
+// Flags returns the lower 4 bits of the fixed header of the message
+func (m *GenericMessage) Flags() byte {
+	return m.fixedHeader & 0x0F
+}
+
+// Body returns the bytes of the message after the remaining length. The returned slice must not be modified.
+func (m *GenericMessage) Body() []byte {
+	return m.body
+}
+
+// ReadMessage reads one complete message (fixed header, remaining length, and body) from the given reader
+//
+func ReadMessage(reader io.Reader) (*GenericMessage, error) {
+	fixedHeader := make([]byte, 1)
+	if _, err := io.ReadFull(reader, fixedHeader); err != nil {
+		return nil, err
+	}
+	remainingLength, err := DecodeVariableInt(reader)
+	if err != nil {
+		return nil, err
+	}
+	msg := GenericMessage{fixedHeader: fixedHeader[0], body: make([]byte, remainingLength)}
+	n, err := io.ReadFull(reader, msg.body)
+	if err != nil {
+		return nil, fmt.Errorf("Expected to read %d bytes remaining length of message but got %d: %s", remainingLength, n, err)
+	}
+	return &msg, nil
+}
+
+// String returns a one line description of the message for traces and logs, for example
+// "PUBLISH(id=3, qos=1, topic=a/b, 5 bytes)". A message that cannot be decoded is described as malformed.
+//
+func (m *GenericMessage) String() string {
+	name := PacketTypeName(m.Type())
+	switch m.Type() {
+	case ConnectType:
+		request, err := DecodeConnect(m)
+		if err != nil {
+			return fmt.Sprintf("%s(malformed: %s)", name, err)
+		}
+		opts := request.options
+		result := fmt.Sprintf("%s(client=%s, clean=%v, keepAlive=%d", name, opts.ClientName, opts.CleanSession, opts.KeepAliveSeconds)
+		if opts.WillTopic != "" {
+			result += fmt.Sprintf(", will=%s, willQoS=%d, willRetain=%v", opts.WillTopic, opts.WillQoS, opts.WillRetain)
+		}
+		if opts.UserName != "" {
+			result += fmt.Sprintf(", user=%s", opts.UserName)
+		}
+		return result + ")"
+
+	case ConnAckType:
+		if len(m.body) != 2 {
+			return fmt.Sprintf("%s(malformed: %d bytes)", name, len(m.body))
+		}
+		return fmt.Sprintf("%s(sp=%v, rc=%d)", name, m.body[0]&1 == 1, m.body[1])
+
+	case PublishType:
+		request, err := DecodePublish(m)
+		if err != nil {
+			return fmt.Sprintf("%s(malformed: %s)", name, err)
+		}
+		opts := request.options
+		result := fmt.Sprintf("%s(", name)
+		if opts.QoS > 0 {
+			result += fmt.Sprintf("id=%d, ", opts.PacketID)
+		}
+		result += fmt.Sprintf("qos=%d, ", opts.QoS)
+		if opts.IsDuplicate {
+			result += "dup, "
+		}
+		if opts.Retain {
+			result += "retain, "
+		}
+		return result + fmt.Sprintf("topic=%s, %d bytes)", opts.Topic, len(opts.Message))
+
+	case PublishAckType, PublishReceivedType, PublishReleaseType, PublishCompleteType, UnsubAckType:
+		packetID, err := AckPacketID(m, m.Type())
+		if err != nil {
+			return fmt.Sprintf("%s(malformed: %s)", name, err)
+		}
+		return fmt.Sprintf("%s(%d)", name, packetID)
+
+	case SubscribeType:
+		request, err := DecodeSubscribe(m)
+		if err != nil {
+			return fmt.Sprintf("%s(malformed: %s)", name, err)
+		}
+		result := fmt.Sprintf("%s(id=%d", name, request.options.PacketID)
+		for _, sub := range request.options.Subscriptions {
+			result += fmt.Sprintf(", %s qos=%d", sub.TopicFilter, sub.QoS)
+		}
+		return result + ")"
+
+	case SubAckType:
+		if len(m.body) < 2 {
+			return fmt.Sprintf("%s(malformed: %d bytes)", name, len(m.body))
+		}
+		return fmt.Sprintf("%s(id=%d, rc=%v)", name, int(m.body[0])<<8|int(m.body[1]), m.body[2:])
+
+	case UnsubscribeType:
+		packetID, filters, err := DecodeUnsubscribe(m)
+		if err != nil {
+			return fmt.Sprintf("%s(malformed: %s)", name, err)
+		}
+		return fmt.Sprintf("%s(id=%d, %v)", name, packetID, filters)
+	}
+	if len(m.body) > 0 {
+		return fmt.Sprintf("%s(%d bytes)", name, len(m.body))
 	}
-	return m2.WriteTo(writer)
+	return name
 }
@@ -0,0 +1,24 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func Test_GenericMessage_String_describes_the_packet(t *testing.T) {
+	testutils.CheckEqual("CONNECT(client=c1, clean=true, keepAlive=10)",
+		NewConnectRequest(ClientName("c1")).MakeMessage().String(), t)
+	testutils.CheckEqual("CONNACK(sp=true, rc=0)", NewConnAckMessage(true, ConnectionAccepted).String(), t)
+	testutils.CheckEqual("PUBLISH(id=3, qos=1, retain, topic=a/b, 5 bytes)",
+		NewPublishRequest(Topic("a/b"), Message([]byte("hello")), QoS(1), PacketID(3), Retain(true)).MakeMessage().String(), t)
+	testutils.CheckEqual("PUBREL(3)", NewAckMessage(PublishReleaseType, 3).String(), t)
+	testutils.CheckEqual("SUBACK(id=4, rc=[1 128])", NewSubAckMessage(4, []byte{1, SubAckFailure}).String(), t)
+	testutils.CheckEqual("PINGREQ", NewPingRequestMessage().String(), t)
+}
+
+func Test_GenericMessage_String_describes_malformed_packet(t *testing.T) {
+	msg := &GenericMessage{fixedHeader: PublishAckType << 4, body: []byte{1}}
+	testutils.CheckEqual("PUBACK(malformed: MQTT protocol violation: PUBACK expects 2 bytes packet ID as the body - got 1 "+
+		"(packet PUBACK, flags 0x0, body [1]))", msg.String(), t)
+}
@@ -1,6 +1,7 @@
 package mqtt
 
 import (
+	"fmt"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -73,6 +74,14 @@ func (f *inFlight) nextPacketID() int {
 	return result
 }
 
+// releasePacketID makes the given packet ID available to nextPacketID() again
+//
+func (f *inFlight) releasePacketID(packetID int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.unsetBit(packetID)
+}
+
 func cappedIncrement(x int) int {
 	x++
 	if x > 0xFFFF {
@@ -84,6 +93,7 @@ func cappedIncrement(x int) int {
 type waitingPacket struct {
 	msg      MessageWriter
 	packetID int
+	acked    chan struct{} // closed when the packet is released
 	next     *waitingPacket
 	prev     *waitingPacket
 }
@@ -96,47 +106,78 @@ func (wp *waitingPacket) prevPacket() *waitingPacket {
 	return wp.prev
 }
 
-// registerWaiting registers a package with a given packetID as waiting for an ACK of some kind
-func (f *inFlight) registerWaiting(packetID int, msg MessageWriter) {
+// registerWaiting registers a package with a given packetID as waiting for an ACK of some kind.
+// The returned channel is closed when the packet is released.
+//
+func (f *inFlight) registerWaiting(packetID int, msg MessageWriter) <-chan struct{} {
 	// TODO: Could use separate mutex
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 	f.setBit(packetID) // Just in case, and this also allows test to just register packets will self asserted unique values
-	theElement := f.waitingList.PushBack(&waitingPacket{msg: msg, packetID: packetID})
+	theElement := f.waitingList.PushBack(&waitingPacket{msg: msg, packetID: packetID, acked: make(chan struct{})})
 	f.waitingIdx[packetID] = theElement
+	return theElement.acked
 }
 
 // relaseWaiting drops the packet with the given packetID from the ordered set of packets waiting for ACK, but does not free the ID
-// as there may be a new packet (QoS==2) of different kind for the same package ID
+// as there may be a new packet (QoS==2) of different kind for the same package ID.
+// An error is returned if there is no packet waiting with the given packetID.
 //
-func (f *inFlight) releaseWaiting(packetID int) {
+func (f *inFlight) releaseWaiting(packetID int) error {
 	log.Debugf("releaseWaitingPacket(%d)", packetID)
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
-	if !f.getBit(packetID) {
-		panic("Cannot release a packet that is not registered as waiting")
-	}
-	theElement := f.waitingIdx[packetID]
-	if theElement == nil {
-		log.Debugf("no registered packed for packed ID: %d", packetID)
+	theElement, err := f.lookupWaiting(packetID)
+	if err != nil {
+		return err
 	}
 	f.waitingList.Remove(theElement)
+	delete(f.waitingIdx, packetID)
+	close(theElement.acked)
+	return nil
 }
 
-// replaceWaiting replaces the message for the given packetID
-func (f *inFlight) replaceWaiting(packetID int, msg MessageWriter) {
+// replaceWaiting replaces the message for the given packetID.
+// An error is returned if there is no packet waiting with the given packetID.
+//
+func (f *inFlight) replaceWaiting(packetID int, msg MessageWriter) error {
 	log.Debugf("replaceWaiting(%d)", packetID)
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
+	theElement, err := f.lookupWaiting(packetID)
+	if err != nil {
+		return err
+	}
+	// Replace
+	theElement.msg = msg
+	return nil
+}
+
+// waitingMessage returns the message waiting for an ACK with the given packetID.
+// An error is returned if there is no packet waiting with the given packetID.
+//
+func (f *inFlight) waitingMessage(packetID int) (MessageWriter, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	theElement, err := f.lookupWaiting(packetID)
+	if err != nil {
+		return nil, err
+	}
+	return theElement.msg, nil
+}
+
+// lookupWaiting returns the waiting packet for the given packetID or an error if there is no such packet.
+// The caller must hold the mutex.
+//
+func (f *inFlight) lookupWaiting(packetID int) (*waitingPacket, error) {
 	if !f.getBit(packetID) {
-		panic("Cannot replace a packet that is not registered as waiting")
+		return nil, fmt.Errorf("packet ID %d is not in flight", packetID)
 	}
 	theElement := f.waitingIdx[packetID]
 	if theElement == nil {
-		log.Debugf("no registered packed for packed ID: %d", packetID)
+		return nil, fmt.Errorf("no packet is waiting for an ACK with packet ID %d", packetID)
 	}
-	// Replace
-	theElement.msg = msg
+	return theElement, nil
 }
 
 // eachWaitingPackage yields each packet to the given function - the intent is for a caller
@@ -152,6 +193,26 @@ func (f *inFlight) eachWaitingPacket(lambda func(packetID int, msg MessageWriter
 	}
 }
 
+// hasWaiting returns true if there are packets waiting for an ACK
+//
+func (f *inFlight) hasWaiting() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.waitingList.Front() != nil
+}
+
+// waitingPacketIDs returns the IDs of the packets waiting for an ACK in the order they were registered
+//
+func (f *inFlight) waitingPacketIDs() []int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	result := []int{}
+	for e := f.waitingList.Front(); e != nil; e = e.nextPacket() {
+		result = append(result, e.packetID)
+	}
+	return result
+}
+
 type waitingPacketList struct {
 	front *waitingPacket
 	back  *waitingPacket
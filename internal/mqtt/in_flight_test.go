@@ -180,7 +180,8 @@ func Test_inFlight_releaseWaitingPacket_drops_it_from_list_without_resetting_bit
 	inF.registerWaiting(2, &data2)
 	inF.registerWaiting(3, &data3)
 
-	inF.releaseWaiting(3)
+	err := inF.releaseWaiting(3)
+	testutils.CheckNotError(err, t)
 
 	val := 0
 	inF.eachWaitingPacket(func(id int, data MessageWriter) {
@@ -190,13 +191,72 @@ func Test_inFlight_releaseWaitingPacket_drops_it_from_list_without_resetting_bit
 	testutils.CheckTrue(inF.getBit(3), t)
 }
 
-func Test_inFlight_releaseWaitingPacket_panics_on_non_registered_package(t *testing.T) {
+func Test_inFlight_releaseWaitingPacket_returns_error_for_non_registered_package(t *testing.T) {
 	inF := newInFlight()
-	defer testutils.ShouldPanic(t)
-	inF.releaseWaiting(1)
+	testutils.CheckError(inF.releaseWaiting(1), t)
+}
+
+func Test_inFlight_releaseWaitingPacket_returns_error_when_released_twice(t *testing.T) {
+	inF := newInFlight()
+	data1 := GenericMessage{fixedHeader: 0, body: []byte{7}}
+	inF.registerWaiting(1, &data1)
+	testutils.CheckNotError(inF.releaseWaiting(1), t)
+	testutils.CheckError(inF.releaseWaiting(1), t)
+}
+
+func Test_inFlight_replaceWaiting_returns_error_for_non_registered_package(t *testing.T) {
+	inF := newInFlight()
+	data1 := GenericMessage{fixedHeader: 0, body: []byte{7}}
+	testutils.CheckError(inF.replaceWaiting(1, &data1), t)
 }
 
 func Test_cappedIncrement_caps_increment_at_0xFFFF_flips_to_1(t *testing.T) {
 	x := 0xFFFF
 	testutils.CheckEqual(1, cappedIncrement(x), t)
 }
+
+func Test_inFlight_releaseWaitingPacket_closes_the_channel_returned_when_registering(t *testing.T) {
+	inF := newInFlight()
+	data1 := GenericMessage{fixedHeader: 0, body: []byte{7}}
+	acked := inF.registerWaiting(1, &data1)
+	select {
+	case <-acked:
+		t.Fatalf("Expected packet to not be acked before it is released")
+	default:
+	}
+	testutils.CheckNotError(inF.releaseWaiting(1), t)
+	_, open := <-acked
+	testutils.CheckFalse(open, t)
+}
+
+func Test_inFlight_waitingPacketIDs_returns_ids_in_registration_order(t *testing.T) {
+	inF := newInFlight()
+	testutils.CheckFalse(inF.hasWaiting(), t)
+	data := GenericMessage{fixedHeader: 0, body: []byte{7}}
+	inF.registerWaiting(3, &data)
+	inF.registerWaiting(1, &data)
+	inF.registerWaiting(2, &data)
+	testutils.CheckNotError(inF.releaseWaiting(1), t)
+	testutils.CheckTrue(inF.hasWaiting(), t)
+	testutils.CheckEqual([]int{3, 2}, inF.waitingPacketIDs(), t)
+}
+
+func Test_inFlight_releasePacketID_can_be_called_while_IDs_are_claimed_from_another_goroutine(t *testing.T) {
+	inF := newInFlight()
+	ids := make(chan int, 100)
+	done := make(chan struct{})
+	go func() {
+		for id := range ids {
+			inF.releasePacketID(id)
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		ids <- inF.nextPacketID()
+	}
+	close(ids)
+	<-done
+	for i := 1; i <= 1000; i++ {
+		testutils.CheckFalse(inF.getBit(i), t)
+	}
+}
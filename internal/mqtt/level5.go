@@ -0,0 +1,234 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Value encodings of MQTT 5 properties that are not a fixed number of bytes
+const (
+	varIntProperty     = -1 // a variable byte integer
+	bytesProperty      = -2 // a string or binary data (16 bit length + the content)
+	stringPairProperty = -3 // two strings
+)
+
+// propertyEncodings gives the encoding of the value of each MQTT 5 property by identifier - the number of bytes of
+// an integer value, or one of the encodings above
+//
+var propertyEncodings = map[int]int{
+	0x01: 1, 0x02: 4, 0x03: bytesProperty, 0x08: bytesProperty, 0x09: bytesProperty, 0x0B: varIntProperty,
+	0x11: 4, 0x12: bytesProperty, 0x13: 2, 0x15: bytesProperty, 0x16: bytesProperty, 0x17: 1, 0x18: 4, 0x19: 1,
+	0x1A: bytesProperty, 0x1C: bytesProperty, 0x1F: bytesProperty, 0x21: 2, 0x22: 2, 0x23: 2, 0x24: 1, 0x25: 1,
+	0x26: stringPairProperty, 0x27: 4, 0x28: 1, 0x29: 1, 0x2A: 1,
+}
+
+// decodeVariableInt decodes a variable byte integer at the start of the given data and returns it and the data
+// following it
+//
+func decodeVariableInt(data []byte) (int, []byte, error) {
+	reader := bytes.NewReader(data)
+	value, err := DecodeVariableInt(reader)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Malformed variable byte integer")
+	}
+	return value, data[len(data)-reader.Len():], nil
+}
+
+// decodeProperties decodes the MQTT 5 properties (the variable byte integer length + the properties) at the start of
+// the given data and returns the values of the integer properties by identifier, and the data following the
+// properties. The values of other properties are only checked for being well formed.
+//
+func decodeProperties(data []byte) (map[int]int64, []byte, error) {
+	length, data, err := decodeVariableInt(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("properties length: %s", err)
+	}
+	if len(data) < length {
+		return nil, nil, fmt.Errorf("properties length %d exceeds the remaining %d bytes", length, len(data))
+	}
+	properties, rest := data[:length], data[length:]
+	values := make(map[int]int64)
+	for len(properties) > 0 {
+		var id int
+		if id, properties, err = decodeVariableInt(properties); err != nil {
+			return nil, nil, fmt.Errorf("property identifier: %s", err)
+		}
+		encoding, ok := propertyEncodings[id]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown property 0x%x", id)
+		}
+		switch encoding {
+		case varIntProperty:
+			_, properties, err = decodeVariableInt(properties)
+		case bytesProperty:
+			_, properties, err = decodeBytes(properties)
+		case stringPairProperty:
+			if _, properties, err = decodeBytes(properties); err == nil {
+				_, properties, err = decodeBytes(properties)
+			}
+		default:
+			if len(properties) < encoding {
+				return nil, nil, fmt.Errorf("property 0x%x expects %d bytes but only %d byte(s) remain", id, encoding, len(properties))
+			}
+			if _, seen := values[id]; seen {
+				return nil, nil, fmt.Errorf("property 0x%x given more than once", id)
+			}
+			var value int64
+			for _, b := range properties[:encoding] {
+				value = value<<8 | int64(b)
+			}
+			values[id] = value
+			properties = properties[encoding:]
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("property 0x%x: %s", id, err)
+		}
+	}
+	return values, rest, nil
+}
+
+// encodeFourByteProperties encodes the given four byte integer properties (identifier followed by value) to the
+// buffer, preceded by their length. A property with the value 0 is left out as 0 is the default of these properties.
+//
+func encodeFourByteProperties(to *bytes.Buffer, idsAndValues ...int64) {
+	var properties bytes.Buffer
+	for i := 0; i+1 < len(idsAndValues); i += 2 {
+		if value := idsAndValues[i+1]; value != 0 {
+			properties.WriteByte(byte(idsAndValues[i]))
+			properties.Write([]byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	EncodeVariableIntTo(properties.Len(), to)
+	to.Write(properties.Bytes())
+}
+
+// connAckReasonCodes are the MQTT 5 CONNACK reason codes for the MQTT 3.1.1 return codes
+var connAckReasonCodes = map[byte]byte{
+	ConnectionAccepted:                  0x00,
+	ConnectionRefusedRejectedVersion:    0x84,
+	ConnectionRefusedRejectedIdentifier: 0x85,
+	ConnectionRefusedServerUnavailable:  0x88,
+	ConnectionRefusedBadUserPassword:    0x86,
+	ConnectionRefusedNotAuthorized:      0x87,
+}
+
+// ToLevel5 returns the MQTT 5 form of a CONNACK, PUBLISH, or SUBACK made for MQTT 3.1.1 (without any properties,
+// and with the CONNACK return code given as the corresponding reason code). Other packets are returned as is - an
+// acknowledgement with only a packet ID means success in MQTT 5, and an UNSUBACK must be made with
+// NewUnsubAckMessage.
+//
+func ToLevel5(msg *GenericMessage) *GenericMessage {
+	var at int // where the empty properties are inserted
+	switch msg.Type() {
+	case ConnAckType:
+		if len(msg.body) != 2 {
+			return msg
+		}
+		return &GenericMessage{fixedHeader: msg.fixedHeader, body: []byte{msg.body[0], connAckReasonCodes[msg.body[1]], 0}}
+	case PublishType:
+		if len(msg.body) < 2 {
+			return msg
+		}
+		at = 2 + (int(msg.body[0])<<8 | int(msg.body[1]))
+		if msg.fixedHeader&(QoSOne|QoSTwo) != 0 {
+			at += 2
+		}
+	case SubAckType:
+		at = 2
+	default:
+		return msg
+	}
+	if at > len(msg.body) {
+		return msg
+	}
+	body := make([]byte, 0, len(msg.body)+1)
+	body = append(append(append(body, msg.body[:at]...), 0), msg.body[at:]...)
+	return &GenericMessage{fixedHeader: msg.fixedHeader, body: body}
+}
+
+// FromLevel5 returns the MQTT 3.1.1 form of a PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, UNSUBSCRIBE, or
+// DISCONNECT received from an MQTT 5 client, and the reason code of an acknowledgement or DISCONNECT (0 if it has
+// none). Properties are dropped, and so are the MQTT 5 subscription options other than the maximum QoS.
+// Other packets are returned as is. An error is returned if the packet is malformed.
+//
+func FromLevel5(msg *GenericMessage) (*GenericMessage, int, error) {
+	body := msg.body
+	switch msg.Type() {
+	case PublishType:
+		_, rest, err := decodeString(body)
+		if err != nil {
+			return nil, 0, fmt.Errorf("PUBLISH topic: %s", err)
+		}
+		at := len(body) - len(rest)
+		if msg.fixedHeader&(QoSOne|QoSTwo) != 0 {
+			if len(rest) < 2 {
+				return nil, 0, fmt.Errorf("PUBLISH too short for packet ID")
+			}
+			at += 2
+		}
+		if _, rest, err = decodeProperties(body[at:]); err != nil {
+			return nil, 0, fmt.Errorf("PUBLISH %s", err)
+		}
+		result := append(append(make([]byte, 0, at+len(rest)), body[:at]...), rest...)
+		return &GenericMessage{fixedHeader: msg.fixedHeader, body: result}, 0, nil
+
+	case PublishAckType, PublishReceivedType, PublishReleaseType, PublishCompleteType:
+		if len(body) <= 2 {
+			return msg, 0, nil
+		}
+		if len(body) > 3 {
+			if _, rest, err := decodeProperties(body[3:]); err != nil || len(rest) != 0 {
+				return nil, 0, fmt.Errorf("%s has malformed properties", PacketTypeName(msg.Type()))
+			}
+		}
+		return &GenericMessage{fixedHeader: msg.fixedHeader, body: body[:2]}, int(body[2]), nil
+
+	case SubscribeType, UnsubscribeType:
+		if len(body) < 2 {
+			return nil, 0, fmt.Errorf("%s too short for packet ID", PacketTypeName(msg.Type()))
+		}
+		_, filters, err := decodeProperties(body[2:])
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s %s", PacketTypeName(msg.Type()), err)
+		}
+		result := append(make([]byte, 0, len(body)), body[:2]...)
+		if msg.Type() == UnsubscribeType {
+			return &GenericMessage{fixedHeader: msg.fixedHeader, body: append(result, filters...)}, 0, nil
+		}
+		for len(filters) > 0 {
+			filter, rest, err := decodeBytes(filters)
+			if err != nil || len(rest) < 1 {
+				return nil, 0, fmt.Errorf("SUBSCRIBE topic filter must be followed by subscription options")
+			}
+			if rest[0]&0xC0 != 0 {
+				return nil, 0, fmt.Errorf("SUBSCRIBE reserved subscription option bits must be 0 - got 0x%x", rest[0])
+			}
+			result = append(append(result, filters[:2+len(filter)]...), rest[0]&3)
+			filters = rest[1:]
+		}
+		return &GenericMessage{fixedHeader: msg.fixedHeader, body: result}, 0, nil
+
+	case DisconnectType:
+		if len(body) == 0 {
+			return msg, 0, nil
+		}
+		if len(body) > 1 {
+			if _, rest, err := decodeProperties(body[1:]); err != nil || len(rest) != 0 {
+				return nil, 0, fmt.Errorf("DISCONNECT has malformed properties")
+			}
+		}
+		return &GenericMessage{fixedHeader: msg.fixedHeader}, int(body[0]), nil
+	}
+	return msg, 0, nil
+}
+
+// NewUnsubAckMessage returns a new MQTT 5 UNSUBACK message for the given packet ID with the given reason codes - one
+// per topic filter in the UNSUBSCRIBE. (An MQTT 3.1.1 UNSUBACK is made with NewAckMessage).
+//
+func NewUnsubAckMessage(packetID int, reasonCodes []byte) *GenericMessage {
+	var buffer bytes.Buffer
+	Encode16BitIntTo(packetID, &buffer)
+	buffer.WriteByte(0) // no properties
+	buffer.Write(reasonCodes)
+	return &GenericMessage{fixedHeader: UnsubAckType << 4, body: buffer.Bytes()}
+}
@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func Test_ToLevel5_and_FromLevel5_add_and_drop_the_properties_of_a_PUBLISH(t *testing.T) {
+	msg := NewPublishRequest(Topic("a/b"), Message([]byte("hi")), QoS(1), PacketID(7)).MakeMessage()
+	level5 := ToLevel5(msg)
+	testutils.CheckEqual([]byte{0, 3, 'a', '/', 'b', 0, 7, 0, 'h', 'i'}, level5.Body(), t)
+
+	// Properties of a received PUBLISH are dropped
+	received := NewGenericMessage(PublishType, QoSOne, []byte{0, 3, 'a', '/', 'b', 0, 7, 5, 0x02, 0, 0, 0, 60, 'h', 'i'})
+	decoded, reasonCode, err := FromLevel5(received)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(0, reasonCode, t)
+	testutils.CheckEqual(msg.Body(), decoded.Body(), t)
+
+	// QoS 0 has no packet ID
+	msg = NewPublishRequest(Topic("a"), Message([]byte("hi"))).MakeMessage()
+	testutils.CheckEqual([]byte{0, 1, 'a', 0, 'h', 'i'}, ToLevel5(msg).Body(), t)
+}
+
+func Test_ToLevel5_gives_the_CONNACK_reason_code_for_the_return_code(t *testing.T) {
+	testutils.CheckEqual([]byte{1, 0, 0}, ToLevel5(NewConnAckMessage(true, ConnectionAccepted)).Body(), t)
+	testutils.CheckEqual([]byte{0, 0x87, 0}, ToLevel5(NewConnAckMessage(false, ConnectionRefusedNotAuthorized)).Body(), t)
+	testutils.CheckEqual([]byte{0, 1, 0, 2}, ToLevel5(NewSubAckMessage(1, []byte{2})).Body(), t)
+	testutils.CheckEqual([]byte{0, 1}, ToLevel5(NewAckMessage(PublishAckType, 1)).Body(), t)
+}
+
+func Test_FromLevel5_keeps_the_maximum_QoS_of_the_subscription_options(t *testing.T) {
+	// Packet ID 1, a user property, and "a" with No Local, Retain As Published, and QoS 2
+	msg := NewGenericMessage(SubscribeType, SubscribeReserved, []byte{0, 1, 7, 0x26, 0, 1, 'k', 0, 1, 'v', 0, 1, 'a', 0x0E})
+	decoded, _, err := FromLevel5(msg)
+	testutils.CheckNotError(err, t)
+	request, err := DecodeSubscribe(decoded)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual([]Subscription{{TopicFilter: "a", QoS: 2}}, request.Options().Subscriptions, t)
+
+	// Reserved option bits must be 0
+	msg = NewGenericMessage(SubscribeType, SubscribeReserved, []byte{0, 1, 0, 0, 1, 'a', 0x42})
+	_, _, err = FromLevel5(msg)
+	testutils.CheckError(err, t)
+}
+
+func Test_FromLevel5_returns_the_reason_code_of_acknowledgements_and_DISCONNECT(t *testing.T) {
+	decoded, reasonCode, err := FromLevel5(NewGenericMessage(PublishReceivedType, 0, []byte{0, 9, 0x10, 0}))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(0x10, reasonCode, t)
+	testutils.CheckEqual([]byte{0, 9}, decoded.Body(), t)
+
+	decoded, reasonCode, err = FromLevel5(NewGenericMessage(DisconnectType, 0, []byte{DisconnectWithWillMessage}))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(DisconnectWithWillMessage, reasonCode, t)
+	testutils.CheckEqual(0, len(decoded.Body()), t)
+}
+
+func Test_FromLevel5_refuses_malformed_properties(t *testing.T) {
+	for _, body := range [][]byte{
+		{0, 1, 'a', 3, 0x02, 0, 0},                          // property value truncated
+		{0, 1, 'a', 2, 0x7F, 0},                             // unknown property
+		{0, 1, 'a', 10, 0x02, 0, 0, 0, 1},                   // length exceeds the packet
+		{0, 1, 'a', 10, 0x02, 0, 0, 0, 1, 0x02, 0, 0, 0, 2}, // given twice
+	} {
+		_, _, err := FromLevel5(NewGenericMessage(PublishType, 0, body))
+		testutils.CheckError(err, t)
+	}
+}
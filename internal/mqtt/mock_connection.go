@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -17,63 +19,61 @@ import (
 // used the same way as a net.Conn returned from net.Dial.
 // In addition to the net.Conn API, the MockConnection supports
 // RemoteRead() and RemoteWrite() for what would be the remote end of
-// a net.Conn.
+// a net.Conn. The remote end is also available as a net.Conn from RemoteConn().
 //
 // The primary intended use case for MockConnection is to help with unit testing
 // logic using a net.Conn.
 //
-// ReadDeadLine is supported (TODO: currently WriteDeadLine is ignored as all writes will succeed until
-// the system is out of memory).
+// ReadDeadLine and WriteDeadLine are supported. Writes block (and can time out) only when the output is limited
+// with LimitOutput() and the remote end does not read.
 //
-// TODO: This MockConnection does not have a way to simulate
-// syscall.ETIMEOUT error return resulting from a TCP keepAlive
-// failure.
+// The remote end can be made to answer what is written as a broker would with Respond(), and the connection can be
+// made to fail - for example with ErrConnectionReset or ErrKeepAliveTimeout (the syscall.ETIMEDOUT resulting
+// from a TCP keepAlive failure) - with Fail().
 //
 type MockConnection struct {
-	input             bytes.Buffer
-	output            bytes.Buffer
-	closed            bool
-	readDeadline      time.Time
-	readDeadLineTimer *time.Timer
-	writeDeadline     time.Time
-	moreData          *sync.Cond // Cond to wait on when there is no data to read
-	moreRemoteData    *sync.Cond // Cond to wait on when there is no data to read at remote end
+	input              bytes.Buffer
+	output             bytes.Buffer
+	outputLimit        int // the number of unread bytes at which writes block (0 for no limit)
+	closed             bool
+	failure            error // the error reads and writes fail with (nil if they do not fail)
+	readDeadline       time.Time
+	readDeadLineTimer  *time.Timer
+	writeDeadline      time.Time
+	writeDeadLineTimer *time.Timer
+	moreData           *sync.Cond // Cond to wait on when there is no data to read
+	moreRemoteData     *sync.Cond // Cond to wait on when there is no data to read at remote end (or no room to write)
+
+	remoteReadDeadline      time.Time
+	remoteReadDeadLineTimer *time.Timer
 }
 
 // NewMockConnection returns a new connection - i.e. comparable to net.Dial() but everything is hardcoded
 func NewMockConnection() *MockConnection {
-	// start out with a stopped timer - this timer is reset when deadline is changed
-	mc := &MockConnection{
-		moreData:          sync.NewCond(&sync.Mutex{}),
-		moreRemoteData:    sync.NewCond(&sync.Mutex{}),
-		readDeadLineTimer: newStoppedTimer(),
+	return &MockConnection{
+		moreData:       sync.NewCond(&sync.Mutex{}),
+		moreRemoteData: sync.NewCond(&sync.Mutex{}),
 	}
-
-	// Run a readDeadLine listener that wakes up those that are blocked reading
-	go func() {
-		for {
-			// wait for timer to fire
-			<-mc.readDeadLineTimer.C
-			// timer fired, lock and Broadcast to those in blocking read
-			if log.IsLevelEnabled(log.DebugLevel) {
-				log.Debugf("MockConnection ReadDeadline fired")
-			}
-			md := mc.moreData
-			md.L.Lock()
-			md.Broadcast()
-			md.L.Unlock()
-		}
-	}()
-	return mc
 }
 
-// newStoppedTimer returns a stopped timer
-func newStoppedTimer() *time.Timer {
-	timer := time.NewTimer(1 * time.Second)
-	if !timer.Stop() {
-		<-timer.C // drain if it fired (very unlikely, but happens when stepping over this in debugging)
+// readDeadlineFired wakes up those that are blocked reading when the read deadline timer fires
+func (c *MockConnection) readDeadlineFired() {
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.Debugf("MockConnection ReadDeadline fired")
 	}
-	return timer
+	md := c.moreData
+	md.L.Lock()
+	md.Broadcast()
+	md.L.Unlock()
+}
+
+// remoteReadDeadlineFired wakes up those that are blocked reading at the remote end when the remote read deadline
+// timer fires - and those blocked writing when the write deadline timer fires
+func (c *MockConnection) remoteReadDeadlineFired() {
+	md := c.moreRemoteData
+	md.L.Lock()
+	md.Broadcast()
+	md.L.Unlock()
 }
 
 // MockConnectionAddr implements net.Addr interface and is a staic "tcp" "0.0.0.0"
@@ -88,28 +88,35 @@ func (a *MockConnectionAddr) String() string { return "0.0.0.0" }
 // Read reads data from the connection.
 // Read can be made to time out and return an Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetReadDeadline.
+// Read returns the error given to Fail() if the connection has failed.
 func (c *MockConnection) Read(b []byte) (n int, err error) {
-	return c.readBufWithLock(b, &c.input, c.moreData, c.readDeadline)
+	return c.readBufWithLock(b, &c.input, c.moreData, &c.readDeadline, true)
 }
 
 // RemoteRead reads data from the connection's remote end (this returns what was written with Write)
 func (c *MockConnection) RemoteRead(b []byte) (n int, err error) {
-	return c.readBufWithLock(b, &c.output, c.moreRemoteData, c.readDeadline) // TODO: should have Remote Deadline too
+	return c.readBufWithLock(b, &c.output, c.moreRemoteData, &c.remoteReadDeadline, false)
 }
 
-// readBufWithLock reads from the buffer and waits for more data if it is empty
-func (c *MockConnection) readBufWithLock(b []byte, buffer *bytes.Buffer, condition *sync.Cond, deadline time.Time) (n int, err error) {
+// readBufWithLock reads from the buffer and waits for more data if it is empty.
+// The deadline is read while holding the lock since it may change while waiting (nil means no deadline).
+// A local read fails if the connection has failed.
+func (c *MockConnection) readBufWithLock(b []byte, buffer *bytes.Buffer, condition *sync.Cond, deadline *time.Time, local bool) (n int, err error) {
 	// TODO: timeout & read of 0 bytes?
 	for {
 		condition.L.Lock()
 	again:
 		availBytes := buffer.Len()
+		if local && c.failure != nil {
+			condition.L.Unlock()
+			return 0, c.failure
+		}
 		if c.closed && availBytes == 0 {
 			fmt.Printf("Read detects MockConnection is closed - returns EOF")
 			condition.L.Unlock()
 			return 0, io.EOF
 		}
-		if !deadline.IsZero() && time.Now().After(deadline) { // while all times are after "zero time", this avoids a system call to Now()
+		if deadline != nil && !deadline.IsZero() && time.Now().After(*deadline) { // while all times are after "zero time", this avoids a system call to Now()
 			if log.IsLevelEnabled(log.DebugLevel) {
 				log.Debugf("MockConnection Read detects it is passed ReadDeadline - returns ErrTimeout")
 			}
@@ -121,6 +128,10 @@ func (c *MockConnection) readBufWithLock(b []byte, buffer *bytes.Buffer, conditi
 			goto again
 		}
 		n, err = buffer.Read(b)
+		if buffer == &c.output && c.outputLimit > 0 {
+			// wake writers waiting for room
+			condition.Broadcast()
+		}
 		condition.L.Unlock()
 		return n, err
 	}
@@ -128,20 +139,50 @@ func (c *MockConnection) readBufWithLock(b []byte, buffer *bytes.Buffer, conditi
 
 // Write writes data to the connection.
 // Write can be made to time out and return an Error with Timeout() == true
-// after a fixed time limit; see SetDeadline and SetWriteDeadline.
+// after a fixed time limit; see SetDeadline and SetWriteDeadline. It only blocks when the output is limited
+// (see LimitOutput), and returns the error given to Fail() if the connection has failed.
 func (c *MockConnection) Write(b []byte) (n int, err error) {
-	return c.writeBufWithLock(b, &c.output, c.moreRemoteData, c.writeDeadline)
+	condition := c.moreRemoteData
+	condition.L.Lock()
+	defer condition.L.Unlock()
+	for {
+		switch {
+		case c.failure != nil:
+			return n, c.failure
+		case c.closed:
+			return n, io.EOF
+		case !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline):
+			return n, ErrTimeout
+		case n == len(b):
+			return n, nil
+		}
+		room := len(b) - n
+		if c.outputLimit > 0 {
+			if free := c.outputLimit - c.output.Len(); free < room {
+				room = free
+			}
+			if room <= 0 {
+				condition.Wait()
+				continue
+			}
+		}
+		if c.output.Len() == 0 {
+			condition.Broadcast()
+		}
+		c.output.Write(b[n : n+room])
+		n += room
+	}
 }
 
 // RemoteWrite writes data to the connection as if something was written on the remote side of
 // a connection. (This data will be returned from subsequent Read() operations).
 //
 func (c *MockConnection) RemoteWrite(b []byte) (n int, err error) {
-	return c.writeBufWithLock(b, &c.input, c.moreData, c.writeDeadline)
+	return c.writeBufWithLock(b, &c.input, c.moreData)
 }
 
 // writeBufWithLock writes to the buffer, and signals a condition if buffer goes from empty to having content
-func (c *MockConnection) writeBufWithLock(b []byte, buffer *bytes.Buffer, condition *sync.Cond, deadline time.Time) (n int, err error) {
+func (c *MockConnection) writeBufWithLock(b []byte, buffer *bytes.Buffer, condition *sync.Cond) (n int, err error) {
 	condition.L.Lock()
 	defer condition.L.Unlock()
 
@@ -149,10 +190,6 @@ func (c *MockConnection) writeBufWithLock(b []byte, buffer *bytes.Buffer, condit
 		return 0, io.EOF
 	}
 
-	if !deadline.IsZero() && time.Now().After(deadline) { // while all times are after "zero time", this avoids a system call to Now()
-		return 0, ErrTimeout
-	}
-
 	availBytes := buffer.Len()
 	n, err = buffer.Write(b)
 	if availBytes == 0 {
@@ -176,13 +213,39 @@ func (c *MockConnection) Close() error {
 	if c.input.Len() == 0 {
 		c.moreData.Broadcast()
 	}
-	// release blocked remote readers so they pick up the close
-	if c.output.Len() == 0 {
+	// release blocked remote readers (and writers waiting for room) so they pick up the close
+	if c.output.Len() == 0 || c.outputLimit > 0 {
 		c.moreRemoteData.Broadcast()
 	}
 	return nil
 }
 
+// Fail makes pending and future reads and writes of the connection return the given error (data not yet read is
+// lost) - as when a network connection breaks, for example with ErrConnectionReset. The remote end is not affected.
+//
+func (c *MockConnection) Fail(err error) {
+	c.moreRemoteData.L.Lock()
+	defer c.moreRemoteData.L.Unlock()
+	c.moreData.L.Lock()
+	defer c.moreData.L.Unlock()
+	c.failure = err
+	c.moreData.Broadcast()
+	c.moreRemoteData.Broadcast()
+}
+
+// LimitOutput makes writes block while the given number of written bytes have not been read at the remote end - as
+// when the remote end does not read and the network buffers are full. A limit of 0 removes the limit.
+//
+func (c *MockConnection) LimitOutput(size int) {
+	if size < 0 {
+		panic("The output limit cannot be negative")
+	}
+	c.moreRemoteData.L.Lock()
+	defer c.moreRemoteData.L.Unlock()
+	c.outputLimit = size
+	c.moreRemoteData.Broadcast()
+}
+
 // LocalAddr returns a hardcoded local network address.
 func (c *MockConnection) LocalAddr() net.Addr {
 	return &MockConnectionAddr{}
@@ -214,13 +277,9 @@ func (c *MockConnection) RemoteAddr() net.Addr {
 // or ListenConfig.KeepAlive, then a keep-alive failure may
 // also return a timeout error. On Unix systems a keep-alive
 // failure on I/O can be detected using
-// errors.Is(err, syscall.ETIMEDOUT).
-//
-// TODO: This MockConnection does not have a way to simulate
-// syscall.ETIMEOUT error return resulting from a TCP keepAlive
-// failure.
+// errors.Is(err, syscall.ETIMEDOUT). This is simulated by
+// calling Fail(ErrKeepAliveTimeout).
 //
-// TODO: At present the WriteDeadLine does not have any effect.
 func (c *MockConnection) SetDeadline(t time.Time) error {
 	c.SetReadDeadline(t)
 	c.SetWriteDeadline(t)
@@ -235,20 +294,34 @@ func (c *MockConnection) SetReadDeadline(t time.Time) error {
 	defer c.moreData.L.Unlock()
 	c.readDeadline = t
 
-	// stop the currently ticking (or possibly fired) timer
-	oldTimer := c.readDeadLineTimer
-	if !oldTimer.Stop() {
-		select {
-		case <-oldTimer.C: // drain if it fired
-		default: // it was stopped already
-		}
+	// stop the currently ticking timer (if any)
+	if c.readDeadLineTimer != nil {
+		c.readDeadLineTimer.Stop()
+		c.readDeadLineTimer = nil
+	}
+	if t.IsZero() {
+		// No need to wake those that are blocked
+		return nil
+	}
+	// Wake those that are blocked when the deadline is reached
+	c.readDeadLineTimer = time.AfterFunc(t.Sub(time.Now()), c.readDeadlineFired)
+	return nil
+}
+
+// setRemoteReadDeadline is SetReadDeadline for the remote end
+func (c *MockConnection) setRemoteReadDeadline(t time.Time) error {
+	c.moreRemoteData.L.Lock()
+	defer c.moreRemoteData.L.Unlock()
+	c.remoteReadDeadline = t
+
+	if c.remoteReadDeadLineTimer != nil {
+		c.remoteReadDeadLineTimer.Stop()
+		c.remoteReadDeadLineTimer = nil
 	}
 	if t.IsZero() {
-		// No need to wake those that are blocked, simply keep the timer in stopped state
 		return nil
 	}
-	// Set a new duration
-	oldTimer.Reset(t.Sub(time.Now()))
+	c.remoteReadDeadLineTimer = time.AfterFunc(t.Sub(time.Now()), c.remoteReadDeadlineFired)
 	return nil
 }
 
@@ -257,9 +330,20 @@ func (c *MockConnection) SetReadDeadline(t time.Time) error {
 // Even if write times out, it may return n > 0, indicating that
 // some of the data was successfully written.
 // A zero value for t means Write will not time out.
-// TODO: At present this WriteDeadLine does not have any effect.
 func (c *MockConnection) SetWriteDeadline(t time.Time) error {
+	c.moreRemoteData.L.Lock()
+	defer c.moreRemoteData.L.Unlock()
 	c.writeDeadline = t
+
+	if c.writeDeadLineTimer != nil {
+		c.writeDeadLineTimer.Stop()
+		c.writeDeadLineTimer = nil
+	}
+	if t.IsZero() {
+		return nil
+	}
+	// Wake writers blocked on a full output when the deadline is reached
+	c.writeDeadLineTimer = time.AfterFunc(t.Sub(time.Now()), c.remoteReadDeadlineFired)
 	return nil
 }
 
@@ -293,11 +377,48 @@ func (r *Remote) ReadByte() (byte, error) {
 	return b[0], nil
 }
 
+// Close closes the connection (both ends)
+func (r *Remote) Close() error {
+	return r.conn.Close()
+}
+
+// LocalAddr returns a hardcoded local network address.
+func (r *Remote) LocalAddr() net.Addr {
+	return &MockConnectionAddr{}
+}
+
+// RemoteAddr returns a hardcoded remote network address.
+func (r *Remote) RemoteAddr() net.Addr {
+	return &MockConnectionAddr{}
+}
+
+// SetDeadline sets the read deadline of the remote end (a write deadline has no effect)
+func (r *Remote) SetDeadline(t time.Time) error {
+	return r.conn.setRemoteReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future and blocked reads at the remote end
+func (r *Remote) SetReadDeadline(t time.Time) error {
+	return r.conn.setRemoteReadDeadline(t)
+}
+
+// SetWriteDeadline has no effect - writes at the remote end never block
+func (r *Remote) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
 // Remote returns a io.ReadWriter for the remote end of this MockConnetion
 func (c *MockConnection) Remote() RemoteIO {
 	return &Remote{conn: c}
 }
 
+// RemoteConn returns the remote end of this MockConnection as a net.Conn. This makes it possible to connect
+// two parties - for example a Session using the MockConnection and a broker serving the remote end.
+//
+func (c *MockConnection) RemoteConn() net.Conn {
+	return &Remote{conn: c}
+}
+
 // TimeoutError is returned for an expired deadline.
 // It implements net.Error interface
 // This type is needed because the error actually returned from net.Conn is an internal data type
@@ -315,3 +436,63 @@ func (e *TimeoutError) Temporary() bool { return true }
 
 // ErrTimeout is returned for an expired deadline
 var ErrTimeout error = &TimeoutError{}
+
+// ErrConnectionReset is like the error returned by a TCP connection reset by the remote end.
+// errors.Is(err, syscall.ECONNRESET) is true for it.
+var ErrConnectionReset error = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+// ErrKeepAliveTimeout is like the error returned by a TCP connection when keep-alive fails.
+// errors.Is(err, syscall.ETIMEDOUT) is true for it, and it is a net.Error with Timeout() == true.
+var ErrKeepAliveTimeout error = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ETIMEDOUT)}
+
+// MockResponse is how the remote end of a MockConnection answers a packet written to the connection
+//
+type MockResponse struct {
+	Delay   time.Duration     // the time to wait before answering
+	Packets []*GenericMessage // the packets to answer with
+	Err     error             // if not nil, the connection fails with this error after the packets (see Fail)
+	Close   bool              // if the connection is closed after the packets
+}
+
+// MockResponder returns how to answer the given packet written to a MockConnection - nil for no answer
+type MockResponder func(packet *GenericMessage) *MockResponse
+
+// MockReply returns a MockResponse answering with the given packets without delay
+func MockReply(packets ...*GenericMessage) *MockResponse {
+	return &MockResponse{Packets: packets}
+}
+
+// Respond makes the remote end answer each packet written to the connection as decided by the given responder -
+// one packet at a time, in the order they are written. This means that nothing else should read at the remote end.
+// The responder stops when the connection is closed.
+//
+func (c *MockConnection) Respond(responder MockResponder) {
+	go func() {
+		remote := c.Remote()
+		for {
+			packet, err := ReadMessage(remote)
+			if err != nil {
+				return
+			}
+			response := responder(packet)
+			if response == nil {
+				continue
+			}
+			if response.Delay > 0 {
+				time.Sleep(response.Delay)
+			}
+			for _, p := range response.Packets {
+				if _, err := p.WriteTo(remote); err != nil {
+					return
+				}
+			}
+			if response.Err != nil {
+				c.Fail(response.Err)
+			}
+			if response.Close {
+				c.Close()
+				return
+			}
+		}
+	}()
+}
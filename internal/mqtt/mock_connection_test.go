@@ -1,8 +1,11 @@
 package mqtt
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
+	"syscall"
 	"testing"
 	"time"
 
@@ -126,3 +129,146 @@ func Test_MockConnection_Read_returns_amount_read_if_buffer_becomes_empty(t *tes
 
 // TODO: Test Multithreaded reading and writing
 // 1. n threads write 1 byte each, n threads read one byte each - all bytes are read
+
+func Test_MockConnection_RemoteConn_reads_what_is_written_and_supports_read_deadline(t *testing.T) {
+	conn := NewMockConnection()
+	remote := conn.RemoteConn()
+	_, err := conn.Write([]byte("ping"))
+	testutils.CheckNotError(err, t)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(remote, buf)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual("ping", string(buf), t)
+
+	remote.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = remote.Read(buf)
+	testutils.CheckEqual(ErrTimeout, err, t)
+}
+
+func Test_MockConnection_write_blocks_on_limited_output_until_the_write_deadline(t *testing.T) {
+	conn := NewMockConnection()
+	conn.LimitOutput(4)
+	conn.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	n, err := conn.Write([]byte("abcdefgh"))
+	testutils.CheckEqual(4, n, t)
+	testutils.CheckEqual(ErrTimeout, err, t)
+
+	// a remote read makes room for a blocked write
+	conn.SetWriteDeadline(time.Time{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.RemoteRead(make([]byte, 4))
+	}()
+	n, err = conn.Write([]byte("efgh"))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(4, n, t)
+	buf := make([]byte, 8)
+	n, _ = conn.RemoteRead(buf)
+	testutils.CheckEqual("efgh", string(buf[:n]), t)
+}
+
+func Test_MockConnection_Close_releases_a_blocked_write(t *testing.T) {
+	conn := NewMockConnection()
+	conn.LimitOutput(1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.Close()
+	}()
+	n, err := conn.Write([]byte("ab"))
+	testutils.CheckEqual(1, n, t)
+	testutils.CheckEqual(io.EOF, err, t)
+}
+
+func Test_MockConnection_Fail_fails_blocked_and_future_reads_and_writes(t *testing.T) {
+	conn := NewMockConnection()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.Fail(ErrConnectionReset)
+	}()
+	_, err := conn.Read(make([]byte, 1))
+	testutils.CheckTrue(errors.Is(err, syscall.ECONNRESET), t)
+	_, err = conn.Write([]byte("a"))
+	testutils.CheckEqual(ErrConnectionReset, err, t)
+
+	conn = NewMockConnection()
+	conn.Fail(ErrKeepAliveTimeout)
+	_, err = conn.Read(make([]byte, 1))
+	testutils.CheckTrue(errors.Is(err, syscall.ETIMEDOUT), t)
+	netErr, ok := err.(net.Error)
+	testutils.CheckTrue(ok && netErr.Timeout(), t)
+}
+
+func Test_MockConnection_Respond_answers_CONNECT_with_a_refusal(t *testing.T) {
+	conn := NewMockConnection()
+	defer conn.Close()
+	conn.Respond(func(packet *GenericMessage) *MockResponse {
+		if packet.Type() == ConnectType {
+			return MockReply(NewConnAckMessage(false, ConnectionRefusedNotAuthorized))
+		}
+		return nil
+	})
+	session := NewSession(ClientID("refused"), Connection(conn))
+	err := session.Connect()
+	testutils.CheckError(err, t)
+}
+
+func Test_MockConnection_Respond_delays_the_CONNACK(t *testing.T) {
+	conn := NewMockConnection()
+	defer conn.Close()
+	conn.Respond(func(packet *GenericMessage) *MockResponse {
+		return &MockResponse{Delay: 200 * time.Millisecond, Packets: []*GenericMessage{NewConnAckMessage(false, ConnectionAccepted)}}
+	})
+	session := NewSession(ClientID("slow"), Connection(conn))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	testutils.CheckError(session.ConnectContext(ctx), t)
+}
+
+func Test_MockConnection_Respond_acknowledges_every_second_PUBLISH(t *testing.T) {
+	conn := NewMockConnection()
+	defer conn.Close()
+	publishes := 0
+	conn.Respond(func(packet *GenericMessage) *MockResponse {
+		switch packet.Type() {
+		case ConnectType:
+			return MockReply(NewConnAckMessage(false, ConnectionAccepted))
+		case PublishType:
+			publishes++
+			if publishes%2 == 0 {
+				pr, _ := DecodePublish(packet)
+				return MockReply(NewAckMessage(PublishAckType, pr.Options().PacketID))
+			}
+		}
+		return nil
+	})
+	session := NewSession(ClientID("acked"), Connection(conn))
+	testutils.CheckNotError(session.Connect(), t)
+	for i := 0; i < 4; i++ {
+		testutils.CheckNotError(session.Publish(Topic("a"), Message([]byte("m")), QoS(1)), t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := session.DisconnectContext(ctx)
+	unacknowledged, ok := err.(*UnacknowledgedError)
+	testutils.CheckTrue(ok, t)
+	testutils.CheckEqual([]int{1, 3}, unacknowledged.PacketIDs, t)
+}
+
+func Test_MockConnection_Respond_can_make_the_connection_fail(t *testing.T) {
+	conn := NewMockConnection()
+	defer conn.Close()
+	conn.Respond(func(packet *GenericMessage) *MockResponse {
+		switch packet.Type() {
+		case ConnectType:
+			return MockReply(NewConnAckMessage(false, ConnectionAccepted))
+		case PublishType:
+			return &MockResponse{Delay: 10 * time.Millisecond, Err: ErrConnectionReset}
+		}
+		return nil
+	})
+	session := NewSession(ClientID("reset"), Connection(conn))
+	testutils.CheckNotError(session.Connect(), t)
+	testutils.CheckNotError(session.Publish(Topic("a"), Message([]byte("m")), QoS(1)), t)
+	testhelperWaitForDone(session, t)
+	testutils.CheckError(session.Err(), t)
+}
@@ -0,0 +1,70 @@
+package mqtt
+
+// Observer is notified about events in a Session. An Observer is registered with the SessionOption Observe().
+//
+// The methods are called without holding any lock of the Session, so it is safe to call methods of the Session
+// (for example Err()) from them. Events of a connection are notified from the goroutine running the event loop
+// of the connection, and a method should therefore not block - until it returns no packets are read from, or written
+// to, the broker.
+//
+// An implementation that is only interested in some events can embed NopObserver.
+//
+type Observer interface {
+	// OnConnected is called when a Connect has completed. The sessionPresent flag is the Session Present flag of the
+	// CONNACK from the broker.
+	OnConnected(sessionPresent bool)
+
+	// OnConnectionLost is called when the connection to the broker ended with the given error (i.e. not because of
+	// a Disconnect).
+	OnConnectionLost(err error)
+
+	// OnReconnecting is called when Connect is called for a Session that has been connected before.
+	OnReconnecting()
+
+	// OnPacketSent is called after a packet has been written to the broker
+	OnPacketSent(packet *GenericMessage)
+
+	// OnPacketReceived is called when a packet has been read from the broker - before it is processed
+	OnPacketReceived(packet *GenericMessage)
+
+	// OnPublishAcknowledged is called when a QoS 1 or QoS 2 message with the given packet ID has been
+	// acknowledged by the broker (PUBACK or PUBCOMP).
+	OnPublishAcknowledged(packetID int)
+
+	// OnMessage is called when a message published by the broker is given to the MessageHandler
+	OnMessage(msg *PublishRequest)
+}
+
+// NopObserver is an Observer that does nothing
+//
+type NopObserver struct{}
+
+// OnConnected does nothing
+func (NopObserver) OnConnected(sessionPresent bool) {}
+
+// OnConnectionLost does nothing
+func (NopObserver) OnConnectionLost(err error) {}
+
+// OnReconnecting does nothing
+func (NopObserver) OnReconnecting() {}
+
+// OnPacketSent does nothing
+func (NopObserver) OnPacketSent(packet *GenericMessage) {}
+
+// OnPacketReceived does nothing
+func (NopObserver) OnPacketReceived(packet *GenericMessage) {}
+
+// OnPublishAcknowledged does nothing
+func (NopObserver) OnPublishAcknowledged(packetID int) {}
+
+// OnMessage does nothing
+func (NopObserver) OnMessage(msg *PublishRequest) {}
+
+// notify calls the given function with each Observer of the session.
+// Must not be called while holding the mutex of the session.
+//
+func (s *Session) notify(event func(o Observer)) {
+	for _, o := range s.options.Observers {
+		event(o)
+	}
+}
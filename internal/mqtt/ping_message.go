@@ -0,0 +1,11 @@
+package mqtt
+
+// NewPingRequestMessage returns a new PINGREQ message
+func NewPingRequestMessage() *GenericMessage {
+	return &GenericMessage{fixedHeader: (PingReqType << 4), body: []byte{}}
+}
+
+// NewPingResponseMessage returns a new PINGRESP message
+func NewPingResponseMessage() *GenericMessage {
+	return &GenericMessage{fixedHeader: (PingRespType << 4), body: []byte{}}
+}
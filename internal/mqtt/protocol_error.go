@@ -0,0 +1,68 @@
+package mqtt
+
+import "fmt"
+
+// ProtocolError describes a violation of the MQTT protocol detected in a received packet.
+// When a Session detects a ProtocolError in a packet from the broker it closes the connection and transitions
+// to DISCONNECTED.
+// The error is then available from Session.Err().
+//
+type ProtocolError struct {
+	PacketType int    // MQTT control packet type of the offending packet
+	Flags      byte   // the lower 4 bits of the fixed header of the offending packet
+	Body       []byte // the bytes after the remaining length of the offending packet
+	Reason     string // describes what is wrong with the packet
+}
+
+// Error returns a string describing the protocol violation and the offending packet
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("MQTT protocol violation: %s (packet %s, flags 0x%x, body %v)",
+		e.Reason, PacketTypeName(e.PacketType), e.Flags, e.Body)
+}
+
+// newProtocolError returns a ProtocolError for the given message with a reason formatted from the given format and values
+func newProtocolError(msg *GenericMessage, format string, values ...interface{}) *ProtocolError {
+	return &ProtocolError{
+		PacketType: int(msg.fixedHeader >> 4),
+		Flags:      msg.fixedHeader & 0x0F,
+		Body:       msg.body,
+		Reason:     fmt.Sprintf(format, values...),
+	}
+}
+
+// PacketTypeName returns the name used in the MQTT specification for the given control packet type (for example
+// "PUBACK" for PublishAckType). For an unknown type the string "UNKNOWN(<type>)" is returned.
+//
+func PacketTypeName(packetType int) string {
+	switch packetType {
+	case ConnectType:
+		return "CONNECT"
+	case ConnAckType:
+		return "CONNACK"
+	case PublishType:
+		return "PUBLISH"
+	case PublishAckType:
+		return "PUBACK"
+	case PublishReceivedType:
+		return "PUBREC"
+	case PublishReleaseType:
+		return "PUBREL"
+	case PublishCompleteType:
+		return "PUBCOMP"
+	case SubscribeType:
+		return "SUBSCRIBE"
+	case SubAckType:
+		return "SUBACK"
+	case UnsubscribeType:
+		return "UNSUBSCRIBE"
+	case UnsubAckType:
+		return "UNSUBACK"
+	case PingReqType:
+		return "PINGREQ"
+	case PingRespType:
+		return "PINGRESP"
+	case DisconnectType:
+		return "DISCONNECT"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", packetType)
+}
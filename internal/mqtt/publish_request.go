@@ -60,7 +60,9 @@ func (r *PublishRequest) fixedHeaderBits() byte {
 	return result
 }
 
-func (r *PublishRequest) makeMessage() *GenericMessage {
+// MakeMessage returns the PUBLISH message for the request
+//
+func (r *PublishRequest) MakeMessage() *GenericMessage {
 	var data bytes.Buffer          // 64 bytes
 	data.Grow(r.remainingLength()) // ensure all to be written fits using only one buffer allocation
 
@@ -150,3 +152,50 @@ func PacketID(id int) PublishOption {
 		return nil
 	}
 }
+
+// Options returns the options of the PublishRequest. For a PUBLISH received from the broker these describe the
+// received message.
+//
+func (r *PublishRequest) Options() PublishOptions {
+	return r.options
+}
+
+// DecodePublish decodes a PUBLISH message into a PublishRequest.
+//
+func DecodePublish(msg *GenericMessage) (*PublishRequest, error) {
+	opts := DefaultPublishOptions()
+	opts.QoS = int(msg.fixedHeader>>1) & 3
+	if opts.QoS == 3 {
+		return nil, fmt.Errorf("PUBLISH with QoS 3 is not allowed")
+	}
+	opts.IsDuplicate = msg.fixedHeader&DupBit != 0
+	opts.Retain = msg.fixedHeader&RetainBit != 0
+	if opts.QoS == 0 && opts.IsDuplicate {
+		return nil, fmt.Errorf("PUBLISH with QoS 0 must not have the DUP flag set")
+	}
+
+	body := msg.body
+	if len(body) < 2 {
+		return nil, fmt.Errorf("PUBLISH too short for topic length - got %d bytes", len(body))
+	}
+	topicLength := int(body[0])<<8 | int(body[1])
+	body = body[2:]
+	if len(body) < topicLength {
+		return nil, fmt.Errorf("PUBLISH topic length %d exceeds the remaining %d bytes", topicLength, len(body))
+	}
+	opts.Topic = string(body[:topicLength])
+	body = body[topicLength:]
+
+	if opts.QoS > 0 {
+		if len(body) < 2 {
+			return nil, fmt.Errorf("PUBLISH with QoS %d too short for packet ID", opts.QoS)
+		}
+		opts.PacketID = int(body[0])<<8 | int(body[1])
+		if opts.PacketID == 0 {
+			return nil, fmt.Errorf("PUBLISH with QoS %d must have a non zero packet ID", opts.QoS)
+		}
+		body = body[2:]
+	}
+	opts.Message = body
+	return &PublishRequest{options: opts}, nil
+}
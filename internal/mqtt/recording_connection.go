@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"net"
+	"sync"
+)
+
+// RecordingConnection is a net.Conn that wraps another net.Conn and records each packet read and written to a
+// capture. What is written is recorded as sent, and what is read as received. A packet is recorded when its last
+// byte has passed - a packet that is not complete when the connection is closed is recorded as it is.
+//
+type RecordingConnection struct {
+	net.Conn
+	capture *CaptureWriter
+	in, out packetAssembler
+}
+
+// packetAssembler collects the bytes passing in one direction into packets
+type packetAssembler struct {
+	mutex   sync.Mutex
+	counter packetCounter
+	packet  []byte // the bytes of the packet not yet complete
+}
+
+// NewRecordingConnection returns a RecordingConnection wrapping the given connection and recording to the given
+// capture. Several connections can record to the same capture.
+//
+func NewRecordingConnection(conn net.Conn, capture *CaptureWriter) *RecordingConnection {
+	return &RecordingConnection{Conn: conn, capture: capture}
+}
+
+// Read reads from the wrapped connection and records the packets it completes as received
+func (c *RecordingConnection) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.add(b[:n], func(packet []byte) { c.capture.Record(false, packet) })
+	return n, err
+}
+
+// Write writes to the wrapped connection and records the packets it completes as sent
+func (c *RecordingConnection) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.add(b[:n], func(packet []byte) { c.capture.Record(true, packet) })
+	return n, err
+}
+
+// Close records the packets that are not complete and closes the wrapped connection
+func (c *RecordingConnection) Close() error {
+	c.in.flush(func(packet []byte) { c.capture.Record(false, packet) })
+	c.out.flush(func(packet []byte) { c.capture.Record(true, packet) })
+	return c.Conn.Close()
+}
+
+// add adds the given bytes, and gives each packet they complete to the given function
+func (a *packetAssembler) add(data []byte, complete func(packet []byte)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for len(data) > 0 {
+		n, completed := a.counter.consume(data, 1)
+		a.packet = append(a.packet, data[:n]...)
+		data = data[n:]
+		if completed == 1 {
+			complete(a.packet)
+			a.packet = nil
+		}
+	}
+}
+
+// flush gives the bytes of a packet that is not complete to the given function
+func (a *packetAssembler) flush(incomplete func(packet []byte)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.packet) > 0 {
+		incomplete(a.packet)
+		a.packet = nil
+		a.counter = packetCounter{}
+	}
+}
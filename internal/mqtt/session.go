@@ -1,7 +1,7 @@
 package mqtt
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -39,21 +39,70 @@ var ErrTIMEOUT = errors.New("TIMEOUT")
 type Session struct {
 	options        SessionOptions
 	inFlight       *inFlight
-	stopAfter      chan int
-	stopped        chan bool
-	toBroker       chan MessageWriter
-	drained        chan bool
 	state          int
+	connection     *connection   // the current (or last) connection to the broker
+	subAcks        *pendingAcks  // SUBSCRIBE requests waiting for SUBACK
+	receivedQoS2   map[int]bool  // packet IDs of QoS 2 messages from the broker waiting for PUBREL
+	done           chan struct{} // closed when the current connection ends
+	err            error         // the error that ended the last connection (nil if it ended with a disconnect)
 	mutex          *sync.RWMutex // mutex for session state changes
 	XIgnorePubAck  bool          // eXceptional behavior - ignore PUBACKs and PUBRECs and let the set of inFligh messages grow
 	XIgnorePubComp bool          // eXceptional behavior - ignore PUBCOMPs and let the set of inFligh messages grow
 }
 
+// pendingAcks keeps track of requests (by packet ID) waiting for an acknowledgement that carries a result.
+//
+type pendingAcks struct {
+	mutex   sync.Mutex
+	waiting map[int]chan []byte
+}
+
+func newPendingAcks() *pendingAcks {
+	return &pendingAcks{waiting: make(map[int]chan []byte)}
+}
+
+// register returns a channel on which the result for the given packetID will be delivered
+func (p *pendingAcks) register(packetID int) <-chan []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	result := make(chan []byte, 1) // buffered, the waiting party may have given up
+	p.waiting[packetID] = result
+	return result
+}
+
+// deliver delivers the result for the given packetID and returns false if nothing was waiting for it
+func (p *pendingAcks) deliver(packetID int, result []byte) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	waiting, ok := p.waiting[packetID]
+	if !ok {
+		return false
+	}
+	delete(p.waiting, packetID)
+	waiting <- result
+	return true
+}
+
+// clear drops everything waiting and calls the given function with each dropped packet ID
+func (p *pendingAcks) clear(lambda func(packetID int)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for packetID := range p.waiting {
+		lambda(packetID)
+	}
+	p.waiting = make(map[int]chan []byte)
+}
+
 func (s *Session) initInFlight(doClean bool) {
 	// Clear the InFlight if this is first connect, or explicitly asking for a CleanSession
 	if s.inFlight == nil || doClean {
 		s.inFlight = newInFlight()
+		s.receivedQoS2 = make(map[int]bool)
 	}
+	// A SUBACK is never received for a SUBSCRIBE sent on an earlier connection
+	s.subAcks.clear(func(packetID int) {
+		s.inFlight.releasePacketID(packetID)
+	})
 }
 
 // Connect connects to a MQTT broker and returns after having received a CONNACK
@@ -63,9 +112,45 @@ func (s *Session) initInFlight(doClean bool) {
 // If calling this to continue the session (after an optional ReEstablish()), the CleanSession(false) option
 // should be used if QoS > 0 and there is a desire to continue with the same packets "in flight".
 //
+// The wait for the CONNACK is limited by the ConnectTimeOut option. ErrTIMEOUT is returned (and the connection
+// is closed) if the CONNACK does not arrive in time.
+//
 func (s *Session) Connect(options ...ConnectOption) error {
+	return s.ConnectContext(context.Background(), options...)
+}
+
+// ConnectContext is like Connect but the wait for the CONNACK is also aborted when the given context is done.
+// When that happens the connection is closed and the error of the context is returned.
+//
+func (s *Session) ConnectContext(ctx context.Context, options ...ConnectOption) error {
 	s.assertReaderWriter()
 
+	s.mutex.RLock()
+	reconnecting := s.state == DISCONNECTED
+	s.mutex.RUnlock()
+	if reconnecting {
+		s.notify(func(o Observer) { o.OnReconnecting() })
+	}
+	c, events, err := s.connect(ctx, options)
+
+	// Observers are notified after the session is unlocked, and before the event loop starts
+	for _, event := range events {
+		s.notify(event)
+	}
+	if err != nil {
+		return err
+	}
+
+	// -- Start the event loop handling all reads from and writes to the broker
+	log.Debugf("Session: starting event loop")
+	go s.run(c)
+	return nil
+}
+
+// connect performs the Connect while holding the session lock, and returns the connection for which the event loop
+// should be started. The returned events should be given to the observers once the lock has been released.
+//
+func (s *Session) connect(ctx context.Context, options []ConnectOption) (*connection, []func(o Observer), error) {
 	// Since go does not have mutex transitions read->write and vice versa a write lock is needed here
 	// since there can otherwise be reace conditions in the gap between releasing a read lock and aquiring a write lock;
 	// meaning state could have changed. Instead this always aquires a write lock.
@@ -75,7 +160,7 @@ func (s *Session) Connect(options ...ConnectOption) error {
 	// Error if not in INITIAL, or DISCONNECTED state
 	if !(s.state == INITIAL || s.state == DISCONNECTED) {
 		// i.e. cannot connect when disconnecting (waiting for drains), and also not when already connected
-		return fmt.Errorf("Cannot Connect when session is disconnecting or already connected")
+		return nil, nil, fmt.Errorf("Cannot Connect when session is disconnecting or already connected")
 	}
 
 	// Create a request (override the client name by appending it - thus overwriting what user gave)
@@ -89,92 +174,138 @@ func (s *Session) Connect(options ...ConnectOption) error {
 	s.XIgnorePubComp = connectionRequest.options.XIgnorePubComp
 
 	// SPEC 3.1.1 states that if CONNACK does not arrive within reasonable time (left open) the client should
-	// close the connection. This is configurable as a ConnectOption.
-	// This is implemented with two channels - a timeOut channel and a connectResult channel.
+	// close the connection. This is configurable as a ConnectOption and is combined with the given context.
 	//
-	connectResult := make(chan error, 1)
-	timeOut := make(chan error, 1)
+	connectCtx := ctx
+	if connectionRequest.options.ConnectTimeOut > 0 {
+		var cancel context.CancelFunc
+		connectCtx, cancel = context.WithTimeout(ctx, time.Duration(connectionRequest.options.ConnectTimeOut)*time.Second)
+		defer cancel()
+	}
 
-	// -- timeout producer
+	// -- connect/connack handler
+	conn := s.options.Conn
+	connectResult := make(chan handshakeResult, 1)
 	go func() {
-		time.Sleep(time.Duration(connectionRequest.options.ConnectTimeOut) * time.Second)
-		timeOut <- ErrTIMEOUT
+		connectResult <- s.handshake(conn, connectionRequest)
 	}()
 
-	// -- connect/connack handler
-	go func() {
-		// Send CONNECT
-		log.Debugf("Broker <- CONNECT(%s)", connectionRequest.options.ClientName)
-
-		msg := connectionRequest.makeMessage()
-		_, err := msg.WriteTo(s.options.Conn)
-		if err != nil {
-			log.Errorf("Error while writing CONNECT message: %s", err)
-			connectResult <- err
+	// Wait for either error free connect or for the context to be done
+	var result handshakeResult
+	select {
+	case result = <-connectResult:
+		if result.err != nil {
+			return nil, result.events(), result.err
 		}
+	case <-connectCtx.Done():
+		log.Errorf("Session: no CONNACK received - closing connection: %s", connectCtx.Err())
+		conn.Close()
+
+		// Closing the connection makes the handshake fail - wait for it so it does not outlive this call
+		result = <-connectResult
+		if ctx.Err() == nil {
+			return nil, result.events(), ErrTIMEOUT // it was the ConnectTimeOut that expired
+		}
+		return nil, result.events(), ctx.Err()
+	}
+	events := result.events()
+	events = append(events, func(o Observer) { o.OnConnected(result.sessionPresent) })
+	keepAlive := time.Duration(connectionRequest.options.KeepAliveSeconds) * time.Second
+	if connectionRequest.options.XNoPingReq {
+		keepAlive = 0
+	}
+	c := newConnection(conn, keepAlive)
 
-		// Wait for CONNACK
-		// SPEC: The first packet sent by a broker on a CONNECT must be a CONNACK (thus waiting on it here)
+	// -- If this is a reconnect (non clean session), resend messages (before the event loop starts writing)
+	if !connectionRequest.IsCleanSession() {
+		s.inFlight.eachWaitingPacket(func(packetID int, msg MessageWriter) {
+			log.Debugf("Resending message with packetID: %d", packetID)
+			if _, err := msg.WriteDupTo(conn); err != nil {
+				log.Errorf("Error while resending message with packetID %d: %s", packetID, err)
+				return
+			}
+			if packet, ok := msg.(*GenericMessage); ok {
+				resent := packet.Duplicate()
+				events = append(events, func(o Observer) { o.OnPacketSent(resent) })
+			}
+		})
+	}
 
-		response := make([]byte, 4)
-		n, err := io.ReadFull(s.options.Conn, response)
+	s.state = CONNECTED
+	s.connection = c
+	s.done = make(chan struct{})
+	s.err = nil
+	return c, events, nil
+}
 
-		if err != nil {
-			log.Errorf("Error while reading CONNACK message: %s", err)
-			connectResult <- err
-		}
-		if n != 4 {
-			connectResult <- fmt.Errorf("Expected to read 4 bytes from MQTT Reader but got %d", n)
-		}
+// handshakeResult is the outcome of sending CONNECT and waiting for CONNACK
+//
+type handshakeResult struct {
+	connect        *GenericMessage // the CONNECT that was sent (nil if it could not be written)
+	connAck        *GenericMessage // the CONNACK that was received (nil if none was read)
+	sessionPresent bool
+	err            error
+}
 
-		if response[0] != ConnAckType<<4 {
-			connectResult <- fmt.Errorf("Did not get a CONNACK back from Connect - got %d", response[0])
-		}
-		if response[1] != 2 {
-			connectResult <- fmt.Errorf("Expected CONNACK length of 2 but got %d", response[1])
-		}
+// events returns the observer events for the packets sent and received in the handshake
+func (r handshakeResult) events() []func(o Observer) {
+	var events []func(o Observer)
+	if r.connect != nil {
+		events = append(events, func(o Observer) { o.OnPacketSent(r.connect) })
+	}
+	if r.connAck != nil {
+		events = append(events, func(o Observer) { o.OnPacketReceived(r.connAck) })
+	}
+	return events
+}
 
-		spFlagSet := false
-		if response[2] == 1 {
-			spFlagSet = true // TODO: What does this mean to a client?
-		}
+// handshake sends the CONNECT for the given request and waits for the CONNACK
+//
+func (s *Session) handshake(conn net.Conn, connectionRequest *ConnectRequest) (result handshakeResult) {
+	// Send CONNECT
+	log.Debugf("Broker <- CONNECT(%s)", connectionRequest.options.ClientName)
 
-		if response[3] != ConnectionAccepted {
-			// TODO: This should translate the error return status to human readable text, not just include the status as a number
-			connectResult <- fmt.Errorf("Did not get ConnectionAccepted return status back - got %d", response[3])
-		}
+	msg := connectionRequest.MakeMessage()
+	_, err := msg.WriteTo(conn)
+	if err != nil {
+		log.Errorf("Error while writing CONNECT message: %s", err)
+		result.err = err
+		return
+	}
+	result.connect = msg
 
-		log.Debugf("Broker -> CONNACK(sp=%v) received ok", spFlagSet)
-		connectResult <- nil
-	}()
+	// Wait for CONNACK
+	// SPEC: The first packet sent by a broker on a CONNECT must be a CONNACK (thus waiting on it here)
 
-	// Wait for either error free connect or for timeout
-	select {
-	case err := <-timeOut:
-		return err
-	case err := <-connectResult:
-		if err != nil {
-			return err
-		}
+	response := make([]byte, 4)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		log.Errorf("Error while reading CONNACK message: %s", err)
+		result.err = err
+		return
 	}
-	s.state = CONNECTED
 
-	// -- Start a broker lister goroutine handling all reads from broker
-	log.Debugf("Session: starting handleMessages()")
-	s.handleMessages()
+	if response[0] != ConnAckType<<4 {
+		result.err = fmt.Errorf("Did not get a CONNACK back from Connect - got %d", response[0])
+		return
+	}
+	if response[1] != 2 {
+		result.err = fmt.Errorf("Expected CONNACK length of 2 but got %d", response[1])
+		return
+	}
+	result.connAck = &GenericMessage{fixedHeader: response[0], body: response[2:]}
 
-	// -- Start a send to broker goroutine handling all write to broker
-	log.Debugf("Session: Starting startSendToBroker()")
-	s.startSendToBroker()
+	// SPEC: the Session Present flag tells if the broker has state for the client from an earlier connection
+	result.sessionPresent = response[2] == 1
 
-	// -- If this is a reconnect (non clean session), resend messages
-	if !connectionRequest.IsCleanSession() {
-		s.inFlight.eachWaitingPacket(func(packetID int, msg MessageWriter) {
-			log.Debugf("Resending message with packetID: %d", packetID)
-			msg.WriteDupTo(s.options.Conn)
-		})
+	if response[3] != ConnectionAccepted {
+		// TODO: This should translate the error return status to human readable text, not just include the status as a number
+		result.err = fmt.Errorf("Did not get ConnectionAccepted return status back - got %d", response[3])
+		return
 	}
-	return nil
+
+	log.Debugf("Broker -> CONNACK(sp=%v) received ok", result.sessionPresent)
+	return
 }
 
 // DisconnectWithoutMessage performs flushing of messages just like Disconnect() but does not send a
@@ -183,233 +314,201 @@ func (s *Session) Connect(options ...ConnectOption) error {
 //
 func (s *Session) DisconnectWithoutMessage(timeout int) error {
 	log.Debugf("DisconnectWithoutMessage()")
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	if s.state == INITIAL {
-		return nil // wasn't connected in the first place - no work to do.
-	}
-	if s.state != CONNECTED {
-		return fmt.Errorf("Session can only be flushed when it is in INITIAL, or CONNECTED state")
-	}
-	log.Debugf("Session: Stopping messageHandler with Timeout %d", timeout)
-	// send stop to the incoming message handler
-	s.stopAfter <- timeout
-
-	// Wait for message handler to stop
-	_ = <-s.stopped
-
-	// Stop accepting messages to the s.toBroker channel - the queue will be drained
-	close(s.toBroker)
-
-	// Wait for outgoing messages to drain
-	// TODO: maybe enqueue an error in case the drain fails...
-	_ = <-s.drained
-
-	log.Debugf("Session: Queue to broker drained")
-
-	s.state = DISCONNECTED
-	return nil // TODO: maybe return an error produced by the drain? Bigger question is handling errors while sending?
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	return s.disconnect(ctx, false)
 }
 
 // Disconnect disconnects the MQTT session from the broker in an orderly fashion by sending a DISCONNECT message
-// The `drain` parameter, if set to `true` will ensure that the Session will wait at least the given `timeout` in seconds
-// to allow messages in flight to be processed. The disconnect will be sent as soon as the in-flight message set is empty
-// or the timeout occurs. If `drain` is set to `false`, processing of incoming ACKS will stop as soon as possible and
-// the DISCONNECT is then sent.
+// The Session will wait at most the given `timeout` in seconds to allow messages in flight to be processed.
+// The DISCONNECT will be sent as soon as the in-flight message set is empty or the timeout occurs. When the timeout
+// occurs with messages still in flight an *UnacknowledgedError listing their packet IDs is returned (the messages
+// remain in flight and are resent on a reconnect that is not a clean session).
 //
-// Note: While the Disconnect is in progress Publish is blocked since it aquires the mutex. Once the mutex is released
-// a Publish requires a CONNECTED state - which the session will not have after the DISCONNECT.
+// Note: While the Disconnect is in progress the session is in DISCONNECTING state and Publish and Subscribe are
+// refused since they require a CONNECTED state.
 //
 func (s *Session) Disconnect(timeout int) error {
 	log.Debugf("Disconnect()")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	return s.disconnect(ctx, true)
+}
+
+// DisconnectContext is like Disconnect but messages in flight are given until the given context is done to be
+// processed instead of a timeout in seconds. Cancelling the context ends the wait and the DISCONNECT is sent.
+//
+func (s *Session) DisconnectContext(ctx context.Context) error {
+	log.Debugf("DisconnectContext()")
+	return s.disconnect(ctx, true)
+}
 
+// disconnect implements Disconnect with or without sending a DISCONNECT message.
+// The event loop of the connection is asked to stop when there are no messages in flight or the given context is
+// done, and this waits for it to end. If the connection ended because of an error (for example a protocol violation)
+// that error is returned, and if messages were still in flight an *UnacknowledgedError.
+//
+func (s *Session) disconnect(ctx context.Context, sendDisconnect bool) error {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
 	if s.state == INITIAL {
+		s.mutex.Unlock()
 		return nil // wasn't connected in the first place - no work to do.
 	}
 	if s.state != CONNECTED {
+		s.mutex.Unlock()
 		return fmt.Errorf("Session can only be disconnected when it is in INITIAL, or CONNECTED state")
 	}
+	s.state = DISCONNECTING
+	c := s.connection
+	s.mutex.Unlock()
 
-	log.Debugf("Session: Stopping messageHandler with Timeout %d", timeout)
-	// send stop to the incoming message handler
-	s.stopAfter <- timeout
-
-	// Wait for message handler to stop
-	_ = <-s.stopped
-
-	log.Debugf("Session: messageHandler() stop signal received")
-
-	log.Debugf("Broker <- DISCONNECT")
-
-	// Enqueue the disconnect to be sent to the broker
-	s.toBroker <- NewDisconnectMessage()
+	select {
+	case c.stop <- stopRequest{ctx: ctx, sendDisconnect: sendDisconnect}:
+	case <-c.ended:
+	}
+	<-c.ended
 
-	// Stop accepting messages to the s.toBroker channel - the queue will be drained
-	close(s.toBroker)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.disconnected(c.err)
+	if c.err == nil && len(c.unacknowledged) > 0 {
+		return &UnacknowledgedError{PacketIDs: c.unacknowledged}
+	}
+	return c.err
+}
 
-	// Wait for outgoing messages to drain (including the disconnect)
-	// TODO: maybe enqueue an error in case the drain fails...
-	_ = <-s.drained
+// UnacknowledgedError is returned from a disconnect when messages were still in flight when the time given
+// to the broker to acknowledge them ran out.
+//
+type UnacknowledgedError struct {
+	PacketIDs []int // IDs of the packets still in flight, in the order they were sent
+}
 
-	log.Debugf("Session: Queue to broker drained")
+// Error returns a string listing the IDs of the unacknowledged packets
+func (e *UnacknowledgedError) Error() string {
+	return fmt.Sprintf("Disconnected with %d packet(s) not acknowledged by the broker: %v", len(e.PacketIDs), e.PacketIDs)
+}
 
+// disconnected transitions the session to DISCONNECTED state with the given error (nil for an orderly disconnect)
+// and signals this to those waiting on Done().
+// The caller must hold the mutex.
+//
+func (s *Session) disconnected(err error) {
 	s.state = DISCONNECTED
-	return nil // TODO: maybe return an error produced by the drain? Bigger question is handling errors while sending?
+	s.err = err
+	close(s.done)
 }
 
-// startSendToBroker starts a goroutine that reads s.toBroker and sends whatever is posted there
-// to the broker. This continues until s.toBroker channel is closed.
+// Done returns a channel that is closed when the current connection of the session ends - either by a call to
+// Disconnect/DisconnectWithoutMessage or because the Session detected a violation of the MQTT protocol.
+// When the session is not connected the returned channel is already closed.
 //
-func (s *Session) startSendToBroker() {
-	s.toBroker = make(chan MessageWriter, 100)
-	go func() {
-		for message := range s.toBroker {
-			message.WriteTo(s.options.Conn) // TODO: error is ignored here
-		}
-		s.drained <- true // signal all written TODO: change to writing error/nil instead
-	}()
+func (s *Session) Done() <-chan struct{} {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.done
 }
 
-// handleMessages starts go routines that listens for incoming ACK and performs the required housekeeping
-// of messages in-flight.
-// Note that a client should call `Disconnect` for an orderly disconnect - that will also optionally do a drain with
-// a timeout.
+// Err returns the error that ended the last connection - for example a *ProtocolError. The returned value is nil
+// if the session is connected, was never connected, or if the last connection ended with a Disconnect.
 //
-func (s *Session) handleMessages() {
-
-	// -- handler go routine
-	go func() {
-		timeout := make(chan bool)
-		messages := make(chan *GenericMessage, 100)
-
-		// -- reader go routine
-		go func() {
-			fixedHeader := make([]byte, 1)
-			for {
-				n, err := io.ReadFull(s.options.Conn, fixedHeader)
-				if err != nil {
-					if err == io.EOF || n == 0 {
-						log.Debugf("Read Loop: EOF on broker connection - stopped reading")
-						break // stop loop, connection is closed
-					}
-				}
-				msg, err := s.readMessage(fixedHeader[0])
-				if err != nil {
-					log.Debugf("readMessage() returned error %s", err)
-					break // stop loop - don't know what to do...
-				}
-				messages <- msg
-			}
-
-		}()
-
-		for {
-			select {
-			case cancelTimeout := <-s.stopAfter:
-				// When receiving information to stop after a timeout on drain, set a timer that will be selected
-				// instead of blocking on a read from the broker
-				//
-				go func() {
-					time.Sleep(time.Duration(cancelTimeout) * time.Second)
-					timeout <- true
-				}()
-
-			case <-timeout:
-				// Asked to stop after timeout - it now timed out, so stop waiting for headers
-				s.stopped <- true
-				break
-
-			case msg := <-messages:
-				// fan out to process specific handlers
-				log.Debugf("Message Loop: msg type %x, length %d, bytes: %v", msg.fixedHeader, len(msg.body), msg.body)
-
-				msgType := int(msg.fixedHeader >> 4)
-				switch msgType {
-				case PublishAckType:
-					s.processPublishAck(msg)
-				case PublishReceivedType:
-					s.processPublishReceived(msg)
-				case PublishCompleteType:
-					s.processPublishComplete(msg)
-				default:
-					// TODO: for now panic as this logic will not correctly read the message to clear for next
-					panic(fmt.Sprintf("Message Processing Loop: Unhandled message type %d - not yet implemented", msgType))
-				}
-			}
-		}
-	}()
+func (s *Session) Err() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.err
 }
 
-// readMessage slurps the rest of a message after reading the first fixed header byte elsewhere
+// processMessage dispatches the given message from the broker to the handler for its type. The handler returns
+// the message to send to the broker in reply (nil if there is no reply).
+// A *ProtocolError is returned if the message is not valid, or not expected.
 //
-func (s *Session) readMessage(fixedHeaderByte byte) (*GenericMessage, error) {
-	remainingLength, err := DecodeVariableInt(s.options.Conn)
-	if err != nil {
-		return nil, err
+// Message processing is performed by the event loop of the connection.
+//
+func (s *Session) processMessage(msg *GenericMessage) (*GenericMessage, error) {
+	msgType := int(msg.fixedHeader >> 4)
+	switch msgType {
+	case PublishAckType:
+		return s.processPublishAck(msg)
+	case PublishReceivedType:
+		return s.processPublishReceived(msg)
+	case PublishCompleteType:
+		return s.processPublishComplete(msg)
+	case PublishType:
+		return s.processPublish(msg)
+	case PublishReleaseType:
+		return s.processPublishRelease(msg)
+	case SubAckType:
+		return s.processSubscribeAck(msg)
+	case PingRespType:
+		return s.processPingResponse(msg)
 	}
-	msg := GenericMessage{fixedHeader: fixedHeaderByte, body: make([]byte, remainingLength)}
-	n, err := io.ReadFull(s.options.Conn, msg.body)
-	if n != remainingLength {
-		err = fmt.Errorf("Expected to read %d bytes remaining length of message but got %d", remainingLength, n)
+	return nil, newProtocolError(msg, "unexpected packet type %d from broker", msgType)
+}
+
+// processPingResponse checks that a PINGRESP is well formed - the event loop then stops waiting for it
+func (s *Session) processPingResponse(msg *GenericMessage) (*GenericMessage, error) {
+	if msg.Flags() != 0 || len(msg.body) != 0 {
+		return nil, newProtocolError(msg, "PINGRESP must have no flags and no body")
 	}
-	return &msg, err
+	log.Debugf("PINGRESP Received")
+	return nil, nil
 }
 
 // processPublishAck performs the required actions when receiving a PUBACK:
 //   - the message in-flight is released
 //   - the packet ID it used is released
 //
-func (s *Session) processPublishAck(msg *GenericMessage) {
-	if msg.fixedHeader>>4 != PublishAckType {
-		panic(fmt.Sprintf("processPublishAck() got generic message of wrong type: %d", msg.fixedHeader>>4))
-	}
-	body := msg.body
-	if len(body) != 2 {
-		panic(fmt.Sprintf("PUBACK expects 2 bytes packet ID as the body - got %d", len(body)))
+func (s *Session) processPublishAck(msg *GenericMessage) (*GenericMessage, error) {
+	packetID, err := AckPacketID(msg, PublishAckType)
+	if err != nil {
+		return nil, err
 	}
-	packetID := int(body[0])<<8 | int(body[1])
 
 	log.Debugf("PUBACK(%d) Received", packetID)
 	if s.XIgnorePubAck {
 		// Exceptional test behavior
 		log.Debugf("PUBACK(%d) Ignored", packetID)
-		return
+		return nil, nil
 	}
 
 	// Packet is no longer waiting since this is QoS 1
-	s.inFlight.releaseWaiting(packetID)
+	if err := s.checkAckType(PublishAckType, packetID); err != nil {
+		return nil, newProtocolError(msg, "PUBACK(%d): %s", packetID, err)
+	}
+	if err := s.inFlight.releaseWaiting(packetID); err != nil {
+		return nil, newProtocolError(msg, "PUBACK(%d): %s", packetID, err)
+	}
 
 	// Mark packetID as available
-	s.inFlight.unsetBit(packetID)
+	s.inFlight.releasePacketID(packetID)
+	s.notify(func(o Observer) { o.OnPublishAcknowledged(packetID) })
+	return nil, nil
 }
 
 // processPublishReceived performs the required actions when receiving a PUBREC
 //   - the message in-flight is replaced with a PUBREL message
-//   - the PUBREL message is queued for sending to broker
+//   - the PUBREL message is sent to the broker in reply
 //
-func (s *Session) processPublishReceived(msg *GenericMessage) {
-	if msg.fixedHeader>>4 != PublishReceivedType {
-		panic(fmt.Sprintf("processPublishReceived() got generic message of wrong type: %d", msg.fixedHeader>>4))
-	}
-	body := msg.body
-	if len(body) != 2 {
-		panic(fmt.Sprintf("PUBREC expects 2 bytes packet ID as the body - got %d", len(body)))
+func (s *Session) processPublishReceived(msg *GenericMessage) (*GenericMessage, error) {
+	packetID, err := AckPacketID(msg, PublishReceivedType)
+	if err != nil {
+		return nil, err
 	}
-	packetID := int(body[0])<<8 | int(body[1])
 
 	log.Debugf("PUBREC(%d) Received", packetID)
 	if s.XIgnorePubAck {
 		// Exceptional test behavior
 		log.Debugf("PUBREC(%d) Ignored", packetID)
-		return
+		return nil, nil
+	}
+	if err := s.checkAckType(PublishReceivedType, packetID); err != nil {
+		return nil, newProtocolError(msg, "PUBREC(%d): %s", packetID, err)
 	}
-	var buffer bytes.Buffer
-	Encode16BitIntTo(packetID, &buffer)
-	releaseMsg := &GenericMessage{fixedHeader: PublishReleaseType<<4 | PublishReleaseReserved, body: buffer.Bytes()}
-	s.inFlight.replaceWaiting(packetID, releaseMsg)
-	s.toBroker <- releaseMsg
+	releaseMsg := NewAckMessage(PublishReleaseType, packetID)
+	if err := s.inFlight.replaceWaiting(packetID, releaseMsg); err != nil {
+		return nil, newProtocolError(msg, "PUBREC(%d): %s", packetID, err)
+	}
+	return releaseMsg, nil
 }
 
 // processPublishComplete performs the required actions when receiving a PUBCOMP
@@ -418,51 +517,253 @@ func (s *Session) processPublishReceived(msg *GenericMessage) {
 //
 // This is the end of the QoS 2 message sequence
 //
-func (s *Session) processPublishComplete(msg *GenericMessage) {
-	if msg.fixedHeader>>4 != PublishCompleteType {
-		panic(fmt.Sprintf("PublishCompleteType() got generic message of wrong type: %d", msg.fixedHeader>>4))
-	}
-	body := msg.body
-	if len(body) != 2 {
-		panic(fmt.Sprintf("PUBCOMP expects 2 bytes packet ID as the body - got %d", len(body)))
+func (s *Session) processPublishComplete(msg *GenericMessage) (*GenericMessage, error) {
+	packetID, err := AckPacketID(msg, PublishCompleteType)
+	if err != nil {
+		return nil, err
 	}
-	packetID := int(body[0])<<8 | int(body[1])
 
 	log.Debugf("PUBCOMP(%d) Received", packetID)
 	if s.XIgnorePubComp {
 		// Exceptional test behavior
 		log.Debugf("PUBCOMP(%d) Ignored", packetID)
-		return
+		return nil, nil
 	}
 
 	// Packet is no longer waiting since this is QoS 2
-	s.inFlight.releaseWaiting(packetID)
+	if err := s.checkAckType(PublishCompleteType, packetID); err != nil {
+		return nil, newProtocolError(msg, "PUBCOMP(%d): %s", packetID, err)
+	}
+	if err := s.inFlight.releaseWaiting(packetID); err != nil {
+		return nil, newProtocolError(msg, "PUBCOMP(%d): %s", packetID, err)
+	}
+
+	// Mark packetID as available
+	s.inFlight.releasePacketID(packetID)
+	s.notify(func(o Observer) { o.OnPublishAcknowledged(packetID) })
+	return nil, nil
+}
+
+// checkAckType returns an error if the packet in flight with the given packet ID is not waiting for an
+// acknowledgement of the given type - a QoS 1 PUBLISH waits for PUBACK, a QoS 2 PUBLISH for PUBREC, and a PUBREL
+// for PUBCOMP.
+//
+func (s *Session) checkAckType(ackType int, packetID int) error {
+	msg, err := s.inFlight.waitingMessage(packetID)
+	if err != nil {
+		return err
+	}
+	packet, ok := msg.(*GenericMessage)
+	if !ok {
+		return nil
+	}
+	expected := PublishAckType
+	switch {
+	case packet.Type() == PublishReleaseType:
+		expected = PublishCompleteType
+	case packet.Flags()&QoSTwo != 0:
+		expected = PublishReceivedType
+	}
+	if ackType != expected {
+		return fmt.Errorf("the packet is waiting for %s", PacketTypeName(expected))
+	}
+	return nil
+}
+
+// processPublish performs the required actions when receiving a PUBLISH
+//   - the message is given to the MessageHandler (once for QoS 2, even if the broker resends it)
+//   - a PUBACK (QoS 1) or PUBREC (QoS 2) is sent to the broker in reply
+//
+func (s *Session) processPublish(msg *GenericMessage) (*GenericMessage, error) {
+	pr, err := DecodePublish(msg)
+	if err != nil {
+		return nil, newProtocolError(msg, "%s", err)
+	}
+	opts := pr.options
+	log.Debugf("PUBLISH(%d, %s, QoS %d) Received", opts.PacketID, opts.Topic, opts.QoS)
+
+	switch opts.QoS {
+	case 1:
+		s.deliver(pr)
+		return NewAckMessage(PublishAckType, opts.PacketID), nil
+	case 2:
+		if !s.receivedQoS2[opts.PacketID] {
+			s.receivedQoS2[opts.PacketID] = true
+			s.deliver(pr)
+		}
+		return NewAckMessage(PublishReceivedType, opts.PacketID), nil
+	}
+	s.deliver(pr)
+	return nil, nil
+}
+
+// processPublishRelease performs the required actions when receiving a PUBREL
+//   - the packet ID is no longer regarded as a received QoS 2 message
+//   - a PUBCOMP is sent to the broker in reply
+//
+func (s *Session) processPublishRelease(msg *GenericMessage) (*GenericMessage, error) {
+	packetID, err := AckPacketID(msg, PublishReleaseType)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("PUBREL(%d) Received", packetID)
+
+	// SPEC: a PUBCOMP is sent even if the packet ID is unknown (the PUBREL may be resent after a reconnect)
+	delete(s.receivedQoS2, packetID)
+	return NewAckMessage(PublishCompleteType, packetID), nil
+}
+
+// processSubscribeAck performs the required actions when receiving a SUBACK
+//   - the return codes are given to the waiting Subscribe
+//   - the packet ID is released
+//
+func (s *Session) processSubscribeAck(msg *GenericMessage) (*GenericMessage, error) {
+	if msg.fixedHeader&0x0F != 0 {
+		return nil, newProtocolError(msg, "SUBACK reserved flags must be 0")
+	}
+	body := msg.body
+	if len(body) < 3 {
+		return nil, newProtocolError(msg, "SUBACK expects packet ID and at least one return code - got %d bytes", len(body))
+	}
+	packetID := int(body[0])<<8 | int(body[1])
+	returnCodes := body[2:]
+	for _, rc := range returnCodes {
+		if !(rc <= 2 || rc == SubAckFailure) {
+			return nil, newProtocolError(msg, "SUBACK(%d) has invalid return code 0x%x", packetID, rc)
+		}
+	}
+	log.Debugf("SUBACK(%d) Received", packetID)
+	if !s.subAcks.deliver(packetID, returnCodes) {
+		return nil, newProtocolError(msg, "SUBACK(%d) does not match a SUBSCRIBE", packetID)
+	}
 
 	// Mark packetID as available
-	s.inFlight.unsetBit(packetID)
+	s.inFlight.releasePacketID(packetID)
+	return nil, nil
+}
+
+// deliver gives a received message to the observers and the MessageHandler
+func (s *Session) deliver(pr *PublishRequest) {
+	s.notify(func(o Observer) { o.OnMessage(pr) })
+	if s.options.MessageHandler == nil {
+		log.Debugf("No MessageHandler - dropping message for topic %s", pr.options.Topic)
+		return
+	}
+	s.options.MessageHandler(pr)
 }
 
 // Publish publishes to the connected MQTT broker (Session handles ACKs)
 //
 func (s *Session) Publish(options ...PublishOption) error {
+	_, _, err := s.publish(context.Background(), options)
+	return err
+}
+
+// PublishContext publishes to the connected MQTT broker and waits until the message has been acknowledged by the
+// broker (PUBACK for QoS 1, PUBCOMP for QoS 2), or the given context is done, or the connection ends.
+// A QoS 0 message is regarded as acknowledged once it has been queued for sending.
+//
+// When the wait is aborted the error of the context (or the error ending the connection) is returned.
+// An aborted message that was sent is still in flight and is resent on a reconnect that is not a clean session.
+//
+func (s *Session) PublishContext(ctx context.Context, options ...PublishOption) error {
+	acked, c, err := s.publish(ctx, options)
+	if err != nil || acked == nil {
+		return err
+	}
+	select {
+	case <-acked:
+		return nil
+	case <-c.ended:
+		return c.endedError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publish queues a message for sending and returns a channel that is closed when it is acknowledged (nil for QoS 0)
+// and the connection it was queued on. A message that could not be queued before the context is done is not sent.
+//
+func (s *Session) publish(ctx context.Context, options []PublishOption) (<-chan struct{}, *connection, error) {
 	s.assertReaderWriter()
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 	if s.state != CONNECTED {
-		return fmt.Errorf("Publish requires session to be in CONNECTED state")
+		return nil, nil, fmt.Errorf("Publish requires session to be in CONNECTED state")
 	}
-	var msg MessageWriter
+	var msg *GenericMessage
+	var acked <-chan struct{}
 	// Set PacketID if required
 	pr := NewPublishRequest(options...)
 	if pr.options.QoS > 0 && pr.options.PacketID == 0 {
 		pr.options.PacketID = s.inFlight.nextPacketID()
-		msg = pr.makeMessage()
-		s.inFlight.registerWaiting(pr.options.PacketID, msg)
+		msg = pr.MakeMessage()
+		acked = s.inFlight.registerWaiting(pr.options.PacketID, msg)
 	} else {
-		msg = pr.makeMessage()
+		msg = pr.MakeMessage()
+	}
+	if err := s.connection.send(ctx, msg); err != nil {
+		if acked != nil {
+			s.inFlight.releaseWaiting(pr.options.PacketID)
+			s.inFlight.releasePacketID(pr.options.PacketID)
+		}
+		return nil, nil, err
+	}
+	return acked, s.connection, nil
+}
+
+// Subscribe subscribes to the given topic filters and waits for the SUBACK. The returned slice has the
+// return code for each subscription in the request - the granted QoS (0-2) or SubAckFailure (0x80).
+//
+func (s *Session) Subscribe(options ...SubscribeOption) ([]int, error) {
+	return s.SubscribeContext(context.Background(), options...)
+}
+
+// SubscribeContext is like Subscribe but the wait for the SUBACK is aborted if the given context is done
+// (the error of the context is then returned). Messages for the subscriptions are given to the
+// MessageHandler of the session.
+//
+func (s *Session) SubscribeContext(ctx context.Context, options ...SubscribeOption) ([]int, error) {
+	result, c, err := s.subscribe(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case returnCodes := <-result:
+		granted := make([]int, len(returnCodes))
+		for i, rc := range returnCodes {
+			granted[i] = int(rc)
+		}
+		return granted, nil
+	case <-c.ended:
+		return nil, c.endedError()
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	s.toBroker <- msg
-	return nil
+}
+
+// subscribe queues a subscribe request for sending and returns the channel where the SUBACK return codes are
+// delivered, and the connection it was queued on.
+//
+func (s *Session) subscribe(ctx context.Context, options []SubscribeOption) (<-chan []byte, *connection, error) {
+	s.assertReaderWriter()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.state != CONNECTED {
+		return nil, nil, fmt.Errorf("Subscribe requires session to be in CONNECTED state")
+	}
+	sr := NewSubscribeRequest(options...)
+	if len(sr.options.Subscriptions) == 0 {
+		return nil, nil, fmt.Errorf("Subscribe requires at least one TopicFilter")
+	}
+	sr.options.PacketID = s.inFlight.nextPacketID()
+	result := s.subAcks.register(sr.options.PacketID)
+	if err := s.connection.send(ctx, sr.MakeMessage()); err != nil {
+		s.subAcks.deliver(sr.options.PacketID, nil)
+		s.inFlight.releasePacketID(sr.options.PacketID)
+		return nil, nil, err
+	}
+	return result, s.connection, nil
 }
 
 func (s *Session) assertReaderWriter() {
@@ -474,10 +775,28 @@ func (s *Session) assertReaderWriter() {
 // SessionOptions are options applicable to a Session
 //
 type SessionOptions struct {
-	ClientName string
-	Conn       net.Conn
+	ClientName     string
+	Conn           net.Conn
+	MessageHandler MessageHandlerFunc
+	Observers      []Observer
+	IgnoreReceived PacketFilterFunc
 }
 
+// PacketFilterFunc is a function that is given a packet and returns true if it should be filtered out.
+// It is called from the goroutine processing incoming packets - it should not block.
+//
+type PacketFilterFunc func(packet *GenericMessage) bool
+
+// MessageHandlerFunc is a function that is given each message the broker publishes to the session.
+// The function is called from the goroutine processing incoming packets - it should not block.
+// The Options() of the given request describe the message.
+//
+// The message is acknowledged (PUBACK for QoS 1, PUBREC for QoS 2) when the function returns. A function that
+// must not have a message acknowledged before it has been taken care of (like a bridge forwarding it) may block
+// until then - at the cost of holding up all other incoming packets.
+//
+type MessageHandlerFunc func(msg *PublishRequest)
+
 // DefaultSessionOptions returns the defaults options for a session
 func DefaultSessionOptions() SessionOptions {
 	return SessionOptions{}
@@ -497,13 +816,16 @@ func NewSession(options ...SessionOption) *Session {
 		}
 	}
 
+	// Not connected - Done() is closed
+	done := make(chan struct{})
+	close(done)
+
 	return &Session{
-		options:   opts,
-		stopAfter: make(chan int),
-		stopped:   make(chan bool),
-		drained:   make(chan bool),
-		mutex:     &sync.RWMutex{},
-		state:     INITIAL,
+		options: opts,
+		done:    done,
+		subAcks: newPendingAcks(),
+		mutex:   &sync.RWMutex{},
+		state:   INITIAL,
 	}
 }
 
@@ -540,6 +862,33 @@ func Connection(conn net.Conn) SessionOption {
 	}
 }
 
+// MessageHandler returns a SessionOption for the function that handles messages published by the broker
+func MessageHandler(handler MessageHandlerFunc) SessionOption {
+	return func(o *SessionOptions) error {
+		o.MessageHandler = handler
+		return nil
+	}
+}
+
+// Observe returns a SessionOption that adds the given Observer to the observers of the session
+func Observe(observer Observer) SessionOption {
+	return func(o *SessionOptions) error {
+		o.Observers = append(o.Observers, observer)
+		return nil
+	}
+}
+
+// IgnoreReceived returns a SessionOption for a function that decides which packets received from the broker are
+// ignored - an ignored packet is given to the observers, but is not processed (as if it had been lost). This makes it
+// possible to test how a broker handles a client that does not acknowledge, for example by ignoring PUBRECs.
+//
+func IgnoreReceived(filter PacketFilterFunc) SessionOption {
+	return func(o *SessionOptions) error {
+		o.IgnoreReceived = filter
+		return nil
+	}
+}
+
 // RandomClientID returns a random UUID string that can be used as ClientName in a Connection.
 // A Short UUID - a Base 57 encoded string is returned.
 //
@@ -1,8 +1,14 @@
 package mqtt
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hlindberg/mezquit/testutils"
 )
@@ -42,6 +48,96 @@ func Test_Session_Connect_and_Disconnect_QoS_0_immediate(t *testing.T) {
 	testutils.CheckEqual(byte(0), lengthByte, t)
 }
 
+func Test_Session_PUBACK_for_unknown_packet_is_a_protocol_violation(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+
+	// PUBACK(7) when nothing is in flight
+	_, err = conn.RemoteWrite([]byte{PublishAckType << 4, 2, 0, 7})
+	testutils.CheckNotError(err, t)
+
+	testhelperWaitForDone(session, t)
+	perr, ok := session.Err().(*ProtocolError)
+	testutils.CheckTrue(ok, t)
+	testutils.CheckEqual(PublishAckType, perr.PacketType, t)
+
+	// The session is DISCONNECTED - Disconnect and Publish are refused
+	testutils.CheckError(session.Disconnect(0), t)
+	testutils.CheckError(session.Publish(Topic("test")), t)
+}
+
+func Test_Session_acknowledgement_of_the_wrong_type_is_a_protocol_violation(t *testing.T) {
+	for _, c := range []struct {
+		qos      int
+		acks     []byte
+		ackType  int
+		expected string
+	}{
+		{2, []byte{PublishAckType << 4, 2, 0, 1}, PublishAckType, "the packet is waiting for PUBREC"},
+		{2, []byte{PublishCompleteType << 4, 2, 0, 1}, PublishCompleteType, "the packet is waiting for PUBREC"},
+		{1, []byte{PublishReceivedType << 4, 2, 0, 1}, PublishReceivedType, "the packet is waiting for PUBACK"},
+		{2, []byte{PublishReceivedType << 4, 2, 0, 1, PublishAckType << 4, 2, 0, 1}, PublishAckType, "the packet is waiting for PUBCOMP"},
+	} {
+		conn := NewMockConnection()
+		_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+		testutils.CheckNotError(err, t)
+
+		session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+		testutils.CheckNotError(session.Connect(), t)
+		testutils.CheckNotError(session.Publish(Topic("test"), Message([]byte("hello")), QoS(c.qos)), t)
+		_, err = conn.RemoteWrite(c.acks)
+		testutils.CheckNotError(err, t)
+
+		testhelperWaitForDone(session, t)
+		perr, ok := session.Err().(*ProtocolError)
+		testutils.CheckTrue(ok, t)
+		testutils.CheckEqual(c.ackType, perr.PacketType, t)
+		testutils.CheckTrue(strings.Contains(perr.Error(), c.expected), t)
+	}
+}
+
+func Test_Session_unexpected_packet_type_is_a_protocol_violation(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+
+	// A second CONNACK
+	_, err = conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	testhelperWaitForDone(session, t)
+	perr, ok := session.Err().(*ProtocolError)
+	testutils.CheckTrue(ok, t)
+	testutils.CheckEqual(ConnAckType, perr.PacketType, t)
+}
+
+func Test_Session_malformed_PUBACK_is_a_protocol_violation(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+
+	// PUBACK with 3 byte body
+	_, err = conn.RemoteWrite([]byte{PublishAckType << 4, 3, 0, 1, 0})
+	testutils.CheckNotError(err, t)
+
+	testhelperWaitForDone(session, t)
+	_, ok := session.Err().(*ProtocolError)
+	testutils.CheckTrue(ok, t)
+}
+
 // func Test_Session_ConnectQoS_2(t *testing.T) {
 // 	inF := newInFlight()
 // 	next := inF.nextPacketID()
@@ -63,20 +159,489 @@ func testhelperConnectionAccepted() []byte {
 	return connectResponse
 }
 
+// Waits for the session's current connection to end
+func testhelperWaitForDone(session *Session, t *testing.T) {
+	t.Helper()
+	select {
+	case <-session.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected session connection to end")
+	}
+}
+
 // Consumes a Connect request from the reader
 func testhelperConsumeConnect(reader io.Reader, t *testing.T) {
 	t.Helper()
-	oneByte := make([]byte, 1)
-	n, err := reader.Read(oneByte)
-	connFirst := oneByte[0]
-	testutils.CheckNotError(err, t)
-	testutils.CheckEqual(ConnectType<<4, int(connFirst), t)
-	value, err := DecodeVariableInt(reader)
-	testutils.CheckEqual(24, value, t)
-	connectMessage := make([]byte, value)
-	n, err = reader.Read(connectMessage)
-	testutils.CheckEqual(value, n, t)
+	testutils.CheckNotError(testhelperReadConnect(reader), t)
+}
+
+// Reads a Connect request from the reader. Returns an error instead of failing the test as it is also used by the
+// goroutines acting as the broker in the tests.
+func testhelperReadConnect(reader io.Reader) error {
+	fixedHeader, body, err := testhelperReadPacketFrom(reader)
+	if err != nil {
+		return err
+	}
+	if int(fixedHeader) != ConnectType<<4 {
+		return fmt.Errorf("expected CONNECT, got fixed header %#x", fixedHeader)
+	}
+	if len(body) != 24 {
+		return fmt.Errorf("expected CONNECT of length 24, got %d", len(body))
+	}
 
 	// TODO: Make checks to assert the Connect request
+	return nil
+}
+
+func Test_Session_ConnectContext_closes_connection_when_context_is_done_before_CONNACK(t *testing.T) {
+	conn := NewMockConnection()
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := session.ConnectContext(ctx)
+	testutils.CheckEqual(context.DeadlineExceeded, err, t)
+
+	// The connection is closed
+	_, err = conn.Write([]byte{0})
+	testutils.CheckEqual(io.EOF, err, t)
+}
+
+func Test_Session_Connect_returns_ErrTIMEOUT_when_CONNACK_does_not_arrive_within_ConnectTimeOut(t *testing.T) {
+	conn := NewMockConnection()
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+
+	err := session.Connect(ConnectTimeOut(1))
+	testutils.CheckEqual(ErrTIMEOUT, err, t)
+}
+
+func Test_Session_PublishContext_QoS_1_returns_when_PUBACK_is_received(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+
+	theRemoteSide := conn.Remote()
+	remoteErr := make(chan error, 1)
+	go func() {
+		if err := testhelperReadConnect(theRemoteSide); err != nil {
+			remoteErr <- err
+			return
+		}
+		fixedHeader, body, err := testhelperReadPacketFrom(theRemoteSide)
+		if err == nil && int(fixedHeader>>4) == PublishType {
+			// packet ID follows the 2 byte length + topic
+			packetID := int(body[2+len("test")])<<8 | int(body[3+len("test")])
+			_, err = NewAckMessage(PublishAckType, packetID).WriteTo(theRemoteSide)
+		}
+		remoteErr <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = session.PublishContext(ctx, Topic("test"), Message([]byte("hello")), QoS(1))
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(<-remoteErr, t)
+	testutils.CheckNotError(session.Disconnect(0), t)
+}
+
+func Test_Session_PublishContext_QoS_1_returns_context_error_when_PUBACK_is_not_received(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = session.PublishContext(ctx, Topic("test"), Message([]byte("hello")), QoS(1))
+	testutils.CheckEqual(context.DeadlineExceeded, err, t)
+
+	// The message is still in flight
+	_, ok := session.Disconnect(0).(*UnacknowledgedError)
+	testutils.CheckTrue(ok, t)
+}
+
+func Test_Session_IgnoreReceived_packets_are_not_processed(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	observer := &testObserver{}
+	ignorePubAck := func(packet *GenericMessage) bool { return packet.Type() == PublishAckType }
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn), Observe(observer), IgnoreReceived(ignorePubAck))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(session.Publish(Topic("test"), Message([]byte("hello")), QoS(1)), t)
+
+	// The PUBACK is ignored - and so is a PUBACK for an unknown packet (otherwise a protocol violation)
+	_, err = conn.RemoteWrite([]byte{PublishAckType << 4, 2, 0, 1, PublishAckType << 4, 2, 0, 7})
+	testutils.CheckNotError(err, t)
+	for i := 0; i < 100 && len(observer.recorded()) < 6; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	unacknowledged, ok := session.Disconnect(0).(*UnacknowledgedError)
+	testutils.CheckTrue(ok, t)
+	testutils.CheckEqual([]int{1}, unacknowledged.PacketIDs, t)
+	testutils.CheckEqual([]string{
+		"sent CONNECT", "received CONNACK", "connected sp=false", "sent PUBLISH", "received PUBACK", "received PUBACK", "sent DISCONNECT",
+	}, observer.recorded(), t)
+}
+
+func Test_Session_SubscribeContext_returns_granted_QoS_and_messages_are_given_to_MessageHandler(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	received := make(chan PublishOptions, 1)
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn), MessageHandler(func(msg *PublishRequest) {
+		received <- msg.Options()
+	}))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+
+	theRemoteSide := conn.Remote()
+	remoteErr := make(chan error, 1)
+	go func() {
+		if err := testhelperReadConnect(theRemoteSide); err != nil {
+			remoteErr <- err
+			return
+		}
+		fixedHeader, body, err := testhelperReadPacketFrom(theRemoteSide)
+		if err == nil && int(fixedHeader>>4) == SubscribeType {
+			// SUBACK granting QoS 1, then a QoS 1 PUBLISH
+			if _, err = theRemoteSide.Write([]byte{SubAckType << 4, 3, body[0], body[1], 1}); err == nil {
+				_, err = NewPublishRequest(Topic("a/b"), Message([]byte("hi")), QoS(1), PacketID(42)).MakeMessage().WriteTo(theRemoteSide)
+			}
+		}
+		remoteErr <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	granted, err := session.SubscribeContext(ctx, TopicFilter("a/+", 1))
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(<-remoteErr, t)
+	testutils.CheckEqual([]int{1}, granted, t)
+
+	select {
+	case msg := <-received:
+		testutils.CheckEqual("a/b", msg.Topic, t)
+		testutils.CheckEqual([]byte("hi"), msg.Message, t)
+		testutils.CheckEqual(42, msg.PacketID, t)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected message to be given to the MessageHandler")
+	}
+
+	// The PUBLISH is acknowledged
+	fixedHeader, body := testhelperReadPacket(theRemoteSide, t)
+	testutils.CheckEqual(byte(PublishAckType<<4), fixedHeader, t)
+	testutils.CheckEqual([]byte{0, 42}, body, t)
+	testutils.CheckNotError(session.Disconnect(0), t)
+}
+
+func Test_Session_DisconnectContext_returns_when_context_is_cancelled(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	testutils.CheckNotError(session.DisconnectContext(ctx), t)
+	testhelperWaitForDone(session, t)
+}
+
+func Test_Session_Disconnect_returns_as_soon_as_nothing_is_in_flight(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(session.Publish(Topic("test"), Message([]byte("hello")), QoS(1)), t)
+
+	// The broker acknowledges after a short while
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		NewAckMessage(PublishAckType, 1).WriteTo(conn.Remote())
+	}()
+
+	start := time.Now()
+	testutils.CheckNotError(session.Disconnect(5), t)
+	testutils.CheckTrue(time.Since(start) < 1*time.Second, t)
+}
+
+func Test_Session_Disconnect_reports_packets_still_in_flight_at_timeout(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(session.Publish(Topic("test"), Message([]byte("hello")), QoS(1)), t)
+	testutils.CheckNotError(session.Publish(Topic("test"), Message([]byte("hello")), QoS(2)), t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = session.DisconnectContext(ctx)
+	uerr, ok := err.(*UnacknowledgedError)
+	testutils.CheckTrue(ok, t)
+	testutils.CheckEqual([]int{1, 2}, uerr.PacketIDs, t)
+
+	// The DISCONNECT was sent after the two PUBLISH
+	theRemoteSide := conn.Remote()
+	testhelperConsumeConnect(theRemoteSide, t)
+	testhelperReadPacket(theRemoteSide, t)
+	testhelperReadPacket(theRemoteSide, t)
+	fixedHeader, _ := testhelperReadPacket(theRemoteSide, t)
+	testutils.CheckEqual(byte(DisconnectType<<4), fixedHeader, t)
+}
+
+func Test_Session_connection_closed_by_broker_ends_the_connection_with_an_error(t *testing.T) {
+	before := runtime.NumGoroutine()
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+
+	conn.Close()
+	testhelperWaitForDone(session, t)
+	testutils.CheckError(session.Err(), t)
+	testutils.CheckError(session.Publish(Topic("test")), t)
+	testutils.CheckNoGoroutineLeak(before, t)
+}
+
+func Test_Session_sends_PINGREQ_when_nothing_is_written_within_the_keep_alive(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	start := time.Now()
+	err = session.Connect(KeepAliveSeconds(1))
+	testutils.CheckNotError(err, t)
+
+	theRemoteSide := conn.Remote()
+	testhelperConsumeConnect(theRemoteSide, t)
+	fixedHeader, body := testhelperReadPacket(theRemoteSide, t)
+	testutils.CheckEqual(PingReqType<<4, int(fixedHeader), t)
+	testutils.CheckEqual(0, len(body), t)
+	testutils.CheckTrue(time.Since(start) >= time.Second, t)
+	_, err = NewPingResponseMessage().WriteTo(theRemoteSide)
+	testutils.CheckNotError(err, t)
+
+	// The PINGRESP keeps the connection alive
+	select {
+	case <-session.Done():
+		t.Fatalf("Expected the connection to be kept alive, got %v", session.Err())
+	case <-time.After(1200 * time.Millisecond):
+	}
+	testutils.CheckNotError(session.Disconnect(0), t)
+}
+
+func Test_Session_connection_is_lost_when_PINGRESP_does_not_arrive_within_the_keep_alive(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	observer := &testObserver{}
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn), Observe(observer))
+	observer.session = session
+	err = session.Connect(KeepAliveSeconds(1))
+	testutils.CheckNotError(err, t)
+
+	theRemoteSide := conn.Remote()
+	testhelperConsumeConnect(theRemoteSide, t)
+	fixedHeader, _ := testhelperReadPacket(theRemoteSide, t)
+	testutils.CheckEqual(PingReqType<<4, int(fixedHeader), t)
+
+	testhelperWaitForDone(session, t)
+	testutils.CheckError(session.Err(), t)
+	events := observer.recorded()
+	testutils.CheckEqual("lost true", events[len(events)-1], t)
+}
+
+func Test_Session_malformed_PINGRESP_is_a_protocol_violation(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn))
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+
+	_, err = conn.RemoteWrite([]byte{PingRespType << 4, 1, 0})
+	testutils.CheckNotError(err, t)
+
+	testhelperWaitForDone(session, t)
+	perr, ok := session.Err().(*ProtocolError)
+	testutils.CheckTrue(ok, t)
+	testutils.CheckEqual(PingRespType, perr.PacketType, t)
+}
+
+// testObserver records the events it is notified about as strings
+type testObserver struct {
+	NopObserver
+	session *Session
+	mutex   sync.Mutex
+	events  []string
+}
+
+func (o *testObserver) record(format string, values ...interface{}) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, values...))
+}
+
+func (o *testObserver) recorded() []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]string{}, o.events...)
+}
+
+func (o *testObserver) OnConnected(sessionPresent bool) { o.record("connected sp=%v", sessionPresent) }
+func (o *testObserver) OnReconnecting()                 { o.record("reconnecting") }
+func (o *testObserver) OnPublishAcknowledged(id int)    { o.record("acknowledged %d", id) }
+func (o *testObserver) OnPacketSent(p *GenericMessage)  { o.record("sent %s", PacketTypeName(p.Type())) }
+func (o *testObserver) OnPacketReceived(p *GenericMessage) {
+	o.record("received %s", PacketTypeName(p.Type()))
+}
+func (o *testObserver) OnConnectionLost(err error) {
+	// The session must not be locked when this is called - Err() would otherwise block
+	o.record("lost %v", o.session.Err() == err)
+}
+
+func Test_Session_Observer_is_notified_about_events(t *testing.T) {
+	conn := NewMockConnection()
+	_, err := conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+
+	observer := &testObserver{}
+	session := NewSession(ClientID("MqttUnitTest"), Connection(conn), Observe(observer))
+	observer.session = session
+	err = session.Connect()
+	testutils.CheckNotError(err, t)
+
+	theRemoteSide := conn.Remote()
+	remoteErr := make(chan error, 1)
+	go func() {
+		if err := testhelperReadConnect(theRemoteSide); err != nil {
+			remoteErr <- err
+			return
+		}
+		_, body, err := testhelperReadPacketFrom(theRemoteSide)
+		if err == nil {
+			packetID := int(body[2+len("test")])<<8 | int(body[3+len("test")])
+			_, err = NewAckMessage(PublishAckType, packetID).WriteTo(theRemoteSide)
+		}
+		remoteErr <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = session.PublishContext(ctx, Topic("test"), Message([]byte("hello")), QoS(1))
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(<-remoteErr, t)
+
+	conn.Close()
+	testhelperWaitForDone(session, t)
+	// The connection lost event is notified after Done() is closed - wait for it
+	for i := 0; i < 100 && len(observer.recorded()) < 7; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Reconnect and disconnect - a Disconnect is not a lost connection
+	conn = NewMockConnection()
+	_, err = conn.RemoteWrite(testhelperConnectionAccepted())
+	testutils.CheckNotError(err, t)
+	session.ReEstablish(Connection(conn))
+	testutils.CheckNotError(session.Connect(), t)
+	testutils.CheckNotError(session.Disconnect(0), t)
+
+	expected := []string{
+		"sent CONNECT", "received CONNACK", "connected sp=false",
+		"sent PUBLISH", "received PUBACK", "acknowledged 1",
+		"lost true",
+		"reconnecting", "sent CONNECT", "received CONNACK", "connected sp=false",
+		"sent DISCONNECT",
+	}
+	testutils.CheckEqual(fmt.Sprintf("%v", expected), fmt.Sprintf("%v", observer.recorded()), t)
+}
+
+func Test_Session_repeated_Connect_and_Disconnect_leaves_no_goroutines_behind(t *testing.T) {
+	before := runtime.NumGoroutine()
+	session := NewSession(ClientID("MqttUnitTest"))
+
+	// Same phases as `pub --test_qos2_resend` - first PUBREC is ignored, then PUBCOMP, then all is processed
+	phases := []struct {
+		options  []ConnectOption
+		response []byte
+	}{
+		{[]ConnectOption{XIgnorePubAck(true), CleanSession(true)}, []byte{PublishReceivedType << 4, 2, 0, 1}},
+		{[]ConnectOption{XIgnorePubComp(true), CleanSession(false)}, []byte{PublishReceivedType << 4, 2, 0, 1, PublishCompleteType << 4, 2, 0, 1}},
+		{[]ConnectOption{CleanSession(false)}, []byte{PublishCompleteType << 4, 2, 0, 1}},
+	}
+	for i, phase := range phases {
+		conn := NewMockConnection()
+		conn.RemoteWrite(testhelperConnectionAccepted())
+		session.ReEstablish(Connection(conn))
+		testutils.CheckNotError(session.Connect(phase.options...), t)
+		if i == 0 {
+			testutils.CheckNotError(session.Publish(Topic("test"), Message([]byte("hello")), QoS(2)), t)
+		}
+		conn.RemoteWrite(phase.response)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := session.DisconnectContext(ctx)
+		cancel()
+		if i < 2 {
+			// The ignored PUBREC/PUBCOMP leaves the message in flight
+			_, ok := err.(*UnacknowledgedError)
+			testutils.CheckTrue(ok, t)
+		} else {
+			testutils.CheckNotError(err, t)
+		}
+		// Note: the connection is deliberately not closed - the session must stop reading on its own
+	}
+	testutils.CheckNoGoroutineLeak(before, t)
+}
+
+// Reads one packet from the reader and returns its fixed header and body
+func testhelperReadPacket(reader io.Reader, t *testing.T) (byte, []byte) {
+	t.Helper()
+	fixedHeader, body, err := testhelperReadPacketFrom(reader)
+	testutils.CheckNotError(err, t)
+	return fixedHeader, body
+}
 
+// Reads one packet from the reader and returns its fixed header and body, or an error. To be used from
+// goroutines other than the one running the test.
+func testhelperReadPacketFrom(reader io.Reader) (byte, []byte, error) {
+	fixedHeader := make([]byte, 1)
+	if _, err := io.ReadFull(reader, fixedHeader); err != nil {
+		return 0, nil, err
+	}
+	length, err := DecodeVariableInt(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return fixedHeader[0], body, nil
 }
@@ -0,0 +1,157 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SubscribeRequest describes a MQTT Subscribe
+type SubscribeRequest struct {
+	options SubscribeOptions
+}
+
+// NewSubscribeRequest creates an instance from default subscribe options plus given options.
+//
+// For example:
+//    request := NewSubscribeRequest(TopicFilter("sensors/+/temperature", 1), TopicFilter("alarms/#", 2))
+//
+func NewSubscribeRequest(options ...SubscribeOption) *SubscribeRequest {
+	opts := DefaultSubscribeOptions()
+	for _, fOpt := range options {
+		if err := fOpt(&opts); err != nil {
+			log.Fatalf("Subscribe option apply failure: %s", err)
+		}
+	}
+	return &SubscribeRequest{options: opts}
+}
+
+// remainingLength computes the Remaining Length value to use in the Fixed Header
+//
+func (r *SubscribeRequest) remainingLength() int {
+	result := 2 // Packet ID
+	for _, sub := range r.options.Subscriptions {
+		// 2 bytes length + the filter + 1 byte requested QoS
+		result += 2 + len(sub.TopicFilter) + 1
+	}
+	return result
+}
+
+// MakeMessage returns the SUBSCRIBE message for the request
+//
+func (r *SubscribeRequest) MakeMessage() *GenericMessage {
+	var data bytes.Buffer
+	data.Grow(r.remainingLength()) // ensure all to be written fits using only one buffer allocation
+
+	// VARIABLE HEADER
+	Encode16BitIntTo(r.options.PacketID, &data)
+
+	// PAYLOAD
+	for _, sub := range r.options.Subscriptions {
+		EncodeStringTo(sub.TopicFilter, &data)
+		data.WriteByte(byte(sub.QoS))
+	}
+	return &GenericMessage{fixedHeader: SubscribeType<<4 | SubscribeReserved, body: data.Bytes()}
+}
+
+// Subscription is a topic filter and the maximum QoS the subscriber wants messages delivered with
+//
+type Subscription struct {
+	TopicFilter string
+	QoS         int
+}
+
+// SubscribeOptions contains options for a SubscribeRequest
+//
+type SubscribeOptions struct {
+	Subscriptions []Subscription
+	PacketID      int // 16 bits ID
+}
+
+// SubscribeOption is an Options-modifying-function
+type SubscribeOption func(*SubscribeOptions) error
+
+// DefaultSubscribeOptions returns the default options for making a MQTT subscribe (without any subscriptions)
+//
+func DefaultSubscribeOptions() SubscribeOptions {
+	return SubscribeOptions{PacketID: 0}
+}
+
+// TopicFilter returns a SubscribeOption that adds a subscription to the given topic filter with the given
+// maximum QoS.
+func TopicFilter(filter string, qos int) SubscribeOption {
+	if filter == "" {
+		panic("A topic filter must be at least one character long")
+	}
+	if qos < 0 || qos > 2 {
+		panic(fmt.Sprintf("QoS must be 0, 1, or 2, got %d", qos))
+	}
+	return func(o *SubscribeOptions) error {
+		o.Subscriptions = append(o.Subscriptions, Subscription{TopicFilter: filter, QoS: qos})
+		return nil
+	}
+}
+
+// Options returns the options of the SubscribeRequest. For a decoded SUBSCRIBE these describe the received request.
+//
+func (r *SubscribeRequest) Options() SubscribeOptions {
+	return r.options
+}
+
+// DecodeSubscribe decodes a SUBSCRIBE message into a SubscribeRequest. The requested QoS of each subscription
+// is validated, but not the topic filters (see ValidateTopicFilter).
+//
+func DecodeSubscribe(msg *GenericMessage) (*SubscribeRequest, error) {
+	if msg.fixedHeader != SubscribeType<<4|SubscribeReserved {
+		return nil, fmt.Errorf("Expected SUBSCRIBE with reserved flags 0x%x - got fixed header 0x%x", SubscribeReserved, msg.fixedHeader)
+	}
+	packetID, body, err := decodePacketID(msg.body)
+	if err != nil {
+		return nil, fmt.Errorf("SUBSCRIBE: %s", err)
+	}
+	opts := SubscribeOptions{PacketID: packetID}
+	for len(body) > 0 {
+		var sub Subscription
+		if sub.TopicFilter, body, err = decodeString(body); err != nil {
+			return nil, fmt.Errorf("SUBSCRIBE topic filter: %s", err)
+		}
+		if len(body) < 1 {
+			return nil, fmt.Errorf("SUBSCRIBE is missing requested QoS for topic filter '%s'", sub.TopicFilter)
+		}
+		if body[0] > 2 {
+			return nil, fmt.Errorf("SUBSCRIBE requested QoS byte must be 0, 1 or 2 - got 0x%x", body[0])
+		}
+		sub.QoS = int(body[0])
+		body = body[1:]
+		opts.Subscriptions = append(opts.Subscriptions, sub)
+	}
+	if len(opts.Subscriptions) == 0 {
+		return nil, fmt.Errorf("SUBSCRIBE must have at least one topic filter")
+	}
+	return &SubscribeRequest{options: opts}, nil
+}
+
+// DecodeUnsubscribe decodes an UNSUBSCRIBE message and returns its packet ID and topic filters
+//
+func DecodeUnsubscribe(msg *GenericMessage) (int, []string, error) {
+	if msg.fixedHeader != UnsubscribeType<<4|UnsubscribeReserved {
+		return 0, nil, fmt.Errorf("Expected UNSUBSCRIBE with reserved flags 0x%x - got fixed header 0x%x", UnsubscribeReserved, msg.fixedHeader)
+	}
+	packetID, body, err := decodePacketID(msg.body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("UNSUBSCRIBE: %s", err)
+	}
+	var filters []string
+	for len(body) > 0 {
+		var filter string
+		if filter, body, err = decodeString(body); err != nil {
+			return 0, nil, fmt.Errorf("UNSUBSCRIBE topic filter: %s", err)
+		}
+		filters = append(filters, filter)
+	}
+	if len(filters) == 0 {
+		return 0, nil, fmt.Errorf("UNSUBSCRIBE must have at least one topic filter")
+	}
+	return packetID, filters, nil
+}
@@ -0,0 +1,30 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func Test_DecodeSubscribe_decodes_what_MakeMessage_produces(t *testing.T) {
+	request := NewSubscribeRequest(TopicFilter("a/+", 1), TopicFilter("b/#", 2))
+	request.options.PacketID = 42
+	decoded, err := DecodeSubscribe(request.MakeMessage())
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(request.Options(), decoded.Options(), t)
+}
+
+func Test_DecodeSubscribe_refuses_SUBSCRIBE_without_topic_filters(t *testing.T) {
+	request := NewSubscribeRequest()
+	request.options.PacketID = 42
+	_, err := DecodeSubscribe(request.MakeMessage())
+	testutils.CheckError(err, t)
+}
+
+func Test_DecodeUnsubscribe_returns_packet_ID_and_topic_filters(t *testing.T) {
+	msg := &GenericMessage{fixedHeader: UnsubscribeType<<4 | UnsubscribeReserved, body: []byte{0, 7, 0, 1, 'a', 0, 3, 'b', '/', '#'}}
+	packetID, filters, err := DecodeUnsubscribe(msg)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(7, packetID, t)
+	testutils.CheckEqual([]string{"a", "b/#"}, filters, t)
+}
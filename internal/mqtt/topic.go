@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidateTopicName returns an error if the given topic name cannot be used in a PUBLISH - it must be at least
+// one character long and must not contain the wildcard characters '+' and '#'.
+//
+func ValidateTopicName(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("A topic name must be at least one character long")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("A topic name must not contain wildcards - got '%s'", topic)
+	}
+	return nil
+}
+
+// ValidateTopicFilter returns an error if the given topic filter cannot be used in a SUBSCRIBE - it must be at
+// least one character long, '+' must occupy an entire level, and '#' must occupy the entire last level.
+//
+func ValidateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("A topic filter must be at least one character long")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("The '+' wildcard must occupy an entire level - got '%s'", filter)
+		}
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("The '#' wildcard must be the entire last level - got '%s'", filter)
+		}
+	}
+	return nil
+}
+
+// TopicMatches returns true if the given topic name matches the given (valid) topic filter.
+//
+// SPEC: A topic starting with '$' is not matched by a filter starting with a wildcard.
+//
+func TopicMatches(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			// matches the parent level and any number of child levels
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,40 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func Test_TopicMatches_handles_wildcards(t *testing.T) {
+	testutils.CheckTrue(TopicMatches("a/b", "a/b"), t)
+	testutils.CheckFalse(TopicMatches("a/b", "a/b/c"), t)
+	testutils.CheckTrue(TopicMatches("a/+/c", "a/b/c"), t)
+	testutils.CheckFalse(TopicMatches("a/+/c", "a/b/d"), t)
+	testutils.CheckTrue(TopicMatches("a/+", "a/"), t)
+	testutils.CheckTrue(TopicMatches("a/#", "a"), t)
+	testutils.CheckTrue(TopicMatches("a/#", "a/b/c"), t)
+	testutils.CheckTrue(TopicMatches("#", "a/b"), t)
+	testutils.CheckFalse(TopicMatches("+", "a/b"), t)
+}
+
+func Test_TopicMatches_does_not_match_dollar_topics_with_leading_wildcard(t *testing.T) {
+	testutils.CheckFalse(TopicMatches("#", "$SYS/uptime"), t)
+	testutils.CheckFalse(TopicMatches("+/uptime", "$SYS/uptime"), t)
+	testutils.CheckTrue(TopicMatches("$SYS/#", "$SYS/uptime"), t)
+}
+
+func Test_ValidateTopicFilter_requires_wildcards_to_occupy_entire_levels(t *testing.T) {
+	testutils.CheckNotError(ValidateTopicFilter("a/+/c/#"), t)
+	testutils.CheckError(ValidateTopicFilter(""), t)
+	testutils.CheckError(ValidateTopicFilter("a/b+"), t)
+	testutils.CheckError(ValidateTopicFilter("a/#/c"), t)
+	testutils.CheckError(ValidateTopicFilter("a/b#"), t)
+}
+
+func Test_ValidateTopicName_refuses_wildcards(t *testing.T) {
+	testutils.CheckNotError(ValidateTopicName("a/b"), t)
+	testutils.CheckError(ValidateTopicName(""), t)
+	testutils.CheckError(ValidateTopicName("a/+"), t)
+	testutils.CheckError(ValidateTopicName("a/#"), t)
+}
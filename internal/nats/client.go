@@ -0,0 +1,570 @@
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServerInfo is the INFO a NATS server sends when a client connects (only the fields used by the Client)
+//
+type ServerInfo struct {
+	ServerID     string `json:"server_id"`
+	ServerName   string `json:"server_name"`
+	Version      string `json:"version"`
+	Proto        int    `json:"proto"`
+	Headers      bool   `json:"headers"`
+	MaxPayload   int    `json:"max_payload"`
+	AuthRequired bool   `json:"auth_required"`
+	Nonce        string `json:"nonce,omitempty"`
+}
+
+// connectInfo is the JSON argument of CONNECT
+type connectInfo struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name,omitempty"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	Protocol  int    `json:"protocol"`
+	Echo      bool   `json:"echo"`
+	Headers   bool   `json:"headers"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// ErrHeadersNotSupported is returned when publishing a message with headers to a server that does not support them
+var ErrHeadersNotSupported = errors.New("The server does not support headers")
+
+// ErrNotConnected is returned when the client is used when it is not connected
+var ErrNotConnected = errors.New("Not connected")
+
+// Client is a minimal client for the NATS core protocol. It connects to a NATS server over a given net.Conn,
+// publishes messages (with headers if the server supports them), and subscribes to subjects. Messages for a
+// subscription are given to its MsgHandler.
+//
+// Example:
+//     client := nats.NewClient(nats.Connection(conn), nats.Name("mezquit"))
+//     err := client.Connect()
+//     sub, err := client.Subscribe("sensors.>", func(msg *nats.Msg) { ... })
+//     err = client.Publish("sensors.kitchen", []byte("21"))
+//
+type Client struct {
+	options ClientOptions
+	info    ServerInfo
+
+	writeMutex sync.Mutex // serializes writes to the connection
+
+	mutex     sync.Mutex
+	connected bool
+	subs      map[int]*Subscription
+	lastSid   int
+	pongs     []chan struct{} // closed when the PONG for a PING sent by Flush arrives - in the order sent
+	serverErr error           // the last -ERR received
+	err       error           // the error that ended the connection (nil if it was closed by Close)
+	done      chan struct{}   // closed when the connection has ended
+}
+
+// MsgHandler is a function that is given each message delivered for a subscription.
+// The function is called from the goroutine reading from the server - it should not block.
+//
+type MsgHandler func(msg *Msg)
+
+// Subscription is a subscription of a Client
+//
+type Subscription struct {
+	client    *Client
+	sid       int
+	Subject   string
+	Queue     string // the queue group (empty if none)
+	handler   MsgHandler
+	max       int // the number of messages after which the subscription ends (0 is no limit)
+	delivered int
+}
+
+// ClientOptions contains options for a Client
+//
+type ClientOptions struct {
+	Conn           net.Conn
+	Name           string // the name of the client - shown in the monitoring of the server
+	Verbose        bool   // if the server should send +OK for each operation
+	Pedantic       bool   // if the server should perform extra checks
+	Echo           bool   // if the client should get the messages it publishes (when it has a matching subscription)
+	User           string
+	Password       string
+	Token          string
+	ConnectTimeOut time.Duration // the time to wait for INFO and for the reply to CONNECT
+}
+
+// ClientOption is an Options-modifying-function
+type ClientOption func(*ClientOptions) error
+
+// DefaultClientOptions returns the default options for a Client (echo, and 10 seconds connect time out)
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{Echo: true, ConnectTimeOut: 10 * time.Second}
+}
+
+// Connection returns a ClientOption for the net.Conn to the server
+func Connection(conn net.Conn) ClientOption {
+	return func(o *ClientOptions) error {
+		o.Conn = conn
+		return nil
+	}
+}
+
+// Name returns a ClientOption for the name of the client
+func Name(name string) ClientOption {
+	return func(o *ClientOptions) error {
+		o.Name = name
+		return nil
+	}
+}
+
+// Verbose returns a ClientOption making the server acknowledge each operation with +OK
+func Verbose(flag bool) ClientOption {
+	return func(o *ClientOptions) error {
+		o.Verbose = flag
+		return nil
+	}
+}
+
+// Pedantic returns a ClientOption making the server perform extra checks
+func Pedantic(flag bool) ClientOption {
+	return func(o *ClientOptions) error {
+		o.Pedantic = flag
+		return nil
+	}
+}
+
+// Echo returns a ClientOption for whether the client gets the messages it publishes itself
+func Echo(flag bool) ClientOption {
+	return func(o *ClientOptions) error {
+		o.Echo = flag
+		return nil
+	}
+}
+
+// UserInfo returns a ClientOption for user name and password authentication
+func UserInfo(user, password string) ClientOption {
+	return func(o *ClientOptions) error {
+		o.User = user
+		o.Password = password
+		return nil
+	}
+}
+
+// Token returns a ClientOption for token authentication
+func Token(token string) ClientOption {
+	return func(o *ClientOptions) error {
+		o.Token = token
+		return nil
+	}
+}
+
+// ConnectTimeOut returns a ClientOption for the time to wait for the server when connecting
+func ConnectTimeOut(timeout time.Duration) ClientOption {
+	if timeout <= 0 {
+		panic("ConnectTimeOut must be positive")
+	}
+	return func(o *ClientOptions) error {
+		o.ConnectTimeOut = timeout
+		return nil
+	}
+}
+
+// NewClient creates a Client from default options plus given options. The client does not communicate with the
+// server until Connect() is called.
+//
+func NewClient(options ...ClientOption) *Client {
+	opts := DefaultClientOptions()
+	for _, fOpt := range options {
+		if err := fOpt(&opts); err != nil {
+			log.Fatalf("Client option apply failure: %s", err)
+		}
+	}
+	done := make(chan struct{})
+	close(done)
+	return &Client{options: opts, subs: make(map[int]*Subscription), done: done}
+}
+
+// Connect reads the INFO from the server, sends CONNECT, and waits for the PONG to a PING to make sure the
+// server accepted the connection. An error is returned (and the connection is closed) if the server refused the
+// connection, or did not reply within the ConnectTimeOut.
+//
+func (c *Client) Connect() error {
+	conn := c.options.Conn
+	if conn == nil {
+		panic("Client requires a net.Conn Connection to operate")
+	}
+	c.mutex.Lock()
+	if c.connected {
+		c.mutex.Unlock()
+		return fmt.Errorf("Client is already connected")
+	}
+	c.mutex.Unlock()
+
+	reader := bufio.NewReader(conn)
+	if err := c.handshake(reader); err != nil {
+		conn.Close()
+		return err
+	}
+	c.mutex.Lock()
+	c.connected = true
+	c.err = nil
+	c.serverErr = nil
+	c.done = make(chan struct{})
+	c.mutex.Unlock()
+	go c.readLoop(reader)
+	return nil
+}
+
+// handshake performs the INFO, CONNECT, PING, PONG exchange
+//
+func (c *Client) handshake(reader *bufio.Reader) error {
+	conn := c.options.Conn
+	conn.SetReadDeadline(time.Now().Add(c.options.ConnectTimeOut))
+	defer conn.SetReadDeadline(time.Time{})
+
+	op, args, err := readOp(reader)
+	if err != nil {
+		return fmt.Errorf("Error while reading INFO: %s", err)
+	}
+	if op != "INFO" || len(args) != 1 {
+		return fmt.Errorf("Expected INFO from server - got %s", op)
+	}
+	if err := json.Unmarshal([]byte(args[0]), &c.info); err != nil {
+		return fmt.Errorf("Invalid INFO from server: %s", err)
+	}
+	log.Debugf("NATS: connected to server %s version %s", c.info.ServerID, c.info.Version)
+
+	connect, err := json.Marshal(connectInfo{
+		Verbose:   c.options.Verbose,
+		Pedantic:  c.options.Pedantic,
+		Name:      c.options.Name,
+		Lang:      "go",
+		Version:   "mezquit",
+		Protocol:  1,
+		Echo:      c.options.Echo,
+		Headers:   true,
+		User:      c.options.User,
+		Pass:      c.options.Password,
+		AuthToken: c.options.Token,
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n")); err != nil {
+		return fmt.Errorf("Error while writing CONNECT: %s", err)
+	}
+	for {
+		op, args, err := readOp(reader)
+		if err != nil {
+			return fmt.Errorf("Error while waiting for the server to accept CONNECT: %s", err)
+		}
+		switch op {
+		case "+OK":
+		case "PONG":
+			return nil
+		case "-ERR":
+			return fmt.Errorf("Server refused CONNECT: %s", errorText(args))
+		default:
+			return fmt.Errorf("Unexpected %s from server while connecting", op)
+		}
+	}
+}
+
+// Info returns the INFO the server sent when the client connected
+//
+func (c *Client) Info() ServerInfo {
+	return c.info
+}
+
+// Done returns a channel that is closed when the connection ends - either by a call to Close, or because the
+// connection was lost. When the client is not connected the returned channel is already closed.
+//
+func (c *Client) Done() <-chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.done
+}
+
+// Err returns the error that ended the last connection - nil if the client is connected, was never connected, or
+// if the connection was closed by Close. If the server sent -ERR before closing the connection that error is
+// returned.
+//
+func (c *Client) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// Close closes the connection and waits until the client has stopped reading from it
+//
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	if !c.connected {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.connected = false
+	done := c.done
+	c.mutex.Unlock()
+	err := c.options.Conn.Close()
+	<-done
+	return err
+}
+
+// Publish publishes the given data to the given subject
+//
+func (c *Client) Publish(subject string, data []byte) error {
+	return c.PublishMsg(&Msg{Subject: subject, Data: data})
+}
+
+// PublishMsg publishes the given message (with HPUB if it has headers)
+//
+func (c *Client) PublishMsg(msg *Msg) error {
+	if err := ValidateSubject(msg.Subject); err != nil {
+		return err
+	}
+	if msg.Reply != "" {
+		if err := ValidateSubject(msg.Reply); err != nil {
+			return err
+		}
+	}
+	if msg.Header != nil {
+		if !c.info.Headers {
+			return ErrHeadersNotSupported
+		}
+		if err := validateHeader(msg.Header); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	size := appendMessage(&buf, "PUB", []string{msg.Subject, msg.Reply}, msg)
+	if c.info.MaxPayload > 0 && size > c.info.MaxPayload {
+		return ErrMaxPayload
+	}
+	return c.writeConnected(buf.Bytes())
+}
+
+// Subscribe subscribes to the given subject (which may contain wildcards). Messages are given to the given handler.
+//
+func (c *Client) Subscribe(subject string, handler MsgHandler) (*Subscription, error) {
+	return c.QueueSubscribe(subject, "", handler)
+}
+
+// QueueSubscribe subscribes to the given subject as a member of the given queue group - each message is given to
+// one of the members of the group
+//
+func (c *Client) QueueSubscribe(subject, queue string, handler MsgHandler) (*Subscription, error) {
+	if err := ValidateSubjectFilter(subject); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(queue, " \t\r\n") {
+		return nil, fmt.Errorf("A queue group cannot contain white space - got '%s'", queue)
+	}
+	if handler == nil {
+		panic("Subscribe requires a MsgHandler")
+	}
+	c.mutex.Lock()
+	c.lastSid++
+	sub := &Subscription{client: c, sid: c.lastSid, Subject: subject, Queue: queue, handler: handler}
+	c.subs[sub.sid] = sub
+	c.mutex.Unlock()
+
+	line := "SUB " + subject
+	if queue != "" {
+		line += " " + queue
+	}
+	if err := c.writeConnected([]byte(line + " " + strconv.Itoa(sub.sid) + "\r\n")); err != nil {
+		c.mutex.Lock()
+		delete(c.subs, sub.sid)
+		c.mutex.Unlock()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Unsubscribe ends the subscription - no more messages are given to its handler
+//
+func (s *Subscription) Unsubscribe() error {
+	s.client.mutex.Lock()
+	delete(s.client.subs, s.sid)
+	s.client.mutex.Unlock()
+	return s.client.writeConnected([]byte("UNSUB " + strconv.Itoa(s.sid) + "\r\n"))
+}
+
+// AutoUnsubscribe ends the subscription when the given total number of messages have been delivered for it
+//
+func (s *Subscription) AutoUnsubscribe(max int) error {
+	if max <= 0 {
+		panic("AutoUnsubscribe requires a positive number of messages")
+	}
+	s.client.mutex.Lock()
+	s.max = max
+	ended := s.delivered >= max
+	if ended {
+		delete(s.client.subs, s.sid)
+	}
+	s.client.mutex.Unlock()
+	if ended {
+		return s.client.writeConnected([]byte("UNSUB " + strconv.Itoa(s.sid) + "\r\n"))
+	}
+	return s.client.writeConnected([]byte("UNSUB " + strconv.Itoa(s.sid) + " " + strconv.Itoa(max) + "\r\n"))
+}
+
+// Flush sends a PING and waits for the PONG from the server - which means that the server has processed everything
+// sent before the PING. The wait is aborted when the given context is done, or the connection ends.
+//
+func (c *Client) Flush(ctx context.Context) error {
+	pong := make(chan struct{})
+	c.mutex.Lock()
+	c.pongs = append(c.pongs, pong)
+	done := c.done
+	c.mutex.Unlock()
+	if err := c.writeConnected([]byte("PING\r\n")); err != nil {
+		return err
+	}
+	select {
+	case <-pong:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		if err := c.Err(); err != nil {
+			return err
+		}
+		return ErrNotConnected
+	}
+}
+
+// writeConnected writes the given protocol data if the client is connected
+//
+func (c *Client) writeConnected(data []byte) error {
+	c.mutex.Lock()
+	connected := c.connected
+	c.mutex.Unlock()
+	if !connected {
+		return ErrNotConnected
+	}
+	return c.write(data)
+}
+
+func (c *Client) write(data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.options.Conn.Write(data)
+	return err
+}
+
+// readLoop reads and processes operations from the server until the connection ends
+//
+func (c *Client) readLoop(reader *bufio.Reader) {
+	err := c.read(reader)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.connected {
+		// The connection was lost (and not closed by Close)
+		c.connected = false
+		c.options.Conn.Close()
+		if c.serverErr != nil {
+			err = c.serverErr
+		}
+		log.Debugf("NATS: connection lost: %s", err)
+		c.err = err
+	}
+	c.pongs = nil
+	close(c.done)
+}
+
+func (c *Client) read(reader *bufio.Reader) error {
+	for {
+		op, args, err := readOp(reader)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "MSG", "HMSG":
+			args, header, data, err := readMessage(reader, args, op == "HMSG", 0)
+			if err != nil {
+				return fmt.Errorf("Invalid %s from server: %s", op, err)
+			}
+			if len(args) != 2 && len(args) != 3 {
+				return fmt.Errorf("Invalid %s from server: expected subject, sid, and optional reply", op)
+			}
+			msg := &Msg{Subject: args[0], Header: header, Data: data}
+			if len(args) == 3 {
+				msg.Reply = args[2]
+			}
+			c.deliver(args[1], msg)
+		case "PING":
+			if err := c.write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case "PONG":
+			c.mutex.Lock()
+			if len(c.pongs) > 0 {
+				close(c.pongs[0])
+				c.pongs = c.pongs[1:]
+			}
+			c.mutex.Unlock()
+		case "+OK":
+		case "-ERR":
+			text := errorText(args)
+			log.Errorf("NATS: server error: %s", text)
+			c.mutex.Lock()
+			c.serverErr = fmt.Errorf("Server error: %s", text)
+			c.mutex.Unlock()
+		case "INFO":
+			// Sent by a server in a cluster when the cluster changes - not used by this client
+			log.Debugf("NATS: ignoring INFO update from server")
+		default:
+			return fmt.Errorf("Unexpected %s from server", op)
+		}
+	}
+}
+
+// deliver gives the given message to the handler of the subscription with the given sid (if it is still
+// subscribed)
+//
+func (c *Client) deliver(sid string, msg *Msg) {
+	id, err := strconv.Atoi(sid)
+	if err != nil {
+		log.Warnf("NATS: dropping message with invalid sid '%s'", sid)
+		return
+	}
+	c.mutex.Lock()
+	sub := c.subs[id]
+	if sub != nil {
+		sub.delivered++
+		if sub.max > 0 && sub.delivered >= sub.max {
+			delete(c.subs, id)
+		}
+	}
+	c.mutex.Unlock()
+	if sub == nil {
+		log.Debugf("NATS: dropping message for %s - not subscribed to sid %d", msg.Subject, id)
+		return
+	}
+	sub.handler(msg)
+}
+
+// errorText returns the text of a -ERR without the enclosing quotes
+func errorText(args []string) string {
+	if len(args) == 0 {
+		return "unknown error"
+	}
+	return strings.Trim(args[0], "'")
+}
@@ -0,0 +1,230 @@
+package nats
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+// testhelperConnect connects a new client to the given server over a net.Pipe
+func testhelperConnect(s *MockServer, t *testing.T, options ...ClientOption) *Client {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	client := NewClient(append(options, Connection(clientConn))...)
+	testutils.CheckNotError(client.Connect(), t)
+	return client
+}
+
+// testhelperReceiver returns a MsgHandler sending the received messages on the returned channel
+func testhelperReceiver() (MsgHandler, <-chan *Msg) {
+	messages := make(chan *Msg, 10)
+	return func(msg *Msg) { messages <- msg }, messages
+}
+
+func testhelperReceive(messages <-chan *Msg, t *testing.T) *Msg {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a message to be received")
+	}
+	return nil
+}
+
+// testhelperFlush makes sure the server has processed everything sent by the given clients
+func testhelperFlush(t *testing.T, clients ...*Client) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, c := range clients {
+		testutils.CheckNotError(c.Flush(ctx), t)
+	}
+}
+
+func Test_Client_publishes_and_receives_messages_with_headers(t *testing.T) {
+	before := runtime.NumGoroutine()
+	s := NewMockServer()
+	publisher := testhelperConnect(s, t, Name("publisher"))
+	subscriber := testhelperConnect(s, t, Verbose(true))
+	testutils.CheckTrue(subscriber.Info().Headers, t)
+
+	handler, messages := testhelperReceiver()
+	_, err := subscriber.Subscribe("sensors.*.temperature", handler)
+	testutils.CheckNotError(err, t)
+	testhelperFlush(t, subscriber)
+
+	testutils.CheckNotError(publisher.Publish("sensors.kitchen.temperature", []byte("21")), t)
+	msg := testhelperReceive(messages, t)
+	testutils.CheckEqual("sensors.kitchen.temperature", msg.Subject, t)
+	testutils.CheckEqual("21", string(msg.Data), t)
+	testutils.CheckTrue(msg.Header == nil, t)
+
+	header := Header{}
+	header.Add("Unit", "C")
+	header.Add("Source", "a")
+	header.Add("Source", "b")
+	err = publisher.PublishMsg(&Msg{Subject: "sensors.hall.temperature", Reply: "replies", Header: header, Data: []byte("19")})
+	testutils.CheckNotError(err, t)
+	msg = testhelperReceive(messages, t)
+	testutils.CheckEqual("19", string(msg.Data), t)
+	testutils.CheckEqual("replies", msg.Reply, t)
+	testutils.CheckEqual("C", msg.Header.Get("Unit"), t)
+	testutils.CheckEqual(2, len(msg.Header["Source"]), t)
+
+	testutils.CheckNotError(publisher.Publish("sensors.kitchen.humidity", []byte("40")), t)
+	testhelperFlush(t, publisher, subscriber)
+	testutils.CheckEqual(0, len(messages), t)
+
+	testutils.CheckNotError(publisher.Close(), t)
+	testutils.CheckNotError(subscriber.Close(), t)
+	testutils.CheckNotError(s.Close(), t)
+	testutils.CheckNoGoroutineLeak(before, t)
+}
+
+func Test_Client_subscriptions_in_queue_groups_share_the_messages(t *testing.T) {
+	s := NewMockServer()
+	defer s.Close()
+	client := testhelperConnect(s, t)
+	defer client.Close()
+
+	handler1, messages1 := testhelperReceiver()
+	handler2, messages2 := testhelperReceiver()
+	handlerAll, messagesAll := testhelperReceiver()
+	_, err := client.QueueSubscribe("jobs", "workers", handler1)
+	testutils.CheckNotError(err, t)
+	_, err = client.QueueSubscribe("jobs", "workers", handler2)
+	testutils.CheckNotError(err, t)
+	_, err = client.Subscribe("jobs", handlerAll)
+	testutils.CheckNotError(err, t)
+
+	for i := 0; i < 4; i++ {
+		testutils.CheckNotError(client.Publish("jobs", []byte("job")), t)
+	}
+	testhelperFlush(t, client)
+	testutils.CheckEqual(2, len(messages1), t)
+	testutils.CheckEqual(2, len(messages2), t)
+	testutils.CheckEqual(4, len(messagesAll), t)
+}
+
+func Test_Client_unsubscribes_at_once_or_after_a_number_of_messages(t *testing.T) {
+	s := NewMockServer()
+	defer s.Close()
+	client := testhelperConnect(s, t)
+	defer client.Close()
+
+	handler, messages := testhelperReceiver()
+	sub, err := client.Subscribe("a", handler)
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(sub.AutoUnsubscribe(2), t)
+	handlerB, messagesB := testhelperReceiver()
+	subB, err := client.Subscribe("b", handlerB)
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(subB.Unsubscribe(), t)
+
+	for i := 0; i < 3; i++ {
+		testutils.CheckNotError(client.Publish("a", []byte("x")), t)
+		testutils.CheckNotError(client.Publish("b", []byte("x")), t)
+	}
+	testhelperFlush(t, client)
+	testutils.CheckEqual(2, len(messages), t)
+	testutils.CheckEqual(0, len(messagesB), t)
+}
+
+func Test_Client_without_echo_does_not_get_its_own_messages(t *testing.T) {
+	s := NewMockServer()
+	defer s.Close()
+	client := testhelperConnect(s, t, Echo(false))
+	defer client.Close()
+
+	handler, messages := testhelperReceiver()
+	_, err := client.Subscribe(">", handler)
+	testutils.CheckNotError(err, t)
+	testutils.CheckNotError(client.Publish("a", []byte("x")), t)
+	testhelperFlush(t, client)
+	testutils.CheckEqual(0, len(messages), t)
+
+	s.Publish(&Msg{Subject: "b", Data: []byte("from server")})
+	testutils.CheckEqual("from server", string(testhelperReceive(messages, t).Data), t)
+}
+
+func Test_Client_authenticates_with_user_and_password_or_token(t *testing.T) {
+	s := NewMockServer(ServerUserInfo("alice", "secret"))
+	defer s.Close()
+	client := testhelperConnect(s, t, UserInfo("alice", "secret"))
+	testutils.CheckNotError(client.Close(), t)
+
+	clientConn, serverConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	client = NewClient(Connection(clientConn), UserInfo("alice", "wrong"))
+	err := client.Connect()
+	testutils.CheckError(err, t)
+	testutils.CheckTrue(strings.Contains(err.Error(), "Authorization Violation"), t)
+
+	s = NewMockServer(ServerToken("t0ken"))
+	defer s.Close()
+	client = testhelperConnect(s, t, Token("t0ken"))
+	testutils.CheckNotError(client.Close(), t)
+}
+
+func Test_Client_refuses_messages_the_server_cannot_take(t *testing.T) {
+	s := NewMockServer(ServerHeaders(false), ServerMaxPayload(4))
+	defer s.Close()
+	client := testhelperConnect(s, t)
+	defer client.Close()
+
+	testutils.CheckEqual(ErrMaxPayload, client.Publish("a", []byte("12345")), t)
+	testutils.CheckEqual(ErrHeadersNotSupported, client.PublishMsg(&Msg{Subject: "a", Header: Header{"k": {"v"}}}), t)
+	testutils.CheckError(client.Publish("a.*", []byte("x")), t)
+	testutils.CheckError(client.Publish("a..b", []byte("x")), t)
+	testutils.CheckError(client.PublishMsg(&Msg{Subject: "a", Header: Header{"k:": {"v"}}}), t)
+	_, err := client.Subscribe("a.>.b", func(msg *Msg) {})
+	testutils.CheckError(err, t)
+	testutils.CheckNotError(client.Publish("a", []byte("1234")), t)
+	testhelperFlush(t, client)
+}
+
+func Test_Client_ends_with_the_error_sent_by_the_server(t *testing.T) {
+	s := NewMockServer(ServerMaxPayload(4))
+	defer s.Close()
+	clientConn, serverConn := net.Pipe()
+	go s.ServeConn(serverConn)
+	client := NewClient(Connection(clientConn))
+	testutils.CheckNotError(client.Connect(), t)
+
+	// Bypass the check in the client
+	client.info.MaxPayload = 0
+	testutils.CheckNotError(client.Publish("a", []byte("12345")), t)
+	<-client.Done()
+	testutils.CheckError(client.Err(), t)
+	testutils.CheckTrue(strings.Contains(client.Err().Error(), "Maximum Payload Violation"), t)
+	testutils.CheckEqual(ErrNotConnected, client.Publish("a", []byte("x")), t)
+}
+
+func Test_decodeHeader_gives_the_status_as_headers(t *testing.T) {
+	h, err := decodeHeader([]byte("NATS/1.0 503 No Responders\r\nA: 1\r\n\r\n"))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual("503", h.Get("Status"), t)
+	testutils.CheckEqual("No Responders", h.Get("Description"), t)
+	testutils.CheckEqual("1", h.Get("A"), t)
+
+	_, err = decodeHeader([]byte("NATS/1.0\r\nA\r\n\r\n"))
+	testutils.CheckError(err, t)
+	_, err = decodeHeader([]byte("HTTP/1.0\r\n\r\n"))
+	testutils.CheckError(err, t)
+}
+
+func Test_SubjectMatches(t *testing.T) {
+	testutils.CheckTrue(SubjectMatches("a.*.c", "a.b.c"), t)
+	testutils.CheckTrue(SubjectMatches("a.>", "a.b.c"), t)
+	testutils.CheckFalse(SubjectMatches("a.>", "a"), t)
+	testutils.CheckFalse(SubjectMatches("a.*", "a.b.c"), t)
+	testutils.CheckFalse(SubjectMatches("a.b", "a.c"), t)
+	testutils.CheckTrue(SubjectMatches(">", "a"), t)
+}
@@ -0,0 +1,434 @@
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MockServer is an in-process stand-in for a NATS server implementing the subset of the core protocol used by the
+// Client: INFO, CONNECT (with optional user/password or token authentication), PUB, HPUB, SUB (with queue groups),
+// UNSUB, MSG, HMSG, PING, PONG, +OK (for verbose clients), and -ERR. There is no clustering, JetStream, or TLS.
+//
+// Like the broker in internal/broker, it serves given net.Conn connections (for example the RemoteConn() of a
+// mqtt.MockConnection), or connections accepted from a net.Listener. Messages can also be published by the code
+// embedding the server with Publish(), and the OnPublish hook is given each message published by a client.
+//
+type MockServer struct {
+	options   MockServerOptions
+	mutex     sync.Mutex
+	clients   map[*serverClient]bool
+	listeners map[net.Listener]bool
+	closed    bool
+	serving   sync.WaitGroup
+	lastID    int
+}
+
+// MockServerOptions contains options for a MockServer
+//
+type MockServerOptions struct {
+	User       string // with Password - the user name clients must give (no authentication if empty)
+	Password   string
+	Token      string // the token clients must give (no token authentication if empty)
+	MaxPayload int    // the maximum size of headers and data of a message
+	Headers    bool   // if HPUB and HMSG are supported
+	OnPublish  func(msg *Msg)
+}
+
+// MockServerOption is an Options-modifying-function
+type MockServerOption func(*MockServerOptions) error
+
+// DefaultMockServerOptions returns the default options for a MockServer (no authentication, headers, and a
+// maximum payload of 1MB like NATS server)
+//
+func DefaultMockServerOptions() MockServerOptions {
+	return MockServerOptions{MaxPayload: 1024 * 1024, Headers: true}
+}
+
+// ServerUserInfo returns a MockServerOption requiring clients to authenticate with the given user and password
+func ServerUserInfo(user, password string) MockServerOption {
+	return func(o *MockServerOptions) error {
+		o.User = user
+		o.Password = password
+		return nil
+	}
+}
+
+// ServerToken returns a MockServerOption requiring clients to authenticate with the given token
+func ServerToken(token string) MockServerOption {
+	return func(o *MockServerOptions) error {
+		o.Token = token
+		return nil
+	}
+}
+
+// ServerMaxPayload returns a MockServerOption for the maximum size of headers and data of a message
+func ServerMaxPayload(size int) MockServerOption {
+	if size <= 0 {
+		panic("ServerMaxPayload must be positive")
+	}
+	return func(o *MockServerOptions) error {
+		o.MaxPayload = size
+		return nil
+	}
+}
+
+// ServerHeaders returns a MockServerOption for whether the server supports headers
+func ServerHeaders(flag bool) MockServerOption {
+	return func(o *MockServerOptions) error {
+		o.Headers = flag
+		return nil
+	}
+}
+
+// OnPublish returns a MockServerOption for a function that is given each message published by a client.
+// The function is called from the goroutine serving the client - it should not block.
+//
+func OnPublish(handler func(msg *Msg)) MockServerOption {
+	return func(o *MockServerOptions) error {
+		o.OnPublish = handler
+		return nil
+	}
+}
+
+// NewMockServer creates a MockServer from default options plus given options
+//
+func NewMockServer(options ...MockServerOption) *MockServer {
+	opts := DefaultMockServerOptions()
+	for _, fOpt := range options {
+		if err := fOpt(&opts); err != nil {
+			log.Fatalf("MockServer option apply failure: %s", err)
+		}
+	}
+	return &MockServer{
+		options:   opts,
+		clients:   make(map[*serverClient]bool),
+		listeners: make(map[net.Listener]bool),
+	}
+}
+
+// Serve accepts connections from the given listener and serves each in a goroutine until the listener is closed,
+// or the server is closed. The error from the listener is returned, or nil if the server was closed.
+//
+func (s *MockServer) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listeners[listener] = true
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, listener)
+		s.mutex.Unlock()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves one client on the given connection and returns when the connection has ended.
+// The connection is closed when it ends.
+//
+func (s *MockServer) ServeConn(conn net.Conn) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	s.lastID++
+	c := &serverClient{server: s, conn: conn, id: s.lastID, subs: make(map[string]*serverSub)}
+	s.clients[c] = true
+	s.serving.Add(1)
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.clients, c)
+		s.mutex.Unlock()
+		conn.Close()
+		s.serving.Done()
+	}()
+	c.serve()
+}
+
+// Close closes all listeners and client connections, and waits until all connections have ended
+//
+func (s *MockServer) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mutex.Unlock()
+	s.serving.Wait()
+	return nil
+}
+
+// Publish delivers the given message to the matching subscriptions of all clients, as if it was published by a
+// client (but it is not given to OnPublish)
+//
+func (s *MockServer) Publish(msg *Msg) {
+	s.route(nil, msg)
+}
+
+// route delivers the given message published by the given client (nil if published by Publish) to the matching
+// subscriptions. A message is delivered once to each client subscription outside queue groups, and to one member
+// of each matching queue group.
+//
+func (s *MockServer) route(from *serverClient, msg *Msg) {
+	type delivery struct {
+		client  *serverClient
+		sub     *serverSub
+		sid     string
+		headers bool
+	}
+	var deliveries []delivery
+	groups := make(map[string][]delivery)
+
+	s.mutex.Lock()
+	for c := range s.clients {
+		if c == from && !c.echo {
+			continue
+		}
+		for _, sub := range c.subs {
+			if !SubjectMatches(sub.subject, msg.Subject) {
+				continue
+			}
+			if sub.queue == "" {
+				deliveries = append(deliveries, delivery{client: c, sub: sub})
+			} else {
+				key := sub.subject + " " + sub.queue
+				groups[key] = append(groups[key], delivery{client: c, sub: sub})
+			}
+		}
+	}
+	for _, members := range groups {
+		// The member with the fewest deliveries gets the message - which spreads the messages evenly
+		sort.Slice(members, func(i, j int) bool { return members[i].sub.delivered < members[j].sub.delivered })
+		deliveries = append(deliveries, members[0])
+	}
+	for i, d := range deliveries {
+		deliveries[i].sid = d.sub.sid
+		deliveries[i].headers = d.client.headers
+		d.sub.delivered++
+		if d.sub.max > 0 && d.sub.delivered >= d.sub.max {
+			delete(d.client.subs, d.sub.sid)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, d := range deliveries {
+		var buf bytes.Buffer
+		if d.headers || msg.Header == nil {
+			appendMessage(&buf, "MSG", []string{msg.Subject, d.sid, msg.Reply}, msg)
+		} else {
+			// A client that does not support headers gets the message without them
+			appendMessage(&buf, "MSG", []string{msg.Subject, d.sid, msg.Reply}, &Msg{Data: msg.Data})
+		}
+		d.client.write(buf.Bytes())
+	}
+}
+
+// serverClient is one connection served by a MockServer
+type serverClient struct {
+	server     *MockServer
+	conn       net.Conn
+	id         int
+	writeMutex sync.Mutex
+
+	// set when CONNECT is processed - guarded by the mutex of the server
+	connected bool
+	verbose   bool
+	echo      bool
+	headers   bool
+
+	subs map[string]*serverSub // guarded by the mutex of the server
+}
+
+// serverSub is a subscription of a client
+type serverSub struct {
+	sid       string
+	subject   string
+	queue     string
+	max       int
+	delivered int
+}
+
+// serverInfo is the INFO sent by a MockServer
+type serverInfo struct {
+	ServerID     string `json:"server_id"`
+	ServerName   string `json:"server_name"`
+	Version      string `json:"version"`
+	Proto        int    `json:"proto"`
+	Headers      bool   `json:"headers"`
+	MaxPayload   int    `json:"max_payload"`
+	AuthRequired bool   `json:"auth_required,omitempty"`
+	ClientID     int    `json:"client_id"`
+}
+
+func (c *serverClient) serve() {
+	s := c.server
+	info, _ := json.Marshal(serverInfo{
+		ServerID:     "MEZQUIT-MOCK",
+		ServerName:   "mezquit-mock",
+		Version:      "2.2.0",
+		Proto:        1,
+		Headers:      s.options.Headers,
+		MaxPayload:   s.options.MaxPayload,
+		AuthRequired: s.options.User != "" || s.options.Token != "",
+		ClientID:     c.id,
+	})
+	if err := c.write([]byte("INFO " + string(info) + "\r\n")); err != nil {
+		return
+	}
+	reader := bufio.NewReader(c.conn)
+	for {
+		op, args, err := readOp(reader)
+		if err != nil {
+			log.Debugf("NATS MockServer: client %d connection ended: %s", c.id, err)
+			return
+		}
+		if err := c.process(reader, op, args); err != nil {
+			log.Debugf("NATS MockServer: client %d: %s", c.id, err)
+			c.write([]byte("-ERR '" + err.Error() + "'\r\n"))
+			return
+		}
+		if c.verbose && op != "PING" && op != "PONG" {
+			c.write([]byte("+OK\r\n"))
+		}
+	}
+}
+
+// process performs the given operation - an error is returned (and sent as -ERR) if the connection should be closed
+//
+func (c *serverClient) process(reader *bufio.Reader, op string, args []string) error {
+	s := c.server
+	if !c.connected && op != "CONNECT" {
+		return fmt.Errorf("Authorization Violation")
+	}
+	switch op {
+	case "CONNECT":
+		if len(args) != 1 {
+			return fmt.Errorf("Invalid CONNECT")
+		}
+		var info connectInfo
+		info.Echo = true
+		if err := json.Unmarshal([]byte(args[0]), &info); err != nil {
+			return fmt.Errorf("Invalid CONNECT: %s", err)
+		}
+		if s.options.User != "" && (info.User != s.options.User || info.Pass != s.options.Password) {
+			return fmt.Errorf("Authorization Violation")
+		}
+		if s.options.Token != "" && info.AuthToken != s.options.Token {
+			return fmt.Errorf("Authorization Violation")
+		}
+		s.mutex.Lock()
+		c.connected = true
+		c.verbose = info.Verbose
+		c.echo = info.Echo
+		c.headers = info.Headers && s.options.Headers
+		s.mutex.Unlock()
+
+	case "PUB", "HPUB":
+		if op == "HPUB" && !c.headers {
+			return fmt.Errorf("Unknown Protocol Operation")
+		}
+		args, header, data, err := readMessage(reader, args, op == "HPUB", s.options.MaxPayload)
+		if err != nil {
+			return err
+		}
+		if len(args) != 1 && len(args) != 2 {
+			return fmt.Errorf("Invalid %s arguments", op)
+		}
+		msg := &Msg{Subject: args[0], Header: header, Data: data}
+		if len(args) == 2 {
+			msg.Reply = args[1]
+		}
+		if err := ValidateSubject(msg.Subject); err != nil {
+			return fmt.Errorf("Invalid Publish Subject")
+		}
+		if s.options.OnPublish != nil {
+			s.options.OnPublish(msg)
+		}
+		s.route(c, msg)
+
+	case "SUB":
+		if len(args) != 2 && len(args) != 3 {
+			return fmt.Errorf("Invalid SUB arguments")
+		}
+		if err := ValidateSubjectFilter(args[0]); err != nil {
+			return fmt.Errorf("Invalid Subject")
+		}
+		sub := &serverSub{subject: args[0], sid: args[len(args)-1]}
+		if len(args) == 3 {
+			sub.queue = args[1]
+		}
+		s.mutex.Lock()
+		c.subs[sub.sid] = sub
+		s.mutex.Unlock()
+
+	case "UNSUB":
+		if len(args) != 1 && len(args) != 2 {
+			return fmt.Errorf("Invalid UNSUB arguments")
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		sub := c.subs[args[0]]
+		if sub == nil {
+			return nil
+		}
+		if len(args) == 1 {
+			delete(c.subs, args[0])
+			return nil
+		}
+		max, err := strconv.Atoi(args[1])
+		if err != nil || max <= 0 {
+			return fmt.Errorf("Invalid UNSUB arguments")
+		}
+		sub.max = max
+		if sub.delivered >= max {
+			delete(c.subs, args[0])
+		}
+
+	case "PING":
+		return c.write([]byte("PONG\r\n"))
+
+	case "PONG":
+
+	default:
+		return fmt.Errorf("Unknown Protocol Operation")
+	}
+	return nil
+}
+
+func (c *serverClient) write(data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.conn.Write(data)
+	return err
+}
@@ -0,0 +1,280 @@
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the standard NATS client port
+const DefaultPort = "4222"
+
+// ErrMaxPayload is returned when a message is larger than the maximum payload of the server
+var ErrMaxPayload = errors.New("Maximum Payload Violation")
+
+// headerLine is the first line of the headers of a HPUB or HMSG
+const headerLine = "NATS/1.0"
+
+// Header contains the headers of a NATS message. A header can have several values.
+//
+type Header map[string][]string
+
+// Add adds the given value to the values of the given header key
+func (h Header) Add(key, value string) {
+	h[key] = append(h[key], value)
+}
+
+// Get returns the first value of the given header key, or an empty string if the key has no values
+func (h Header) Get(key string) string {
+	if values := h[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// validateHeader returns an error if the given headers cannot be encoded - a key must not be empty or contain
+// ':' or white space, and a value must not contain CR or LF
+//
+func validateHeader(h Header) error {
+	for key, values := range h {
+		if key == "" || strings.ContainsAny(key, ": \t\r\n") {
+			return fmt.Errorf("Invalid header key '%s'", key)
+		}
+		for _, value := range values {
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("The value of header '%s' cannot contain CR or LF", key)
+			}
+		}
+	}
+	return nil
+}
+
+// encodeHeader returns the given headers in the wire format of HPUB and HMSG - keys in sorted order
+//
+func encodeHeader(h Header) []byte {
+	var data bytes.Buffer
+	data.WriteString(headerLine + "\r\n")
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range h[key] {
+			data.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+	data.WriteString("\r\n")
+	return data.Bytes()
+}
+
+// decodeHeader decodes headers in the wire format of HPUB and HMSG. A status in the first line (for example
+// "NATS/1.0 503") is given as the header "Status", and a description following it as "Description".
+//
+func decodeHeader(data []byte) (Header, error) {
+	text := string(data)
+	if !strings.HasPrefix(text, headerLine) || !strings.HasSuffix(text, "\r\n\r\n") {
+		return nil, fmt.Errorf("Headers must start with '%s' and end with an empty line", headerLine)
+	}
+	lines := strings.Split(strings.TrimSuffix(text, "\r\n\r\n"), "\r\n")
+	h := Header{}
+	if status := strings.TrimSpace(strings.TrimPrefix(lines[0], headerLine)); status != "" {
+		parts := strings.SplitN(status, " ", 2)
+		h.Add("Status", parts[0])
+		if len(parts) == 2 {
+			h.Add("Description", strings.TrimSpace(parts[1]))
+		}
+	}
+	for _, line := range lines[1:] {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid header line '%s'", line)
+		}
+		h.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return h, nil
+}
+
+// Msg is a message published to, or delivered from, a NATS server
+//
+type Msg struct {
+	Subject string
+	Reply   string // the subject to reply to (empty if none)
+	Header  Header // nil if the message has no headers
+	Data    []byte
+}
+
+// ValidateSubject returns an error if the given subject cannot be published to - it must consist of non empty
+// tokens separated by '.', without white space, and without the wildcard tokens '*' and '>'.
+//
+func ValidateSubject(subject string) error {
+	return validateSubject(subject, false)
+}
+
+// ValidateSubjectFilter returns an error if the given subject cannot be subscribed to - like ValidateSubject but
+// a token may be the wildcard '*', and the last token may be the wildcard '>'.
+//
+func ValidateSubjectFilter(subject string) error {
+	return validateSubject(subject, true)
+}
+
+func validateSubject(subject string, wildcards bool) error {
+	if subject == "" {
+		return fmt.Errorf("A subject cannot be empty")
+	}
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("A subject cannot contain white space - got '%s'", subject)
+	}
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return fmt.Errorf("A subject cannot have an empty token - got '%s'", subject)
+		case !wildcards && (token == "*" || token == ">"):
+			return fmt.Errorf("A subject to publish to cannot contain wildcards - got '%s'", subject)
+		case token == ">" && i != len(tokens)-1:
+			return fmt.Errorf("The '>' wildcard must be the last token - got '%s'", subject)
+		}
+	}
+	return nil
+}
+
+// SubjectMatches returns true if the given subject matches the given (valid) subject filter
+//
+func SubjectMatches(filter, subject string) bool {
+	filterTokens := strings.Split(filter, ".")
+	tokens := strings.Split(subject, ".")
+	for i, f := range filterTokens {
+		if f == ">" {
+			return len(tokens) > i
+		}
+		if i >= len(tokens) || (f != "*" && f != tokens[i]) {
+			return false
+		}
+	}
+	return len(filterTokens) == len(tokens)
+}
+
+// readOp reads one protocol line and returns the (upper cased) operation name and its arguments. The arguments of
+// INFO, CONNECT, and -ERR are returned as one argument.
+//
+func readOp(r *bufio.Reader) (string, []string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+	op := strings.ToUpper(parts[0])
+	rest := ""
+	if len(parts) == 2 {
+		rest = strings.TrimSpace(parts[1])
+	}
+	switch op {
+	case "INFO", "CONNECT", "-ERR":
+		if rest == "" {
+			return op, nil, nil
+		}
+		return op, []string{rest}, nil
+	}
+	return op, strings.Fields(rest), nil
+}
+
+// readPayload reads a payload of the given size followed by CRLF
+//
+func readPayload(r *bufio.Reader, size int) ([]byte, error) {
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return nil, fmt.Errorf("Payload of %d bytes is not followed by CRLF", size)
+	}
+	return data[:size], nil
+}
+
+// parseSize parses a byte count argument
+func parseSize(arg string) (int, error) {
+	size, err := strconv.Atoi(arg)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Invalid size '%s'", arg)
+	}
+	return size, nil
+}
+
+// readMessage reads the payload (and headers) of a PUB, HPUB, MSG, or HMSG given its arguments. With headers the
+// last two arguments are the header size and the total size, otherwise the last argument is the payload size.
+// The arguments before the sizes are returned. ErrMaxPayload is returned (without reading the payload) if the total
+// size is larger than the given limit (0 is no limit).
+//
+func readMessage(r *bufio.Reader, args []string, headers bool, limit int) ([]string, Header, []byte, error) {
+	sizes := 1
+	if headers {
+		sizes = 2
+	}
+	if len(args) < sizes {
+		return nil, nil, nil, fmt.Errorf("Missing size argument")
+	}
+	total, err := parseSize(args[len(args)-1])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if limit > 0 && total > limit {
+		return nil, nil, nil, ErrMaxPayload
+	}
+	headerSize := 0
+	if headers {
+		if headerSize, err = parseSize(args[len(args)-2]); err != nil {
+			return nil, nil, nil, err
+		}
+		if headerSize > total {
+			return nil, nil, nil, fmt.Errorf("Header size %d is larger than the total size %d", headerSize, total)
+		}
+	}
+	data, err := readPayload(r, total)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var h Header
+	if headers {
+		if h, err = decodeHeader(data[:headerSize]); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return args[:len(args)-sizes], h, data[headerSize:], nil
+}
+
+// appendMessage appends a PUB/HPUB (op "PUB") or MSG/HMSG (op "MSG") with the given arguments before the sizes
+// to the given buffer, and returns the total size of headers and data. The header form is used if the message has
+// headers.
+//
+func appendMessage(buf *bytes.Buffer, op string, args []string, msg *Msg) int {
+	var header []byte
+	if msg.Header != nil {
+		header = encodeHeader(msg.Header)
+		buf.WriteString("H")
+	}
+	buf.WriteString(op)
+	for _, arg := range args {
+		if arg != "" {
+			buf.WriteString(" " + arg)
+		}
+	}
+	if header != nil {
+		buf.WriteString(" " + strconv.Itoa(len(header)))
+	}
+	size := len(header) + len(msg.Data)
+	buf.WriteString(" " + strconv.Itoa(size) + "\r\n")
+	buf.Write(header)
+	buf.Write(msg.Data)
+	buf.WriteString("\r\n")
+	return size
+}
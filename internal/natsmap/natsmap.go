@@ -0,0 +1,193 @@
+// Package natsmap maps MQTT topics and topic filters to NATS subjects and back.
+//
+// The mapping follows the conventions of the MQTT support in NATS server:
+//
+//     MQTT                 NATS
+//     a/b/c                a.b.c        levels are separated by '.' instead of '/'
+//     /a  a/  a//b         /.a  a./  a./.b     an empty level is '/'
+//     a.b                  a//b         a '.' in a level is '//'
+//     a/+/c                a.*.c        single level wildcard
+//     a/#                  a  and  a.>  multi level wildcard (which also matches the parent level)
+//
+// NATS server refuses MQTT topics with characters that cannot be used in a NATS subject. Here such characters
+// are escaped instead - as '%' followed by two hex digits: space, tab, CR, and LF, as well as '%' itself. A level
+// that is "*" or ">" would be a wildcard in NATS and is escaped as "%2A" or "%3E". (This makes the mapping of a
+// topic containing '%' different from the one in NATS server.)
+//
+// A subject for a topic filter matches the subject of a topic exactly when the filter matches the topic - except
+// for topics starting with '$', which MQTT does not match by a leading wildcard, while NATS does.
+//
+package natsmap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+)
+
+// TopicToSubject returns the NATS subject for the given MQTT topic name. An error is returned if the topic name is
+// not valid.
+//
+func TopicToSubject(topic string) (string, error) {
+	if err := mqtt.ValidateTopicName(topic); err != nil {
+		return "", err
+	}
+	return levelsToSubject(strings.Split(topic, "/"), false), nil
+}
+
+// FilterToSubjects returns the NATS subjects to subscribe to for the given MQTT topic filter. This is one subject,
+// except for a filter ending with "/#" which also matches the parent level - for example "a/#" gives "a" and
+// "a.>". An error is returned if the topic filter is not valid.
+//
+func FilterToSubjects(filter string) ([]string, error) {
+	if err := mqtt.ValidateTopicFilter(filter); err != nil {
+		return nil, err
+	}
+	levels := strings.Split(filter, "/")
+	subject := levelsToSubject(levels, true)
+	if len(levels) > 1 && levels[len(levels)-1] == "#" {
+		return []string{levelsToSubject(levels[:len(levels)-1], true), subject}, nil
+	}
+	return []string{subject}, nil
+}
+
+// SubjectToTopic returns the MQTT topic name for the given NATS subject. An error is returned if the subject
+// contains a wildcard, or is not the mapping of a topic name.
+//
+func SubjectToTopic(subject string) (string, error) {
+	return subjectToLevels(subject, false)
+}
+
+// SubjectToFilter returns the MQTT topic filter for the given NATS subject, where the NATS wildcards '*' and '>'
+// are mapped to '+' and '#'. An error is returned if the subject is not the mapping of a topic filter.
+//
+func SubjectToFilter(subject string) (string, error) {
+	return subjectToLevels(subject, true)
+}
+
+// levelsToSubject returns the NATS subject for the given levels of a valid topic name or (if wildcards is true)
+// topic filter
+//
+func levelsToSubject(levels []string, wildcards bool) string {
+	tokens := make([]string, len(levels))
+	for i, level := range levels {
+		switch {
+		case level == "":
+			tokens[i] = "/"
+		case wildcards && level == "+":
+			tokens[i] = "*"
+		case wildcards && level == "#":
+			tokens[i] = ">"
+		case level == "*" || level == ">":
+			tokens[i] = escape(level[0])
+		default:
+			tokens[i] = levelToToken(level)
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// levelToToken returns the NATS subject token for a topic level that is neither empty nor a wildcard
+//
+func levelToToken(level string) string {
+	var token strings.Builder
+	for i := 0; i < len(level); i++ {
+		switch c := level[i]; c {
+		case '.':
+			token.WriteString("//")
+		case ' ', '\t', '\r', '\n', '%':
+			token.WriteString(escape(c))
+		default:
+			token.WriteByte(c)
+		}
+	}
+	return token.String()
+}
+
+// escaped are the characters that are escaped in a NATS subject token
+const escaped = " \t\r\n%*>"
+
+// escape returns the escaped form of the given character
+func escape(c byte) string {
+	return fmt.Sprintf("%%%02X", c)
+}
+
+// subjectToLevels returns the MQTT topic name or (if wildcards is true) topic filter for the given NATS subject
+//
+func subjectToLevels(subject string, wildcards bool) (string, error) {
+	if subject == "" {
+		return "", fmt.Errorf("A NATS subject cannot be empty")
+	}
+	tokens := strings.Split(subject, ".")
+	levels := make([]string, len(tokens))
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return "", fmt.Errorf("NATS subject '%s' has an empty token", subject)
+		case token == "/":
+			levels[i] = ""
+		case token == "*" || token == ">":
+			if !wildcards {
+				return "", fmt.Errorf("NATS subject '%s' has a wildcard and cannot be mapped to a MQTT topic name", subject)
+			}
+			if token == ">" {
+				if i != len(tokens)-1 {
+					return "", fmt.Errorf("NATS subject '%s' has '>' before the last token", subject)
+				}
+				levels[i] = "#"
+			} else {
+				levels[i] = "+"
+			}
+		default:
+			level, err := tokenToLevel(token)
+			if err != nil {
+				return "", fmt.Errorf("NATS subject '%s': %s", subject, err)
+			}
+			levels[i] = level
+		}
+	}
+	result := strings.Join(levels, "/")
+	validate := mqtt.ValidateTopicName
+	if wildcards {
+		validate = mqtt.ValidateTopicFilter
+	}
+	if err := validate(result); err != nil {
+		return "", fmt.Errorf("NATS subject '%s': %s", subject, err)
+	}
+	return result, nil
+}
+
+// tokenToLevel returns the topic level for a NATS subject token that is neither "/" nor a wildcard
+//
+func tokenToLevel(token string) (string, error) {
+	var level strings.Builder
+	for i := 0; i < len(token); i++ {
+		switch c := token[i]; c {
+		case '/':
+			if i+1 >= len(token) || token[i+1] != '/' {
+				return "", fmt.Errorf("token '%s' has a '/' that is not part of '//'", token)
+			}
+			level.WriteByte('.')
+			i++
+		case '%':
+			if i+2 >= len(token) {
+				return "", fmt.Errorf("token '%s' has an incomplete escape", token)
+			}
+			decoded, err := strconv.ParseUint(token[i+1:i+3], 16, 8)
+			if err != nil || !strings.ContainsRune(escaped, rune(decoded)) {
+				return "", fmt.Errorf("token '%s' has an invalid escape '%s'", token, token[i:i+3])
+			}
+			level.WriteByte(byte(decoded))
+			i += 2
+		case ' ', '\t', '\r', '\n':
+			return "", fmt.Errorf("token '%s' has white space", token)
+		case '+', '#':
+			return "", fmt.Errorf("token '%s' has the MQTT wildcard '%c'", token, c)
+		default:
+			level.WriteByte(c)
+		}
+	}
+	return level.String(), nil
+}
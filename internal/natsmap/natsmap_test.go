@@ -0,0 +1,151 @@
+package natsmap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+func Test_TopicToSubject_follows_the_NATS_server_conventions(t *testing.T) {
+	for topic, subject := range map[string]string{
+		"a/b/c":     "a.b.c",
+		"/a":        "/.a",
+		"a/":        "a./",
+		"a//b":      "a./.b",
+		"/":         "/./",
+		"a.b/c":     "a//b.c",
+		"a b":       "a%20b",
+		"100%":      "100%25",
+		"a/*/>":     "a.%2A.%3E",
+		"a*/b>":     "a*.b>",
+		"$SYS/x":    "$SYS.x",
+		"tab\there": "tab%09here",
+	} {
+		result, err := TopicToSubject(topic)
+		testutils.CheckNotError(err, t)
+		testutils.CheckEqual(subject, result, t)
+	}
+	_, err := TopicToSubject("a/+")
+	testutils.CheckError(err, t)
+	_, err = TopicToSubject("")
+	testutils.CheckError(err, t)
+}
+
+func Test_FilterToSubjects_maps_wildcards(t *testing.T) {
+	for filter, subjects := range map[string]string{
+		"a/+/c": "a.*.c",
+		"+":     "*",
+		"#":     ">",
+		"a/#":   "a a.>",
+		"+/#":   "* *.>",
+		"/#":    "/ /.>",
+		"a.b/#": "a//b a//b.>",
+	} {
+		result, err := FilterToSubjects(filter)
+		testutils.CheckNotError(err, t)
+		testutils.CheckEqual(subjects, strings.Join(result, " "), t)
+	}
+	_, err := FilterToSubjects("a/#/b")
+	testutils.CheckError(err, t)
+}
+
+func Test_SubjectToTopic_refuses_subjects_that_are_not_mapped_topics(t *testing.T) {
+	for _, subject := range []string{
+		"", "a..b", ".a", "a.", "a.*", "a.>", "a/b", "a///b", "a%2", "a%zz", "a%2F", "a%41", "a b", "a+", "a.#",
+	} {
+		_, err := SubjectToTopic(subject)
+		testutils.CheckError(err, t)
+	}
+	for _, subject := range []string{"a.>.b", "a.b#", "a+.b"} {
+		_, err := SubjectToFilter(subject)
+		testutils.CheckError(err, t)
+	}
+	topic, err := SubjectToTopic("a.%2a.%3e")
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual("a/*/>", topic, t)
+}
+
+// testhelperStrings returns all strings of the given length made from the given characters
+func testhelperStrings(chars string, length int) []string {
+	result := []string{""}
+	for i := 0; i < length; i++ {
+		longer := []string{}
+		for _, s := range result {
+			for _, c := range chars {
+				longer = append(longer, s+string(c))
+			}
+		}
+		result = longer
+	}
+	return result
+}
+
+// testhelperNATSMatches returns true if the given NATS subject (with wildcards) matches the given subject
+func testhelperNATSMatches(pattern, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	tokens := strings.Split(subject, ".")
+	for i, p := range patternTokens {
+		if p == ">" {
+			return len(tokens) > i
+		}
+		if i >= len(tokens) || (p != "*" && p != tokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(tokens)
+}
+
+func Test_all_short_topics_round_trip_and_map_to_distinct_valid_subjects(t *testing.T) {
+	subjects := map[string]string{}
+	for length := 1; length <= 5; length++ {
+		for _, topic := range testhelperStrings("a/. %*>\t", length) {
+			subject, err := TopicToSubject(topic)
+			testutils.CheckNotError(err, t)
+			for _, token := range strings.Split(subject, ".") {
+				if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+					t.Fatalf("Topic '%s' gave the invalid subject '%s'", topic, subject)
+				}
+			}
+			if other, ok := subjects[subject]; ok {
+				t.Fatalf("Topics '%s' and '%s' both gave the subject '%s'", other, topic, subject)
+			}
+			subjects[subject] = topic
+
+			result, err := SubjectToTopic(subject)
+			testutils.CheckNotError(err, t)
+			testutils.CheckEqual(topic, result, t)
+		}
+	}
+}
+
+func Test_all_short_filters_round_trip_and_match_like_in_MQTT(t *testing.T) {
+	topics := []string{}
+	for length := 1; length <= 4; length++ {
+		topics = append(topics, testhelperStrings("a/.", length)...)
+	}
+	for length := 1; length <= 4; length++ {
+		for _, filter := range testhelperStrings("a/.+#", length) {
+			if mqtt.ValidateTopicFilter(filter) != nil {
+				continue
+			}
+			subjects, err := FilterToSubjects(filter)
+			testutils.CheckNotError(err, t)
+			result, err := SubjectToFilter(subjects[len(subjects)-1])
+			testutils.CheckNotError(err, t)
+			testutils.CheckEqual(filter, result, t)
+
+			for _, topic := range topics {
+				subject, _ := TopicToSubject(topic)
+				natsMatches := false
+				for _, pattern := range subjects {
+					natsMatches = natsMatches || testhelperNATSMatches(pattern, subject)
+				}
+				if natsMatches != mqtt.TopicMatches(filter, topic) {
+					t.Fatalf("Filter '%s' %v matching topic '%s' (%s) differs from MQTT", filter, subjects, topic, subject)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Package pcap reads packet captures in the classic pcap and the pcapng formats (as written by tcpdump and
+// Wireshark), and reassembles the TCP connections in them.
+//
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// The link types of the captured packets that are supported
+const (
+	LinkTypeNull     = 0   // BSD loopback - a 4 byte address family in host byte order
+	LinkTypeEthernet = 1   // Ethernet
+	LinkTypeRaw      = 101 // raw IPv4 or IPv6
+	LinkTypeLinuxSLL = 113 // Linux "cooked" capture (tcpdump -i any)
+	LinkTypeLinuxSL2 = 276 // Linux "cooked" capture v2
+)
+
+// magic numbers of the formats
+const (
+	pcapMicros    = 0xa1b2c3d4
+	pcapNanos     = 0xa1b23c4d
+	ngSection     = 0x0a0d0d0a
+	ngByteOrder   = 0x1a2b3c4d
+	ngInterface   = 0x00000001
+	ngSimple      = 0x00000003
+	ngEnhanced    = 0x00000006
+	maxBlockSize  = 256 * 1024 * 1024
+	optionEnd     = 0
+	optionTSResol = 9
+)
+
+// Packet is a captured packet
+type Packet struct {
+	Time     time.Time // when the packet was captured
+	LinkType int       // the link type of the interface it was captured on, for example LinkTypeEthernet
+	Data     []byte    // the captured bytes (fewer than were sent if the capture has a snap length)
+	Length   int       // the number of bytes that were sent
+}
+
+// Reader reads the packets of a pcap or pcapng capture
+type Reader struct {
+	reader     *bufio.Reader
+	ng         bool
+	order      binary.ByteOrder
+	linkType   int               // the link type of a pcap capture
+	nanos      bool              // true if the timestamps of a pcap capture are in nanoseconds
+	interfaces []pcapngInterface // the interfaces of the current section of a pcapng capture
+}
+
+// pcapngInterface is an interface of a pcapng capture
+type pcapngInterface struct {
+	linkType   int
+	resolution byte // if_tsresol - the high bit tells if the low bits are a power of 2 (else a power of 10)
+}
+
+// IsCapture returns true if the given data starts like a pcap or pcapng capture
+func IsCapture(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(data) {
+		case pcapMicros, pcapNanos, ngSection:
+			return true
+		}
+	}
+	return false
+}
+
+// NewReader returns a Reader of the pcap or pcapng capture read from the given reader
+func NewReader(reader io.Reader) (*Reader, error) {
+	r := &Reader{reader: bufio.NewReader(reader)}
+	magic, err := r.reader.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("not a pcap or pcapng capture - it is too short")
+	}
+	if binary.LittleEndian.Uint32(magic) == ngSection {
+		r.ng = true
+		return r, nil
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(magic) {
+		case pcapMicros, pcapNanos:
+			r.order = order
+		}
+	}
+	if r.order == nil {
+		return nil, fmt.Errorf("not a pcap or pcapng capture")
+	}
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return nil, fmt.Errorf("the pcap header is truncated")
+	}
+	r.nanos = r.order.Uint32(header) == pcapNanos
+	r.linkType = int(r.order.Uint32(header[20:]) & 0xFFFF)
+	return r, nil
+}
+
+// Next returns the next packet of the capture. The error is io.EOF when there are no more packets.
+func (r *Reader) Next() (*Packet, error) {
+	if r.ng {
+		return r.nextBlock()
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("a pcap record header is truncated")
+		}
+		return nil, err
+	}
+	seconds := int64(r.order.Uint32(header))
+	fraction := int64(r.order.Uint32(header[4:]))
+	if !r.nanos {
+		fraction *= 1000
+	}
+	captured := r.order.Uint32(header[8:])
+	if captured > maxBlockSize {
+		return nil, fmt.Errorf("a pcap record has the unreasonable length %d", captured)
+	}
+	p := &Packet{Time: time.Unix(seconds, fraction).UTC(), LinkType: r.linkType, Data: make([]byte, captured),
+		Length: int(r.order.Uint32(header[12:]))}
+	if _, err := io.ReadFull(r.reader, p.Data); err != nil {
+		return nil, fmt.Errorf("a pcap record is truncated")
+	}
+	return p, nil
+}
+
+// nextBlock returns the packet of the next packet block of a pcapng capture
+func (r *Reader) nextBlock() (*Packet, error) {
+	for {
+		blockType, body, err := r.readBlock()
+		if err != nil {
+			return nil, err
+		}
+		switch blockType {
+		case ngInterface:
+			if len(body) < 8 {
+				return nil, fmt.Errorf("a pcapng interface block is truncated")
+			}
+			iface := pcapngInterface{linkType: int(r.order.Uint16(body)), resolution: 6}
+			r.forOptions(body[8:], func(code int, value []byte) {
+				if code == optionTSResol && len(value) > 0 {
+					iface.resolution = value[0]
+				}
+			})
+			r.interfaces = append(r.interfaces, iface)
+
+		case ngEnhanced:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("a pcapng packet block is truncated")
+			}
+			id := int(r.order.Uint32(body))
+			if id >= len(r.interfaces) {
+				return nil, fmt.Errorf("a pcapng packet block refers to the undefined interface %d", id)
+			}
+			captured := int(r.order.Uint32(body[12:]))
+			if 20+captured > len(body) {
+				return nil, fmt.Errorf("a pcapng packet block is truncated")
+			}
+			timestamp := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+			return &Packet{
+				Time:     r.interfaces[id].time(timestamp),
+				LinkType: r.interfaces[id].linkType,
+				Data:     body[20 : 20+captured],
+				Length:   int(r.order.Uint32(body[16:])),
+			}, nil
+
+		case ngSimple:
+			// a simple packet block has no time and no captured length - the snap length limits it to the block
+			if len(r.interfaces) == 0 {
+				return nil, fmt.Errorf("a pcapng simple packet block comes before the interface block")
+			}
+			if len(body) < 4 {
+				return nil, fmt.Errorf("a pcapng simple packet block is truncated")
+			}
+			length := int(r.order.Uint32(body))
+			data := body[4:]
+			if length < len(data) {
+				data = data[:length]
+			}
+			return &Packet{LinkType: r.interfaces[0].linkType, Data: data, Length: length}, nil
+		}
+	}
+}
+
+// readBlock reads a pcapng block and returns its type and body. A section header block is handled (it sets the byte
+// order, and starts a new set of interfaces) and its body is not returned.
+//
+func (r *Reader) readBlock() (int, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, fmt.Errorf("a pcapng block header is truncated")
+		}
+		return 0, nil, err
+	}
+	if binary.LittleEndian.Uint32(header) == ngSection {
+		magic := make([]byte, 4)
+		if _, err := io.ReadFull(r.reader, magic); err != nil {
+			return 0, nil, fmt.Errorf("a pcapng section header block is truncated")
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == ngByteOrder:
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == ngByteOrder:
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("a pcapng section header block has an unknown byte order magic")
+		}
+		r.interfaces = nil
+		_, err := r.readBody(r.order.Uint32(header[4:]), 4)
+		return ngSection, nil, err
+	}
+	if r.order == nil {
+		return 0, nil, fmt.Errorf("a pcapng capture must start with a section header block")
+	}
+	body, err := r.readBody(r.order.Uint32(header[4:]), 0)
+	return int(r.order.Uint32(header)), body, err
+}
+
+// readBody reads the rest of a block of the given total length, where the given number of bytes of the body have
+// been read, and returns the unread part of the body
+//
+func (r *Reader) readBody(length uint32, read int) ([]byte, error) {
+	if length%4 != 0 || length < uint32(12+read) || length > maxBlockSize {
+		return nil, fmt.Errorf("a pcapng block has the invalid length %d", length)
+	}
+	rest := make([]byte, int(length)-8-read)
+	if _, err := io.ReadFull(r.reader, rest); err != nil {
+		return nil, fmt.Errorf("a pcapng block is truncated")
+	}
+	if r.order.Uint32(rest[len(rest)-4:]) != length {
+		return nil, fmt.Errorf("a pcapng block has different lengths at its start and end")
+	}
+	return rest[:len(rest)-4], nil
+}
+
+// forOptions calls the given function with the code and value of each of the given pcapng options
+func (r *Reader) forOptions(options []byte, f func(code int, value []byte)) {
+	for len(options) >= 4 {
+		code := int(r.order.Uint16(options))
+		length := int(r.order.Uint16(options[2:]))
+		if code == optionEnd || 4+length > len(options) {
+			return
+		}
+		f(code, options[4:4+length])
+		options = options[4+(length+3)/4*4:]
+	}
+}
+
+// time returns the time of the given timestamp of a packet captured on the interface
+func (i pcapngInterface) time(timestamp uint64) time.Time {
+	exponent := uint(i.resolution & 0x7F)
+	if i.resolution&0x80 != 0 {
+		seconds := timestamp >> exponent
+		fraction := float64(timestamp&(1<<exponent-1)) / float64(uint64(1)<<exponent)
+		return time.Unix(int64(seconds), int64(fraction*1e9)).UTC()
+	}
+	if exponent > 9 {
+		return time.Unix(0, int64(timestamp/uint64(math.Pow10(int(exponent)-9)))).UTC()
+	}
+	unit := uint64(math.Pow10(int(exponent)))
+	return time.Unix(int64(timestamp/unit), int64(timestamp%unit)*int64(math.Pow10(9-int(exponent)))).UTC()
+}
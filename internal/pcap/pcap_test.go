@@ -0,0 +1,159 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+// testhelperStart is the time of the first packet of the test captures
+var testhelperStart = time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+
+// testhelperFrame is a TCP segment between 10.0.0.2:50000 (the client) and 10.0.0.1:1883
+type testhelperFrame struct {
+	fromClient bool
+	seq        uint32
+	flags      byte
+	payload    string
+}
+
+// testhelperEthernet returns the frame as an Ethernet frame with an IPv4 packet padded to 60 bytes
+func testhelperEthernet(f testhelperFrame) []byte {
+	client, server := []byte{10, 0, 0, 2}, []byte{10, 0, 0, 1}
+	src, dst, srcPort, dstPort := client, server, 50000, 1883
+	if !f.fromClient {
+		src, dst, srcPort, dstPort = server, client, 1883, 50000
+	}
+	var b bytes.Buffer
+	b.Write(make([]byte, 12))
+	b.Write([]byte{0x08, 0x00})
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(40+len(f.payload)))
+	ip[9] = 6
+	copy(ip[12:], src)
+	copy(ip[16:], dst)
+	b.Write(ip)
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp, uint16(srcPort))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint32(tcp[4:], f.seq)
+	tcp[12] = 5 << 4
+	tcp[13] = f.flags
+	b.Write(tcp)
+	b.WriteString(f.payload)
+	for b.Len() < 60 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// testhelperPcap returns a classic pcap capture (little endian, microseconds) of the frames, one millisecond apart
+func testhelperPcap(frames []testhelperFrame) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{pcapMicros, 0x00040002, 0, 0, 65535, LinkTypeEthernet})
+	for i, f := range frames {
+		data := testhelperEthernet(f)
+		at := testhelperStart.Add(time.Duration(i) * time.Millisecond)
+		binary.Write(&b, binary.LittleEndian,
+			[]uint32{uint32(at.Unix()), uint32(at.Nanosecond() / 1000), uint32(len(data)), uint32(len(data))})
+		b.Write(data)
+	}
+	return b.Bytes()
+}
+
+// testhelperPcapng returns a big endian pcapng capture with nanosecond timestamps of the frames, one millisecond
+// apart
+//
+func testhelperPcapng(frames []testhelperFrame) []byte {
+	var b bytes.Buffer
+	block := func(blockType uint32, body []byte) {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		binary.Write(&b, binary.BigEndian, []uint32{blockType, uint32(12 + len(body))})
+		b.Write(body)
+		binary.Write(&b, binary.BigEndian, uint32(12+len(body)))
+	}
+	block(ngSection, []byte{0x1a, 0x2b, 0x3c, 0x4d, 0, 1, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	block(ngInterface, []byte{0, LinkTypeEthernet, 0, 0, 0, 0, 0xff, 0xff, 0, optionTSResol, 0, 1, 9, 0, 0, 0, 0, 0, 0, 0})
+	for i, f := range frames {
+		data := testhelperEthernet(f)
+		at := uint64(testhelperStart.Add(time.Duration(i) * time.Millisecond).UnixNano())
+		var body bytes.Buffer
+		binary.Write(&body, binary.BigEndian, []uint32{0, uint32(at >> 32), uint32(at), uint32(len(data)), uint32(len(data))})
+		body.Write(data)
+		block(ngEnhanced, body.Bytes())
+	}
+	return b.Bytes()
+}
+
+func Test_Reader_reads_pcap_and_pcapng(t *testing.T) {
+	frames := []testhelperFrame{{true, 100, 0x02, ""}, {true, 101, 0x18, "abc"}}
+	for _, data := range [][]byte{testhelperPcap(frames), testhelperPcapng(frames)} {
+		testutils.CheckTrue(IsCapture(data), t)
+		r, err := NewReader(bytes.NewReader(data))
+		testutils.CheckNotError(err, t)
+		p, err := r.Next()
+		testutils.CheckNotError(err, t)
+		testutils.CheckEqual(testhelperStart, p.Time, t)
+		testutils.CheckEqual(LinkTypeEthernet, p.LinkType, t)
+		testutils.CheckEqual(60, len(p.Data), t)
+		p, err = r.Next()
+		testutils.CheckNotError(err, t)
+		testutils.CheckEqual(testhelperStart.Add(time.Millisecond), p.Time, t)
+		_, err = r.Next()
+		testutils.CheckEqual("EOF", err.Error(), t)
+	}
+	testutils.CheckFalse(IsCapture([]byte{0x10, 0x0c, 0x00, 0x04}), t)
+	_, err := NewReader(bytes.NewReader([]byte("not a capture")))
+	testutils.CheckError(err, t)
+}
+
+func Test_ReadConnections_reassembles_the_data_of_each_direction(t *testing.T) {
+	frames := []testhelperFrame{
+		{true, 1000, 0x02, ""},  // SYN
+		{false, 5000, 0x12, ""}, // SYN ACK
+		{true, 1001, 0x18, "hel"},
+		{true, 1007, 0x18, "wor"}, // out of order
+		{true, 1004, 0x18, "lo "},
+		{true, 1004, 0x18, "lo "}, // retransmitted
+		{false, 5001, 0x18, "ok"},
+		{true, 1010, 0x18, "ld"},
+		{true, 1020, 0x18, "after gap"}, // 8 bytes were not captured
+		{true, 1029, 0x11, ""},          // FIN
+		{true, 7000, 0x02, ""},          // a new connection from the same port
+		{true, 7001, 0x18, "again"},
+	}
+	connections, err := ReadConnections(bytes.NewReader(testhelperPcap(frames)), 1883)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(2, len(connections), t)
+	c := connections[0]
+	testutils.CheckEqual("10.0.0.2:50000", c.Client, t)
+	testutils.CheckEqual("10.0.0.1:1883", c.Server, t)
+	testutils.CheckEqual(testhelperStart, c.Started, t)
+
+	var client, server string
+	for _, d := range c.Data {
+		if d.FromClient {
+			client += string(d.Bytes)
+		} else {
+			server += string(d.Bytes)
+		}
+	}
+	testutils.CheckEqual("hello worldafter gap", client, t)
+	testutils.CheckEqual("ok", server, t)
+	last := c.Data[len(c.Data)-1]
+	testutils.CheckEqual(8, last.Missing, t)
+	testutils.CheckEqual(testhelperStart.Add(8*time.Millisecond), last.At, t)
+
+	testutils.CheckEqual(testhelperStart.Add(10*time.Millisecond), connections[1].Started, t)
+	testutils.CheckEqual("again", string(connections[1].Data[0].Bytes), t)
+
+	none, err := ReadConnections(bytes.NewReader(testhelperPcap(frames)), 8883)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(0, len(none), t)
+}
@@ -0,0 +1,350 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxPending is the number of out of order segments of a direction held while waiting for a missing segment - the
+// missing bytes are taken to not have been captured when there are more
+//
+const maxPending = 64
+
+// Connection is a TCP connection in a capture
+type Connection struct {
+	Client  string    // the host:port of the client
+	Server  string    // the host:port of the server
+	Started time.Time // the time of the first captured packet of the connection
+	Data    []Data    // the data of the connection in the order it was captured
+}
+
+// Data is data sent on a TCP connection, in the order of the stream of its direction
+type Data struct {
+	At         time.Time // when the packet with the data was captured
+	FromClient bool      // true if the client sent the data (false if the server did)
+	Missing    int       // the number of bytes before this data that were not captured
+	Bytes      []byte    // the data
+}
+
+// ReadConnectionsFile returns the TCP connections to the given server port in the pcap or pcapng capture file
+func ReadConnectionsFile(fileName string, port int) ([]*Connection, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadConnections(f, port)
+}
+
+// ReadConnections returns the TCP connections to the given server port in the pcap or pcapng capture read from the
+// given reader, in the order they were first seen. The data of each direction is reassembled - retransmitted data
+// is dropped, and out of order data is put in order. Fragmented IP packets are not supported.
+//
+func ReadConnections(reader io.Reader, port int) ([]*Connection, error) {
+	r, err := NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	a := &assembler{port: port, open: make(map[string]*assembly)}
+	for count := 1; ; count++ {
+		p, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("packet %d: %s", count, err)
+		}
+		if s := parseSegment(p); s != nil {
+			a.add(p.Time, s)
+		}
+	}
+	var connections []*Connection
+	for _, c := range a.all {
+		c.flush(true)
+		c.flush(false)
+		connections = append(connections, c.Connection)
+	}
+	return connections, nil
+}
+
+// segment is a TCP segment
+type segment struct {
+	src, dst         net.IP
+	srcPort, dstPort int
+	seq              uint32
+	syn, ack         bool
+	fin, rst         bool
+	payload          []byte
+	missing          int // the number of bytes of the payload that were not captured
+}
+
+// parseSegment returns the TCP segment in the given packet (nil if it is not TCP over IP)
+func parseSegment(p *Packet) *segment {
+	data := p.Data
+	etherType := 0
+	switch p.LinkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType = int(binary.BigEndian.Uint16(data[12:]))
+		data = data[14:]
+		for etherType == 0x8100 || etherType == 0x88a8 { // VLAN tags
+			if len(data) < 4 {
+				return nil
+			}
+			etherType = int(binary.BigEndian.Uint16(data[2:]))
+			data = data[4:]
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		etherType = int(binary.BigEndian.Uint16(data[14:]))
+		data = data[16:]
+	case LinkTypeLinuxSL2:
+		if len(data) < 20 {
+			return nil
+		}
+		etherType = int(binary.BigEndian.Uint16(data))
+		data = data[20:]
+	case LinkTypeNull, LinkTypeRaw:
+		if p.LinkType == LinkTypeNull {
+			if len(data) < 4 {
+				return nil
+			}
+			data = data[4:]
+		}
+		if len(data) > 0 {
+			etherType = map[byte]int{4: 0x0800, 6: 0x86dd}[data[0]>>4]
+		}
+	}
+
+	s := &segment{}
+	var ipLength int // the length of the IP payload
+	switch etherType {
+	case 0x0800:
+		if len(data) < 20 || data[0]>>4 != 4 {
+			return nil
+		}
+		headerLength := int(data[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		fragment := binary.BigEndian.Uint16(data[6:])
+		if data[9] != 6 || fragment&0x3FFF != 0 || headerLength < 20 || len(data) < headerLength {
+			return nil // not TCP, or a fragment
+		}
+		s.src, s.dst = net.IP(data[12:16]), net.IP(data[16:20])
+		ipLength = total - headerLength
+		data = data[headerLength:]
+	case 0x86dd:
+		if len(data) < 40 {
+			return nil
+		}
+		ipLength = int(binary.BigEndian.Uint16(data[4:]))
+		next := data[6]
+		s.src, s.dst = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40:]
+		for next == 0 || next == 43 || next == 60 { // hop-by-hop, routing, and destination options
+			if len(data) < 8 {
+				return nil
+			}
+			length := 8 + int(data[1])*8
+			if len(data) < length {
+				return nil
+			}
+			next = data[0]
+			data = data[length:]
+			ipLength -= length
+		}
+		if next != 6 {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if len(data) < 20 {
+		return nil
+	}
+	headerLength := int(data[12]>>4) * 4
+	if headerLength < 20 || len(data) < headerLength || ipLength < headerLength {
+		return nil
+	}
+	s.srcPort = int(binary.BigEndian.Uint16(data))
+	s.dstPort = int(binary.BigEndian.Uint16(data[2:]))
+	s.seq = binary.BigEndian.Uint32(data[4:])
+	flags := data[13]
+	s.fin, s.syn, s.rst, s.ack = flags&0x01 != 0, flags&0x02 != 0, flags&0x04 != 0, flags&0x10 != 0
+	payloadLength := ipLength - headerLength
+	s.payload = data[headerLength:]
+	if len(s.payload) > payloadLength {
+		s.payload = s.payload[:payloadLength] // Ethernet padding
+	} else {
+		s.missing = payloadLength - len(s.payload) // cut by the snap length
+	}
+	return s
+}
+
+// assembler reassembles the connections to a port
+type assembler struct {
+	port int
+	open map[string]*assembly // the open connection between a client and server
+	all  []*assembly          // all connections in the order they were first seen
+}
+
+// assembly reassembles a connection
+type assembly struct {
+	*Connection
+	directions [2]direction // from the client, and from the server
+	closed     bool         // true when a FIN or RST has been seen
+}
+
+// direction is the state of the reassembly of a direction of a connection
+type direction struct {
+	started bool
+	next    uint32 // the sequence number of the next byte
+	missing int    // bytes not captured before the next data
+	pending map[uint32]pendingData
+}
+
+// pendingData is out of order data of a direction
+type pendingData struct {
+	at      time.Time
+	payload []byte
+	missing int
+}
+
+func (a *assembler) add(at time.Time, s *segment) {
+	var client, server string
+	fromClient := s.dstPort == a.port
+	switch {
+	case fromClient:
+		client, server = hostPort(s.src, s.srcPort), hostPort(s.dst, s.dstPort)
+	case s.srcPort == a.port:
+		client, server = hostPort(s.dst, s.dstPort), hostPort(s.src, s.srcPort)
+	default:
+		return
+	}
+	key := client + " " + server
+	c := a.open[key]
+	if c == nil || c.closed && fromClient && s.syn && !s.ack {
+		c = &assembly{Connection: &Connection{Client: client, Server: server, Started: at}}
+		a.open[key] = c
+		a.all = append(a.all, c)
+	}
+	c.add(at, fromClient, s)
+	if s.fin || s.rst {
+		c.closed = true
+	}
+}
+
+// add adds the data of the segment sent in the given direction to the connection
+func (c *assembly) add(at time.Time, fromClient bool, s *segment) {
+	d := &c.directions[index(fromClient)]
+	if s.syn {
+		d.started = true
+		d.next = s.seq + 1
+		return
+	}
+	if len(s.payload) == 0 && s.missing == 0 {
+		if s.fin || s.rst {
+			c.flush(fromClient)
+		}
+		return
+	}
+	if !d.started {
+		d.started = true
+		d.next = s.seq
+	}
+	if int32(s.seq-d.next) > 0 {
+		if d.pending == nil {
+			d.pending = make(map[uint32]pendingData)
+		}
+		if p, ok := d.pending[s.seq]; !ok || len(p.payload) < len(s.payload) {
+			d.pending[s.seq] = pendingData{at: at, payload: s.payload, missing: s.missing}
+		}
+		if len(d.pending) > maxPending {
+			c.flush(fromClient)
+		}
+		return
+	}
+	c.emit(at, fromClient, s.seq, s.payload, s.missing)
+	c.drain(fromClient)
+	if s.fin || s.rst {
+		c.flush(fromClient)
+	}
+}
+
+// emit adds the data at the given sequence number to the connection - the part that was already added is dropped
+func (c *assembly) emit(at time.Time, fromClient bool, seq uint32, payload []byte, missing int) {
+	d := &c.directions[index(fromClient)]
+	behind := int(int32(d.next - seq))
+	if behind >= len(payload)+missing {
+		return // retransmitted
+	}
+	if behind > 0 {
+		if behind >= len(payload) {
+			missing -= behind - len(payload)
+			payload = nil
+		} else {
+			payload = payload[behind:]
+		}
+	}
+	if len(payload) > 0 {
+		c.Data = append(c.Data, Data{At: at, FromClient: fromClient, Missing: d.missing, Bytes: payload})
+		d.missing = 0
+	}
+	d.missing += missing
+	d.next += uint32(len(payload) + missing)
+}
+
+// drain adds the pending data of the direction that is no longer out of order
+func (c *assembly) drain(fromClient bool) {
+	d := &c.directions[index(fromClient)]
+	for {
+		found := false
+		for seq, p := range d.pending {
+			if int32(seq-d.next) <= 0 {
+				delete(d.pending, seq)
+				c.emit(p.at, fromClient, seq, p.payload, p.missing)
+				found = true
+			}
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+// flush adds all pending data of the direction - the bytes missing before each are taken to not have been captured
+func (c *assembly) flush(fromClient bool) {
+	d := &c.directions[index(fromClient)]
+	c.drain(fromClient)
+	for len(d.pending) > 0 {
+		var seqs []uint32
+		for seq := range d.pending {
+			seqs = append(seqs, seq)
+		}
+		sort.Slice(seqs, func(i, j int) bool { return int32(seqs[i]-d.next) < int32(seqs[j]-d.next) })
+		d.missing += int(int32(seqs[0] - d.next))
+		d.next = seqs[0]
+		c.drain(fromClient)
+	}
+}
+
+func index(fromClient bool) int {
+	if fromClient {
+		return 0
+	}
+	return 1
+}
+
+func hostPort(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
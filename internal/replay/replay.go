@@ -0,0 +1,261 @@
+// Package replay replays captured MQTT sessions - as a broker answering a client the way the broker in the capture
+// did, or as a client publishing what the client in the capture published.
+//
+package replay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Broker answers the packets of a client with the packets the broker in a capture of a client answered with. The
+// client is expected to send packets of the same types in the same order as the client in the capture. The packet
+// IDs in the answers are changed to the IDs the client uses, if they differ from those in the capture.
+//
+type Broker struct {
+	records []mqtt.CaptureRecord
+	speed   float64
+
+	mutex sync.Mutex  // guards the below
+	next  int         // the index of the next record
+	ids   map[int]int // packet ID in the capture -> packet ID used by the client
+	err   error       // the first error returned by Answer from the Responder
+}
+
+// Answer is a packet to answer with, and when to answer it
+//
+type Answer struct {
+	After  time.Duration // the time after the packet of the client
+	Packet *mqtt.GenericMessage
+}
+
+// NewBroker returns a Broker answering like the broker in the given capture of a client. The time between a packet
+// of the client and an answer is the time in the capture divided by the given speed - or no time if speed is 0.
+//
+func NewBroker(capture *mqtt.Capture, speed float64) *Broker {
+	if speed < 0 {
+		panic("The speed of a replay cannot be negative")
+	}
+	return &Broker{records: capture.Records, speed: speed, ids: make(map[int]int)}
+}
+
+// Answer returns the packets the broker in the capture answered the packet corresponding to the given one with. An
+// error is returned if the capture has no more packets from the client, or if the packet of the client in the
+// capture is of another type.
+//
+func (b *Broker) Answer(packet *mqtt.GenericMessage) ([]Answer, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.next < len(b.records) && !b.records[b.next].Sent {
+		b.next++ // received before anything was sent - nothing to answer
+	}
+	if b.next == len(b.records) {
+		return nil, fmt.Errorf("The client sent %s after the end of the capture", packet)
+	}
+	sent := b.records[b.next]
+	b.next++
+	recorded, err := sent.Message()
+	if err != nil {
+		return nil, fmt.Errorf("The packet sent at %s in the capture is not valid: %s", sent.At, err)
+	}
+	if recorded.Type() != packet.Type() {
+		return nil, fmt.Errorf("The client sent %s where the capture has %s (at %s)", packet, recorded, sent.At)
+	}
+	if id, ok := clientPacketID(recorded); ok {
+		actual, _ := clientPacketID(packet)
+		b.ids[id] = actual
+	}
+
+	var answers []Answer
+	for ; b.next < len(b.records) && !b.records[b.next].Sent; b.next++ {
+		received := b.records[b.next]
+		answer, err := received.Message()
+		if err != nil {
+			return nil, fmt.Errorf("The packet received at %s in the capture is not valid: %s", received.At, err)
+		}
+		var after time.Duration
+		if b.speed > 0 {
+			after = time.Duration(float64(received.At-sent.At) / b.speed)
+		}
+		answers = append(answers, Answer{After: after, Packet: b.withClientID(answer)})
+	}
+	return answers, nil
+}
+
+// Done returns true if the client has sent all packets of the capture
+func (b *Broker) Done() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i := b.next; i < len(b.records); i++ {
+		if b.records[i].Sent {
+			return false
+		}
+	}
+	return true
+}
+
+// Err returns the first error returned by Answer from the Responder (nil if there was none)
+func (b *Broker) Err() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.err
+}
+
+// Responder returns a MockResponder answering like the broker in the capture. All answers to a packet are given
+// after the time of the first. The connection is closed if a packet is not as expected - the error is then
+// available from Err().
+//
+func (b *Broker) Responder() mqtt.MockResponder {
+	return func(packet *mqtt.GenericMessage) *mqtt.MockResponse {
+		answers, err := b.Answer(packet)
+		if err != nil {
+			b.mutex.Lock()
+			if b.err == nil {
+				b.err = err
+			}
+			b.mutex.Unlock()
+			return &mqtt.MockResponse{Close: true}
+		}
+		response := &mqtt.MockResponse{}
+		for i, answer := range answers {
+			if i == 0 {
+				response.Delay = answer.After
+			}
+			response.Packets = append(response.Packets, answer.Packet)
+		}
+		return response
+	}
+}
+
+// Serve answers the packets read from the given connection until the connection ends, or a packet is not as
+// expected. The error returned for such a packet is returned (nil if the connection ended).
+//
+func (b *Broker) Serve(conn net.Conn) error {
+	defer conn.Close()
+	for {
+		packet, err := mqtt.ReadMessage(conn)
+		if err != nil {
+			log.Debugf("Replay: connection ended: %s", err)
+			return nil
+		}
+		received := time.Now()
+		answers, err := b.Answer(packet)
+		if err != nil {
+			return err
+		}
+		for _, answer := range answers {
+			time.Sleep(time.Until(received.Add(answer.After)))
+			if _, err := answer.Packet.WriteTo(conn); err != nil {
+				log.Debugf("Replay: cannot write %s: %s", answer.Packet, err)
+				return nil
+			}
+		}
+	}
+}
+
+// withClientID returns the given acknowledgement from the broker with the packet ID of the client instead of the
+// one in the capture
+//
+func (b *Broker) withClientID(packet *mqtt.GenericMessage) *mqtt.GenericMessage {
+	switch packet.Type() {
+	case mqtt.PublishAckType, mqtt.PublishReceivedType, mqtt.PublishCompleteType, mqtt.SubAckType, mqtt.UnsubAckType:
+	default:
+		return packet
+	}
+	body := packet.Body()
+	if len(body) < 2 {
+		return packet
+	}
+	actual, ok := b.ids[int(body[0])<<8|int(body[1])]
+	if !ok {
+		return packet
+	}
+	replaced := append([]byte{byte(actual >> 8), byte(actual)}, body[2:]...)
+	return mqtt.NewGenericMessage(packet.Type(), packet.Flags(), replaced)
+}
+
+// clientPacketID returns the packet ID of a PUBLISH (with QoS > 0), PUBREL, SUBSCRIBE, or UNSUBSCRIBE
+func clientPacketID(packet *mqtt.GenericMessage) (int, bool) {
+	switch packet.Type() {
+	case mqtt.PublishType:
+		pr, err := mqtt.DecodePublish(packet)
+		if err != nil || pr.Options().QoS == 0 {
+			return 0, false
+		}
+		return pr.Options().PacketID, true
+	case mqtt.PublishReleaseType, mqtt.SubscribeType, mqtt.UnsubscribeType:
+		body := packet.Body()
+		if len(body) < 2 {
+			return 0, false
+		}
+		return int(body[0])<<8 | int(body[1]), true
+	}
+	return 0, false
+}
+
+// Publish publishes the PUBLISH packets the client in the given capture sent (except duplicates) with the given
+// session. The time between the publishes is the time in the capture divided by the given speed - or no time if
+// speed is 0. The number of published messages is returned.
+//
+func Publish(ctx context.Context, session *mqtt.Session, capture *mqtt.Capture, speed float64) (int, error) {
+	if speed < 0 {
+		panic("The speed of a replay cannot be negative")
+	}
+	started := time.Now()
+	var first time.Duration
+	count := 0
+	for _, r := range capture.Records {
+		if !r.Sent {
+			continue
+		}
+		packet, err := r.Message()
+		if err != nil || packet.Type() != mqtt.PublishType {
+			continue
+		}
+		pr, err := mqtt.DecodePublish(packet)
+		if err != nil {
+			return count, fmt.Errorf("The PUBLISH sent at %s in the capture is not valid: %s", r.At, err)
+		}
+		o := pr.Options()
+		if o.IsDuplicate {
+			continue
+		}
+		if count == 0 {
+			first = r.At
+		}
+		if speed > 0 {
+			select {
+			case <-time.After(time.Until(started.Add(time.Duration(float64(r.At-first) / speed)))):
+			case <-ctx.Done():
+				return count, ctx.Err()
+			}
+		}
+		err = session.Publish(mqtt.Topic(o.Topic), mqtt.Message(o.Message), mqtt.QoS(o.QoS), mqtt.Retain(o.Retain))
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Connect returns the first CONNECT the client in the given capture sent (nil if there is none)
+func Connect(capture *mqtt.Capture) *mqtt.ConnectRequest {
+	for _, r := range capture.Records {
+		if !r.Sent {
+			continue
+		}
+		if packet, err := r.Message(); err == nil && packet.Type() == mqtt.ConnectType {
+			if cr, err := mqtt.DecodeConnect(packet); err == nil {
+				return cr
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/broker"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+// testhelperRecord returns a capture of a client connecting to a broker, publishing, subscribing, and
+// disconnecting
+//
+func testhelperRecord(t *testing.T) *mqtt.Capture {
+	t.Helper()
+	b := broker.NewBroker()
+	defer b.Close()
+	var captured bytes.Buffer
+	mock := mqtt.NewMockConnection()
+	go b.ServeConn(mock.RemoteConn())
+	conn := mqtt.NewRecordingConnection(mock, mqtt.NewCaptureWriter(&captured))
+
+	session := mqtt.NewSession(mqtt.ClientID("recorded"), mqtt.Connection(conn))
+	testutils.CheckNotError(session.Connect(mqtt.KeepAliveSeconds(0)), t)
+	testhelperSession(session, t)
+	conn.Close()
+
+	capture, err := mqtt.ReadCapture(&captured)
+	testutils.CheckNotError(err, t)
+	return capture
+}
+
+// testhelperSession publishes with QoS 1 and 2, subscribes, and disconnects
+func testhelperSession(session *mqtt.Session, t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	testutils.CheckNotError(session.PublishContext(ctx, mqtt.Topic("a"), mqtt.Message([]byte("one")), mqtt.QoS(1)), t)
+	testutils.CheckNotError(session.PublishContext(ctx, mqtt.Topic("a"), mqtt.Message([]byte("two")), mqtt.QoS(2)), t)
+	granted, err := session.SubscribeContext(ctx, mqtt.TopicFilter("b/#", 1))
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual([]int{1}, granted, t)
+	testutils.CheckNotError(session.DisconnectContext(ctx), t)
+}
+
+func Test_Broker_answers_a_client_like_the_captured_broker(t *testing.T) {
+	capture := testhelperRecord(t)
+	// CONNECT, CONNACK, PUBLISH, PUBACK, PUBLISH, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, SUBACK, DISCONNECT
+	testutils.CheckEqual(11, len(capture.Records), t)
+
+	replayed := NewBroker(capture, 1)
+	conn := mqtt.NewMockConnection()
+	defer conn.Close()
+	conn.Respond(replayed.Responder())
+	session := mqtt.NewSession(mqtt.ClientID("replayed"), mqtt.Connection(conn))
+	testutils.CheckNotError(session.Connect(mqtt.KeepAliveSeconds(0)), t)
+	testhelperSession(session, t)
+	// the DISCONNECT is answered with nothing - wait for the responder to have read it
+	for deadline := time.Now().Add(2 * time.Second); !replayed.Done() && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	testutils.CheckNotError(replayed.Err(), t)
+	testutils.CheckTrue(replayed.Done(), t)
+}
+
+func Test_Broker_uses_the_packet_IDs_of_the_client(t *testing.T) {
+	capture := testhelperRecord(t)
+	replayed := NewBroker(capture, 0)
+	connect := mqtt.NewConnectRequest(mqtt.ClientName("replayed")).MakeMessage()
+	_, err := replayed.Answer(connect)
+	testutils.CheckNotError(err, t)
+
+	publish := mqtt.NewPublishRequest(mqtt.Topic("a"), mqtt.QoS(1), mqtt.PacketID(42)).MakeMessage()
+	answers, err := replayed.Answer(publish)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(1, len(answers), t)
+	testutils.CheckEqual(time.Duration(0), answers[0].After, t)
+	id, err := mqtt.AckPacketID(answers[0].Packet, mqtt.PublishAckType)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(42, id, t)
+}
+
+func Test_Broker_reports_a_client_that_does_not_do_as_captured(t *testing.T) {
+	capture := testhelperRecord(t)
+	replayed := NewBroker(capture, 0)
+	conn := mqtt.NewMockConnection()
+	defer conn.Close()
+	conn.Respond(replayed.Responder())
+	session := mqtt.NewSession(mqtt.ClientID("replayed"), mqtt.Connection(conn))
+	testutils.CheckNotError(session.Connect(mqtt.KeepAliveSeconds(0)), t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := session.SubscribeContext(ctx, mqtt.TopicFilter("b/#", 1))
+	testutils.CheckError(err, t)
+	testutils.CheckError(replayed.Err(), t)
+	testutils.CheckFalse(replayed.Done(), t)
+}
+
+func Test_Publish_publishes_the_captured_messages_with_their_timing(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	received := make(chan mqtt.PublishOptions, 10)
+	subscriberConn := mqtt.NewMockConnection()
+	go b.ServeConn(subscriberConn.RemoteConn())
+	subscriber := mqtt.NewSession(mqtt.ClientID("subscriber"), mqtt.Connection(subscriberConn),
+		mqtt.MessageHandler(func(pr *mqtt.PublishRequest) { received <- pr.Options() }))
+	testutils.CheckNotError(subscriber.Connect(mqtt.KeepAliveSeconds(0)), t)
+	_, err := subscriber.Subscribe(mqtt.TopicFilter("#", 1))
+	testutils.CheckNotError(err, t)
+
+	var data bytes.Buffer
+	mqtt.NewPublishRequest(mqtt.Topic("x"), mqtt.Message([]byte("one")), mqtt.QoS(1), mqtt.PacketID(1)).MakeMessage().WriteTo(&data)
+	one := data.Bytes()
+	data = bytes.Buffer{}
+	mqtt.NewPublishRequest(mqtt.Topic("x"), mqtt.Message([]byte("one")), mqtt.QoS(1), mqtt.PacketID(1)).MakeMessage().Duplicate().WriteTo(&data)
+	duplicate := data.Bytes()
+	data = bytes.Buffer{}
+	mqtt.NewPublishRequest(mqtt.Topic("y"), mqtt.Message([]byte("two")), mqtt.Retain(true)).MakeMessage().WriteTo(&data)
+	two := data.Bytes()
+	capture := &mqtt.Capture{Records: []mqtt.CaptureRecord{
+		{At: time.Second, Sent: true, Data: one},
+		{At: time.Second + 10*time.Millisecond, Sent: false, Data: []byte{0x40, 0x02, 0x00, 0x01}},
+		{At: time.Second + 20*time.Millisecond, Sent: true, Data: duplicate},
+		{At: time.Second + 100*time.Millisecond, Sent: true, Data: two},
+	}}
+
+	publisherConn := mqtt.NewMockConnection()
+	go b.ServeConn(publisherConn.RemoteConn())
+	publisher := mqtt.NewSession(mqtt.ClientID("publisher"), mqtt.Connection(publisherConn))
+	testutils.CheckNotError(publisher.Connect(mqtt.KeepAliveSeconds(0)), t)
+	start := time.Now()
+	count, err := Publish(context.Background(), publisher, capture, 2)
+	testutils.CheckNotError(err, t)
+	testutils.CheckEqual(2, count, t)
+	elapsed := time.Since(start)
+	testutils.CheckTrue(elapsed >= 50*time.Millisecond && elapsed < time.Second, t)
+	testutils.CheckNotError(publisher.Disconnect(1), t)
+
+	for _, expected := range []string{"one", "two"} {
+		select {
+		case o := <-received:
+			testutils.CheckEqual(expected, string(o.Message), t)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected the message '%s'", expected)
+		}
+	}
+	subscriber.Disconnect(1)
+}
+
+func Test_Connect_returns_the_captured_CONNECT(t *testing.T) {
+	capture := testhelperRecord(t)
+	cr := Connect(capture)
+	testutils.CheckTrue(cr != nil, t)
+	testutils.CheckEqual("recorded", cr.Options().ClientName, t)
+	testutils.CheckTrue(Connect(&mqtt.Capture{}) == nil, t)
+}
@@ -0,0 +1,481 @@
+// Package xcheck checks how messages cross between MQTT and NATS - for example through the MQTT support in NATS
+// server, or a gateway between a MQTT broker and a NATS server.
+//
+// A Checker publishes numbered messages on one side and receives them on the other, where the NATS subject is the
+// mapping of the MQTT topic given by package natsmap. The resulting Report tells which messages were lost,
+// duplicated, or received out of order, what the messages looked like on the receiving side (NATS headers, or
+// the MQTT QoS and retain flag), and the latency of each message.
+//
+package xcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/internal/nats"
+	"github.com/hlindberg/mezquit/internal/natsmap"
+	log "github.com/sirupsen/logrus"
+)
+
+// Direction is the direction messages are sent in by a check
+//
+type Direction int
+
+const (
+	// MQTTToNATS publishes over MQTT and receives over NATS
+	MQTTToNATS Direction = iota
+
+	// NATSToMQTT publishes over NATS and receives over MQTT
+	NATSToMQTT
+)
+
+// String returns the direction as "mqtt->nats" or "nats->mqtt"
+func (d Direction) String() string {
+	if d == NATSToMQTT {
+		return "nats->mqtt"
+	}
+	return "mqtt->nats"
+}
+
+// SeqHeader is the NATS header with the sequence number of a message published over NATS
+const SeqHeader = "Mezquit-Seq"
+
+// payloadPrefix starts the payload of every message published by a Checker
+const payloadPrefix = "mezquit-xcheck"
+
+// Checker sends messages between MQTT and NATS and reports on how they were received.
+//
+// Example:
+//     c := xcheck.NewChecker(xcheck.MQTTConnection(mqttConn), xcheck.NATSConnection(natsConn), xcheck.QoS(1))
+//     err := c.Start()
+//     ...
+//     report, err := c.Run(ctx, xcheck.MQTTToNATS)
+//     ...
+//     c.Close()
+//
+type Checker struct {
+	options  CheckerOptions
+	subject  string
+	session  *mqtt.Session
+	client   *nats.Client
+	arrivals chan arrival
+	runs     int
+}
+
+// arrival is a message received by a Checker on either side
+type arrival struct {
+	viaNATS    bool
+	payload    []byte
+	properties []string
+	at         time.Time
+}
+
+// CheckerOptions contains options for a Checker
+//
+type CheckerOptions struct {
+	MQTTConn   net.Conn
+	NATSConn   net.Conn
+	ClientName string        // the MQTT client ID, and the NATS connection name
+	Topic      string        // the MQTT topic to publish to and subscribe to
+	QoS        int           // the QoS to publish and subscribe with over MQTT
+	Count      int           // the number of messages to send in each direction
+	Interval   time.Duration // the time between sending two messages
+	Wait       time.Duration // the time to wait for messages after the last has been sent
+}
+
+// CheckerOption is an Options-modifying-function
+type CheckerOption func(*CheckerOptions) error
+
+// DefaultCheckerOptions returns the default options for a Checker (client name "mezquit-xcheck", topic
+// "mezquit/xcheck", QoS 0, 10 messages, 10ms interval, and 2s wait). Both connections must be given.
+//
+func DefaultCheckerOptions() CheckerOptions {
+	return CheckerOptions{
+		ClientName: "mezquit-xcheck",
+		Topic:      "mezquit/xcheck",
+		Count:      10,
+		Interval:   10 * time.Millisecond,
+		Wait:       2 * time.Second,
+	}
+}
+
+// MQTTConnection returns a CheckerOption for the connection to the MQTT broker
+func MQTTConnection(conn net.Conn) CheckerOption {
+	return func(o *CheckerOptions) error {
+		o.MQTTConn = conn
+		return nil
+	}
+}
+
+// NATSConnection returns a CheckerOption for the connection to the NATS server
+func NATSConnection(conn net.Conn) CheckerOption {
+	return func(o *CheckerOptions) error {
+		o.NATSConn = conn
+		return nil
+	}
+}
+
+// ClientName returns a CheckerOption for the MQTT client ID and NATS connection name
+func ClientName(name string) CheckerOption {
+	if name == "" {
+		panic("ClientName of a checker cannot be empty")
+	}
+	return func(o *CheckerOptions) error {
+		o.ClientName = name
+		return nil
+	}
+}
+
+// Topic returns a CheckerOption for the MQTT topic to send messages to - the NATS subject is its mapping
+func Topic(topic string) CheckerOption {
+	if err := mqtt.ValidateTopicName(topic); err != nil {
+		panic(err.Error())
+	}
+	return func(o *CheckerOptions) error {
+		o.Topic = topic
+		return nil
+	}
+}
+
+// QoS returns a CheckerOption for the QoS to publish and subscribe with over MQTT
+func QoS(qos int) CheckerOption {
+	if qos < 0 || qos > 2 {
+		panic(fmt.Sprintf("QoS must be 0, 1, or 2, got %d", qos))
+	}
+	return func(o *CheckerOptions) error {
+		o.QoS = qos
+		return nil
+	}
+}
+
+// Count returns a CheckerOption for the number of messages to send in each direction
+func Count(count int) CheckerOption {
+	if count < 1 {
+		panic("Count must be at least 1")
+	}
+	return func(o *CheckerOptions) error {
+		o.Count = count
+		return nil
+	}
+}
+
+// Interval returns a CheckerOption for the time between sending two messages (0 sends them as fast as possible)
+func Interval(interval time.Duration) CheckerOption {
+	if interval < 0 {
+		panic("Interval cannot be negative")
+	}
+	return func(o *CheckerOptions) error {
+		o.Interval = interval
+		return nil
+	}
+}
+
+// Wait returns a CheckerOption for the time to wait for the missing messages after the last message has been sent
+func Wait(wait time.Duration) CheckerOption {
+	if wait < 0 {
+		panic("Wait cannot be negative")
+	}
+	return func(o *CheckerOptions) error {
+		o.Wait = wait
+		return nil
+	}
+}
+
+// NewChecker creates a Checker. It does not connect until Start() is called.
+//
+func NewChecker(options ...CheckerOption) *Checker {
+	opts := DefaultCheckerOptions()
+	for _, fOpt := range options {
+		if err := fOpt(&opts); err != nil {
+			log.Fatalf("Checker option apply failure: %s", err)
+		}
+	}
+	c := &Checker{options: opts, arrivals: make(chan arrival, 1000)}
+	c.session = mqtt.NewSession(mqtt.ClientID(opts.ClientName), mqtt.Connection(opts.MQTTConn),
+		mqtt.MessageHandler(c.receiveMQTT))
+	c.client = nats.NewClient(nats.Connection(opts.NATSConn), nats.Name(opts.ClientName))
+	return c
+}
+
+// Subject returns the NATS subject the messages are sent to
+//
+func (c *Checker) Subject() string {
+	return c.subject
+}
+
+// Start connects to the MQTT broker and the NATS server, and subscribes to the topic and its subject on both.
+// The connections are closed if an error is returned.
+//
+func (c *Checker) Start() error {
+	if c.options.MQTTConn == nil || c.options.NATSConn == nil {
+		panic("A Checker requires both a MQTT and a NATS connection")
+	}
+	subject, err := natsmap.TopicToSubject(c.options.Topic)
+	if err != nil {
+		c.options.MQTTConn.Close()
+		c.options.NATSConn.Close()
+		return err
+	}
+	c.subject = subject
+
+	if err := c.client.Connect(); err != nil {
+		c.options.MQTTConn.Close()
+		return fmt.Errorf("Cannot connect to the NATS server: %s", err)
+	}
+	if err := c.session.Connect(); err != nil {
+		c.client.Close()
+		return fmt.Errorf("Cannot connect to the MQTT broker: %s", err)
+	}
+	if err := c.subscribe(); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *Checker) subscribe() error {
+	granted, err := c.session.Subscribe(mqtt.TopicFilter(c.options.Topic, c.options.QoS))
+	if err != nil {
+		return err
+	}
+	if granted[0] == mqtt.SubAckFailure {
+		return fmt.Errorf("The subscription to %s was refused by the MQTT broker", c.options.Topic)
+	}
+	if _, err := c.client.Subscribe(c.subject, c.receiveNATS); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return c.client.Flush(ctx)
+}
+
+// Close disconnects from the MQTT broker and the NATS server
+//
+func (c *Checker) Close() error {
+	err := c.client.Close()
+	if mqttErr := c.session.Disconnect(1); mqttErr != nil {
+		err = mqttErr
+	}
+	return err
+}
+
+func (c *Checker) receiveMQTT(msg *mqtt.PublishRequest) {
+	o := msg.Options()
+	c.arrive(arrival{
+		payload:    o.Message,
+		properties: []string{"qos=" + strconv.Itoa(o.QoS), "retain=" + strconv.FormatBool(o.Retain)},
+		at:         time.Now(),
+	})
+}
+
+func (c *Checker) receiveNATS(msg *nats.Msg) {
+	properties := []string{}
+	for key, values := range msg.Header {
+		for _, value := range values {
+			properties = append(properties, key+"="+value)
+		}
+	}
+	if len(properties) == 0 {
+		properties = append(properties, "no headers")
+	}
+	c.arrive(arrival{viaNATS: true, payload: msg.Data, properties: properties, at: time.Now()})
+}
+
+// arrive queues a received message for Run. The message is dropped if the queue is full - which only happens
+// when a lot of messages are received while no check is running.
+//
+func (c *Checker) arrive(a arrival) {
+	select {
+	case c.arrivals <- a:
+	default:
+		log.Warnf("xcheck: dropping a received message - too many messages received between checks")
+	}
+}
+
+// Run sends the messages in the given direction, waits for them to be received, and returns the report. Run
+// returns as soon as every message has been received, or when the Wait time has passed after the last message was
+// sent - a duplicate received after that is not reported. An error is returned if a message could not be sent.
+// Run must not be called concurrently.
+//
+func (c *Checker) Run(ctx context.Context, direction Direction) (*Report, error) {
+	c.runs++
+	runID := fmt.Sprintf("%d-%d", c.runs, time.Now().UnixNano())
+	r := newReport(direction, c.options.Topic, c.subject, c.options.QoS, c.options.Count)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sent := make(chan error, 1)
+	go func() { sent <- c.send(ctx, direction, runID) }()
+
+	var wait <-chan time.Time
+	for r.Received < r.Sent {
+		select {
+		case a := <-c.arrivals:
+			if a.viaNATS == (direction == MQTTToNATS) {
+				r.add(runID, a)
+			}
+		case err := <-sent:
+			if err != nil {
+				return nil, err
+			}
+			wait = time.After(c.options.Wait)
+		case <-wait:
+			r.finish()
+			return r, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if wait == nil {
+		if err := <-sent; err != nil {
+			return nil, err
+		}
+	}
+	r.finish()
+	return r, nil
+}
+
+// send sends the messages of a run
+func (c *Checker) send(ctx context.Context, direction Direction, runID string) error {
+	headers := c.client.Info().Headers
+	for seq := 1; seq <= c.options.Count; seq++ {
+		if seq > 1 && c.options.Interval > 0 {
+			select {
+			case <-time.After(c.options.Interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		payload := []byte(fmt.Sprintf("%s %s %d %d", payloadPrefix, runID, seq, time.Now().UnixNano()))
+		if direction == MQTTToNATS {
+			err := c.session.PublishContext(ctx, mqtt.Topic(c.options.Topic), mqtt.Message(payload), mqtt.QoS(c.options.QoS))
+			if err != nil {
+				return fmt.Errorf("Cannot publish message %d over MQTT: %s", seq, err)
+			}
+			continue
+		}
+		msg := &nats.Msg{Subject: c.subject, Data: payload}
+		if headers {
+			msg.Header = nats.Header{SeqHeader: {strconv.Itoa(seq)}}
+		}
+		if err := c.client.PublishMsg(msg); err != nil {
+			return fmt.Errorf("Cannot publish message %d over NATS: %s", seq, err)
+		}
+	}
+	if direction == NATSToMQTT {
+		// Make sure the server has processed the messages before waiting for them
+		return c.client.Flush(ctx)
+	}
+	return nil
+}
+
+// parsePayload returns the run ID, sequence number, and send time of a payload sent by a Checker, and false if the
+// payload was not sent by a Checker
+//
+func parsePayload(payload []byte) (string, int, time.Time, bool) {
+	fields := strings.Fields(string(payload))
+	if len(fields) != 4 || fields[0] != payloadPrefix {
+		return "", 0, time.Time{}, false
+	}
+	seq, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", 0, time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return "", 0, time.Time{}, false
+	}
+	return fields[1], seq, time.Unix(0, nanos), true
+}
+
+// Report is the outcome of sending messages in one direction
+//
+type Report struct {
+	Direction  Direction
+	Topic      string
+	Subject    string
+	QoS        int
+	Sent       int
+	Received   int             // the number of distinct messages received
+	Lost       []int           // the sequence numbers (from 1) of the messages that were not received
+	Duplicates int             // the number of messages received more than once
+	OutOfOrder int             // the number of messages received after a message sent later
+	Properties map[string]int  // the number of received messages with each header or MQTT property
+	Latencies  []time.Duration // the latency of each message by sequence number (from 1) - negative if lost
+	Unexpected int             // the number of received messages that were not sent by a Checker
+	maxSeq     int
+}
+
+func newReport(direction Direction, topic, subject string, qos, count int) *Report {
+	r := &Report{Direction: direction, Topic: topic, Subject: subject, QoS: qos, Sent: count,
+		Properties: make(map[string]int), Latencies: make([]time.Duration, count)}
+	for i := range r.Latencies {
+		r.Latencies[i] = -1
+	}
+	return r
+}
+
+// add adds a received message to the report
+func (r *Report) add(runID string, a arrival) {
+	id, seq, sentAt, ok := parsePayload(a.payload)
+	if !ok {
+		r.Unexpected++
+		return
+	}
+	if id != runID || seq < 1 || seq > r.Sent {
+		// sent by another run
+		return
+	}
+	if r.Latencies[seq-1] >= 0 {
+		r.Duplicates++
+		return
+	}
+	r.Received++
+	r.Latencies[seq-1] = a.at.Sub(sentAt)
+	if seq < r.maxSeq {
+		r.OutOfOrder++
+	} else {
+		r.maxSeq = seq
+	}
+	for _, p := range a.properties {
+		r.Properties[p]++
+	}
+}
+
+// finish lists the lost messages
+func (r *Report) finish() {
+	for i, latency := range r.Latencies {
+		if latency < 0 {
+			r.Lost = append(r.Lost, i+1)
+		}
+	}
+}
+
+// Passed returns true if every message was received once and in order
+//
+func (r *Report) Passed() bool {
+	return len(r.Lost) == 0 && r.Duplicates == 0 && r.OutOfOrder == 0
+}
+
+// LatencySummary returns the minimum, median, and maximum latency of the received messages (all zero if no
+// message was received)
+//
+func (r *Report) LatencySummary() (time.Duration, time.Duration, time.Duration) {
+	received := make([]time.Duration, 0, r.Received)
+	for _, latency := range r.Latencies {
+		if latency >= 0 {
+			received = append(received, latency)
+		}
+	}
+	if len(received) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(received, func(i, j int) bool { return received[i] < received[j] })
+	return received[0], received[len(received)/2], received[len(received)-1]
+}
@@ -0,0 +1,185 @@
+package xcheck
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hlindberg/mezquit/internal/broker"
+	"github.com/hlindberg/mezquit/internal/mqtt"
+	"github.com/hlindberg/mezquit/internal/nats"
+	"github.com/hlindberg/mezquit/internal/natsmap"
+	"github.com/hlindberg/mezquit/testutils"
+)
+
+// testGateway stands in for the MQTT support in NATS server. It forwards messages between a broker and a
+// MockServer: a message published over MQTT with QoS 1 or 2 gets the header Nmqtt-Pub with the QoS, and a message
+// published over NATS is delivered over MQTT with QoS 0 (and without its headers). The mangle function (if any)
+// is given each message forwarded to NATS, and returns the messages to deliver instead.
+//
+type testGateway struct {
+	broker  *broker.Broker
+	server  *nats.MockServer
+	session *mqtt.Session
+	mangle  func(msg *nats.Msg) []*nats.Msg
+}
+
+func testhelperGateway(mangle func(msg *nats.Msg) []*nats.Msg, t *testing.T) *testGateway {
+	t.Helper()
+	g := &testGateway{broker: broker.NewBroker(), mangle: mangle}
+	g.server = nats.NewMockServer(nats.OnPublish(g.toMQTT))
+	g.session = mqtt.NewSession(mqtt.ClientID("gateway"), mqtt.Connection(g.mqttConn()),
+		mqtt.MessageHandler(g.toNATS))
+	testutils.CheckNotError(g.session.Connect(mqtt.KeepAliveSeconds(0)), t)
+	_, err := g.session.Subscribe(mqtt.TopicFilter("#", 2))
+	testutils.CheckNotError(err, t)
+	return g
+}
+
+func (g *testGateway) mqttConn() net.Conn {
+	conn := mqtt.NewMockConnection()
+	go g.broker.ServeConn(conn.RemoteConn())
+	return conn
+}
+
+func (g *testGateway) natsConn() net.Conn {
+	clientConn, serverConn := net.Pipe()
+	go g.server.ServeConn(serverConn)
+	return clientConn
+}
+
+func (g *testGateway) toNATS(msg *mqtt.PublishRequest) {
+	o := msg.Options()
+	subject, err := natsmap.TopicToSubject(o.Topic)
+	if err != nil {
+		return
+	}
+	natsMsg := &nats.Msg{Subject: subject, Data: o.Message}
+	if o.QoS > 0 {
+		natsMsg.Header = nats.Header{"Nmqtt-Pub": {strconv.Itoa(o.QoS)}}
+	}
+	messages := []*nats.Msg{natsMsg}
+	if g.mangle != nil {
+		messages = g.mangle(natsMsg)
+	}
+	for _, m := range messages {
+		g.server.Publish(m)
+	}
+}
+
+func (g *testGateway) toMQTT(msg *nats.Msg) {
+	topic, err := natsmap.SubjectToTopic(msg.Subject)
+	if err != nil {
+		return
+	}
+	g.session.Publish(mqtt.Topic(topic), mqtt.Message(msg.Data), mqtt.QoS(0))
+}
+
+func (g *testGateway) Close() {
+	g.session.Disconnect(1)
+	g.server.Close()
+	g.broker.Close()
+}
+
+func testhelperChecker(g *testGateway, t *testing.T, options ...CheckerOption) *Checker {
+	t.Helper()
+	options = append(options, MQTTConnection(g.mqttConn()), NATSConnection(g.natsConn()), Interval(0))
+	c := NewChecker(options...)
+	testutils.CheckNotError(c.Start(), t)
+	return c
+}
+
+func testhelperRun(c *Checker, direction Direction, t *testing.T) *Report {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := c.Run(ctx, direction)
+	testutils.CheckNotError(err, t)
+	return r
+}
+
+func Test_Checker_reports_messages_from_MQTT_to_NATS(t *testing.T) {
+	g := testhelperGateway(nil, t)
+	defer g.Close()
+	c := testhelperChecker(g, t, Topic("xcheck/a.b/c d"), QoS(1))
+	defer c.Close()
+	testutils.CheckEqual("xcheck.a//b.c%20d", c.Subject(), t)
+
+	r := testhelperRun(c, MQTTToNATS, t)
+	testutils.CheckTrue(r.Passed(), t)
+	testutils.CheckEqual(10, r.Sent, t)
+	testutils.CheckEqual(10, r.Received, t)
+	testutils.CheckEqual(10, r.Properties["Nmqtt-Pub=1"], t)
+	testutils.CheckEqual(1, len(r.Properties), t)
+	min, median, max := r.LatencySummary()
+	testutils.CheckTrue(min > 0 && min <= median && median <= max, t)
+}
+
+func Test_Checker_reports_messages_from_NATS_to_MQTT(t *testing.T) {
+	g := testhelperGateway(nil, t)
+	defer g.Close()
+	c := testhelperChecker(g, t, QoS(2), Count(5))
+	defer c.Close()
+
+	r := testhelperRun(c, NATSToMQTT, t)
+	testutils.CheckTrue(r.Passed(), t)
+	testutils.CheckEqual(5, r.Received, t)
+	testutils.CheckEqual(5, r.Properties["qos=0"], t)
+	testutils.CheckEqual(5, r.Properties["retain=false"], t)
+
+	// A second run only reports on its own messages
+	r = testhelperRun(c, MQTTToNATS, t)
+	testutils.CheckTrue(r.Passed(), t)
+	testutils.CheckEqual(5, r.Properties["Nmqtt-Pub=2"], t)
+	testutils.CheckEqual(0, r.Unexpected, t)
+}
+
+func Test_Checker_reports_lost_duplicated_and_reordered_messages(t *testing.T) {
+	var held *nats.Msg
+	mangle := func(msg *nats.Msg) []*nats.Msg {
+		_, seq, _, _ := parsePayload(msg.Data)
+		switch seq {
+		case 3:
+			return nil
+		case 5:
+			return []*nats.Msg{msg, msg}
+		case 7:
+			held = msg
+			return nil
+		case 8:
+			return []*nats.Msg{msg, held}
+		}
+		return []*nats.Msg{msg}
+	}
+	g := testhelperGateway(mangle, t)
+	defer g.Close()
+	c := testhelperChecker(g, t, QoS(1), Wait(100*time.Millisecond))
+	defer c.Close()
+
+	g.server.Publish(&nats.Msg{Subject: c.Subject(), Data: []byte("not from a checker")})
+	r := testhelperRun(c, MQTTToNATS, t)
+	testutils.CheckFalse(r.Passed(), t)
+	testutils.CheckEqual(9, r.Received, t)
+	testutils.CheckEqual(1, len(r.Lost), t)
+	testutils.CheckEqual(3, r.Lost[0], t)
+	testutils.CheckEqual(1, r.Duplicates, t)
+	testutils.CheckEqual(1, r.OutOfOrder, t)
+	testutils.CheckEqual(1, r.Unexpected, t)
+	testutils.CheckTrue(r.Latencies[2] < 0, t)
+	testutils.CheckTrue(r.Latencies[6] > 0, t)
+}
+
+func Test_parsePayload_only_accepts_checker_payloads(t *testing.T) {
+	id, seq, at, ok := parsePayload([]byte("mezquit-xcheck 1-2 7 1000"))
+	testutils.CheckTrue(ok, t)
+	testutils.CheckEqual("1-2", id, t)
+	testutils.CheckEqual(7, seq, t)
+	testutils.CheckEqual(int64(1000), at.UnixNano(), t)
+
+	_, _, _, ok = parsePayload([]byte("mezquit-xcheck 1-2 x 1000"))
+	testutils.CheckFalse(ok, t)
+	_, _, _, ok = parsePayload([]byte("hello"))
+	testutils.CheckFalse(ok, t)
+}
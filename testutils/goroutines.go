@@ -0,0 +1,23 @@
+package testutils
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// CheckNoGoroutineLeak checks that the number of goroutines returns to the given number (obtained with
+// runtime.NumGoroutine() before the code under test was run) within a second. The stacks of all goroutines
+// are included in the failure.
+func CheckNoGoroutineLeak(before int, t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(1 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			stacks := make([]byte, 1<<16)
+			stacks = stacks[:runtime.Stack(stacks, true)]
+			t.Fatalf("Expected: %d goroutines, got %d:\n%s", before, runtime.NumGoroutine(), stacks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}